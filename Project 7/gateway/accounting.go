@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+)
+
+var clientBytesLabel = flag.String("client-bytes-metric", "", "Also count each session's bytes in pqc_gateway_client_bytes_total, labelled by client ip or identity (empty disables; either can mean many series)")
+
+// traffic returns the SMTP bytes exchanged with the client so far, TLS
+// overhead aside, and who the client was
+func (s *smtpSession) traffic() (in, out int64, identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytesIn, s.bytesOut, s.clientIdentity()
+}
+
+// reportTraffic logs a finished session's byte counts, and adds them to the
+// per-client metric with -client-bytes-metric
+func reportTraffic(log *slog.Logger, clientConn net.Conn, session *smtpSession) {
+	in, out, identity := session.traffic()
+	log.Info("Session traffic", "event", "session_bytes", "bytes_in", in, "bytes_out", out,
+		"client_identity", identity)
+
+	var client string
+	switch *clientBytesLabel {
+	case "ip":
+		client = remoteIP(clientConn)
+	case "identity":
+		client = identity
+	default:
+		return
+	}
+	if client == "" {
+		client = "anonymous"
+	}
+	clientBytes.WithLabelValues(client, "in").Add(float64(in))
+	clientBytes.WithLabelValues(client, "out").Add(float64(out))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn counts the bytes a client sends and receives
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// sessionBytes waits for the session_bytes line in logs and returns it
+func sessionBytes(t *testing.T, logs *syncBuffer) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			var entry map[string]any
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["event"] == "session_bytes" {
+				return entry
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no session_bytes line logged")
+	return nil
+}
+
+func TestSessionTraffic(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo, "")
+	old := *clientBytesLabel
+	*clientBytesLabel = "ip"
+	t.Cleanup(func() { *clientBytesLabel = old })
+	before := clientByteCount("127.0.0.1", "in")
+	startTestBackend(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(conn, nil)
+		}
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.SetDeadline(time.Now().Add(10 * time.Second))
+	conn := &countingConn{Conn: raw}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	expect(t, c, 220)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+	// Read to the gateway's close, so every byte it sent is counted
+	io.Copy(io.Discard, conn)
+
+	entry := sessionBytes(t, logs)
+	if got, want := entry["bytes_in"], float64(conn.written.Load()); got != want {
+		t.Errorf("bytes_in = %v, client sent %v", got, want)
+	}
+	if got, want := entry["bytes_out"], float64(conn.read.Load()); got != want {
+		t.Errorf("bytes_out = %v, client received %v", got, want)
+	}
+	if got := clientByteCount("127.0.0.1", "in") - before; got != float64(conn.written.Load()) {
+		t.Errorf("metric counted %v bytes in, want %v", got, conn.written.Load())
+	}
+}
+
+// clientByteCount reads the per-client byte counter
+func clientByteCount(client, direction string) float64 {
+	families, _ := metricsRegistry.Gather()
+	for _, f := range families {
+		if f.GetName() != "pqc_gateway_client_bytes_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["client"] == client && labels["direction"] == direction {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	allowCIDR = flag.String("allow-cidr", "", "Comma-separated client networks allowed to connect (empty allows all)")
+	denyCIDR  = flag.String("deny-cidr", "", "Comma-separated client networks refused before the greeting; overrides -allow-cidr")
+	aclFile   = flag.String("acl-file", "", "File of more client networks, a line each of \"allow <network>\" or \"deny <network>\" (# starts a comment), added to -allow-cidr and -deny-cidr. Reloaded when it changes and on SIGHUP, for new connections")
+	aclPoll   = flag.Duration("acl-poll", 5*time.Second, "How often to check -acl-file for changes (0 disables; SIGHUP always reloads)")
+)
+
+// Sent to a client refused by the access list when -limit-action=reply
+var deniedGreetings = map[string]string{
+	"smtp": "554 5.7.1 Access denied\r\n",
+	"imap": "* BYE Access denied\r\n",
+}
+
+// accessList admits clients by source network. It is checked against the
+// address RemoteAddr reports, which is the real client's once a PROXY
+// header has been read.
+type accessList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Client access list for every listener, set up in main and replaced by
+// reloadAccessList; a connection is checked against the one current when
+// it arrives
+var clientACL atomic.Pointer[accessList]
+
+func newAccessList(allow, deny string) (*accessList, error) {
+	var a accessList
+	var err error
+	if a.allow, err = parsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("-allow-cidr: %w", err)
+	}
+	if a.deny, err = parsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("-deny-cidr: %w", err)
+	}
+	return &a, nil
+}
+
+// loadAccessList builds the access list from -allow-cidr and -deny-cidr,
+// and -acl-file when set
+func loadAccessList() (*accessList, error) {
+	a, err := newAccessList(*allowCIDR, *denyCIDR)
+	if err != nil || *aclFile == "" {
+		return a, err
+	}
+	b, err := os.ReadFile(*aclFile)
+	if err != nil {
+		return nil, fmt.Errorf("-acl-file: %w", err)
+	}
+	allow, deny, err := parseACLFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("-acl-file %s: %w", *aclFile, err)
+	}
+	a.allow = append(a.allow, allow...)
+	a.deny = append(a.deny, deny...)
+	return a, nil
+}
+
+// parseACLFile reads -acl-file's "allow <network>" and "deny <network>"
+// lines. One bad line fails the whole file, so a typo can't quietly open
+// or close the gateway to more than meant.
+func parseACLFile(b []byte) (allow, deny []netip.Prefix, err error) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: want \"allow <network>\" or \"deny <network>\"", n)
+		}
+		p, err := parsePrefixes(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			allow = append(allow, p...)
+		case "deny":
+			deny = append(deny, p...)
+		default:
+			return nil, nil, fmt.Errorf("line %d: %q is neither allow nor deny", n, fields[0])
+		}
+	}
+	return allow, deny, sc.Err()
+}
+
+// reloadAccessList loads the access list again and makes it current. A
+// list that fails to load leaves the current one in place.
+func reloadAccessList(reason string) error {
+	a, err := loadAccessList()
+	if err != nil {
+		slog.Error("Failed to reload client access list, keeping the current one", "event", "acl_reload_failed",
+			"reason", reason, "file", *aclFile, "error", err)
+		return err
+	}
+	clientACL.Store(a)
+	slog.Info("Client access list reloaded", "event", "acl_reloaded", "reason", reason, "file", *aclFile,
+		"allow", len(a.allow), "deny", len(a.deny))
+	return nil
+}
+
+// watchAccessList reloads -acl-file on SIGHUP and, every interval, when it
+// has changed
+func watchAccessList(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	stamp := fileStamp(*aclFile)
+	for {
+		select {
+		case <-hup:
+			reloadAccessList("sighup")
+			stamp = fileStamp(*aclFile)
+		case <-tick:
+			// A file that fails to load is checked again next time, in
+			// case it was caught mid-write
+			if s := fileStamp(*aclFile); s != stamp && reloadAccessList("file_changed") == nil {
+				stamp = s
+			}
+		}
+	}
+}
+
+// parsePrefixes reads a list of CIDRs; a bare address means just that host
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(list) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q", item)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", item)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// denied returns why conn may not connect, or "" when it may. A deny entry
+// wins over an allow entry that also matches. Unix socket clients, which
+// have no address to match, are always let in.
+func (a *accessList) denied(conn net.Conn) string {
+	if a == nil || (len(a.allow) == 0 && len(a.deny) == 0) {
+		return ""
+	}
+	if unixPeer(conn) {
+		return ""
+	}
+	addr, err := netip.ParseAddr(remoteIP(conn))
+	if err != nil {
+		if len(a.allow) > 0 {
+			return "address not in -allow-cidr"
+		}
+		return ""
+	}
+	// An IPv4 client on a dual-stack socket shows up as ::ffff:a.b.c.d
+	addr = addr.Unmap().WithZone("")
+	for _, p := range a.deny {
+		if p.Contains(addr) {
+			return "matched -deny-cidr " + p.String()
+		}
+	}
+	if len(a.allow) == 0 {
+		return ""
+	}
+	for _, p := range a.allow {
+		if p.Contains(addr) {
+			return ""
+		}
+	}
+	return "address not in -allow-cidr"
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	acl, err := newAccessList("10.0.0.0/8, 2001:db8::/32, 192.0.2.7", "10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip     string
+		denied bool
+	}{
+		{"10.2.3.4", false},
+		{"10.1.2.3", true}, // deny wins over the wider allow
+		{"192.0.2.7", false},
+		{"192.0.2.8", true},
+		{"2001:db8::1", false},
+		{"2001:db9::1", true},
+		{"::ffff:10.2.3.4", false}, // IPv4 client on a dual-stack socket
+		{"::ffff:10.1.2.3", true},
+	} {
+		reason := acl.denied(connFrom(tc.ip))
+		if (reason != "") != tc.denied {
+			t.Errorf("%s: denied=%q, want denied=%v", tc.ip, reason, tc.denied)
+		}
+	}
+}
+
+func TestAccessListDenyOnly(t *testing.T) {
+	acl, err := newAccessList("", "203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := acl.denied(connFrom("198.51.100.1")); r != "" {
+		t.Errorf("unlisted address refused: %s", r)
+	}
+	if r := acl.denied(connFrom("203.0.113.9")); !strings.Contains(r, "203.0.113.0/24") {
+		t.Errorf("reason %q doesn't name the rule", r)
+	}
+}
+
+func TestParsePrefixesInvalid(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "example.com", "10.0.0.1/x"} {
+		if _, err := parsePrefixes(list); err == nil {
+			t.Errorf("parsePrefixes(%q) accepted", list)
+		}
+	}
+	if _, err := newAccessList("10.0.0.0/8", "nonsense"); err == nil || !strings.HasPrefix(err.Error(), "-deny-cidr") {
+		t.Errorf("error %v doesn't name the flag", err)
+	}
+}
+
+func TestAccessListUnixSocket(t *testing.T) {
+	acl, err := newAccessList("10.0.0.0/8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "acl.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if r := acl.denied(conn); r != "" {
+		t.Errorf("Unix socket client refused: %s", r)
+	}
+}
+
+func TestParseACLFile(t *testing.T) {
+	allow, deny, err := parseACLFile([]byte("# office\nallow 10.0.0.0/8\n\n  DENY 10.1.0.0/16  # lab\nallow 2001:db8::1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allow) != 2 || allow[1].String() != "2001:db8::1/128" || len(deny) != 1 || deny[0].String() != "10.1.0.0/16" {
+		t.Errorf("allow %v, deny %v", allow, deny)
+	}
+	for _, bad := range []string{"allow", "allow 10.0.0.0/33", "permit 10.0.0.0/8", "deny 10.0.0.1 10.0.0.2"} {
+		if _, _, err := parseACLFile([]byte("allow 192.0.2.1\n" + bad + "\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: error %v, want line 2 named", bad, err)
+		}
+	}
+}
+
+// serveGreeting accepts gateway connections on a loopback listener, as
+// serve does, greeting those the access list lets in with 220
+func serveGreeting(t *testing.T) string {
+	t.Helper()
+	oldLimiter := limiter
+	limiter = newConnLimiter(0, 0, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ln, "smtp", func(c net.Conn) {
+			defer c.Close()
+			c.Write([]byte("220 gateway ESMTP\r\n"))
+		})
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		activeConns.Wait()
+		limiter = oldLimiter
+	})
+	return ln.Addr().String()
+}
+
+// greeting connects to addr and returns the first line it is sent
+func greeting(t *testing.T, addr string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestReloadAccessList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	write := func(list string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("allow 127.0.0.1\n")
+	setFlags(t, map[string]string{"acl-file": path, "allow-cidr": "192.0.2.0/24"})
+	old := clientACL.Load()
+	t.Cleanup(func() { clientACL.Store(old) })
+	logs := captureLogs(t, slog.LevelInfo, "")
+	if err := reloadAccessList("test"); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveGreeting(t)
+	if got := greeting(t, addr); !strings.HasPrefix(got, "220") {
+		t.Fatalf("greeted %q with 127.0.0.1 allowed", got)
+	}
+
+	// The new list applies to the next connection
+	write("# locked down\ndeny 127.0.0.0/8\n")
+	if err := reloadAccessList("test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := greeting(t, addr); got != "554 5.7.1 Access denied" {
+		t.Errorf("greeted %q with 127.0.0.0/8 denied", got)
+	}
+
+	// A bad entry leaves that list in place
+	write("allow 127.0.0.1\nallow 127.0.0.300\n")
+	if err := reloadAccessList("test"); err == nil {
+		t.Fatal("invalid list loaded")
+	}
+	if got := greeting(t, addr); got != "554 5.7.1 Access denied" {
+		t.Errorf("greeted %q after a failed reload", got)
+	}
+	if !strings.Contains(logs.String(), `"event":"acl_reload_failed"`) || !strings.Contains(logs.String(), "line 2") {
+		t.Errorf("no acl_reload_failed log naming the line in %s", logs)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+var tlsALPN = flag.String("tls-alpn", "", "Comma-separated ALPN protocols offered: smtp, imap. On the implicit-TLS SMTP port a client negotiating imap is proxied to Dovecot, so one port can serve both; a client offering none gets SMTP")
+
+// ALPN protocol IDs -tls-alpn accepts
+const (
+	alpnSMTP = "smtp"
+	alpnIMAP = "imap"
+)
+
+// parseALPN checks a -tls-alpn list
+func parseALPN(s string) ([]string, error) {
+	protos := splitList(s)
+	for _, p := range protos {
+		if p != alpnSMTP && p != alpnIMAP {
+			return nil, fmt.Errorf("unknown protocol %q (want smtp or imap)", p)
+		}
+	}
+	return protos, nil
+}
+
+// byALPN picks a connection's handler by the protocol its TLS handshake
+// negotiated, falling back to the listener's own. The handshake is run
+// here to find out; a failed one is left to the fallback handler, which
+// gets the same error from it and reports it as usual.
+func byALPN(fallback func(net.Conn), handlers map[string]func(net.Conn)) func(net.Conn) {
+	return func(conn net.Conn) {
+		tc, ok := conn.(*tls.Conn)
+		if !ok {
+			fallback(conn)
+			return
+		}
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if handle := handlers[tc.ConnectionState().NegotiatedProtocol]; err == nil && handle != nil {
+			handle(conn)
+			return
+		}
+		fallback(conn)
+	}
+}
+
+// onlyALPN narrows the protocols config offers to proto, for a listener
+// that serves nothing else: a client asking for another is refused in the
+// handshake rather than answered in the wrong protocol
+func onlyALPN(config *tls.Config, proto string) *tls.Config {
+	if config == nil || len(config.NextProtos) == 0 {
+		return config
+	}
+	var protos []string
+	if slices.Contains(config.NextProtos, proto) {
+		protos = []string{proto}
+	}
+	c := config.Clone()
+	c.NextProtos = protos
+	perClient := config.GetConfigForClient
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		cc, err := perClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		cc.NextProtos = protos
+		return cc, nil
+	}
+	return c
+}
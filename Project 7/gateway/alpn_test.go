@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestDovecot runs an IMAP backend that only greets, and points
+// -dovecot at it
+func startTestDovecot(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("* OK dovecot ready\r\n"))
+			go func() {
+				defer c.Close()
+				bufio.NewReader(c).ReadString('\n')
+			}()
+		}
+	}()
+	setFlags(t, map[string]string{"dovecot": ln.Addr().String()})
+}
+
+// alpnListener serves the SMTP listener's connections over implicit TLS
+// with -tls-alpn set to protos
+func alpnListener(t *testing.T, protos string) string {
+	t.Helper()
+	dir := t.TempDir()
+	setFlags(t, map[string]string{
+		"tls-alpn": protos,
+		"cert":     filepath.Join(dir, "missing.crt"),
+		"key":      filepath.Join(dir, "missing.key"),
+	})
+	config, err := getHybridTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	t.Cleanup(func() { ln.Close() })
+	handle := smtpHandler(nil)
+	go func() {
+		defer close(done)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handle(tls.Server(conn, config))
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// alpnGreeting dials addr offering protos and returns the protocol
+// negotiated and the first line the client is sent
+func alpnGreeting(t *testing.T, addr string, protos ...string) (string, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().NegotiatedProtocol, line
+}
+
+func TestALPNRoutesConnections(t *testing.T) {
+	startTestBackend(t)
+	startTestDovecot(t)
+	addr := alpnListener(t, "smtp,imap")
+	for _, tc := range []struct {
+		name   string
+		offer  []string
+		proto  string
+		prefix string
+	}{
+		{"smtp", []string{alpnSMTP}, alpnSMTP, "220 "},
+		{"imap", []string{alpnIMAP}, alpnIMAP, "* OK dovecot"},
+		{"none offered", nil, "", "220 "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proto, line := alpnGreeting(t, addr, tc.offer...)
+			if proto != tc.proto || !strings.HasPrefix(line, tc.prefix) {
+				t.Errorf("negotiated %q and got %q, want %q and %q...", proto, line, tc.proto, tc.prefix)
+			}
+		})
+	}
+}
+
+func TestALPNOnlyIMAP(t *testing.T) {
+	config := onlyALPN(&tls.Config{
+		NextProtos:         []string{alpnSMTP, alpnIMAP},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return &tls.Config{}, nil },
+	}, alpnIMAP)
+	perClient, _ := config.GetConfigForClient(nil)
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != alpnIMAP || len(perClient.NextProtos) != 1 {
+		t.Errorf("IMAP listener offers %q, %q per client", config.NextProtos, perClient.NextProtos)
+	}
+	if c := onlyALPN(&tls.Config{}, alpnIMAP); len(c.NextProtos) != 0 {
+		t.Errorf("ALPN offered without -tls-alpn: %q", c.NextProtos)
+	}
+}
+
+func TestParseALPN(t *testing.T) {
+	if got, err := parseALPN(" smtp, imap "); err != nil || strings.Join(got, ",") != "smtp,imap" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := parseALPN("smtp,h2"); err == nil {
+		t.Error("h2 accepted")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	auditLogPath    = flag.String("audit-log", "", "JSON Lines file recording every message signed, apart from the operational log (empty disables)")
+	auditLogMaxSize = flag.Int("audit-log-max-size", 100<<20, "Rotate the audit log before it grows past this many bytes (0 disables)")
+	auditLogMaxAge  = flag.Duration("audit-log-max-age", 0, "Rotate the audit log once its first entry is this old (0 disables)")
+	auditLogKeep    = flag.Int("audit-log-keep", 10, "Rotated audit logs kept, as -audit-log.1 (newest) onwards")
+)
+
+// Audit log, set up in main; nil when -audit-log is unset
+var audit *auditLog
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time          time.Time `json:"time"`
+	MessageID     string    `json:"message_id"`
+	Sender        string    `json:"sender,omitempty"`
+	Recipients    []string  `json:"recipients"`
+	Algorithm     string    `json:"algorithm"`
+	KeyID         string    `json:"kid,omitempty"`
+	Hash          string    `json:"hash"`           // hex SHA-256 of the signed message
+	SignatureHash string    `json:"signature_hash"` // hex SHA-256 of the signature
+}
+
+func newAuditEntry(r Receipt) auditEntry {
+	sum := sha256.Sum256([]byte(r.Signature))
+	return auditEntry{
+		Time:          r.Timestamp,
+		MessageID:     r.MessageID,
+		Sender:        r.Sender,
+		Recipients:    r.Recipients,
+		Algorithm:     r.Algorithm,
+		KeyID:         r.KeyID,
+		Hash:          r.Hash,
+		SignatureHash: hex.EncodeToString(sum[:]),
+	}
+}
+
+// auditLog appends entries to a file, rotating it by size or age:
+// path.1 is the newest rotated file, and files past -audit-log-keep are
+// removed. Entries are written straight to the file, which is synced on
+// rotation and when it is closed.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	started time.Time // time of the file's first entry; zero while empty
+
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+	now     func() time.Time // time.Now, except in tests
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: int64(*auditLogMaxSize), maxAge: *auditLogMaxAge, keep: *auditLogKeep, now: time.Now}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open opens the current file, appending to what an earlier run left
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size, a.started = f, info.Size(), time.Time{}
+	if a.size > 0 {
+		a.started = a.firstEntryTime()
+	}
+	return nil
+}
+
+// firstEntryTime returns the time of the file's first entry, or now if it
+// can't be read, so the file still ages
+func (a *auditLog) firstEntryTime() time.Time {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return a.now()
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadBytes('\n')
+	var e auditEntry
+	if json.Unmarshal(line, &e) != nil || e.Time.IsZero() {
+		return a.now()
+	}
+	return e.Time
+}
+
+// Record appends an entry for a signed message
+func (a *auditLog) Record(r Receipt) error {
+	line, err := json.Marshal(newAuditEntry(r))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return os.ErrClosed
+	}
+	if a.due(int64(len(line))) {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if a.started.IsZero() {
+		a.started = a.now()
+	}
+	return err
+}
+
+// due reports whether the file must be rotated before n more bytes are
+// written. A file is never rotated empty, so one entry over the size
+// limit still gets written.
+func (a *auditLog) due(n int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.maxSize > 0 && a.size+n > a.maxSize {
+		return true
+	}
+	return a.maxAge > 0 && a.now().Sub(a.started) >= a.maxAge
+}
+
+// rotate moves path to path.1, shifting older files up and dropping the
+// oldest, and starts a new file. The current file is reopened even if the
+// renames fail, so entries keep being recorded.
+func (a *auditLog) rotate() error {
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	a.f = nil
+	err := a.shift()
+	if oerr := a.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (a *auditLog) shift() error {
+	if a.keep <= 0 {
+		return os.Remove(a.path)
+	}
+	os.Remove(a.rotated(a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotated(i), a.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(a.path, a.rotated(1))
+}
+
+func (a *auditLog) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Close syncs the file to disk and closes it
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Sync()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	a.f = nil
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAudit returns the entries in an audit log file
+func readAudit(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("bad audit line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func auditReceipt(id string) Receipt {
+	r := newReceipt([]byte("body"), []byte("signature"), "ML-DSA-65")
+	r.MessageID, r.KeyID, r.Sender = id, "k1", "a@example.com"
+	r.Recipients = []string{"b@example.com"}
+	// Fixed, so every entry is the same length
+	r.Timestamp = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	return r
+}
+
+func TestAuditLogRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	line, _ := json.Marshal(newAuditEntry(auditReceipt("<1@example.com>")))
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// Room for two entries a file
+	a.maxSize, a.keep = int64(2*(len(line)+1)), 2
+
+	for _, id := range []string{"<1@example.com>", "<2@example.com>", "<3@example.com>", "<4@example.com>", "<5@example.com>", "<6@example.com>", "<7@example.com>"} {
+		if err := a.Record(auditReceipt(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	for file, want := range map[string][]string{
+		path:        {"<7@example.com>"},
+		path + ".1": {"<5@example.com>", "<6@example.com>"},
+		path + ".2": {"<3@example.com>", "<4@example.com>"},
+	} {
+		var got []string
+		for _, e := range readAudit(t, file) {
+			got = append(got, e.MessageID)
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s holds %q, want %q", filepath.Base(file), got, want)
+		}
+		if info, _ := os.Stat(file); info.Size() > a.maxSize {
+			t.Errorf("%s is %d bytes, over %d", filepath.Base(file), info.Size(), a.maxSize)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than -audit-log-keep files: %v", err)
+	}
+}
+
+func TestAuditLogRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.now, a.maxSize, a.maxAge = func() time.Time { return now }, 0, time.Hour
+
+	a.Record(auditReceipt("<1@example.com>"))
+	now = now.Add(59 * time.Minute)
+	a.Record(auditReceipt("<2@example.com>"))
+	now = now.Add(time.Minute)
+	a.Record(auditReceipt("<3@example.com>"))
+
+	if n := len(readAudit(t, path+".1")); n != 2 {
+		t.Errorf("rotated file holds %d entries, want 2", n)
+	}
+	if n := len(readAudit(t, path)); n != 1 {
+		t.Errorf("current file holds %d entries, want 1", n)
+	}
+}
+
+func TestAuditLogSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := auditReceipt("<1@example.com>")
+	a.Record(first)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Record(auditReceipt("<closed@example.com>")); err == nil {
+		t.Error("recorded to a closed log")
+	}
+
+	a, err = openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if !a.started.Equal(first.Timestamp) {
+		t.Errorf("reopened log started %v, want the first entry's %v", a.started, first.Timestamp)
+	}
+	a.Record(auditReceipt("<2@example.com>"))
+	a.Close()
+
+	entries := readAudit(t, path)
+	if len(entries) != 2 || entries[0].MessageID != "<1@example.com>" || entries[1].MessageID != "<2@example.com>" {
+		t.Fatalf("entries after restart: %+v", entries)
+	}
+	e := entries[0]
+	if e.Algorithm != "ML-DSA-65" || e.KeyID != "k1" || e.Sender != "a@example.com" ||
+		len(e.Recipients) != 1 || e.Hash != first.Hash || len(e.SignatureHash) != 64 {
+		t.Errorf("entry: %+v", e)
+	}
+	if strings.Contains(e.SignatureHash, "signature") {
+		t.Error("audit log holds the signature itself")
+	}
+}
+
+func TestSessionWritesAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := audit
+	audit = a
+	t.Cleanup(func() {
+		audit = old
+		a.Close()
+	})
+	startTestBackend(t)
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+
+	entries := readAudit(t, path)
+	if len(entries) != 1 {
+		t.Fatalf("audit log holds %d entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.MessageID == "" || e.Algorithm == "" || len(e.Recipients) == 0 {
+		t.Errorf("entry: %+v", e)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	requireAuth = flag.Bool("require-auth", false, "Refuse MAIL FROM with 530 until the client has authenticated (SMTP AUTH or a -client-ca certificate)")
+	authUsers   = flag.String("auth-users", "", "Check SMTP AUTH against this file of user:salt:hex(sha256(salt+password)) lines instead of relaying it to the backend")
+)
+
+// Authenticator checks SMTP AUTH credentials on the gateway
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) error
+}
+
+// Authenticator for -auth-users, set up in main. nil relays AUTH to the
+// backend and trusts its verdict.
+var authenticator Authenticator
+
+var errBadCredentials = errors.New("invalid username or password")
+
+// fileAuthenticator holds salted SHA-256 password hashes by username
+type fileAuthenticator map[string]passwordHash
+
+type passwordHash struct {
+	salt string
+	sum  []byte
+}
+
+// loadAuthUsers reads a user:salt:hexhash file; blank lines and # comments
+// are skipped
+func loadAuthUsers(path string) (fileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := fileAuthenticator{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s:%d: want user:salt:hash", path, n)
+		}
+		sum, err := hex.DecodeString(parts[2])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: hash must be hex SHA-256", path, n)
+		}
+		users[parts[0]] = passwordHash{salt: parts[1], sum: sum}
+	}
+	return users, sc.Err()
+}
+
+func (a fileAuthenticator) Authenticate(ctx context.Context, username, password string) error {
+	h, ok := a[username]
+	if !ok {
+		// Spend the same work as a known user so timing doesn't reveal which exist
+		h = passwordHash{sum: make([]byte, sha256.Size)}
+	}
+	sum := sha256.Sum256([]byte(h.salt + password))
+	if subtle.ConstantTimeCompare(sum[:], h.sum) != 1 || !ok {
+		return errBadCredentials
+	}
+	return nil
+}
+
+// Mechanisms the gateway answers itself
+const authMechanisms = "PLAIN LOGIN"
+
+// authExchange follows one AUTH PLAIN or LOGIN exchange. With a local
+// authenticator it collects the credentials to check; when relaying it
+// only notes the username for logs and receipts.
+type authExchange struct {
+	mech     string
+	username string
+	password string
+	haveUser bool // LOGIN: the username has been sent
+	done     bool // all credentials sent; further lines are commands again
+}
+
+// feed takes one base64 client response and reports whether the exchange
+// has all the credentials it needs
+func (a *authExchange) feed(resp string) (bool, error) {
+	decoded, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return false, errors.New("invalid base64")
+	}
+	if a.mech == "PLAIN" {
+		// authzid NUL authcid NUL passwd (RFC 4616)
+		parts := bytes.Split(decoded, []byte{0})
+		if len(parts) != 3 {
+			return false, errors.New("malformed PLAIN response")
+		}
+		a.username, a.password = string(parts[1]), string(parts[2])
+		a.done = true
+		return true, nil
+	}
+	if !a.haveUser {
+		a.username, a.haveUser = string(decoded), true
+		return false, nil
+	}
+	a.password = string(decoded)
+	a.done = true
+	return true, nil
+}
+
+// challenge is the 334 continuation asking for the next response
+func (a *authExchange) challenge() string {
+	switch {
+	case a.mech == "PLAIN":
+		return "334 \r\n"
+	case a.haveUser:
+		return "334 UGFzc3dvcmQ6\r\n" // "Password:"
+	default:
+		return "334 VXNlcm5hbWU6\r\n" // "Username:"
+	}
+}
+
+// authenticated reports whether the client may start mail under -require-auth
+func (s *smtpSession) authenticated() bool {
+	return s.authed || s.clientIdentity() != ""
+}
+
+// startAuth handles an AUTH command. With a local authenticator the gateway
+// runs the exchange itself; otherwise AUTH is relayed and the backend's
+// reply decides.
+func (s *smtpSession) startAuth(ctx context.Context, cmd []byte) {
+	fields := strings.Fields(string(cmd))
+	mech := ""
+	if len(fields) >= 2 {
+		mech = strings.ToUpper(fields[1])
+	}
+	resp, hasResp := "", len(fields) >= 3
+	if hasResp && fields[2] != "=" { // "=" is an empty initial response
+		resp = fields[2]
+	}
+
+	if authenticator == nil {
+		s.toBackend = append(s.toBackend, cmd...)
+		s.command(cmd)
+		s.auth = &authExchange{mech: mech}
+		if hasResp {
+			s.observeAuth(resp)
+		}
+		return
+	}
+
+	switch {
+	case s.authed:
+		s.reply("AUTH", 503, "5.5.1 Already authenticated")
+	case s.mailFrom != "":
+		s.reply("AUTH", 503, "5.5.1 AUTH not permitted during a mail transaction")
+	case mech != "PLAIN" && mech != "LOGIN":
+		s.reply("AUTH", 504, "5.5.4 Unrecognized authentication type")
+	case !s.tls:
+		s.reply("AUTH", 538, "5.7.11 Encryption required for requested authentication mechanism")
+	default:
+		s.auth = &authExchange{mech: mech}
+		if hasResp {
+			s.authResponse(ctx, resp)
+			return
+		}
+		s.inflight = append(s.inflight, pendingReply{verb: "AUTH", local: []byte(s.auth.challenge())})
+	}
+}
+
+// authLine handles a client line sent in answer to a 334 challenge
+func (s *smtpSession) authLine(ctx context.Context, line []byte) {
+	resp := string(bytes.TrimRight(line, "\r\n"))
+	if authenticator != nil {
+		s.authResponse(ctx, resp)
+		return
+	}
+	s.toBackend = append(s.toBackend, line...)
+	s.inflight = append(s.inflight, pendingReply{verb: "AUTH"})
+	s.observeAuth(resp)
+}
+
+// authResponse advances a locally checked exchange by one client response
+func (s *smtpSession) authResponse(ctx context.Context, resp string) {
+	a := s.auth
+	if resp == "*" {
+		s.auth = nil
+		s.reply("AUTH", 501, "5.7.0 Authentication cancelled")
+		return
+	}
+	done, err := a.feed(resp)
+	switch {
+	case err != nil:
+		s.auth = nil
+		s.reply("AUTH", 501, "5.5.2 "+err.Error())
+	case !done:
+		s.inflight = append(s.inflight, pendingReply{verb: "AUTH", local: []byte(a.challenge())})
+	default:
+		s.auth = nil
+		if err := authenticator.Authenticate(ctx, a.username, a.password); err != nil {
+			s.log.Warn("Authentication failed", "event", "auth_failed", "username", a.username, "error", err)
+			s.reply("AUTH", 535, "5.7.8 Authentication credentials invalid")
+			return
+		}
+		s.authed, s.authUser = true, a.username
+		s.log.Info("Client authenticated", "event", "auth_succeeded", "username", a.username)
+		s.reply("AUTH", 235, "2.7.0 Authentication successful")
+	}
+}
+
+// observeAuth notes the username from a relayed PLAIN or LOGIN response
+func (s *smtpSession) observeAuth(resp string) {
+	if s.auth.mech == "PLAIN" || s.auth.mech == "LOGIN" {
+		s.auth.feed(resp)
+	}
+}
+
+// authReply follows a relayed exchange through the backend's replies
+func (s *smtpSession) authReply(line []byte) {
+	if bytes.HasPrefix(line, []byte("334")) || s.auth == nil {
+		// Another challenge; the client's answer is relayed the same way
+		return
+	}
+	if line[0] == '2' {
+		s.authed, s.authUser = true, s.auth.username
+		s.log.Info("Client authenticated by backend", "event", "auth_succeeded", "username", s.auth.username)
+	} else {
+		s.log.Warn("Backend refused authentication", "event", "auth_failed", "username", s.auth.username,
+			"reply", string(line))
+	}
+	s.auth = nil
+}
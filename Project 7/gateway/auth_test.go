@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAuthenticator checks AUTH against a for the rest of the test
+func useAuthenticator(t *testing.T, a Authenticator) {
+	old := authenticator
+	authenticator = a
+	t.Cleanup(func() { authenticator = old })
+}
+
+// usersFile writes an -auth-users file with the given user:password pairs
+func usersFile(t *testing.T, creds ...string) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("# test users\n\n")
+	for _, c := range creds {
+		user, pass, _ := strings.Cut(c, ":")
+		sum := sha256.Sum256([]byte("salt" + pass))
+		b.WriteString(user + ":salt:" + hex.EncodeToString(sum[:]) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	users, err := loadAuthUsers(usersFile(t, "alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"bob", "", false},
+	} {
+		if err := users.Authenticate(context.Background(), tc.user, tc.pass); (err == nil) != tc.ok {
+			t.Errorf("%s/%s: %v", tc.user, tc.pass, err)
+		}
+	}
+}
+
+func TestLoadAuthUsersInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	for _, line := range []string{"alice:salt", "alice:salt:nothex", "alice:salt:abcd"} {
+		os.WriteFile(path, []byte(line+"\n"), 0o600)
+		if _, err := loadAuthUsers(path); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+}
+
+func TestAuthExchange(t *testing.T) {
+	plain := &authExchange{mech: "PLAIN"}
+	done, err := plain.feed(b64("\x00alice\x00secret"))
+	if !done || err != nil || plain.username != "alice" || plain.password != "secret" {
+		t.Errorf("PLAIN: %v %v %+v", done, err, plain)
+	}
+	if _, err := (&authExchange{mech: "PLAIN"}).feed(b64("alice\x00secret")); err == nil {
+		t.Error("PLAIN without authzid field accepted")
+	}
+	if _, err := (&authExchange{mech: "PLAIN"}).feed("not base64!"); err == nil {
+		t.Error("invalid base64 accepted")
+	}
+
+	login := &authExchange{mech: "LOGIN"}
+	if got := login.challenge(); got != "334 VXNlcm5hbWU6\r\n" {
+		t.Errorf("first LOGIN challenge %q", got)
+	}
+	if done, _ := login.feed(b64("alice")); done {
+		t.Fatal("LOGIN done after the username")
+	}
+	if got := login.challenge(); got != "334 UGFzc3dvcmQ6\r\n" {
+		t.Errorf("second LOGIN challenge %q", got)
+	}
+	if done, _ := login.feed(b64("secret")); !done || login.username != "alice" || login.password != "secret" {
+		t.Errorf("LOGIN: %+v", login)
+	}
+}
+
+func b64(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+// dialGatewaySTARTTLS runs a gateway session that offers STARTTLS and
+// returns the client side, past the greeting but still in plaintext
+func dialGatewaySTARTTLS(t *testing.T) (*textproto.Conn, net.Conn) {
+	t.Helper()
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As in dialGatewayConn, the session ends before the test's flags and
+	// stores are put back
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	c := textproto.NewConn(conn)
+	expect(t, c, 220)
+	return c, conn
+}
+
+// upgrade runs STARTTLS and returns the encrypted conversation, after EHLO
+func upgrade(t *testing.T, c *textproto.Conn, conn net.Conn) *textproto.Conn {
+	t.Helper()
+	command(t, c, 220, "STARTTLS")
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = textproto.NewConn(tc)
+	if ehlo := command(t, c, 250, "EHLO client.example.com"); !strings.Contains(ehlo, "AUTH "+authMechanisms) {
+		t.Errorf("AUTH not offered over TLS: %q", ehlo)
+	}
+	return c
+}
+
+func TestSessionAuth(t *testing.T) {
+	users, err := loadAuthUsers(usersFile(t, "alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAuthenticator(t, users)
+	setFlag(t, requireAuth, true)
+
+	type step struct {
+		line string
+		code int
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+		authd bool
+	}{
+		{"plain", []step{{"AUTH PLAIN " + b64("\x00alice\x00secret"), 235}}, true},
+		{"plain challenge", []step{{"AUTH PLAIN", 334}, {b64("\x00alice\x00secret"), 235}}, true},
+		{"plain wrong password", []step{{"AUTH PLAIN " + b64("\x00alice\x00guess"), 535}}, false},
+		{"login", []step{{"AUTH LOGIN", 334}, {b64("alice"), 334}, {b64("secret"), 235}}, true},
+		{"login initial response", []step{{"AUTH LOGIN " + b64("alice"), 334}, {b64("secret"), 235}}, true},
+		{"login unknown user", []step{{"AUTH LOGIN", 334}, {b64("mallory"), 334}, {b64("secret"), 535}}, false},
+		{"cancelled", []step{{"AUTH LOGIN", 334}, {"*", 501}}, false},
+		{"unknown mechanism", []step{{"AUTH CRAM-MD5", 504}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			startTestBackend(t)
+			c, conn := dialGatewaySTARTTLS(t)
+			c = upgrade(t, c, conn)
+			for _, st := range tc.steps {
+				command(t, c, st.code, st.line)
+			}
+			want := 530
+			if tc.authd {
+				want = 250
+			}
+			command(t, c, want, "MAIL FROM:<alice@example.com>")
+			command(t, c, 221, "QUIT")
+		})
+	}
+}
+
+func TestSessionAuthBeforeSTARTTLS(t *testing.T) {
+	users, err := loadAuthUsers(usersFile(t, "alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAuthenticator(t, users)
+	setFlag(t, requireAuth, true)
+	startTestBackend(t)
+
+	c, conn := dialGatewaySTARTTLS(t)
+	if ehlo := command(t, c, 250, "EHLO client.example.com"); strings.Contains(ehlo, "AUTH") {
+		t.Errorf("AUTH offered in plaintext: %q", ehlo)
+	}
+	command(t, c, 538, "AUTH PLAIN "+b64("\x00alice\x00secret"))
+	command(t, c, 530, "MAIL FROM:<alice@example.com>")
+
+	// Once encrypted the same credentials work
+	c = upgrade(t, c, conn)
+	command(t, c, 235, "AUTH PLAIN "+b64("\x00alice\x00secret"))
+	command(t, c, 250, "MAIL FROM:<alice@example.com>")
+}
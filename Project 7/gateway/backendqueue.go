@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	backendQueueSize    = flag.Int("backend-queue", 64, "Writes buffered for a slow SMTP backend before the client has to wait")
+	backendStallTimeout = flag.Duration("backend-stall-timeout", 30*time.Second, "Close a session whose backend write queue stays full this long (0 waits indefinitely)")
+	retryBackend        = flag.Bool("retry-backend", false, "When writing a message to the backend fails before its end reaches it, reconnect once and resend the transaction")
+)
+
+// Returned when the backend's write queue stays full past -backend-stall-timeout
+var errBackendStalled = errors.New("backend not accepting data")
+
+// backendWriter owns writes to the backend connection. The session hands
+// it buffers through a bounded queue, so a slow backend pushes back on the
+// client instead of stalling every write, and one that stops reading
+// altogether ends the session.
+type backendWriter struct {
+	conn  net.Conn
+	timer *sessionTimer
+	queue chan queuedWrite
+	done  chan struct{} // closed when run returns
+	err   error         // why run returned; read only after done is closed
+}
+
+// queuedWrite is one buffer for the backend, with the span to end once it
+// has been written, if any
+type queuedWrite struct {
+	p     []byte
+	span  trace.Span
+	retry *resendPlan
+}
+
+// resendPlan is how a message write recovers from a failed connection,
+// with -retry-backend
+type resendPlan struct {
+	// within is where the message ends in the buffer. Only a write that
+	// failed short of it is retried: the backend never saw the end of the
+	// message, so it can't have accepted it.
+	within int
+	// reconnect moves the session to a new backend connection that has
+	// been taken through the transaction up to DATA
+	reconnect func(cause error) error
+	// settled is called once the write has succeeded or failed for good
+	settled func()
+}
+
+func newBackendWriter(conn net.Conn, timer *sessionTimer) *backendWriter {
+	return &backendWriter{
+		conn:  conn,
+		timer: timer,
+		queue: make(chan queuedWrite, max(*backendQueueSize, 1)),
+		done:  make(chan struct{}),
+	}
+}
+
+// run writes queued buffers in order until ctx ends or a write fails
+func (w *backendWriter) run(ctx context.Context) error {
+	defer close(w.done)
+	for {
+		select {
+		case q := <-w.queue:
+			err := w.send(q)
+			if q.span != nil {
+				q.span.SetAttributes(attrBytes.Int(len(q.p)))
+				endSpan(q.span, err)
+			}
+			if err != nil {
+				w.err = fmt.Errorf("write to backend: %w", err)
+				return w.err
+			}
+		case <-ctx.Done():
+			w.err = ctx.Err()
+			return nil
+		}
+	}
+}
+
+// send writes one queued buffer, resending it once on a new connection
+// when its plan allows
+func (w *backendWriter) send(q queuedWrite) error {
+	if q.retry != nil {
+		defer q.retry.settled()
+	}
+	w.conn.SetWriteDeadline(w.timer.next())
+	n, err := w.conn.Write(q.p)
+	if err == nil || q.retry == nil || n >= q.retry.within {
+		return err
+	}
+	if rerr := q.retry.reconnect(err); rerr != nil {
+		return fmt.Errorf("%w (resend failed: %v)", err, rerr)
+	}
+	w.conn.SetWriteDeadline(w.timer.next())
+	_, err = w.conn.Write(q.p)
+	return err
+}
+
+// write queues p, which the writer then owns, waiting up to
+// -backend-stall-timeout for room
+func (w *backendWriter) write(p []byte) error {
+	return w.writeMessage(queuedWrite{p: p})
+}
+
+// writeMessage is write for a buffer carrying a message: its span is ended
+// once it has reached the backend, and its resend plan is settled even if
+// it never gets queued
+func (w *backendWriter) writeMessage(q queuedWrite) error {
+	err := w.enqueue(q)
+	if err != nil {
+		if q.span != nil {
+			endSpan(q.span, err)
+		}
+		if q.retry != nil {
+			q.retry.settled()
+		}
+	}
+	return err
+}
+
+// idle reports whether everything queued reached the backend. It is only
+// meaningful once run has returned.
+func (w *backendWriter) idle() bool {
+	return len(w.queue) == 0 && (w.err == nil || errors.Is(w.err, context.Canceled))
+}
+
+func (w *backendWriter) enqueue(q queuedWrite) error {
+	select {
+	case w.queue <- q:
+		return nil
+	case <-w.done:
+		return w.err
+	default:
+	}
+
+	backendQueueFull.Inc()
+	var expired <-chan time.Time
+	if *backendStallTimeout > 0 {
+		t := time.NewTimer(*backendStallTimeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case w.queue <- q:
+		return nil
+	case <-w.done:
+		return w.err
+	case <-expired:
+		return errBackendStalled
+	}
+}
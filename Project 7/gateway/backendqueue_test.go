@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+// startDroppingBackend starts a backend whose first connection fails
+// partway through a message, and whose later ones accept everything. With
+// afterBody, the first connection reads the whole message before it drops
+// without replying; otherwise it resets the connection as soon as it has
+// sent 354.
+func startDroppingBackend(t *testing.T, afterBody bool) *smtptest.Server {
+	s := &smtptest.Server{}
+	if afterBody {
+		s.Inject(".", smtptest.Fault{HangUp: true, Times: 1})
+	} else {
+		// A reset rather than a FIN, so the gateway's next write fails
+		s.Inject("DATA", smtptest.Fault{Reply: "354 go ahead", HangUp: true, Reset: true, Times: 1})
+	}
+	startFakeBackend(t, s)
+	return s
+}
+
+func TestRetryBackendResendsMessage(t *testing.T) {
+	setFlags(t, map[string]string{"retry-backend": "true"})
+	b := startDroppingBackend(t, false)
+	smtptest.Run(t, dialGateway(t), `
+		C: EHLO client.example.com
+		S: 250
+		C: MAIL FROM:<a@example.com>
+		S: 250
+		C: RCPT TO:<b@example.com> NOTIFY=FAILURE
+		S: 250
+		C: RCPT TO:<c@example.com>
+		S: 250
+		C: DATA
+		S: 354
+		C: Subject: hi
+		C:
+		C: body
+		C: .
+		S: 250
+		# The session carries on with the new connection
+		C: NOOP
+		S: 250
+	`)
+
+	sessions, messages := b.Sessions(), b.Messages()
+	if len(sessions) != 2 || len(messages) != 1 {
+		t.Fatalf("%d connections, %d messages accepted; want 2 and 1", len(sessions), len(messages))
+	}
+	replayed := strings.Join(sessions[1], "\n")
+	want := "EHLO client.example.com\nMAIL FROM:<a@example.com>\nRCPT TO:<b@example.com> NOTIFY=FAILURE\nRCPT TO:<c@example.com>\nDATA\nNOOP"
+	if replayed != want {
+		t.Errorf("new connection got\n%s\nwant\n%s", replayed, want)
+	}
+}
+
+func TestRetryBackendDisabled(t *testing.T) {
+	b := startDroppingBackend(t, false)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte(testBody))
+	w.Close()
+	if _, _, err := c.ReadResponse(250); err == nil {
+		t.Error("message accepted after the backend dropped")
+	}
+	if sessions := b.Sessions(); len(sessions) != 1 {
+		t.Errorf("reconnected without -retry-backend: %d connections", len(sessions))
+	}
+}
+
+func TestRetryBackendNoDuplicate(t *testing.T) {
+	setFlags(t, map[string]string{"retry-backend": "true"})
+	// The whole message reached the backend, which may have queued it
+	// before dropping: resending could deliver it twice
+	b := startDroppingBackend(t, true)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte(testBody))
+	w.Close()
+	if _, _, err := c.ReadResponse(250); err == nil {
+		t.Error("message accepted after the backend dropped")
+	}
+	if sessions := b.Sessions(); len(sessions) != 1 {
+		t.Errorf("message resent after its end reached the backend: %d connections", len(sessions))
+	}
+}
+
+// startStalledBackend starts a backend that takes a transaction up to its
+// 354 and then never reads again
+func startStalledBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	old := postfixBackends
+	postfixBackends = newBackendPool(ln.Addr().String())
+	t.Cleanup(func() { postfixBackends = old })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 backend.example.com ESMTP")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			if strings.EqualFold(line, "DATA") {
+				c.PrintfLine("354 go ahead")
+				return
+			}
+			c.PrintfLine("250 ok")
+		}
+	}()
+}
+
+func TestBackendStallClosesSession(t *testing.T) {
+	setFlags(t, map[string]string{
+		"backend-queue":         "1",
+		"backend-stall-timeout": "200ms",
+		"stream-above":          "1",
+	})
+	logs := captureLogs(t, slog.LevelInfo, "")
+	startStalledBackend(t)
+	c, _, done := runSession(t)
+	expect(t, c, 220)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+
+	// Write until the gateway stops reading: once the backend's socket
+	// buffers and the queue are full, the client is held for at most the
+	// stall timeout before the session is closed
+	line := []byte(strings.Repeat("x", 998) + "\r\n")
+	wrote := make(chan error, 1)
+	go func() {
+		c.W.WriteString("Subject: hi\r\n\r\n")
+		for {
+			if _, err := c.W.Write(line); err != nil {
+				wrote <- err
+				return
+			}
+		}
+	}()
+	waitSession(t, done)
+	select {
+	case <-wrote:
+	case <-time.After(10 * time.Second):
+		t.Fatal("client still writing after the session closed")
+	}
+	if !strings.Contains(logs.String(), `"event":"backend_stalled","reason":"backend not accepting data","timeout":"200ms"`) {
+		t.Errorf("no backend_stalled in the logs:\n%s", logs)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	backendDialTimeout = flag.Duration("backend-dial-timeout", 10*time.Second, "How long connecting to a backend may take before failing over to the next")
+	tcpKeepAlive       = flag.Duration("tcp-keepalive", 30*time.Second, "TCP keepalive period for client and backend connections (negative disables)")
+)
+
+// How long a backend that refused a connection is tried only as a last resort
+const backendRetryAfter = 30 * time.Second
+
+// Dialer for backend connections, set up in main
+var backendDialer *net.Dialer
+
+func newBackendDialer() *net.Dialer {
+	return &net.Dialer{Timeout: *backendDialTimeout, KeepAlive: *tcpKeepAlive}
+}
+
+// Sent to a client before closing when no backend could be reached
+var unavailableGreetings = map[string]string{
+	"smtp": "421 4.4.1 Service not available, backend unreachable\r\n",
+	"imap": "* BYE Backend unavailable, try again later\r\n",
+}
+
+// backendUnavailable tells a client its session has no backend. On an
+// implicit-TLS connection the write finishes the handshake, so reads are
+// bounded too.
+func backendUnavailable(conn net.Conn, proto string) {
+	conn.SetDeadline(time.Now().Add(refusalTimeout))
+	conn.Write(closingGreeting(unavailableGreetings, proto))
+}
+
+// backendPool spreads sessions round-robin over the -postfix servers. A
+// backend that fails to answer is moved to the back of the order for
+// backendRetryAfter, and a session fails over to the next one in turn.
+type backendPool struct {
+	addrs []string
+
+	mu        sync.Mutex
+	next      int
+	downUntil map[string]time.Time
+	idle      []idleConn // connections kept for reuse, with -backend-pool
+}
+
+// Postfix servers, set up in main
+var postfixBackends *backendPool
+
+// splitList parses a comma-separated list, dropping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func newBackendPool(list string) *backendPool {
+	return &backendPool{addrs: splitList(list), downUntil: map[string]time.Time{}}
+}
+
+// order returns the addresses to try for a new session: healthy backends
+// starting from the next in the rotation, then ones marked down
+func (p *backendPool) order(now time.Time) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var up, down []string
+	for i := range p.addrs {
+		addr := p.addrs[(p.next+i)%len(p.addrs)]
+		if now.Before(p.downUntil[addr]) {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+	p.next = (p.next + 1) % len(p.addrs)
+	return append(up, down...)
+}
+
+func (p *backendPool) markDown(addr string, now time.Time) {
+	p.mu.Lock()
+	p.downUntil[addr] = now.Add(backendRetryAfter)
+	p.mu.Unlock()
+}
+
+func (p *backendPool) markUp(addr string) {
+	p.mu.Lock()
+	delete(p.downUntil, addr)
+	p.mu.Unlock()
+}
+
+// addrNetwork splits a listen or backend address into its network and
+// address. "unix:/path" names a socket, e.g. Dovecot's LMTP listener;
+// anything else is host:port.
+func addrNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// dial connects to the first backend that answers and returns its address
+func (p *backendPool) dial(log *slog.Logger) (net.Conn, string, error) {
+	if len(p.addrs) == 0 {
+		return nil, "", errors.New("no backends configured")
+	}
+	var errs []error
+	for _, addr := range p.order(time.Now()) {
+		network, address := addrNetwork(addr)
+		conn, err := backendDialer.Dial(network, address)
+		if err == nil {
+			conn, err = secureBackend(conn, addr)
+		}
+		if err == nil {
+			p.markUp(addr)
+			return conn, addr, nil
+		}
+		log.Warn("Backend unreachable, trying next", "event", "backend_failover", "backend", addr, "error", err)
+		p.markDown(addr, time.Now())
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return nil, "", errors.Join(errs...)
+}
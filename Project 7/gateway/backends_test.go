@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+func TestBackendDialTimeout(t *testing.T) {
+	oldTimeout, oldDialer, oldPool := *backendDialTimeout, backendDialer, postfixBackends
+	*backendDialTimeout = 100 * time.Millisecond
+	backendDialer = newBackendDialer()
+	// A backend whose SYNs are dropped never answers the connect
+	backendDialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	postfixBackends = newBackendPool("192.0.2.1:25")
+	t.Cleanup(func() { *backendDialTimeout, backendDialer, postfixBackends = oldTimeout, oldDialer, oldPool })
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server, nil)
+		close(done)
+	}()
+	start := time.Now()
+	client.SetDeadline(start.Add(5 * time.Second))
+	c := textproto.NewConn(client)
+	defer c.Close()
+	expect(t, c, 421)
+	if elapsed := time.Since(start); elapsed < *backendDialTimeout {
+		t.Errorf("refused after %v, before the dial timed out", elapsed)
+	}
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("connection left open: %v", err)
+	}
+	<-done
+}
+
+func TestBackendDialer(t *testing.T) {
+	oldTimeout, oldKeepAlive := *backendDialTimeout, *tcpKeepAlive
+	*backendDialTimeout, *tcpKeepAlive = 3*time.Second, -1
+	t.Cleanup(func() { *backendDialTimeout, *tcpKeepAlive = oldTimeout, oldKeepAlive })
+	if d := newBackendDialer(); d.Timeout != 3*time.Second || d.KeepAlive >= 0 {
+		t.Errorf("dialer has timeout %v, keepalive %v", d.Timeout, d.KeepAlive)
+	}
+}
+
+func TestBackendFailover(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo, "")
+	down := closedAddr(t)
+	s := &smtptest.Server{}
+	old := postfixBackends
+	postfixBackends = newBackendPool(down + "," + s.Start(t))
+	t.Cleanup(func() { postfixBackends = old })
+
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+	if msgs := s.Messages(); len(msgs) != 1 {
+		t.Errorf("second backend got %d messages, want the session's", len(msgs))
+	}
+	if !strings.Contains(logs.String(), `"event":"backend_failover","backend":"`+down+`"`) {
+		t.Errorf("no backend_failover log for %s in %s", down, logs)
+	}
+
+	// The refusing backend is tried last for a while, so the next session
+	// doesn't dial it
+	c = dialGateway(t)
+	command(t, c, 221, "QUIT")
+	if strings.Count(logs.String(), "backend_failover") != 1 {
+		t.Errorf("refusing backend tried again: %s", logs)
+	}
+	if n := len(s.Sessions()); n != 2 {
+		t.Errorf("second backend had %d sessions, want both", n)
+	}
+}
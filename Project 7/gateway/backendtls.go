@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	backendTLS     = flag.String("backend-tls", "off", "TLS to the SMTP backends (-postfix and -routes): off, tls for implicit TLS from the start, or starttls. Unix socket backends never use it")
+	backendCA      = flag.String("backend-ca", "", "PEM CA bundle backend certificates must chain to (empty uses the system roots)")
+	backendVerify  = flag.String("backend-verify", "full", "How backend certificates are checked: full (chain and name), ca (chain only, for backends addressed by a name their certificate lacks) or none (trusts any certificate; for tests)")
+	backendTLSName = flag.String("backend-tls-name", "", "Name backend certificates must carry with -backend-verify full (empty checks each backend's host, as its address gives it)")
+)
+
+// -backend-tls modes
+const (
+	backendTLSOff      = "off"
+	backendTLSImplicit = "tls"
+	backendTLSStartTLS = "starttls"
+)
+
+// -backend-verify modes
+const (
+	verifyFull   = "full"
+	verifyCAOnly = "ca"
+	verifyNoCert = "none"
+)
+
+// TLS settings for backend connections, set up in main; nil with
+// -backend-tls off
+var backendTLSConfig *tls.Config
+
+// newBackendTLSConfig builds the client side TLS settings for -backend-tls
+func newBackendTLSConfig(mode, caFile, verify string) (*tls.Config, error) {
+	switch mode {
+	case backendTLSOff:
+		return nil, nil
+	case backendTLSImplicit, backendTLSStartTLS:
+	default:
+		return nil, fmt.Errorf("-backend-tls: %q must be off, tls or starttls", mode)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("-backend-ca: %w", err)
+		}
+		config.RootCAs = pool
+	}
+	switch verify {
+	case verifyFull:
+	case verifyCAOnly:
+		// The standard check would insist on the name; the chain is checked
+		// here instead
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyChain(cs.PeerCertificates, config.RootCAs)
+		}
+	case verifyNoCert:
+		config.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("-backend-verify: %q must be full, ca or none", verify)
+	}
+	return config, nil
+}
+
+// verifyChain checks a backend's certificates chain to roots, the system's
+// when nil, whatever names the leaf carries
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("backend sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// secureBackend starts TLS on a new connection to the backend at addr, as
+// -backend-tls says, closing it if that fails. With starttls the gateway
+// greets the backend with its own EHLO to ask for it, and the backend's
+// greeting is replayed from the connection returned, so the session goes on
+// as if it were the first thing the backend said.
+func secureBackend(conn net.Conn, addr string) (net.Conn, error) {
+	if backendTLSConfig == nil || conn.RemoteAddr().Network() == "unix" {
+		return conn, nil
+	}
+	conn.SetDeadline(time.Now().Add(*backendDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	config := backendTLSConfig.Clone()
+	config.ServerName = *backendTLSName
+	if config.ServerName == "" {
+		_, address := addrNetwork(addr)
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	var greeting []byte
+	if *backendTLS == backendTLSStartTLS {
+		var err error
+		if greeting, err = startBackendTLS(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	if greeting != nil {
+		return &greetedConn{Conn: tc, greeting: greeting}, nil
+	}
+	return tc, nil
+}
+
+// startBackendTLS asks the backend on conn for STARTTLS, returning its
+// greeting. A backend that doesn't offer it is an error: relaying in
+// plaintext is what -backend-tls is there to prevent.
+func startBackendTLS(conn net.Conn) ([]byte, error) {
+	r := bufio.NewReader(conn)
+	greeting, err := readReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("greeting: %w", err)
+	}
+	if !bytes.HasPrefix(greeting, []byte("220")) {
+		return nil, fmt.Errorf("greeting: %s", bytes.TrimRight(greeting, "\r\n"))
+	}
+	if _, err := conn.Write([]byte("EHLO " + gatewayHostname() + "\r\n")); err != nil {
+		return nil, err
+	}
+	ehlo, err := readReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("EHLO: %w", err)
+	}
+	offered := false
+	for _, line := range strings.Split(strings.TrimRight(string(ehlo), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if len(line) > 4 && strings.EqualFold(ehloKeyword(line[4:]), "STARTTLS") {
+			offered = true
+		}
+	}
+	if !strings.HasPrefix(string(ehlo), "250") || !offered {
+		return nil, errors.New("backend doesn't offer STARTTLS")
+	}
+	if _, err := conn.Write([]byte("STARTTLS\r\n")); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("STARTTLS: %w", err)
+	}
+	if !bytes.HasPrefix(reply, []byte("220")) {
+		return nil, fmt.Errorf("STARTTLS: %s", bytes.TrimRight(reply, "\r\n"))
+	}
+	return greeting, nil
+}
+
+// greetedConn is a backend connection whose greeting was read before the
+// session started, returned again by the first reads
+type greetedConn struct {
+	net.Conn
+	greeting []byte
+}
+
+func (c *greetedConn) Read(p []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(p, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueServer signs a server certificate for hosts, names or IP addresses
+func (ca *testCA) issueServer(t *testing.T, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// useBackendTLS relays to backends over TLS for the rest of the test, with
+// certificates checked against ca
+func useBackendTLS(t *testing.T, mode, verify, name string, ca *testCA) {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "backend-ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{"backend-tls": mode, "backend-ca": caFile, "backend-verify": verify, "backend-tls-name": name})
+	config, err := newBackendTLSConfig(mode, caFile, verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := backendTLSConfig
+	backendTLSConfig = config
+	t.Cleanup(func() { backendTLSConfig = old })
+}
+
+// startTLSBackend runs a test backend with cert, speaking TLS from the
+// start or offering STARTTLS
+func startTLSBackend(t *testing.T, mode string, cert tls.Certificate) *testBackend {
+	t.Helper()
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if mode == backendTLSStartTLS {
+		b := startTestBackend(t)
+		b.startTLS = config
+		return b
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := serveTestBackend(t, tls.NewListener(ln, config))
+	old := postfixBackends
+	postfixBackends = newBackendPool(ln.Addr().String())
+	t.Cleanup(func() { postfixBackends = old })
+	return b
+}
+
+func TestBackendTLS(t *testing.T) {
+	ca, other := newTestCA(t, "Backend CA"), newTestCA(t, "Other CA")
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		verify  string
+		issuer  *testCA
+		host    string // the certificate's
+		tlsName string
+		failure string // logged when the backend is refused, "" if it isn't
+	}{
+		{"verified", backendTLSImplicit, verifyFull, ca, "127.0.0.1", "", ""},
+		{"starttls verified", backendTLSStartTLS, verifyFull, ca, "127.0.0.1", "", ""},
+		{"unverified", backendTLSImplicit, verifyFull, other, "127.0.0.1", "", "certificate signed by unknown authority"},
+		{"starttls unverified", backendTLSStartTLS, verifyFull, other, "127.0.0.1", "", "certificate signed by unknown authority"},
+		{"name mismatch", backendTLSImplicit, verifyFull, ca, "mx.example.com", "", "cannot validate certificate for 127.0.0.1"},
+		{"starttls name mismatch", backendTLSStartTLS, verifyFull, ca, "mx.example.com", "", "cannot validate certificate for 127.0.0.1"},
+		{"name given", backendTLSImplicit, verifyFull, ca, "mx.example.com", "mx.example.com", ""},
+		{"chain only", backendTLSImplicit, verifyCAOnly, ca, "mx.example.com", "", ""},
+		{"chain only unverified", backendTLSImplicit, verifyCAOnly, other, "mx.example.com", "", "certificate signed by unknown authority"},
+		{"no checks", backendTLSImplicit, verifyNoCert, other, "mx.example.com", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useBackendTLS(t, tc.mode, tc.verify, tc.tlsName, ca)
+			b := startTLSBackend(t, tc.mode, tc.issuer.issueServer(t, tc.host))
+			logs := captureLogs(t, slog.LevelInfo, "")
+			c := textproto.NewConn(dialGatewayConn(t))
+			if tc.failure != "" {
+				expect(t, c, 421)
+				if !strings.Contains(logs.String(), tc.failure) {
+					t.Errorf("no %q in %s", tc.failure, logs)
+				}
+				if msgs := b.messages(); len(msgs) != 0 {
+					t.Errorf("backend got %q", msgs)
+				}
+				return
+			}
+			expect(t, c, 220)
+			sendMessage(t, c, 250, testBody)
+			command(t, c, 221, "QUIT")
+			if msgs := b.messages(); len(msgs) != 1 {
+				t.Errorf("backend got %q", msgs)
+			}
+			if tc.mode == backendTLSStartTLS && !slices.Contains(b.commands(), "STARTTLS") {
+				t.Errorf("backend got %q, want STARTTLS", b.commands())
+			}
+		})
+	}
+}
+
+func TestBackendTLSNotOffered(t *testing.T) {
+	useBackendTLS(t, backendTLSStartTLS, verifyFull, "", newTestCA(t, "Backend CA"))
+	b := startTestBackend(t)
+	logs := captureLogs(t, slog.LevelInfo, "")
+	c := textproto.NewConn(dialGatewayConn(t))
+	expect(t, c, 421)
+	if !strings.Contains(logs.String(), "backend doesn't offer STARTTLS") {
+		t.Errorf("no STARTTLS error in %s", logs)
+	}
+	if slices.ContainsFunc(b.commands(), func(cmd string) bool { return strings.HasPrefix(cmd, "MAIL") }) {
+		t.Errorf("backend got %q in plaintext", b.commands())
+	}
+}
+
+func TestBackendTLSConfigInvalid(t *testing.T) {
+	for _, tc := range [][3]string{
+		{"ssl", "", verifyFull},
+		{backendTLSImplicit, "", "strict"},
+		{backendTLSImplicit, filepath.Join(t.TempDir(), "missing.pem"), verifyFull},
+	} {
+		if _, err := newBackendTLSConfig(tc[0], tc[1], tc[2]); err == nil {
+			t.Errorf("%q accepted", tc)
+		}
+	}
+	if c, err := newBackendTLSConfig(backendTLSOff, "", "strict"); c != nil || err != nil {
+		t.Errorf("off gave %v, %v", c, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"net"
+	"strings"
+	"time"
+)
+
+var greetingBanner = flag.String("banner", "", "Text after the hostname in the 220 greeting, e.g. \"ESMTP ready\"; when set the gateway greets clients itself, as -myhostname, rather than relaying the backend's greeting")
+
+// gatewayGreeting is the 220 the gateway greets a client with itself: for
+// a pooled backend connection, and for every session with -banner
+func gatewayGreeting() []byte {
+	text := *greetingBanner
+	if text == "" {
+		text = "ESMTP"
+	}
+	return []byte("220 " + gatewayHostname() + " " + text + "\r\n")
+}
+
+// ownGreeting reads the greeting of conn, a new backend connection, unless
+// XCLIENT already has, and returns the one for the client: the gateway's
+// with -banner, or the backend's if it refused the session
+func ownGreeting(conn net.Conn, greeting []byte) ([]byte, error) {
+	if greeting == nil {
+		conn.SetDeadline(time.Now().Add(*backendDialTimeout))
+		defer conn.SetDeadline(time.Time{})
+		var err error
+		if greeting, err = readReply(bufio.NewReader(conn)); err != nil {
+			return nil, err
+		}
+	}
+	if !bytes.HasPrefix(greeting, []byte("220")) {
+		return greeting, nil
+	}
+	return gatewayGreeting(), nil
+}
+
+// withHostname puts the gateway's hostname in reply, after the code and
+// enhanced status code, as RFC 5321 section 4.2 has a 421 that closes the
+// session name the server: "421 4.7.0 Too many connections" becomes
+// "421 4.7.0 mx.example.com Too many connections"
+func withHostname(reply string) string {
+	code, rest, _ := strings.Cut(reply, " ")
+	if status, text, ok := strings.Cut(rest, " "); ok && strings.Count(status, ".") == 2 {
+		return code + " " + status + " " + gatewayHostname() + " " + text
+	}
+	return code + " " + gatewayHostname() + " " + rest
+}
+
+// closingGreeting is what a client turned away before its session is sent
+// from greetings, named by the gateway if it speaks SMTP
+func closingGreeting(greetings map[string]string, proto string) []byte {
+	greeting := greetings[proto]
+	if proto == "smtp" {
+		greeting = withHostname(greeting)
+	}
+	return []byte(greeting)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+func TestWithHostname(t *testing.T) {
+	setFlags(t, map[string]string{"myhostname": "mx.example.com"})
+	for reply, want := range map[string]string{
+		"421 4.7.0 Too many connections\r\n": "421 4.7.0 mx.example.com Too many connections\r\n",
+		"421 Service not available\r\n":      "421 mx.example.com Service not available\r\n",
+	} {
+		if got := withHostname(reply); got != want {
+			t.Errorf("%q: %q, want %q", reply, got, want)
+		}
+	}
+}
+
+func TestGreetingBanner(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		banner string
+		want   string
+	}{
+		{"relayed", "", "backend ESMTP"},
+		{"own", "ESMTP PQC gateway ready", "mx.example.com ESMTP PQC gateway ready"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"myhostname": "mx.example.com", "banner": tc.banner})
+			b := startTestBackend(t)
+			c := textproto.NewConn(dialGatewayConn(t))
+			if got := expect(t, c, 220); got != tc.want {
+				t.Errorf("greeted with %q, want %q", got, tc.want)
+			}
+			command(t, c, 250, "EHLO client.example.com")
+			command(t, c, 221, "QUIT")
+			if cmds := b.commands(); len(cmds) == 0 || cmds[0] != "EHLO client.example.com" {
+				t.Errorf("backend got %q", cmds)
+			}
+		})
+	}
+}
+
+func TestGreetingBannerBackendRefuses(t *testing.T) {
+	setFlags(t, map[string]string{"myhostname": "mx.example.com", "banner": "ESMTP"})
+	startFakeBackend(t, &smtptest.Server{Greeting: "554 5.3.2 backend.example.com No service here"})
+	c := textproto.NewConn(dialGatewayConn(t))
+	if got := expect(t, c, 554); got != "5.3.2 backend.example.com No service here" {
+		t.Errorf("greeted with %q, want the backend's refusal", got)
+	}
+}
+
+// refusal returns what refuse sends a client turned away for reason
+func refusal(t *testing.T, proto, reason string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	refuse(server, proto, reason)
+	b, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRefusalNamesGateway(t *testing.T) {
+	setFlags(t, map[string]string{"myhostname": "mx.example.com"})
+	for _, tc := range []struct {
+		proto, reason, want string
+	}{
+		{"smtp", "max_conns", "421 4.7.0 mx.example.com Too many connections, try again later\r\n"},
+		{"smtp", "access_denied", "554 5.7.1 Access denied\r\n"},
+		{"imap", "max_conns", "* BYE Too many connections, try again later\r\n"},
+	} {
+		if got := refusal(t, tc.proto, tc.reason); got != tc.want {
+			t.Errorf("%s %s: %q, want %q", tc.proto, tc.reason, got, tc.want)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		backendUnavailable(server, "smtp")
+		server.Close()
+	}()
+	if b, _ := io.ReadAll(client); string(b) != "421 4.4.1 mx.example.com Service not available, backend unreachable\r\n" {
+		t.Errorf("backend unavailable: %q", b)
+	}
+}
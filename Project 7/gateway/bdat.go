@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BDAT (RFC 3030 CHUNKING) is handled by the gateway itself: the chunks
+// are put back together and the message goes to the backend with DATA,
+// signed like any other, so the backend needn't support CHUNKING.
+
+// bdatArgs parses a BDAT <size> [LAST] command line
+func bdatArgs(cmd []byte) (size int64, last bool, ok bool) {
+	fields := strings.Fields(string(cmd))
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, false, false
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, false
+	}
+	if len(fields) == 3 {
+		if !strings.EqualFold(fields[2], "LAST") {
+			return 0, false, false
+		}
+		last = true
+	}
+	return size, last, true
+}
+
+// startChunk reads a BDAT command; its chunk follows the line directly.
+// Whether the message can be accepted is only decided once the replies
+// before it are in, so every chunk is read either way.
+func (s *smtpSession) startChunk(cmd []byte) {
+	size, last, ok := bdatArgs(cmd)
+	if !ok {
+		s.reply("BDAT", 501, "5.5.4 Syntax: BDAT <size> [LAST]")
+		return
+	}
+	if !s.chunked {
+		s.chunked = true
+		s.body, s.discard = nil, nil
+		_, s.dataSpan = tracer.Start(trace.ContextWithSpan(context.Background(), s.span), "smtp.data")
+	}
+	s.phase, s.chunkSize, s.chunkLeft, s.lastChunk = phaseChunk, size, size, last
+	if size == 0 {
+		s.endChunk()
+	}
+}
+
+// addChunk adds chunk bytes to the message, unless it is already over a
+// size limit
+func (s *smtpSession) addChunk(p []byte) {
+	if s.discard != nil {
+		return
+	}
+	s.body = append(s.body, p...)
+	if err := s.oversized(s.body); err != nil {
+		// Stop buffering; the rest is read and dropped
+		s.body, s.discard = nil, err
+	}
+}
+
+// endChunk queues the reply to a chunk read in full. The last one holds
+// the session's commands until the message has been handed on.
+func (s *smtpSession) endChunk() {
+	if s.lastChunk {
+		s.phase = phaseChunkPending
+		s.inflight = append(s.inflight, pendingReply{verb: "BDAT", chunks: true})
+		return
+	}
+	s.phase = phaseCommand
+	size, err := s.chunkSize, s.discard
+	s.inflight = append(s.inflight, pendingReply{verb: "BDAT", decide: func() []byte {
+		switch {
+		case err != nil:
+			rejected := smtpReplyFor(err)
+			return fmt.Appendf(nil, "%d %s\r\n", rejected.code, rejected.text)
+		case len(s.recipients) == 0:
+			return []byte("554 5.5.1 No valid recipients\r\n")
+		}
+		return fmt.Appendf(nil, "250 2.0.0 %d octets received\r\n", size)
+	}})
+}
+
+// finishChunks hands on the message BDAT LAST completed, now that the RCPT
+// replies before it are known
+func (s *smtpSession) finishChunks() error {
+	body, err := s.body, s.discard
+	s.chunked, s.discard = false, nil
+	switch {
+	case err != nil:
+		s.endDataSpan(0, err)
+		s.rejectMessage(err)
+		return nil
+	case len(s.recipients) == 0:
+		s.endDataSpan(0, nil)
+		s.phase, s.body = phaseCommand, nil
+		s.reply("BDAT", 554, "5.5.1 No valid recipients")
+		return nil
+	}
+	s.endDataSpan(len(body), nil)
+	return s.finishData(s.ctx, chunkedMessage(body))
+}
+
+// abandonChunks drops a BDAT message cut short by RSET or a new greeting
+func (s *smtpSession) abandonChunks() {
+	if !s.chunked {
+		return
+	}
+	s.endDataSpan(0, nil)
+	s.chunked = false
+	s.body, s.discard = nil, nil
+}
+
+// chunkedMessage puts a message sent with BDAT in the form DATA delivers
+// one: CRLF line endings, including after the last line. BDAT data isn't
+// dot-stuffed.
+func chunkedMessage(body []byte) []byte {
+	msg := normalizeLineEndings(body)
+	if len(msg) > 0 && !bytes.HasSuffix(msg, crlf) {
+		msg = append(msg, crlf...)
+	}
+	return msg
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// bdat sends data as one BDAT chunk
+func bdat(t *testing.T, c *textproto.Conn, data string, last bool) {
+	t.Helper()
+	cmd := fmt.Sprintf("BDAT %d", len(data))
+	if last {
+		cmd += " LAST"
+	}
+	write(t, c, cmd+"\r\n"+data)
+}
+
+func TestSessionBDAT(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	if ehlo := command(t, c, 250, "EHLO client.example.com"); !strings.Contains(ehlo, "\nCHUNKING") {
+		t.Errorf("CHUNKING not offered: %q", ehlo)
+	}
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	chunks := []string{
+		"From: a@example.com\r\nTo: b@example.com\r\nSubj",
+		"ect: chunked\r\n\r\nfirst line\r\n.dot line\r\n",
+		"last line",
+	}
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		bdat(t, c, chunk, last)
+		if reply := expect(t, c, 250); !last && reply != fmt.Sprintf("2.0.0 %d octets received", len(chunk)) {
+			t.Errorf("chunk %d: %q", i, reply)
+		}
+	}
+	command(t, c, 221, "QUIT")
+
+	msgs := b.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("backend got %q, want one message", msgs)
+	}
+	msg := unstuffDots([]byte(msgs[0]))
+	if !strings.Contains(string(msg), "Subject: chunked\r\n") || !strings.HasSuffix(string(msg), "\r\n.dot line\r\nlast line\r\n") {
+		t.Errorf("message not put back together: %q", msgs[0])
+	}
+	if r := verifyMessage(context.Background(), msg); r.status != verifyPass {
+		t.Errorf("relayed message: %+v", r)
+	}
+	if cmds := b.commands(); !slices.Contains(cmds, "DATA") || slices.ContainsFunc(cmds, func(cmd string) bool {
+		return strings.HasPrefix(cmd, "BDAT")
+	}) {
+		t.Errorf("backend got %q, want DATA and no BDAT", cmds)
+	}
+}
+
+func TestSessionBDATPipelined(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	write(t, c, "MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<bad@example.com>\r\n"+
+		"BDAT 24\r\nSubject: pipelined\r\n\r\nbo"+
+		"BDAT 4 LAST\r\ndy\r\n"+
+		"MAIL FROM:<a@example.com>\r\n")
+	for _, code := range []int{250, 250, 550, 250, 250, 250} {
+		expect(t, c, code)
+	}
+	command(t, c, 221, "QUIT")
+
+	// Under the gateway's Received
+	if msgs := b.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "\r\nSubject: pipelined\r\n") ||
+		!strings.HasSuffix(msgs[0], "\r\n\r\nbody\r\n") {
+		t.Errorf("backend got %q", msgs)
+	}
+}
+
+func TestSessionBDATNoRecipients(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 550, "RCPT TO:<bad@example.com>")
+	bdat(t, c, "Subject: one\r\n", false)
+	expect(t, c, 554)
+	bdat(t, c, "\r\nbody\r\n", true)
+	expect(t, c, 554)
+	command(t, c, 250, "NOOP")
+
+	if msgs := b.messages(); len(msgs) != 0 {
+		t.Errorf("backend got %q", msgs)
+	}
+}
+
+func TestSessionDATAAfterBDAT(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	bdat(t, c, "Subject: mixed\r\n\r\nbody\r\n", false)
+	expect(t, c, 250)
+	command(t, c, 503, "DATA")
+	bdat(t, c, "", true)
+	expect(t, c, 250)
+
+	if msgs := b.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "Subject: mixed") {
+		t.Errorf("backend got %q", msgs)
+	}
+}
+
+func TestSessionBDATTooLarge(t *testing.T) {
+	old := *maxMessageSize
+	*maxMessageSize = 64
+	t.Cleanup(func() { *maxMessageSize = old })
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	bdat(t, c, "Subject: big\r\n\r\n"+strings.Repeat("x", 100), false)
+	expect(t, c, 552)
+	bdat(t, c, "\r\n", true)
+	expect(t, c, 552)
+
+	// The transaction is closed on the backend, and the session goes on
+	sendTo(t, c, "b@example.com", "Subject: small\r\n\r\nbody\r\n")
+	if msgs := b.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "Subject: small") {
+		t.Errorf("backend got %q", msgs)
+	}
+}
+
+func TestBdatArgs(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		size int64
+		last bool
+		ok   bool
+	}{
+		{"BDAT 100\r\n", 100, false, true},
+		{"bdat 0 last\r\n", 0, true, true},
+		{"BDAT 5 LAST\r\n", 5, true, true},
+		{"BDAT\r\n", 0, false, false},
+		{"BDAT -1\r\n", 0, false, false},
+		{"BDAT x LAST\r\n", 0, false, false},
+		{"BDAT 5 FIRST\r\n", 0, false, false},
+		{"BDAT 5 LAST more\r\n", 0, false, false},
+	} {
+		size, last, ok := bdatArgs([]byte(tc.cmd))
+		if size != tc.size || last != tc.last || ok != tc.ok {
+			t.Errorf("bdatArgs(%q) = %d, %v, %v", tc.cmd, size, last, ok)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Header/body canonicalization applied before signing, as the c= tag names
+// it (after DKIM, RFC 6376 section 3.4). Signatures made before c= existed
+// cover the raw message and are treated as "simple".
+const (
+	canonRelaxed = "relaxed/relaxed"
+	canonSimple  = "simple"
+)
+
+// Trace fields relays prepend in transit. They are never covered, so
+// delivery through Postfix and Dovecot doesn't break a signature.
+var traceHeaders = map[string]bool{
+	"received":      true,
+	"return-path":   true,
+	"delivered-to":  true,
+	"x-original-to": true,
+}
+
+// canonicalize returns the bytes a signature with the given c= and h= values
+// covers. With an h= list only those headers are covered, in that order;
+// without one, every header but the trace fields is.
+func canonicalize(msg []byte, c string, signedHeaders []string) ([]byte, error) {
+	switch strings.ToLower(c) {
+	case "", canonSimple:
+		return msg, nil
+	case canonRelaxed:
+	default:
+		return nil, fmt.Errorf("unsupported canonicalization %q", c)
+	}
+
+	msg = normalizeLineEndings(msg)
+	end := headerEnd(msg)
+	var b bytes.Buffer
+	b.Grow(len(msg))
+	fields := parseHeaders(msg)
+	if signedHeaders != nil {
+		fields = selectHeaders(fields, signedHeaders)
+	}
+	for _, f := range fields {
+		if signedHeaders == nil && traceHeaders[strings.ToLower(f.Name)] {
+			continue
+		}
+		b.WriteString(relaxedHeader(f))
+	}
+	b.Write(crlf)
+	b.Write(relaxedBody(bytes.TrimPrefix(msg[end:], crlf)))
+	return b.Bytes(), nil
+}
+
+// selectHeaders picks the fields an h= list names. As in DKIM, a name
+// listed more than once takes instances from the bottom up, and a name with
+// no instance left contributes nothing: adding that header later breaks the
+// signature.
+func selectHeaders(fields []headerField, names []string) []headerField {
+	used := make([]bool, len(fields))
+	var out []headerField
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].Name, name) {
+				used[i] = true
+				out = append(out, fields[i])
+				break
+			}
+		}
+	}
+	return out
+}
+
+// relaxedHeader renders a field as lowercase-name:value with folding undone
+// and runs of whitespace collapsed
+func relaxedHeader(f headerField) string {
+	return strings.ToLower(f.Name) + ":" + strings.Join(strings.FieldsFunc(f.Value(), isWSP), " ") + "\r\n"
+}
+
+// relaxedBody collapses whitespace within lines, strips it from line ends
+// and drops trailing empty lines
+func relaxedBody(body []byte) []byte {
+	var b bytes.Buffer
+	b.Grow(len(body))
+	blank := 0 // empty lines held back in case they are trailing
+	for len(body) > 0 {
+		line := body
+		if i := bytes.Index(body, crlf); i >= 0 {
+			line, body = body[:i], body[i+len(crlf):]
+		} else {
+			body = nil
+		}
+		line = bytes.TrimRight(line, " \t")
+		if len(line) == 0 {
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			b.Write(crlf)
+		}
+		// Copy the line a run at a time, each whitespace run becoming one space
+		for len(line) > 0 {
+			if i := bytes.IndexAny(line, " \t"); i != 0 {
+				if i < 0 {
+					i = len(line)
+				}
+				b.Write(line[:i])
+				line = line[i:]
+				continue
+			}
+			b.WriteByte(' ')
+			line = bytes.TrimLeft(line, " \t")
+		}
+		b.Write(crlf)
+	}
+	return b.Bytes()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// normalizeLineEndings turns bare LFs into CRLF
+func normalizeLineEndings(msg []byte) []byte {
+	if bytes.Count(msg, []byte("\n")) == bytes.Count(msg, crlf) {
+		return msg
+	}
+	msg = bytes.ReplaceAll(msg, crlf, []byte("\n"))
+	return bytes.ReplaceAll(msg, []byte("\n"), crlf)
+}
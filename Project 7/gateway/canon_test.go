@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestRelaxedCanon(t *testing.T) {
+	msg := []byte("Received: by mx\r\nSubject:  Hello \t world\r\n  again\r\nTO: b@x\r\n\r\nline  one \t\r\n\r\n two\r\n\r\n\r\n")
+	got, err := canonicalize(msg, canonRelaxed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "subject:Hello world again\r\nto:b@x\r\n\r\nline one\r\n\r\n two\r\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := canonicalize(msg, "nowsp", nil); err == nil {
+		t.Error("unknown canonicalization accepted")
+	}
+}
+
+func BenchmarkRelaxedCanon(b *testing.B) {
+	msg := largeMessage(1 << 20)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := canonicalize(msg, canonRelaxed, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRelaxedCanonUTF8(t *testing.T) {
+	msg := []byte("From: 用户@例子.广告\r\nSubject:  Grüße \u00a0 – 你好\u00a0\r\n \u3000again\r\n\r\nZeile  mit Umlauten: äöü \t\r\n\u00a0\r\n")
+	got, err := canonicalize(msg, canonRelaxed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only SP and HTAB are whitespace; the no-break and ideographic spaces
+	// are text like any other
+	want := "from:用户@例子.广告\r\nsubject:Grüße \u00a0 – 你好\u00a0 \u3000again\r\n\r\nZeile mit Umlauten: äöü\r\n\u00a0\r\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var certPoll = flag.Duration("cert-poll", 30*time.Second, "How often to check -cert and -key for a renewed certificate (0 disables; SIGHUP always reloads, along with the signing key)")
+
+// certHolder serves the listener certificate through GetCertificate. A
+// reload swaps the pointer, so new handshakes get the new certificate while
+// established connections carry on with the one they negotiated.
+type certHolder struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// Server certificate for SMTP and IMAP, set up by getHybridTLSConfig
+var serverCert certHolder
+
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load(), nil
+}
+
+func (h *certHolder) set(cert tls.Certificate) {
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	h.cert.Store(&cert)
+}
+
+// reloadCertificate loads -cert/-key (or -key-env) again. A pair that fails to load, e.g.
+// with only one file renewed so far, leaves the current certificate serving.
+func reloadCertificate(reason string) error {
+	cert, err := loadKeyPair()
+	if err != nil {
+		slog.Error("Failed to reload TLS certificate, keeping the current one", "event", "tls_cert_reload_failed",
+			"reason", reason, "cert", *certFile, "error", err)
+		return err
+	}
+	serverCert.set(cert)
+	attrs := []any{"event", "tls_cert_reloaded", "reason", reason, "cert", *certFile}
+	if leaf := serverCert.cert.Load().Leaf; leaf != nil {
+		attrs = append(attrs, "subject", leaf.Subject.String(), "not_after", leaf.NotAfter.Format(time.RFC3339))
+	}
+	slog.Info("TLS certificate reloaded", attrs...)
+	return nil
+}
+
+// watchCertificate reloads the certificate on SIGHUP and, every interval,
+// when -cert or -key has changed. The same SIGHUP reloads the signing key
+// (see watchSigningKey).
+func watchCertificate(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	stamp := fileStamp(*certFile, *keyFile)
+	for {
+		select {
+		case <-hup:
+			reloadCertificate("sighup")
+			stamp = fileStamp(*certFile, *keyFile)
+		case <-tick:
+			if s := fileStamp(*certFile, *keyFile); s != stamp && reloadCertificate("file_changed") == nil {
+				stamp = s
+			}
+		}
+	}
+}
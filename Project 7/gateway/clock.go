@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// Clock tells the time to the parts of the gateway that write it into what
+// they produce, receipt timestamps and signature nonces, and to the replay
+// window that reads the nonces back. Tests swap in one they control.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Clock for receipts, nonces and the replay window
+var signingClock Clock = systemClock{}
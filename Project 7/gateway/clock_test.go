@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSigningClock makes c the clock receipts, nonces and replay guards made
+// from now on read, for the rest of the test
+func useSigningClock(t *testing.T, c Clock) {
+	old := signingClock
+	signingClock = c
+	t.Cleanup(func() { signingClock = old })
+}
+
+func TestReceiptTimestamp(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	useSigningClock(t, clock)
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+
+	out, delivered, err := processMail(context.Background(), slog.Default(), envelope{mailFrom: "a@example.com"}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Hour) // the receipt is of signing, not delivery
+	delivered()
+	if r := <-store.calls; !r.Timestamp.Equal(time.Unix(1700000000, 0)) || r.Timestamp.Location() != time.UTC {
+		t.Errorf("receipt timestamp %v, want 2023-11-14 22:13:20 UTC", r.Timestamp)
+	}
+	if n := signatureTags(t, out)["n"]; !strings.HasPrefix(n, "1700000000.") {
+		t.Errorf("nonce %q, want one from the signing time", n)
+	}
+}
+
+func TestNonceWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	useSigningClock(t, clock)
+	useReplayGuard(t, newReplayGuard(time.Hour))
+	msg := preSigned(t)
+	check := func() verifyResult {
+		return checkReplay(slog.Default(), "", verifyMessage(context.Background(), msg))
+	}
+
+	if r := check(); r.status != verifyPass {
+		t.Fatalf("first delivery: %+v", r)
+	}
+	clock.advance(59 * time.Minute)
+	if r := check(); r.status != verifyFail {
+		t.Errorf("replay within the window: %+v", r)
+	}
+	clock.advance(time.Hour)
+	if r := check(); r.status != verifyPass {
+		t.Errorf("delivery after the window: %+v", r)
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configFile = flag.String("config", "", "YAML configuration file (command-line flags take precedence)")
+
+// Config is the gateway configuration as it appears in the -config file.
+// Every setting is tagged with the flag it corresponds to: values from the
+// file fill in flags that weren't given on the command line, so precedence
+// is flags, then file, then built-in defaults.
+type Config struct {
+	Listen         string   `yaml:"listen" flag:"listen"`
+	IMAPListen     string   `yaml:"imap_listen" flag:"imap-listen"`
+	MyHostname     string   `yaml:"myhostname" flag:"myhostname"`
+	Banner         string   `yaml:"banner" flag:"banner"`
+	LogLevel       string   `yaml:"log_level" flag:"log-level"`
+	TraceIP        []string `yaml:"trace_ip" flag:"trace-ip"`
+	MaxMessageSize int      `yaml:"max_message_size" flag:"max-message-size"`
+	MaxHeaderSize  int      `yaml:"max_header_size" flag:"max-header-size"`
+	BufferSize     int      `yaml:"buffer_size" flag:"buffer-size"`
+	ProxyProtocol  bool     `yaml:"proxy_protocol" flag:"proxy-protocol"`
+	ProxyTrusted   []string `yaml:"proxy_trusted" flag:"proxy-trusted"`
+	ReusePort      bool     `yaml:"reuse_port" flag:"reuse-port"`
+	Observe        bool     `yaml:"observe" flag:"observe"`
+	FailClosed     bool     `yaml:"fail_closed" flag:"fail-closed"`
+	AnnotateErrors bool     `yaml:"annotate_backend_errors" flag:"annotate-backend-errors"`
+	OTelEndpoint   string   `yaml:"otel_endpoint" flag:"otel-endpoint"`
+	ClientBytes    string   `yaml:"client_bytes_metric" flag:"client-bytes-metric"`
+	Backends       struct {
+		Postfix     string            `yaml:"postfix" flag:"postfix"`
+		Routes      map[string]string `yaml:"routes" flag:"routes"`
+		Dovecot     string            `yaml:"dovecot" flag:"dovecot"`
+		Queue       int               `yaml:"queue" flag:"backend-queue"`
+		LMTP        bool              `yaml:"lmtp" flag:"lmtp"`
+		RewriteHELO bool              `yaml:"rewrite_helo" flag:"rewrite-helo"`
+		XCLIENT     bool              `yaml:"xclient" flag:"xclient"`
+		Pool        int               `yaml:"pool" flag:"backend-pool"`
+		PoolIdle    time.Duration     `yaml:"pool_idle" flag:"backend-pool-idle"`
+		Retry       bool              `yaml:"retry" flag:"retry-backend"`
+		TLS         string            `yaml:"tls" flag:"backend-tls"`
+		TLSCA       string            `yaml:"tls_ca" flag:"backend-ca"`
+		TLSVerify   string            `yaml:"tls_verify" flag:"backend-verify"`
+		TLSName     string            `yaml:"tls_name" flag:"backend-tls-name"`
+	} `yaml:"backends"`
+	TLS struct {
+		Cert       string        `yaml:"cert" flag:"cert"`
+		Key        string        `yaml:"key" flag:"key"`
+		KeyEnv     string        `yaml:"key_env" flag:"key-env"`
+		WriteCert  bool          `yaml:"write_cert" flag:"write-cert"`
+		Poll       time.Duration `yaml:"poll" flag:"cert-poll"`
+		StartTLS   bool          `yaml:"starttls" flag:"starttls"`
+		Require    bool          `yaml:"require" flag:"require-tls"`
+		ClientCA   string        `yaml:"client_ca" flag:"client-ca"`
+		Curves     []string      `yaml:"curves" flag:"tls-curves"`
+		Ciphers    []string      `yaml:"ciphers" flag:"tls-ciphers"`
+		MinVersion string        `yaml:"min_version" flag:"tls-min-version"`
+		MaxVersion string        `yaml:"max_version" flag:"tls-max-version"`
+		ALPN       []string      `yaml:"alpn" flag:"tls-alpn"`
+
+		SessionTickets bool          `yaml:"session_tickets" flag:"tls-session-tickets"`
+		TicketRotation time.Duration `yaml:"ticket_rotation" flag:"tls-ticket-rotation"`
+	} `yaml:"tls"`
+	Auth struct {
+		Require bool   `yaml:"require" flag:"require-auth"`
+		Users   string `yaml:"users" flag:"auth-users"`
+	} `yaml:"auth"`
+	Limits struct {
+		MaxConns      int           `yaml:"max_conns" flag:"max-conns"`
+		IPRate        int           `yaml:"ip_rate" flag:"ip-rate"`
+		IPBurst       int           `yaml:"ip_burst" flag:"ip-burst"`
+		Action        string        `yaml:"action" flag:"limit-action"`
+		Quota         int           `yaml:"quota" flag:"quota"`
+		QuotaWindow   time.Duration `yaml:"quota_window" flag:"quota-window"`
+		DNSBL         []string      `yaml:"dnsbl" flag:"dnsbl"`
+		DNSBLCacheTTL time.Duration `yaml:"dnsbl_cache_ttl" flag:"dnsbl-cache-ttl"`
+		RecipientMap  string        `yaml:"recipient_map" flag:"recipient-map"`
+		Callout       bool          `yaml:"recipient_callout" flag:"recipient-callout"`
+		CalloutTTL    time.Duration `yaml:"recipient_callout_ttl" flag:"recipient-callout-ttl"`
+		Allow         []string      `yaml:"allow_cidr" flag:"allow-cidr"`
+		Deny          []string      `yaml:"deny_cidr" flag:"deny-cidr"`
+		ACLFile       string        `yaml:"acl_file" flag:"acl-file"`
+		ACLPoll       time.Duration `yaml:"acl_poll" flag:"acl-poll"`
+		LineLength    int           `yaml:"max_line_length" flag:"max-line-length"`
+		LongLines     int           `yaml:"max_long_lines" flag:"max-long-lines"`
+		DenyTypes     []string      `yaml:"deny_content_types" flag:"deny-content-types"`
+	} `yaml:"limits"`
+	Timeouts struct {
+		Idle          time.Duration `yaml:"idle" flag:"idle-timeout"`
+		Session       time.Duration `yaml:"session" flag:"session-timeout"`
+		ShutdownGrace time.Duration `yaml:"shutdown_grace" flag:"shutdown-grace"`
+		BackendStall  time.Duration `yaml:"backend_stall" flag:"backend-stall-timeout"`
+		BackendDial   time.Duration `yaml:"backend_dial" flag:"backend-dial-timeout"`
+		TCPKeepAlive  time.Duration `yaml:"tcp_keepalive" flag:"tcp-keepalive"`
+	} `yaml:"timeouts"`
+	Signing struct {
+		Algorithm      string        `yaml:"algorithm" flag:"sig-alg"`
+		Key            string        `yaml:"key" flag:"sig-key"`
+		PublicKey      string        `yaml:"public_key" flag:"sig-pubkey"`
+		DomainKeys     string        `yaml:"domain_keys" flag:"sig-domain-keys"`
+		KeyPoll        time.Duration `yaml:"key_poll" flag:"sig-key-poll"`
+		Headers        []string      `yaml:"headers" flag:"sign-headers"`
+		RejectOnBadSig bool          `yaml:"reject_on_bad_sig" flag:"reject-on-bad-sig"`
+		VerifyCache    int           `yaml:"verify_cache_size" flag:"verify-cache-size"`
+		VerifyCacheTTL time.Duration `yaml:"verify_cache_ttl" flag:"verify-cache-ttl"`
+		Format         string        `yaml:"format" flag:"signature-format"`
+		ResignPolicy   string        `yaml:"resign_policy" flag:"resign-policy"`
+		ReplayWindow   time.Duration `yaml:"replay_window" flag:"replay-window"`
+		StreamAbove    int           `yaml:"stream_above" flag:"stream-above"`
+		DKIMKey        string        `yaml:"dkim_key" flag:"dkim-key"`
+		DKIMDomain     string        `yaml:"dkim_domain" flag:"dkim-domain"`
+		DKIMSelector   string        `yaml:"dkim_selector" flag:"dkim-selector"`
+	} `yaml:"signing"`
+	Receipts struct {
+		Store           string        `yaml:"store" flag:"receipt-store"`
+		File            string        `yaml:"file" flag:"receipt-file"`
+		URL             string        `yaml:"url" flag:"receipts"`
+		Timeout         time.Duration `yaml:"timeout" flag:"receipt-timeout"`
+		Attempts        int           `yaml:"attempts" flag:"receipt-attempts"`
+		Backoff         time.Duration `yaml:"backoff" flag:"receipt-backoff"`
+		Queue           int           `yaml:"queue" flag:"receipt-queue"`
+		RetryInterval   time.Duration `yaml:"retry_interval" flag:"receipt-retry-interval"`
+		MaxRetries      int           `yaml:"max_retries" flag:"receipt-max-retries"`
+		DrainTimeout    time.Duration `yaml:"drain_timeout" flag:"receipt-drain-timeout"`
+		BatchSize       int           `yaml:"batch_size" flag:"receipt-batch-size"`
+		BatchInterval   time.Duration `yaml:"batch_interval" flag:"receipt-batch-interval"`
+		BreakerFailures int           `yaml:"breaker_failures" flag:"receipt-breaker-failures"`
+		BreakerCooldown time.Duration `yaml:"breaker_cooldown" flag:"receipt-breaker-cooldown"`
+		API             bool          `yaml:"api" flag:"receipt-api"`
+		APITokenFile    string        `yaml:"api_token_file" flag:"receipt-api-token-file"`
+		KeyFile         string        `yaml:"key_file" flag:"receipt-key"`
+	} `yaml:"receipts"`
+	Health struct {
+		Listen    string `yaml:"listen" flag:"health-listen"`
+		Cert      string `yaml:"cert" flag:"health-cert"`
+		Key       string `yaml:"key" flag:"health-key"`
+		TokenFile string `yaml:"token_file" flag:"health-token-file"`
+	} `yaml:"health"`
+	Audit struct {
+		Log     string        `yaml:"log" flag:"audit-log"`
+		MaxSize int           `yaml:"max_size" flag:"audit-log-max-size"`
+		MaxAge  time.Duration `yaml:"max_age" flag:"audit-log-max-age"`
+		Keep    int           `yaml:"keep" flag:"audit-log-keep"`
+	} `yaml:"audit"`
+}
+
+// loadConfig applies the -config file (if any) to flags not set on the
+// command line, then validates and returns the effective configuration
+func loadConfig(fs *flag.FlagSet, path string) (*Config, error) {
+	if path != "" {
+		if err := applyConfigFile(fs, path); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := configFromFlags(fs)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	// Decode strictly into the struct to catch typos, and separately into a
+	// node tree to tell "absent" from "set to the zero value"
+	var file Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	setOnCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setOnCommandLine[f.Name] = true })
+
+	return walkConfig(reflect.ValueOf(&file).Elem(), nil, func(path []string, name string, v reflect.Value) error {
+		if setOnCommandLine[name] || !yamlHasKey(&root, path) {
+			return nil
+		}
+		if err := fs.Set(name, formatConfigValue(v)); err != nil {
+			return fmt.Errorf("config %s: %w", strings.Join(path, "."), err)
+		}
+		return nil
+	})
+}
+
+// configFromFlags snapshots the current flag values as a Config
+func configFromFlags(fs *flag.FlagSet) (*Config, error) {
+	cfg := &Config{}
+	err := walkConfig(reflect.ValueOf(cfg).Elem(), nil, func(path []string, name string, v reflect.Value) error {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("config %s refers to unknown flag -%s", strings.Join(path, "."), name)
+		}
+		return parseConfigValue(v, f.Value.String())
+	})
+	return cfg, err
+}
+
+// walkConfig calls fn for every flag-tagged leaf field of a Config
+func walkConfig(v reflect.Value, path []string, fn func(path []string, flagName string, v reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		fieldPath := append(append([]string(nil), path...), key)
+		if name := field.Tag.Get("flag"); name != "" {
+			if err := fn(fieldPath, name, v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			if err := walkConfig(v.Field(i), fieldPath, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlHasKey reports whether the document sets the given nested key
+func yamlHasKey(node *yaml.Node, path []string) bool {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return false
+		}
+		node = node.Content[0]
+	}
+	for _, key := range path {
+		if node.Kind != yaml.MappingNode {
+			return false
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next = node.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return false
+		}
+		node = next
+	}
+	return true
+}
+
+// formatConfigValue renders a field the way its flag parses it
+func formatConfigValue(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Duration:
+		return x.String()
+	case []string:
+		return strings.Join(x, ",")
+	case map[string]string:
+		return formatRoutes(x)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// parseConfigValue is the inverse of formatConfigValue
+func parseConfigValue(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case map[string]string:
+		routes, err := parseRoutes(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(routes))
+	case string:
+		v.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+// validateHostPort checks an address is host:port, bracketing any IPv6 host
+func validateHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return errors.New("IPv6 addresses must be in brackets, e.g. [::1]:25")
+		}
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) {
+			return errors.New(addrErr.Err)
+		}
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("port %q must be a number from 0 to 65535", port)
+	}
+	if _, err := netip.ParseAddr(host); strings.Contains(host, ":") && err != nil {
+		return fmt.Errorf("%q is not a valid IPv6 address", host)
+	}
+	return nil
+}
+
+// validate checks settings that would otherwise only fail at first use
+func (c *Config) validate() error {
+	var errs []error
+	checkHostPort := func(name, addr string) {
+		if network, path := addrNetwork(addr); network == "unix" {
+			if path == "" {
+				errs = append(errs, fmt.Errorf("%s: %q has no socket path", name, addr))
+			}
+			return
+		}
+		if err := validateHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q must be host:port: %w", name, addr, err))
+		}
+	}
+	checkHostPort("listen", c.Listen)
+	if c.IMAPListen != "" {
+		checkHostPort("imap_listen", c.IMAPListen)
+	}
+	if err := validateHostPort(c.Health.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("health.listen: %q must be host:port: %w", c.Health.Listen, err))
+	}
+	if (c.Health.Cert == "") != (c.Health.Key == "") {
+		errs = append(errs, errors.New("health.cert and health.key must be set together"))
+	}
+	postfix := splitList(c.Backends.Postfix)
+	if len(postfix) == 0 {
+		errs = append(errs, errors.New("backends.postfix: at least one address is required"))
+	}
+	for _, addr := range postfix {
+		checkHostPort("backends.postfix", addr)
+	}
+	for name, backends := range c.Backends.Routes {
+		list := splitList(backends)
+		if routeName(name) == "" || len(list) == 0 {
+			errs = append(errs, fmt.Errorf("backends.routes: %q needs a name and at least one address", name))
+		}
+		for _, addr := range list {
+			checkHostPort("backends.routes."+name, addr)
+		}
+	}
+	checkHostPort("backends.dovecot", c.Backends.Dovecot)
+
+	switch c.Receipts.Store {
+	case "http":
+		if u, err := url.Parse(c.Receipts.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("receipts.url: %q must be an http(s) URL", c.Receipts.URL))
+		}
+	case "file":
+		if c.Receipts.File == "" {
+			errs = append(errs, errors.New("receipts.file is required with receipts.store file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("receipts.store: %q must be http or file", c.Receipts.Store))
+	}
+	if c.Receipts.APITokenFile != "" && !c.Receipts.API {
+		errs = append(errs, errors.New("receipts.api_token_file is set but receipts.api is off"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	minVersion, err := parseTLSVersion(c.TLS.MinVersion)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("tls.min_version: %w", err))
+	}
+	if c.TLS.MaxVersion != "" {
+		if maxVersion, err := parseTLSVersion(c.TLS.MaxVersion); err != nil {
+			errs = append(errs, fmt.Errorf("tls.max_version: %w", err))
+		} else if maxVersion < minVersion {
+			errs = append(errs, fmt.Errorf("tls.max_version %s is below tls.min_version %s", c.TLS.MaxVersion, c.TLS.MinVersion))
+		}
+	}
+	if _, err := parseCipherSuites(strings.Join(c.TLS.Ciphers, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("tls.ciphers: %w", err))
+	}
+	if _, err := parseCurves(strings.Join(c.TLS.Curves, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("tls.curves: %w", err))
+	}
+	if _, err := parseALPN(strings.Join(c.TLS.ALPN, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("tls.alpn: %w", err))
+	}
+	if _, err := parsePrefixes(strings.Join(c.TraceIP, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("trace_ip: %w", err))
+	}
+	if _, err := parsePrefixes(strings.Join(c.ProxyTrusted, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("proxy_trusted: %w", err))
+	}
+	if _, err := parsePrefixes(strings.Join(c.Limits.Allow, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("limits.allow_cidr: %w", err))
+	}
+	if _, err := parsePrefixes(strings.Join(c.Limits.Deny, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("limits.deny_cidr: %w", err))
+	}
+	if _, err := newContentTypeFilter(c.Limits.DenyTypes); err != nil {
+		errs = append(errs, fmt.Errorf("limits.deny_content_types: %w", err))
+	}
+	if c.Signing.Key != "" && c.Signing.PublicKey == "" {
+		errs = append(errs, errors.New("signing.public_key is required with signing.key"))
+	}
+	// A command line then always arrives in one or two reads
+	if longest := max(c.Limits.LineLength, maxCommandLine); c.BufferSize < longest {
+		errs = append(errs, fmt.Errorf("buffer_size: %d is below %d, the longest command line accepted", c.BufferSize, longest))
+	}
+	if c.Limits.LineLength < 512 {
+		errs = append(errs, fmt.Errorf("limits.max_line_length: %d is below the 512 octets RFC 5321 requires", c.Limits.LineLength))
+	}
+	switch c.Backends.TLS {
+	case backendTLSOff, backendTLSImplicit, backendTLSStartTLS:
+	default:
+		errs = append(errs, fmt.Errorf("backends.tls: %q must be off, tls or starttls", c.Backends.TLS))
+	}
+	switch c.Backends.TLSVerify {
+	case verifyFull, verifyCAOnly, verifyNoCert:
+	default:
+		errs = append(errs, fmt.Errorf("backends.tls_verify: %q must be full, ca or none", c.Backends.TLSVerify))
+	}
+	switch c.Signing.Format {
+	case formatHeader, formatMultipart, formatBoth:
+	default:
+		errs = append(errs, fmt.Errorf("signing.format: %q must be header, multipart or both", c.Signing.Format))
+	}
+	switch c.Signing.ResignPolicy {
+	case resignAdd, resignSkip, resignReplace:
+	default:
+		errs = append(errs, fmt.Errorf("signing.resign_policy: %q must be add, skip or replace", c.Signing.ResignPolicy))
+	}
+	if _, err := lookupSigAlg(c.Signing.Algorithm); err != nil {
+		errs = append(errs, fmt.Errorf("signing.algorithm: %w", err))
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"limits.quota_window", c.Limits.QuotaWindow},
+		{"limits.dnsbl_cache_ttl", c.Limits.DNSBLCacheTTL},
+		{"limits.recipient_callout_ttl", c.Limits.CalloutTTL},
+		{"limits.acl_poll", c.Limits.ACLPoll},
+		{"timeouts.idle", c.Timeouts.Idle},
+		{"timeouts.session", c.Timeouts.Session},
+		{"timeouts.shutdown_grace", c.Timeouts.ShutdownGrace},
+		{"timeouts.backend_stall", c.Timeouts.BackendStall},
+		{"receipts.timeout", c.Receipts.Timeout},
+		{"receipts.backoff", c.Receipts.Backoff},
+		{"receipts.drain_timeout", c.Receipts.DrainTimeout},
+		{"receipts.breaker_cooldown", c.Receipts.BreakerCooldown},
+		{"signing.key_poll", c.Signing.KeyPoll},
+		{"signing.verify_cache_ttl", c.Signing.VerifyCacheTTL},
+		{"signing.replay_window", c.Signing.ReplayWindow},
+		{"tls.poll", c.TLS.Poll},
+		{"tls.ticket_rotation", c.TLS.TicketRotation},
+		{"audit.max_age", c.Audit.MaxAge},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", d.name))
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"max_message_size", c.MaxMessageSize},
+		{"max_header_size", c.MaxHeaderSize},
+		{"backends.pool", c.Backends.Pool},
+		{"audit.max_size", c.Audit.MaxSize},
+		{"audit.keep", c.Audit.Keep},
+		{"signing.verify_cache_size", c.Signing.VerifyCache},
+		{"signing.stream_above", c.Signing.StreamAbove},
+		{"limits.max_conns", c.Limits.MaxConns},
+		{"limits.ip_rate", c.Limits.IPRate},
+		{"limits.ip_burst", c.Limits.IPBurst},
+		{"limits.max_long_lines", c.Limits.LongLines},
+		{"limits.quota", c.Limits.Quota},
+		{"backends.queue", c.Backends.Queue},
+		{"receipts.batch_size", c.Receipts.BatchSize},
+		{"receipts.max_retries", c.Receipts.MaxRetries},
+		{"receipts.breaker_failures", c.Receipts.BreakerFailures},
+	} {
+		if n.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", n.name))
+		}
+	}
+	if c.Limits.Quota > 0 && c.Limits.QuotaWindow <= 0 {
+		errs = append(errs, errors.New("limits.quota_window must be positive with limits.quota"))
+	}
+	switch c.ClientBytes {
+	case "", "ip", "identity":
+	default:
+		errs = append(errs, fmt.Errorf("client_bytes_metric: %q must be ip, identity or empty", c.ClientBytes))
+	}
+	if c.Limits.Action != "reply" && c.Limits.Action != "drop" {
+		errs = append(errs, fmt.Errorf("limits.action: %q must be reply or drop", c.Limits.Action))
+	}
+	if c.Backends.Pool > 0 && c.Backends.PoolIdle <= 0 {
+		errs = append(errs, errors.New("backends.pool_idle must be positive when pooling"))
+	}
+	if c.Timeouts.BackendDial <= 0 {
+		errs = append(errs, errors.New("timeouts.backend_dial must be positive"))
+	}
+	if c.Signing.DKIMKey != "" && (c.Signing.DKIMDomain == "" || c.Signing.DKIMSelector == "") {
+		errs = append(errs, errors.New("signing.dkim_domain and signing.dkim_selector must be set with signing.dkim_key"))
+	}
+	if c.Receipts.RetryInterval <= 0 {
+		errs = append(errs, errors.New("receipts.retry_interval must be positive"))
+	}
+	if c.Receipts.BatchSize > 0 && c.Receipts.BatchInterval <= 0 {
+		errs = append(errs, errors.New("receipts.batch_interval must be positive when batching"))
+	}
+	return errors.Join(errs...)
+}
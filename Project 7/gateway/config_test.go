@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// defaultConfig is the configuration the built-in flag defaults give
+func defaultConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg, err := configFromFlags(flag.CommandLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("defaults don't validate: %v", err)
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		edit  func(*Config)
+		error string // "" when the config is valid
+	}{
+		{"ipv6 listen", func(c *Config) { c.Listen = "[::1]:2525" }, ""},
+		{"any-host listen", func(c *Config) { c.Listen = ":2525" }, ""},
+		{"unix backend", func(c *Config) { c.Backends.Postfix = "unix:/run/postfix.sock" }, ""},
+		{"unix listen", func(c *Config) { c.Listen = "unix:/run/pqc-gateway/smtp.sock" }, ""},
+		{"unix dovecot", func(c *Config) { c.Backends.Dovecot = "unix:/run/dovecot/imap" }, ""},
+		{"empty socket path", func(c *Config) { c.IMAPListen = "unix:" }, `imap_listen: "unix:" has no socket path`},
+		{"backend list", func(c *Config) { c.Backends.Postfix = "mx1:25, [2001:db8::1]:25" }, ""},
+		{"missing port", func(c *Config) { c.Listen = "localhost" },
+			`listen: "localhost" must be host:port: missing port in address`},
+		{"unbracketed ipv6", func(c *Config) { c.Listen = "::1:2525" },
+			`listen: "::1:2525" must be host:port: IPv6 addresses must be in brackets, e.g. [::1]:25`},
+		{"invalid ipv6", func(c *Config) { c.Backends.Dovecot = "[::g]:143" },
+			`backends.dovecot: "[::g]:143" must be host:port: "::g" is not a valid IPv6 address`},
+		{"port out of range", func(c *Config) { c.IMAPListen = ":70000" },
+			`imap_listen: ":70000" must be host:port: port "70000" must be a number from 0 to 65535`},
+		{"named port", func(c *Config) { c.Backends.Postfix = "mx1:smtp" },
+			`backends.postfix: "mx1:smtp" must be host:port: port "smtp" must be a number`},
+		{"no backend", func(c *Config) { c.Backends.Postfix = " , " },
+			"backends.postfix: at least one address is required"},
+		{"receipt url", func(c *Config) { c.Receipts.URL = "receipts:6000" }, "receipts.url"},
+		{"bad network", func(c *Config) { c.Limits.Allow = []string{"10.0.0.0/33"} }, `limits.allow_cidr: invalid network "10.0.0.0/33"`},
+		{"key without pubkey", func(c *Config) { c.Signing.Key = "sk.bin" }, "signing.public_key is required"},
+		{"alpn", func(c *Config) { c.TLS.ALPN = []string{"smtp", "imap"} }, ""},
+		{"unknown alpn", func(c *Config) { c.TLS.ALPN = []string{"h2"} }, `tls.alpn: unknown protocol "h2"`},
+		{"dkim without selector", func(c *Config) { c.Signing.DKIMKey, c.Signing.DKIMDomain = "dkim.pem", "example.com" }, "signing.dkim_selector must be set"},
+		{"token without api", func(c *Config) { c.Receipts.APITokenFile = "token" }, "receipts.api_token_file is set"},
+		{"small buffer", func(c *Config) { c.BufferSize = 4096 }, "buffer_size: 4096 is below 16384"},
+		{"buffer under line length", func(c *Config) { c.Limits.LineLength = 64 << 10 }, "buffer_size: 32768 is below 65536"},
+		{"backend tls mode", func(c *Config) { c.Backends.TLS = "ssl" }, `backends.tls: "ssl" must be off, tls or starttls`},
+		{"backend verify mode", func(c *Config) { c.Backends.TLSVerify = "strict" }, `backends.tls_verify: "strict" must be full, ca or none`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultConfig(t)
+			tc.edit(cfg)
+			err := cfg.validate()
+			switch {
+			case tc.error == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.error != "" && (err == nil || !strings.Contains(err.Error(), tc.error)):
+				t.Errorf("got %v, want an error containing %q", err, tc.error)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := defaultConfig(t)
+	cfg.Listen, cfg.LogLevel = "nowhere", "loud"
+	err := cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "listen:") || !strings.Contains(err.Error(), "log_level:") {
+		t.Errorf("got %v, want both errors", err)
+	}
+}
+
+func TestConfigFileUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("listne: \":2525\"\n"), 0o600)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := applyConfigFile(fs, path); err == nil || !strings.Contains(err.Error(), "listne") {
+		t.Errorf("got %v, want the typo reported", err)
+	}
+}
+
+// textFlag is a flag that keeps its value as given, for flag sets that
+// mustn't touch the gateway's own flags
+type textFlag string
+
+func (f *textFlag) String() string     { return string(*f) }
+func (f *textFlag) Set(s string) error { *f = textFlag(s); return nil }
+
+// gatewayFlags returns a flag set with every gateway flag at its default,
+// apart from those of flag.CommandLine
+func gatewayFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := textFlag(f.DefValue)
+		fs.Var(&v, f.Name, f.Usage)
+	})
+	return fs
+}
+
+func TestLoadConfigMerges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("listen: \"127.0.0.1:2600\"\n"+
+		"timeouts:\n  idle: 2m\n  session: 45m\n"+
+		"signing:\n  headers: [From, Subject]\n"), 0o600)
+	fs := gatewayFlags()
+	if err := fs.Parse([]string{"-listen", "127.0.0.1:2700", "-session-timeout", "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(fs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultConfig(t)
+
+	// The command line beats the file
+	if cfg.Listen != "127.0.0.1:2700" || cfg.Timeouts.Session != time.Hour {
+		t.Errorf("listen %s, session timeout %v; want the command line's", cfg.Listen, cfg.Timeouts.Session)
+	}
+	// The file beats the defaults
+	if cfg.Timeouts.Idle != 2*time.Minute || !reflect.DeepEqual(cfg.Signing.Headers, []string{"From", "Subject"}) {
+		t.Errorf("idle timeout %v, sign headers %q; want the file's", cfg.Timeouts.Idle, cfg.Signing.Headers)
+	}
+	if got := fs.Lookup("idle-timeout").Value.String(); got != "2m0s" {
+		t.Errorf("-idle-timeout %s, want the file's set on the flag", got)
+	}
+	// What neither sets keeps its default
+	if cfg.Backends.Postfix != def.Backends.Postfix || cfg.Timeouts.ShutdownGrace != def.Timeouts.ShutdownGrace {
+		t.Errorf("backend %s, shutdown grace %v; want the defaults %s, %v",
+			cfg.Backends.Postfix, cfg.Timeouts.ShutdownGrace, def.Backends.Postfix, def.Timeouts.ShutdownGrace)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// Shown by /config in place of a secret
+const redactedValue = "[redacted]"
+
+// Settings /config masks, by flag: where the key material and credentials
+// live is as much as an attacker needs to go after them
+var secretSettings = map[string]bool{
+	"key":                    true,
+	"sig-key":                true,
+	"sig-domain-keys":        true,
+	"dkim-key":               true,
+	"receipt-key":            true,
+	"receipt-api-token-file": true,
+	"health-key":             true,
+	"health-token-file":      true,
+	"auth-users":             true,
+}
+
+// Settings that are URLs, shown without any password they carry
+var urlSettings = map[string]bool{
+	"receipts":      true,
+	"otel-endpoint": true,
+}
+
+// configHandler serves GET /config: the effective configuration, with
+// flags, -config file and defaults merged, keyed as in the file
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, err := effectiveConfig(flag.CommandLine)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, cfg)
+}
+
+// effectiveConfig snapshots fs as nested maps keyed by -config file name,
+// durations spelled out as in the file and secrets redacted
+func effectiveConfig(fs *flag.FlagSet) (map[string]any, error) {
+	cfg, err := configFromFlags(fs)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]any{}
+	err = walkConfig(reflect.ValueOf(cfg).Elem(), nil, func(path []string, name string, v reflect.Value) error {
+		section := out
+		for _, key := range path[:len(path)-1] {
+			next, ok := section[key].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				section[key] = next
+			}
+			section = next
+		}
+		section[path[len(path)-1]] = shownValue(name, v)
+		return nil
+	})
+	return out, err
+}
+
+// shownValue is what /config reports for the setting of flag name
+func shownValue(name string, v reflect.Value) any {
+	switch x := v.Interface().(type) {
+	case string:
+		switch {
+		case x == "":
+			return x
+		case secretSettings[name]:
+			return redactedValue
+		case urlSettings[name]:
+			if u, err := url.Parse(x); err == nil {
+				return u.Redacted()
+			}
+			return redactedValue
+		}
+	case time.Duration:
+		return x.String()
+	case []string:
+		if x == nil {
+			return []string{}
+		}
+	}
+	return v.Interface()
+}
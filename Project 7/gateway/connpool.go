@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+var (
+	backendPoolSize = flag.Int("backend-pool", 0, "Idle backend connections kept per backend list for later sessions to reuse (0 opens one per session)")
+	backendPoolIdle = flag.Duration("backend-pool-idle", 30*time.Second, "How long a pooled backend connection may sit unused before it is closed")
+)
+
+// idleConn is a backend connection waiting in a pool for its next session
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// pooling reports whether sessions hand their backend connections back
+func pooling() bool {
+	return *backendPoolSize > 0
+}
+
+// connect is dial, preferring a pooled connection with -backend-pool. The
+// backend greeted a reused connection long ago.
+func (p *backendPool) connect(log *slog.Logger) (conn net.Conn, addr string, reused bool, err error) {
+	if pooling() {
+		if conn := p.get(log); conn != nil {
+			return conn, conn.RemoteAddr().String(), true, nil
+		}
+	}
+	conn, addr, err = p.dial(log)
+	return conn, addr, false, err
+}
+
+// get returns a pooled connection that still answers RSET, closing ones
+// that have sat too long or fail the check. It returns nil when there are
+// none and a new one has to be dialed.
+func (p *backendPool) get(log *slog.Logger) net.Conn {
+	for {
+		p.mu.Lock()
+		p.evictIdle(time.Now())
+		var c idleConn
+		n := len(p.idle)
+		if n > 0 {
+			// Newest first, leaving the oldest to expire
+			c, p.idle = p.idle[n-1], p.idle[:n-1]
+		}
+		p.mu.Unlock()
+		if c.conn == nil {
+			return nil
+		}
+		if err := resetBackend(c.conn); err != nil {
+			log.Info("Closing pooled backend connection", "event", "backend_pool_evicted",
+				"backend", c.conn.RemoteAddr().String(), "reason", err.Error())
+			backendPoolConns.WithLabelValues("evicted").Inc()
+			c.conn.Close()
+			continue
+		}
+		backendPoolConns.WithLabelValues("reused").Inc()
+		return c.conn
+	}
+}
+
+// put pools a connection a session is done with, or closes it if the pool
+// is full
+func (p *backendPool) put(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evictIdle(time.Now())
+	if len(p.idle) >= *backendPoolSize {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+// evictIdle closes connections unused for -backend-pool-idle, with mu held.
+// Sessions keep the pool swept; the backend closes any left over once it
+// tires of them.
+func (p *backendPool) evictIdle(now time.Time) {
+	keep := p.idle[:0]
+	for _, c := range p.idle {
+		if now.Sub(c.since) < *backendPoolIdle {
+			keep = append(keep, c)
+			continue
+		}
+		backendPoolConns.WithLabelValues("expired").Inc()
+		c.conn.Close()
+	}
+	clear(p.idle[len(keep):])
+	p.idle = keep
+}
+
+// resetBackend checks a pooled connection is still alive and clears what
+// the last session left behind
+func resetBackend(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(*backendDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("RSET\r\n")); err != nil {
+		return err
+	}
+	if _, _, err := textproto.NewReader(bufio.NewReader(conn)).ReadResponse(250); err != nil {
+		return fmt.Errorf("RSET: %w", err)
+	}
+	return nil
+}
+
+// idleBackend returns the session's backend connection if another session
+// could take it over: nothing owed in either direction and no transaction
+// half sent. One the client logged in to through the gateway keeps that
+// login, so it is never reused.
+func (s *smtpSession) idleBackend() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(s.inflight) > 0, len(s.resp) > 0, len(s.toBackend) > 0, s.message != nil:
+		return nil
+	case s.phase != phaseCommand, !s.backend.idle():
+		return nil
+	case s.authed && authenticator == nil:
+		return nil
+	}
+	conn, _ := s.link.current()
+	return conn
+}
+
+// answerQuit replies to QUIT for a session whose backend connection is
+// kept, and ends the session once the reply is out
+func (s *smtpSession) answerQuit() []byte {
+	s.quit = true
+	return []byte("221 2.0.0 Bye\r\n")
+}
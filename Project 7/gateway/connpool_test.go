@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePool turns on -backend-pool for the rest of the test
+func usePool(t *testing.T, size int, idle time.Duration) {
+	oldSize, oldIdle := *backendPoolSize, *backendPoolIdle
+	*backendPoolSize, *backendPoolIdle = size, idle
+	t.Cleanup(func() { *backendPoolSize, *backendPoolIdle = oldSize, oldIdle })
+}
+
+// waitPooled waits for p to hold n idle connections; sessions hand theirs
+// back after the client has gone
+func waitPooled(t *testing.T, p *backendPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		got := len(p.idle)
+		p.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pooled connections, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func poolConns(result string) float64 {
+	families, _ := metricsRegistry.Gather()
+	for _, f := range families {
+		if f.GetName() != "pqc_gateway_backend_pool_connections_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" && l.GetValue() == result {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestBackendPoolReuse(t *testing.T) {
+	usePool(t, 2, time.Minute)
+	b := startTestBackend(t)
+	t.Cleanup(b.hangUp)
+	reused := poolConns("reused")
+
+	for i := 0; i < 3; i++ {
+		c := dialGateway(t)
+		sendMessage(t, c, 250, testBody)
+		command(t, c, 221, "QUIT")
+		waitPooled(t, postfixBackends, 1)
+	}
+
+	if n := b.connections(); n != 1 {
+		t.Errorf("backend accepted %d connections, want 1", n)
+	}
+	if n := len(b.messages()); n != 3 {
+		t.Errorf("backend got %d messages, want 3", n)
+	}
+	var resets int
+	for _, cmd := range b.commands() {
+		switch strings.ToUpper(cmd) {
+		case "RSET":
+			resets++
+		case "QUIT":
+			t.Error("client's QUIT reached a pooled connection")
+		}
+	}
+	if resets != 2 {
+		t.Errorf("%d RSETs, want one before each reuse", resets)
+	}
+	if got := poolConns("reused") - reused; got != 2 {
+		t.Errorf("reused %v times, want 2", got)
+	}
+}
+
+func TestBackendPoolEvictsDeadConnection(t *testing.T) {
+	usePool(t, 2, time.Minute)
+	b := startTestBackend(t)
+	t.Cleanup(b.hangUp)
+	evicted := poolConns("evicted")
+
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 221, "QUIT")
+	waitPooled(t, postfixBackends, 1)
+
+	// The backend drops the idle connection, as at its own timeout
+	b.hangUp()
+	c = dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+
+	if n := b.connections(); n != 2 {
+		t.Errorf("backend accepted %d connections, want a new one after the dead one", n)
+	}
+	if got := poolConns("evicted") - evicted; got != 1 {
+		t.Errorf("evicted %v connections, want 1", got)
+	}
+}
+
+func TestBackendPoolExpiresIdle(t *testing.T) {
+	usePool(t, 2, 20*time.Millisecond)
+	b := startTestBackend(t)
+	t.Cleanup(b.hangUp)
+
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 221, "QUIT")
+	waitPooled(t, postfixBackends, 1)
+	time.Sleep(40 * time.Millisecond)
+
+	c = dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	if n := b.connections(); n != 2 {
+		t.Errorf("backend accepted %d connections, want a new one", n)
+	}
+}
+
+func TestIdleBackend(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	session := func() *smtpSession {
+		return &smtpSession{backend: newBackendWriter(conn, nil), link: newBackendLink(conn)}
+	}
+	if got := session().idleBackend(); got != conn {
+		t.Errorf("idle session: %v", got)
+	}
+	for name, busy := range map[string]func(*smtpSession){
+		"reply owed":       func(s *smtpSession) { s.inflight = []pendingReply{{verb: "RCPT"}} },
+		"partial response": func(s *smtpSession) { s.resp = []byte("250-") },
+		"unsent command":   func(s *smtpSession) { s.toBackend = []byte("NOOP\r\n") },
+		"in DATA":          func(s *smtpSession) { s.phase = phaseData },
+		"backend AUTH":     func(s *smtpSession) { s.authed = true },
+	} {
+		s := session()
+		busy(s)
+		if s.idleBackend() != nil {
+			t.Errorf("%s: connection handed on", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	dkimKeyFile  = flag.String("dkim-key", "", "PEM private key (RSA or Ed25519) to add a DKIM-Signature with alongside the PQC signature, for receivers that only check DKIM; empty adds none. Messages over -stream-above aren't DKIM-signed")
+	dkimDomain   = flag.String("dkim-domain", "", "DKIM signing domain (d=), required with -dkim-key")
+	dkimSelector = flag.String("dkim-selector", "", "DKIM selector (s=), required with -dkim-key: the public key is published in TXT <selector>._domainkey.<domain>")
+)
+
+// Smallest RSA key DKIM verifiers must accept (RFC 8301 section 3.2)
+const minDKIMRSABits = 1024
+
+// Set up from -dkim-key in main; nil when no DKIM signature is added
+var dkim *dkimSigner
+
+// dkimSigner adds a classical DKIM-Signature (RFC 6376) for the
+// migration, so a receiver without PQC support still has a signature it
+// can check. It uses the relaxed/relaxed canonicalization X-PQC-Signature
+// does and covers the -sign-headers list.
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+	alg      string           // a= value
+	now      func() time.Time // time.Now, except in tests
+}
+
+// loadDKIMSigner reads a PKCS#8 or PKCS#1 PEM key from path
+func loadDKIMSigner(path, domain, selector string) (*dkimSigner, error) {
+	warnIfExposed(path)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key found", path)
+	}
+	var key any
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: not a PKCS#8 or PKCS#1 private key", path)
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	d, err := newDKIMSigner(signer, domain, selector)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return d, nil
+}
+
+func newDKIMSigner(key crypto.Signer, domain, selector string) (*dkimSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM signing needs a domain and a selector")
+	}
+	if err := checkTagValue("d", domain); err != nil {
+		return nil, err
+	}
+	if err := checkTagValue("s", selector); err != nil {
+		return nil, err
+	}
+	d := &dkimSigner{domain: domain, selector: selector, key: key, now: time.Now}
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minDKIMRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits is too short for DKIM (want %d or more)", k.N.BitLen(), minDKIMRSABits)
+		}
+		d.alg = "rsa-sha256"
+	case ed25519.PublicKey:
+		d.alg = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T (want RSA or Ed25519)", k)
+	}
+	return d, nil
+}
+
+// record is the DNS TXT record publishing the key, for the operator to add
+// at <selector>._domainkey.<domain>
+func (d *dkimSigner) record() string {
+	var k, p string
+	switch pub := d.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		k, p = "rsa", base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		// RFC 8463 publishes the bare 32-byte key
+		k, p = "ed25519", base64.StdEncoding.EncodeToString(pub)
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", k, p)
+}
+
+// sign returns msg with a DKIM-Signature added over the headers named in
+// signedHeaders and the body. A nil list covers every header present but
+// the trace fields, as for X-PQC-Signature. From is always covered, as DKIM
+// requires.
+func (d *dkimSigner) sign(msg []byte, signedHeaders []string) ([]byte, error) {
+	// Hashed with line endings fixed but added to msg as it is, so as not
+	// to change bytes a multipart/signed part was signed as
+	canon := normalizeLineEndings(msg)
+	fields := parseHeaders(canon)
+	names := dkimHeaderNames(fields, signedHeaders)
+
+	var b bytes.Buffer
+	for _, f := range selectHeaders(fields, names) {
+		b.WriteString(relaxedHeader(f))
+	}
+	bodyHash := sha256.Sum256(relaxedBody(bytes.TrimPrefix(canon[headerEnd(canon):], crlf)))
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		d.alg, d.domain, d.selector, d.now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// The signature covers its own header with b= empty, last and without
+	// its line break
+	self := relaxedHeader(headerField{Name: "DKIM-Signature", Raw: []byte("DKIM-Signature: " + value)})
+	b.WriteString(strings.TrimSuffix(self, "\r\n"))
+
+	digest := sha256.Sum256(b.Bytes())
+	var opts crypto.SignerOpts = crypto.SHA256
+	if d.alg == "ed25519-sha256" {
+		// Ed25519 signs the digest as its message (RFC 8463 section 3)
+		opts = crypto.Hash(0)
+	}
+	sig, err := d.key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return nil, err
+	}
+	return insertHeader(msg, "DKIM-Signature", value+chunkSignature([]byte(base64.StdEncoding.EncodeToString(sig)))), nil
+}
+
+// dkimHeaderNames returns h= for a DKIM signature from the -sign-headers
+// list, or from the header fields present when it is empty, with From
+// added if missing
+func dkimHeaderNames(fields []headerField, signedHeaders []string) []string {
+	names := signedHeaders
+	if names == nil {
+		for _, f := range fields {
+			if !traceHeaders[strings.ToLower(f.Name)] {
+				names = append(names, f.Name)
+			}
+		}
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, "From") {
+			return names
+		}
+	}
+	return append([]string{"From"}, names...)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 8463 appendix A: the Ed25519 key from RFC 8032's first test vector,
+// and the message signed with it
+const (
+	rfc8463Seed    = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+)
+
+func rfc8463Key() ed25519.PrivateKey {
+	seed, _ := hex.DecodeString(rfc8463Seed)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+var (
+	wsp      = regexp.MustCompile(`[ \t]+`)
+	bTag     = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	fieldEnd = regexp.MustCompile(`\r\n([^ \t])`)
+)
+
+// dkimVerify checks the first DKIM-Signature in msg against pub the way
+// RFC 6376 section 6 describes, for relaxed/relaxed. It shares no code
+// with the signer, and is itself checked against RFC 8463's example.
+func dkimVerify(msg string, pub crypto.PublicKey) error {
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		return errors.New("no end to the header block")
+	}
+	var fields []string // unfolded, without line breaks
+	for _, f := range strings.Split(fieldEnd.ReplaceAllString(head, "\x00$1"), "\x00") {
+		fields = append(fields, strings.ReplaceAll(f, "\r\n", ""))
+	}
+	relaxed := func(f string) string {
+		name, value, _ := strings.Cut(f, ":")
+		return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	}
+
+	sigField := -1
+	for i, f := range fields {
+		if strings.HasPrefix(strings.ToLower(f), "dkim-signature:") {
+			sigField = i
+			break
+		}
+	}
+	if sigField < 0 {
+		return errors.New("no DKIM-Signature")
+	}
+	tags := map[string]string{}
+	_, value, _ := strings.Cut(fields[sigField], ":")
+	for _, tag := range strings.Split(value, ";") {
+		if name, v, ok := strings.Cut(tag, "="); ok {
+			tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(v), "")
+		}
+	}
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected v=%q c=%q", tags["v"], tags["c"])
+	}
+
+	lines := strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(lines[i], " "), " ")
+	}
+	canonBody := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if canonBody != "" {
+		canonBody += "\r\n"
+	}
+	bh := sha256.Sum256([]byte(canonBody))
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != tags["bh"] {
+		return fmt.Errorf("body hash %s, want bh=%s", got, tags["bh"])
+	}
+
+	var data strings.Builder
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if n, _, _ := strings.Cut(fields[i], ":"); !used[i] && strings.EqualFold(strings.TrimSpace(n), name) {
+				used[i] = true
+				data.WriteString(relaxed(fields[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	data.WriteString(relaxed(bTag.ReplaceAllString(fields[sigField], "$1$2")))
+	digest := sha256.Sum256([]byte(data.String()))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch tags["a"] {
+	case "ed25519-sha256":
+		if !ed25519.Verify(pub.(ed25519.PublicKey), digest[:], sig) {
+			return errors.New("bad Ed25519 signature")
+		}
+	case "rsa-sha256":
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+	default:
+		return fmt.Errorf("unexpected a=%q", tags["a"])
+	}
+	return nil
+}
+
+func TestDKIMVerifierRFC8463(t *testing.T) {
+	if err := dkimVerify(rfc8463Message, rfc8463Key().Public()); err != nil {
+		t.Fatal(err)
+	}
+	altered := strings.Replace(rfc8463Message, "dinner", "lunch", 1)
+	if err := dkimVerify(altered, rfc8463Key().Public()); err == nil {
+		t.Error("altered Subject verified")
+	}
+}
+
+// testDKIMKeys are an Ed25519 and an RSA DKIM key
+func testDKIMKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"ed25519": rfc8463Key(), "rsa": rsaKey}
+}
+
+func TestDKIMSign(t *testing.T) {
+	_, msg, _ := strings.Cut(rfc8463Message, "Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n")
+	for name, key := range testDKIMKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			d, err := newDKIMSigner(key, "football.example.com", "brisbane")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.now = func() time.Time { return time.Unix(1528637909, 0) }
+			out, err := d.sign([]byte(msg), []string{"To", "Subject", "Date", "Message-ID"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dkimVerify(string(out), key.Public()); err != nil {
+				t.Fatalf("%v in\n%s", err, out)
+			}
+			value, _ := headerValue(out, "DKIM-Signature")
+			// From is covered even though the list leaves it out
+			for _, want := range []string{"d=football.example.com", "s=brisbane", "t=1528637909", "h=From:To:Subject",
+				"bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="} {
+				if !strings.Contains(value, want) {
+					t.Errorf("DKIM-Signature %q lacks %s", value, want)
+				}
+			}
+			if !strings.HasSuffix(string(out), msg[headerEnd([]byte(msg)):]) {
+				t.Error("body changed")
+			}
+			for _, tamper := range []string{"Suzie Q", "hungry"} {
+				altered := strings.Replace(string(out), tamper, tamper+"!", 1)
+				if err := dkimVerify(altered, key.Public()); err == nil {
+					t.Errorf("verified with %q altered", tamper)
+				}
+			}
+		})
+	}
+}
+
+func TestDKIMSignAllHeaders(t *testing.T) {
+	key := rfc8463Key()
+	d, err := newDKIMSigner(key, "example.com", "sel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "Received: by mx\r\nSubject: hi\r\nX-Extra: one\r\nFrom: a@example.com\r\n\r\nbody\r\n"
+	out, err := d.sign([]byte(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := headerValue(out, "DKIM-Signature"); !strings.Contains(value, "h=Subject:X-Extra:From;") {
+		t.Errorf("DKIM-Signature %q, want every header but the trace fields", value)
+	}
+	if err := dkimVerify(string(out), key.Public()); err != nil {
+		t.Error(err)
+	}
+}
+
+// useDKIM signs with key as -dkim-key would for the rest of the test
+func useDKIM(t *testing.T, key crypto.Signer) {
+	t.Helper()
+	d, err := newDKIMSigner(key, "example.com", "sel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := dkim
+	dkim = d
+	t.Cleanup(func() { dkim = old })
+}
+
+func TestSignMessageWithDKIM(t *testing.T) {
+	key := rfc8463Key()
+	useDKIM(t, key)
+	for _, format := range []string{formatHeader, formatMultipart, formatBoth} {
+		t.Run(format, func(t *testing.T) {
+			useSignatureFormat(t, format)
+			out, _, err := processMail(context.Background(), slog.Default(), envelope{}, mimeMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Both signatures are there, and neither breaks the other
+			if err := dkimVerify(string(out), key.Public()); err != nil {
+				t.Errorf("DKIM: %v", err)
+			}
+			if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+				t.Errorf("PQC: %+v", r)
+			}
+			if _, ok := headerValue(out, "X-PQC-Signature"); ok != (format != formatMultipart) {
+				t.Errorf("X-PQC-Signature present: %v", ok)
+			}
+		})
+	}
+}
+
+func TestSignMessageWithDKIMAllHeaders(t *testing.T) {
+	key := rfc8463Key()
+	useDKIM(t, key)
+	old := *signHeaders
+	*signHeaders = ""
+	t.Cleanup(func() { *signHeaders = old })
+
+	// The header signature, made last, covers the DKIM-Signature too
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dkimVerify(string(out), key.Public()); err != nil {
+		t.Errorf("DKIM: %v", err)
+	}
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Errorf("PQC: %+v", r)
+	}
+	altered := strings.Replace(string(out), "d=example.com", "d=example.org", 1)
+	if r := verifyMessage(context.Background(), []byte(altered)); r.status != verifyFail {
+		t.Errorf("PQC with the DKIM-Signature altered: %+v", r)
+	}
+}
+
+func TestLoadDKIMSigner(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	edDER, _ := x509.MarshalPKCS8PrivateKey(rfc8463Key())
+	rsaKey := testDKIMKeys(t)["rsa"].(*rsa.PrivateKey)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	os.WriteFile(filepath.Join(dir, "junk.pem"), []byte("not a key\n"), 0o600)
+
+	for _, tc := range []struct {
+		name, path, alg, wantErr string
+	}{
+		{"ed25519 pkcs8", write("ed.pem", "PRIVATE KEY", edDER), "ed25519-sha256", ""},
+		{"rsa pkcs1", write("rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), "rsa-sha256", ""},
+		{"ecdsa", write("ec.pem", "PRIVATE KEY", ecDER), "", "unsupported DKIM key type"},
+		{"not pem", filepath.Join(dir, "junk.pem"), "", "no PEM key found"},
+		{"missing", filepath.Join(dir, "missing.pem"), "", "no such file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := loadDKIMSigner(tc.path, "example.com", "sel")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.alg != tc.alg {
+				t.Errorf("a=%s, want %s", d.alg, tc.alg)
+			}
+		})
+	}
+
+	if _, err := loadDKIMSigner(filepath.Join(dir, "ed.pem"), "example.com", ""); err == nil {
+		t.Error("loaded without a selector")
+	}
+}
+
+func TestDKIMRecord(t *testing.T) {
+	d, err := newDKIMSigner(rfc8463Key(), "football.example.com", "brisbane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As published in RFC 8463 appendix A.2
+	if got, want := d.record(), "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="; got != want {
+		t.Errorf("record %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dnsblZones    = flag.String("dnsbl", "", "Comma-separated DNS blocklist zones, e.g. zen.spamhaus.org; unauthenticated clients listed in any get 554 to MAIL FROM")
+	dnsblCacheTTL = flag.Duration("dnsbl-cache-ttl", 5*time.Minute, "How long a client's blocklist result is reused")
+)
+
+// How long the blocklist lookups for one client may take before the session
+// goes on without them
+const dnsblTimeout = 5 * time.Second
+
+// dnsResolver is the part of net.Resolver blocklist checks use
+type dnsResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsblChecker looks up clients in DNS blocklists, remembering each
+// client's result for a while so a busy sender isn't looked up on every
+// connection. Lookups that fail aren't remembered.
+type dnsblChecker struct {
+	zones    []string
+	resolver dnsResolver
+	ttl      time.Duration
+	now      func() time.Time // time.Now, except in tests
+
+	mu        sync.Mutex
+	results   map[netip.Addr]dnsblResult
+	lastSweep time.Time
+}
+
+type dnsblResult struct {
+	zone    string // the zone listing the client, "" if none does
+	expires time.Time
+}
+
+// Blocklists for -dnsbl, set up in main; nil checks nobody
+var blocklists *dnsblChecker
+
+func newDNSBLChecker(zones []string, resolver dnsResolver, ttl time.Duration) *dnsblChecker {
+	if len(zones) == 0 {
+		return nil
+	}
+	return &dnsblChecker{
+		zones:    zones,
+		resolver: resolver,
+		ttl:      ttl,
+		now:      time.Now,
+		results:  map[netip.Addr]dnsblResult{},
+	}
+}
+
+// listed returns the first zone listing addr, or "" if none does
+func (c *dnsblChecker) listed(ctx context.Context, addr netip.Addr) (string, error) {
+	now := c.now()
+	c.mu.Lock()
+	r, ok := c.results[addr]
+	c.mu.Unlock()
+	if ok && now.Before(r.expires) {
+		dnsblLookups.WithLabelValues("cached").Inc()
+		return r.zone, nil
+	}
+
+	zone, err := c.lookup(ctx, addr)
+	if err != nil {
+		dnsblLookups.WithLabelValues("error").Inc()
+		return "", err
+	}
+	if zone != "" {
+		dnsblLookups.WithLabelValues("listed").Inc()
+	} else {
+		dnsblLookups.WithLabelValues("clean").Inc()
+	}
+	c.mu.Lock()
+	c.sweep(now)
+	c.results[addr] = dnsblResult{zone: zone, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return zone, nil
+}
+
+// lookup queries each zone in turn, stopping at the first that lists addr
+func (c *dnsblChecker) lookup(ctx context.Context, addr netip.Addr) (string, error) {
+	name := reverseName(addr)
+	for _, zone := range c.zones {
+		answers, err := c.resolver.LookupHost(ctx, name+"."+zone)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", zone, err)
+		}
+		for _, a := range answers {
+			ip, err := netip.ParseAddr(a)
+			if err != nil || !ip.Is4() || ip.As4()[0] != 127 {
+				continue
+			}
+			// 127.255.255.x is the zone refusing the query, e.g. Spamhaus
+			// turning away a public resolver, rather than a listing
+			if b := ip.As4(); b[1] == 255 && b[2] == 255 {
+				return "", fmt.Errorf("%s: query refused (%s)", zone, a)
+			}
+			return zone, nil
+		}
+	}
+	return "", nil
+}
+
+// sweep forgets expired results, at most once a minute
+func (c *dnsblChecker) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for addr, r := range c.results {
+		if !now.Before(r.expires) {
+			delete(c.results, addr)
+		}
+	}
+}
+
+// reverseName is addr as a blocklist query label: the octets of an IPv4
+// address, or the nibbles of an IPv6 one, in reverse order
+func reverseName(addr netip.Addr) string {
+	if addr.Is4() {
+		b := addr.As4()
+		return fmt.Sprintf("%d.%d.%d.%d", b[3], b[2], b[1], b[0])
+	}
+	const hex = "0123456789abcdef"
+	b := addr.As16()
+	labels := make([]string, 0, 32)
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[b[i]&0xf]), string(hex[b[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
+
+// blocklisted returns the zone listing the session's client when it should
+// be refused. Authenticated clients, often on listed dynamic addresses, are
+// never refused, and neither is anyone when the lookups fail.
+func (s *smtpSession) blocklisted(ctx context.Context) string {
+	if blocklists == nil || s.authenticated() {
+		return ""
+	}
+	addr, err := netip.ParseAddr(remoteIP(s.client))
+	if err != nil {
+		return "" // a Unix socket client has no address to look up
+	}
+	addr = addr.Unmap().WithZone("")
+	ctx, cancel := context.WithTimeout(ctx, dnsblTimeout)
+	defer cancel()
+	zone, err := blocklists.listed(ctx, addr)
+	if err != nil {
+		s.log.Warn("Failed to check DNS blocklists, allowing client", "event", "dnsbl_failed", "error", err)
+		return ""
+	}
+	if zone != "" {
+		s.log.Info("Refusing blocklisted client", "event", "dnsbl_listed", "zone", zone)
+	}
+	return zone
+}
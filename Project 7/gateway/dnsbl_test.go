@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers blocklist queries from a table; names not in it are
+// NXDOMAIN
+type fakeResolver struct {
+	mu      sync.Mutex
+	answers map[string][]string
+	err     error // returned for every query when set
+	queries []string
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, host)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if a, ok := r.answers[host]; ok {
+		return a, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+func useBlocklists(t *testing.T, c *dnsblChecker) {
+	old := blocklists
+	blocklists = c
+	t.Cleanup(func() { blocklists = old })
+}
+
+func TestReverseName(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.0.2.1":   "1.2.0.192",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+	} {
+		if got := reverseName(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestDNSBLListed(t *testing.T) {
+	r := &fakeResolver{answers: map[string][]string{
+		"2.2.0.192.bl.example": {"127.0.0.2"},
+		"3.2.0.192.bl.example": {"192.0.2.99"}, // not a 127/8 answer
+	}}
+	c := newDNSBLChecker([]string{"clean.example", "bl.example"}, r, time.Minute)
+	for addr, want := range map[string]string{
+		"192.0.2.1": "",
+		"192.0.2.2": "bl.example",
+		"192.0.2.3": "",
+	} {
+		zone, err := c.listed(context.Background(), netip.MustParseAddr(addr))
+		if err != nil || zone != want {
+			t.Errorf("%s: listed by %q (%v), want %q", addr, zone, err, want)
+		}
+	}
+}
+
+func TestDNSBLCache(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	r := &fakeResolver{answers: map[string][]string{"2.2.0.192.bl.example": {"127.0.0.2"}}}
+	c := newDNSBLChecker([]string{"bl.example"}, r, time.Minute)
+	c.now = clock.Now
+	listed := netip.MustParseAddr("192.0.2.2")
+	clean := netip.MustParseAddr("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		c.listed(context.Background(), listed)
+		c.listed(context.Background(), clean)
+	}
+	if n := r.count(); n != 2 {
+		t.Errorf("%d queries for two clients within the TTL, want 2", n)
+	}
+	clock.advance(time.Minute)
+	if zone, _ := c.listed(context.Background(), listed); zone != "bl.example" || r.count() != 3 {
+		t.Errorf("after the TTL: listed by %q after %d queries", zone, r.count())
+	}
+}
+
+func TestDNSBLFailure(t *testing.T) {
+	for _, answer := range []string{"", "127.255.255.254"} {
+		r := &fakeResolver{err: errors.New("server misbehaving")}
+		if answer != "" {
+			r = &fakeResolver{answers: map[string][]string{"1.2.0.192.bl.example": {answer}}}
+		}
+		c := newDNSBLChecker([]string{"bl.example"}, r, time.Minute)
+		addr := netip.MustParseAddr("192.0.2.1")
+		if _, err := c.listed(context.Background(), addr); err == nil {
+			t.Errorf("%q: no error", answer)
+		}
+		// A failed lookup is tried again next time
+		c.listed(context.Background(), addr)
+		if n := r.count(); n != 2 {
+			t.Errorf("%q: %d queries, want 2", answer, n)
+		}
+	}
+}
+
+func TestSessionDNSBL(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		answers map[string][]string
+		code    int
+	}{
+		{"listed", map[string][]string{"1.0.0.127.bl.example": {"127.0.0.2"}}, 554},
+		{"unlisted", nil, 250},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useBlocklists(t, newDNSBLChecker([]string{"bl.example"}, &fakeResolver{answers: tc.answers}, time.Minute))
+			b := startTestBackend(t)
+			c := dialGateway(t)
+			command(t, c, 250, "EHLO client.example.com")
+			msg := command(t, c, tc.code, "MAIL FROM:<a@example.com>")
+			if tc.code == 554 {
+				if !strings.Contains(msg, "bl.example") {
+					t.Errorf("reply %q doesn't name the blocklist", msg)
+				}
+				for _, cmd := range b.commands() {
+					if strings.HasPrefix(cmd, "MAIL") {
+						t.Errorf("refused MAIL reached the backend")
+					}
+				}
+			}
+		})
+	}
+}
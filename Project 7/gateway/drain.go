@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainState is the gateway stopping: its listeners close, on SIGINT or
+// SIGTERM or a POST /drain, so new connections are refused while the
+// sessions already running finish
+type drainState struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	since     time.Time // zero until draining starts
+}
+
+// The gateway's listeners, set up in main
+var draining = &drainState{}
+
+// add has l closed when draining starts, or at once if it has
+func (d *drainState) add(l net.Listener) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.since.IsZero() {
+		l.Close()
+		return
+	}
+	d.listeners = append(d.listeners, l)
+}
+
+// start closes the listeners, reporting whether this call began draining
+// rather than one before it
+func (d *drainState) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.since.IsZero() {
+		return false
+	}
+	d.since = time.Now()
+	for _, l := range d.listeners {
+		l.Close()
+	}
+	d.listeners = nil
+	return true
+}
+
+// started returns when draining began, or the zero time if it hasn't
+func (d *drainState) started() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.since
+}
+
+// drainReport is the /drain body
+type drainReport struct {
+	Draining bool   `json:"draining"`
+	Since    string `json:"since,omitempty"` // RFC 3339
+	Active   int64  `json:"active"`          // sessions still running
+}
+
+func currentDrainReport() drainReport {
+	report := drainReport{Active: stats.active()}
+	if since := draining.started(); !since.IsZero() {
+		report.Draining, report.Since = true, since.UTC().Format(time.RFC3339)
+	}
+	return report
+}
+
+// drainHandler serves /drain: POST stops the gateway accepting connections,
+// as SIGTERM does, and GET reports whether it has. Either way the gateway
+// stays up until it is signalled, so a node can be drained ahead of a
+// deploy and checked on until its sessions reach 0.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if draining.start() {
+			slog.Info("No longer accepting connections", "event", "shutdown", "requested_by", r.RemoteAddr,
+				"active", stats.active())
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, currentDrainReport())
+}
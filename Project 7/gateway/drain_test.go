@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useDraining gives the test a drain state of its own
+func useDraining(t *testing.T) *drainState {
+	old := draining
+	draining = &drainState{}
+	t.Cleanup(func() { draining = old })
+	return draining
+}
+
+// drainRequest sends method /drain and returns the status and report
+func drainRequest(t *testing.T, srv *httptest.Server, method, auth string) (int, drainReport) {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+"/drain", nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report drainReport
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, report
+}
+
+// serveEcho accepts connections on a loopback listener the drain state
+// closes, as serve does, echoing each line back
+func serveEcho(t *testing.T, d *drainState) string {
+	t.Helper()
+	oldLimiter := limiter
+	limiter = newConnLimiter(0, 0, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.add(ln)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ln, "smtp", func(c net.Conn) {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				c.Write([]byte(line))
+			}
+		})
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		activeConns.Wait()
+		limiter = oldLimiter
+	})
+	return ln.Addr().String()
+}
+
+// echo sends line on c and fails unless it comes back
+func echo(t *testing.T, c net.Conn, r *bufio.Reader, line string) {
+	t.Helper()
+	if _, err := c.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.ReadString('\n'); err != nil || got != line {
+		t.Fatalf("echoed %q, %v; want %q", got, err, line)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	d := useDraining(t)
+	addr := serveEcho(t, d)
+	srv := httptest.NewServer(newHealthServer("", "t0ken", "").Handler)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	echo(t, c, r, "before\n")
+
+	if code, report := drainRequest(t, srv, http.MethodGet, "Bearer t0ken"); code != http.StatusOK || report.Draining || report.Active != 1 {
+		t.Fatalf("GET /drain before: %d %+v", code, report)
+	}
+	if code, _ := drainRequest(t, srv, http.MethodPost, ""); code != http.StatusUnauthorized {
+		t.Fatalf("POST /drain without the token: %d", code)
+	}
+	if !d.started().IsZero() {
+		t.Fatal("draining without the token")
+	}
+
+	code, report := drainRequest(t, srv, http.MethodPost, "Bearer t0ken")
+	if code != http.StatusOK || !report.Draining || report.Since == "" || report.Active != 1 {
+		t.Fatalf("POST /drain: %d %+v", code, report)
+	}
+	if again, _ := drainRequest(t, srv, http.MethodPost, "Bearer t0ken"); again != http.StatusOK {
+		t.Errorf("second POST /drain: %d", again)
+	}
+	if nc, err := net.Dial("tcp", addr); err == nil {
+		nc.Close()
+		t.Error("new connection accepted while draining")
+	}
+	if got := get(t, srv.URL+"/ready", ""); got != http.StatusServiceUnavailable {
+		t.Errorf("/ready while draining: %d", got)
+	}
+	// The session already running carries on
+	echo(t, c, r, "after\n")
+
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, report = drainRequest(t, srv, http.MethodGet, "Bearer t0ken")
+		if report.Active == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !report.Draining || report.Active != 0 {
+		t.Errorf("GET /drain once the session ended: %+v", report)
+	}
+}
+
+func TestDrainNeedsToken(t *testing.T) {
+	useDraining(t)
+	srv := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer srv.Close()
+	if code, _ := drainRequest(t, srv, http.MethodPost, ""); code != http.StatusNotFound {
+		t.Errorf("POST /drain with no token configured: %d, want 404", code)
+	}
+	if !draining.started().IsZero() {
+		t.Error("drained with no token configured")
+	}
+}
+
+func TestDrainStateLateListener(t *testing.T) {
+	d := &drainState{}
+	if !d.start() || d.start() {
+		t.Fatal("start didn't report the first call alone")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	d.add(ln)
+	if _, err := ln.Accept(); err == nil {
+		t.Error("listener added after draining started still accepting")
+	}
+}
+
+func TestSIGTERMDrains(t *testing.T) {
+	d := useDraining(t)
+	addr := serveEcho(t, d)
+	logs := captureLogs(t, slog.LevelInfo, "")
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	echo(t, c, r, "before\n")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	signalled := stopOnSignal(sigs)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-signalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM not handled")
+	}
+	if nc, err := net.Dial("tcp", addr); err == nil {
+		nc.Close()
+		t.Error("new connection accepted after SIGTERM")
+	}
+
+	// The session in flight finishes, and the drain waits for it
+	drained := make(chan struct{})
+	go func() {
+		drainConnections(5 * time.Second)
+		close(drained)
+	}()
+	echo(t, c, r, "after\n")
+	select {
+	case <-drained:
+		t.Fatal("drain finished with a session still open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain still waiting once the session ended")
+	}
+	for _, event := range []string{`"event":"shutdown","signal":"terminated"`, `"event":"drain_done"`} {
+		if !strings.Contains(logs.String(), event) {
+			t.Errorf("no %s in %s", event, logs)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+var rewriteHELO = flag.Bool("rewrite-helo", false, "Greet the backend with -myhostname instead of the client's HELO/EHLO hostname, which is logged")
+
+// Headroom kept under the backend's SIZE limit for the headers the gateway
+// adds (X-PQC-Signature, Message-ID). SPHINCS+ signatures are the largest
+// at ~23KB base64-encoded.
+const addedHeaderAllowance = 32 * 1024
+
+// Extensions the gateway can't proxy. BINARYMIME bodies can't be passed
+// on with DATA, which is how BDAT messages reach the backend.
+var unproxiedExtensions = map[string]bool{
+	"BINARYMIME": true,
+}
+
+// heloCommand returns the line to send the backend for a client's HELO or
+// EHLO: LHLO to an LMTP backend, and naming the gateway with -rewrite-helo
+func heloCommand(cmd []byte) []byte {
+	verb := cmd[:len("EHLO")]
+	if *lmtpMode {
+		verb = []byte("LHLO")
+	}
+	if !*rewriteHELO {
+		return append(append([]byte(nil), verb...), cmd[len(verb):]...)
+	}
+	return []byte(string(verb) + " " + gatewayHostname() + "\r\n")
+}
+
+// ehloPolicy is what the gateway itself supports on this session
+type ehloPolicy struct {
+	startTLS  bool  // STARTTLS will be accepted
+	maxSize   int64 // gateway's own message size limit, 0 for none
+	localAuth bool  // AUTH is answered by the gateway, not the backend
+	offerAuth bool  // advertise the gateway's AUTH mechanisms
+}
+
+// rewriteEHLO rebuilds a backend EHLO response so it advertises what the
+// client can actually use through the gateway. lines are the backend's
+// response lines without CRLF; the 250-/250 framing is regenerated.
+func rewriteEHLO(lines [][]byte, policy ehloPolicy) []byte {
+	if len(lines) == 0 || !bytes.HasPrefix(lines[0], []byte("250")) {
+		// Error reply; relay as-is
+		var out []byte
+		for _, l := range lines {
+			out = append(append(out, l...), crlf...)
+		}
+		return out
+	}
+
+	texts := make([]string, 0, len(lines)+2)
+	sawSize := false
+	for i, l := range lines {
+		text := ""
+		if len(l) > 4 {
+			text = string(l[4:])
+		}
+		// The first line is the server's greeting, not a keyword
+		if i > 0 {
+			var ok bool
+			if text, ok = rewriteExtension(text, policy); !ok {
+				continue
+			}
+			sawSize = sawSize || strings.EqualFold(ehloKeyword(text), "SIZE")
+		}
+		texts = append(texts, text)
+	}
+	if !sawSize && policy.maxSize > 0 {
+		texts = append(texts, "SIZE "+strconv.FormatInt(policy.maxSize, 10))
+	}
+	// The gateway takes BDAT itself, whatever the backend supports
+	texts = append(texts, "CHUNKING")
+	if policy.startTLS {
+		texts = append(texts, "STARTTLS")
+	}
+	if policy.offerAuth {
+		texts = append(texts, "AUTH "+authMechanisms)
+	}
+
+	var b bytes.Buffer
+	for i, text := range texts {
+		sep := "-"
+		if i == len(texts)-1 {
+			sep = " "
+		}
+		b.WriteString("250" + sep + text + "\r\n")
+	}
+	return b.Bytes()
+}
+
+// rewriteExtension adjusts one advertised extension, returning false if it
+// should be dropped
+func rewriteExtension(text string, policy ehloPolicy) (string, bool) {
+	keyword := strings.ToUpper(ehloKeyword(text))
+	switch {
+	case keyword == "STARTTLS" || keyword == "CHUNKING":
+		// Only the gateway's own are offered
+		return "", false
+	case unproxiedExtensions[keyword]:
+		return "", false
+	case policy.localAuth && (keyword == "AUTH" || strings.HasPrefix(keyword, "AUTH=")):
+		// The backend's mechanisms aren't the ones the gateway checks
+		return "", false
+	case keyword == "SIZE":
+		return rewriteSize(text, policy.maxSize), true
+	}
+	return text, true
+}
+
+// rewriteSize lowers the backend's SIZE limit so a message that fits the
+// advertisement still fits once the gateway has added its headers, and
+// caps it at the gateway's own limit. A backend limit too small to leave
+// room for the headers is passed on as it is, rather than advertising a
+// limit no message could meet.
+func rewriteSize(text string, maxSize int64) string {
+	fields := strings.Fields(text)
+	limit := int64(0)
+	if len(fields) >= 2 {
+		var err error
+		if limit, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return text
+		}
+	}
+	// SIZE 0 (or no parameter) means no fixed limit
+	if limit > addedHeaderAllowance {
+		limit -= addedHeaderAllowance
+	}
+	if maxSize > 0 && (limit == 0 || maxSize < limit) {
+		limit = maxSize
+	}
+	if limit == 0 {
+		return text
+	}
+	return fields[0] + " " + strconv.FormatInt(limit, 10)
+}
+
+// ehloKeyword returns the extension keyword of an EHLO response line
+func ehloKeyword(text string) string {
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
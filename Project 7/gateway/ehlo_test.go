@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteSize(t *testing.T) {
+	big := strconv.Itoa(10<<20 + addedHeaderAllowance)
+	for _, tc := range []struct {
+		in      string
+		maxSize int64
+		want    string
+	}{
+		{"SIZE " + big, 0, "SIZE " + strconv.Itoa(10<<20)},
+		{"SIZE " + big, 1 << 20, "SIZE " + strconv.Itoa(1<<20)},
+		{"SIZE 1000", 0, "SIZE 1000"},
+		{"SIZE 1000", 500, "SIZE 500"},
+		{"SIZE " + strconv.Itoa(addedHeaderAllowance), 0, "SIZE " + strconv.Itoa(addedHeaderAllowance)},
+		{"SIZE 0", 0, "SIZE 0"},
+		{"SIZE", 2048, "SIZE 2048"},
+		{"SIZE junk", 2048, "SIZE junk"},
+	} {
+		if got := rewriteSize(tc.in, tc.maxSize); got != tc.want {
+			t.Errorf("rewriteSize(%q, %d) = %q, want %q", tc.in, tc.maxSize, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteEHLO(t *testing.T) {
+	lines := [][]byte{
+		[]byte("250-backend"),
+		[]byte("250-SIZE 1000"),
+		[]byte("250-STARTTLS"),
+		[]byte("250-CHUNKING"),
+		[]byte("250 8BITMIME"),
+	}
+	got := rewriteEHLO(lines, ehloPolicy{startTLS: true})
+	want := "250-backend\r\n250-SIZE 1000\r\n250-8BITMIME\r\n250-CHUNKING\r\n250 STARTTLS\r\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	refused := rewriteEHLO([][]byte{[]byte("554 go away")}, ehloPolicy{})
+	if !bytes.Equal(refused, []byte("554 go away\r\n")) {
+		t.Errorf("error reply rewritten: %q", refused)
+	}
+}
+
+func TestRewriteEHLOSMTPUTF8(t *testing.T) {
+	// Offered when the backend offers it, as it is the one delivering
+	with := rewriteEHLO([][]byte{[]byte("250-backend"), []byte("250-8BITMIME"), []byte("250 SMTPUTF8")}, ehloPolicy{})
+	if want := "250-backend\r\n250-8BITMIME\r\n250-SMTPUTF8\r\n250 CHUNKING\r\n"; string(with) != want {
+		t.Errorf("got %q, want %q", with, want)
+	}
+	without := rewriteEHLO([][]byte{[]byte("250-backend"), []byte("250 8BITMIME")}, ehloPolicy{})
+	if bytes.Contains(without, []byte("SMTPUTF8")) {
+		t.Errorf("SMTPUTF8 offered for a backend without it: %q", without)
+	}
+}
+
+func TestHeloCommand(t *testing.T) {
+	oldHost := *myHostname
+	*myHostname = "gw.example"
+	t.Cleanup(func() { *myHostname = oldHost })
+
+	for _, tc := range []struct {
+		rewrite, lmtp bool
+		in, want      string
+	}{
+		{false, false, "ehlo client.example\r\n", "ehlo client.example\r\n"},
+		{false, true, "EHLO client.example\r\n", "LHLO client.example\r\n"},
+		{true, false, "EHLO client.example\r\n", "EHLO gw.example\r\n"},
+		{true, false, "HELO\r\n", "HELO gw.example\r\n"},
+		{true, true, "HELO client.example\r\n", "LHLO gw.example\r\n"},
+	} {
+		setFlag(t, rewriteHELO, tc.rewrite)
+		setFlag(t, lmtpMode, tc.lmtp)
+		if got := string(heloCommand([]byte(tc.in))); got != tc.want {
+			t.Errorf("heloCommand(%q) with rewrite=%v lmtp=%v = %q, want %q", tc.in, tc.rewrite, tc.lmtp, got, tc.want)
+		}
+	}
+}
+
+func TestSessionRewritesHelo(t *testing.T) {
+	oldHost := *myHostname
+	*myHostname = "gw.example"
+	t.Cleanup(func() { *myHostname = oldHost })
+	setFlag(t, rewriteHELO, true)
+	logs := captureLogs(t, slog.LevelInfo, "")
+	b := startTestBackend(t)
+
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "HELO other.example.com")
+	command(t, c, 221, "QUIT")
+
+	want := []string{"EHLO gw.example", "HELO gw.example"}
+	if got := b.greetings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("backend was greeted with %q, want %q", got, want)
+	}
+	for _, helo := range []string{"client.example.com", "other.example.com"} {
+		if !strings.Contains(logs.String(), `"client_helo":"`+helo+`"`) {
+			t.Errorf("client's %s not logged: %s", helo, logs)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"strings"
+)
+
+var denyContentTypes = flag.String("deny-content-types", "", "Comma-separated MIME types refused with 550 wherever they appear in a message, such as application/x-msdownload; type/* matches a whole type. Set, messages are held whole rather than streamed (-stream-above)")
+
+// Reply to a message a filter failed on: the filter can't vouch for it,
+// so the client is asked to try again rather than it going through
+var errFilterFailed = &smtpError{451, "4.3.0 Message could not be checked, try again later"}
+
+// Filter inspects a message after DATA and before it is signed, and says
+// what is to become of it. msg is the whole message, unstuffed, with the
+// gateway's own Message-ID and Authentication-Results; a filter must not
+// change it. An error refuses the message for now.
+type Filter interface {
+	Inspect(msg []byte) (Action, error)
+}
+
+// What an Action does with a message
+type verdict int
+
+const (
+	verdictAccept verdict = iota
+	verdictReject
+	verdictModify
+)
+
+func (v verdict) String() string {
+	switch v {
+	case verdictReject:
+		return "reject"
+	case verdictModify:
+		return "modify"
+	}
+	return "accept"
+}
+
+// Action is a filter's decision on a message: Accept, Reject or
+// ModifyHeaders
+type Action struct {
+	verdict verdict
+	reply   *smtpError   // for verdictReject
+	edits   []HeaderEdit // for verdictModify
+}
+
+// HeaderEdit replaces every field called Name with one holding Value, or
+// with none if Value is empty
+type HeaderEdit struct {
+	Name  string
+	Value string
+}
+
+// Accept lets a message through unchanged
+func Accept() Action { return Action{} }
+
+// Reject refuses a message with the given 4xx or 5xx reply; text should
+// start with an enhanced status code
+func Reject(code int, text string) Action {
+	return Action{verdict: verdictReject, reply: &smtpError{code, text}}
+}
+
+// ModifyHeaders lets a message through with its header changed, the edits
+// made in order before it is signed so the signature covers them
+func ModifyHeaders(edits ...HeaderEdit) Action {
+	return Action{verdict: verdictModify, edits: edits}
+}
+
+// Filters run on every message, in order, set up in main
+var filters []Filter
+
+// filterName identifies f in logs and metrics
+func filterName(f Filter) string {
+	if s, ok := f.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+// runFilters passes msg through each filter, returning it with their header
+// edits made. It stops at the first to reject the message, returning that
+// reply; under -observe, that is only logged.
+func runFilters(log *slog.Logger, msgID string, msg []byte) ([]byte, error) {
+	for _, f := range filters {
+		name := filterName(f)
+		action, err := f.Inspect(msg)
+		if err == nil && action.verdict == verdictReject && !validReply(action.reply) {
+			err = fmt.Errorf("rejected with invalid reply %d", action.reply.code)
+		}
+		if err == nil && action.verdict == verdictModify {
+			var modified []byte
+			if modified, err = applyHeaderEdits(msg, action.edits); err == nil {
+				msg = modified
+			}
+		}
+		if err != nil {
+			log.Error("Content filter failed", "event", "filter_failed", "message_id", msgID, "filter", name, "error", err)
+			filterActions.WithLabelValues(name, "error").Inc()
+			if *observeOnly {
+				continue
+			}
+			return nil, errFilterFailed
+		}
+		filterActions.WithLabelValues(name, action.verdict.String()).Inc()
+		if action.verdict != verdictReject {
+			continue
+		}
+		if *observeOnly {
+			log.Info("Would reject message", "event", "observe_only", "message_id", msgID,
+				"reason", "content filter", "filter", name, "reply", action.reply.Error())
+			continue
+		}
+		log.Info("Content filter rejected message", "event", "message_filtered", "message_id", msgID,
+			"filter", name, "code", action.reply.code, "reply", action.reply.text)
+		return nil, action.reply
+	}
+	return msg, nil
+}
+
+// validReply reports whether r refuses a message, temporarily or for good
+func validReply(r *smtpError) bool {
+	return r != nil && r.code >= 400 && r.code < 600 && !strings.ContainsAny(r.text, "\r\n")
+}
+
+// applyHeaderEdits makes a filter's header changes to msg
+func applyHeaderEdits(msg []byte, edits []HeaderEdit) ([]byte, error) {
+	for _, e := range edits {
+		if e.Name == "" || strings.IndexFunc(e.Name, func(r rune) bool { return r <= ' ' || r >= 0x7f || r == ':' }) >= 0 {
+			return nil, fmt.Errorf("invalid header name %q", e.Name)
+		}
+		fields := parseHeaders(msg)
+		// Bottom up, so earlier fields keep their offsets
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].Name, e.Name) {
+				msg = removeHeader(msg, fields[i])
+			}
+		}
+		if e.Value != "" {
+			msg = insertHeader(msg, e.Name, e.Value)
+		}
+	}
+	return msg, nil
+}
+
+// Deepest MIME nesting contentTypeFilter looks into; a message nested
+// deeper is refused, as what it hides can't be seen
+const maxMIMEDepth = 16
+
+var errMIMETooDeep = errors.New("MIME parts nested too deeply")
+
+// contentTypeFilter refuses messages with a part of a denied MIME type,
+// -deny-content-types
+type contentTypeFilter struct {
+	denied []string // lowercase; "type/*" matches the whole type
+}
+
+func newContentTypeFilter(types []string) (*contentTypeFilter, error) {
+	f := &contentTypeFilter{}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		major, minor, ok := strings.Cut(t, "/")
+		if !ok || major == "" || minor == "" || strings.ContainsAny(t, " ;") {
+			return nil, fmt.Errorf("invalid MIME type %q (want type/subtype or type/*)", t)
+		}
+		f.denied = append(f.denied, t)
+	}
+	return f, nil
+}
+
+func (f *contentTypeFilter) String() string { return "content_type" }
+
+func (f *contentTypeFilter) Inspect(msg []byte) (Action, error) {
+	end := headerEnd(msg)
+	denied, err := f.scan(parseHeaders(msg), bytes.TrimPrefix(msg[end:], crlf), 0)
+	switch {
+	case err != nil:
+		return Reject(550, "5.6.0 "+err.Error()), nil
+	case denied != "":
+		return Reject(550, fmt.Sprintf("5.7.1 Content type %s not accepted", denied)), nil
+	}
+	return Accept(), nil
+}
+
+// scan returns the first denied type among a part with the given header
+// fields and body and the parts inside it, errMIMETooDeep if they go too
+// deep to see
+func (f *contentTypeFilter) scan(fields []headerField, body []byte, depth int) (string, error) {
+	if depth > maxMIMEDepth {
+		return "", errMIMETooDeep
+	}
+	mediaType, params := "text/plain", map[string]string(nil)
+	for _, h := range fields {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			t, p, err := mime.ParseMediaType(h.Value())
+			if err != nil {
+				// Unparseable, it is as good as its type alone
+				t, _, _ = strings.Cut(h.Value(), ";")
+				t = strings.ToLower(strings.TrimSpace(t))
+			}
+			mediaType, params = t, p
+		}
+	}
+	if f.denies(mediaType) {
+		return mediaType, nil
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return "", nil
+	}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := r.NextRawPart()
+		if err != nil {
+			// The end, or a malformed body with nothing more to check
+			return "", nil
+		}
+		// Without its closing delimiter a part runs to the end, as mail
+		// readers show it, so it is checked all the same
+		partBody, readErr := io.ReadAll(p)
+		var partFields []headerField
+		for name, values := range p.Header {
+			for _, v := range values {
+				partFields = append(partFields, headerField{Name: name, Raw: []byte(name + ": " + v + "\r\n")})
+			}
+		}
+		if denied, err := f.scan(partFields, partBody, depth+1); denied != "" || err != nil || readErr != nil {
+			return denied, err
+		}
+	}
+}
+
+// denies reports whether mediaType is on the list
+func (f *contentTypeFilter) denies(mediaType string) bool {
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, d := range f.denied {
+		if d == mediaType || d == major+"/*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// filterFunc is a Filter deciding with a function
+type filterFunc func(msg []byte) (Action, error)
+
+func (f filterFunc) Inspect(msg []byte) (Action, error) { return f(msg) }
+
+func (f filterFunc) String() string { return "test" }
+
+// useFilters runs fs on every message for the rest of the test
+func useFilters(t *testing.T, fs ...Filter) {
+	old := filters
+	filters = fs
+	t.Cleanup(func() { filters = old })
+}
+
+func decide(a Action, err error) Filter {
+	return filterFunc(func([]byte) (Action, error) { return a, err })
+}
+
+func TestProcessMailFilters(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		filters   []Filter
+		wantReply string // empty if accepted
+		header    string // said to be added, if any
+	}{
+		{"accept", []Filter{decide(Accept(), nil)}, "", ""},
+		{"reject", []Filter{decide(Reject(554, "5.7.1 No thanks"), nil), decide(Accept(), errors.New("not reached"))},
+			"554 5.7.1 No thanks", ""},
+		{"error", []Filter{decide(Accept(), errors.New("scanner down"))}, errFilterFailed.Error(), ""},
+		{"invalid reply", []Filter{decide(Reject(250, "2.0.0 Ok"), nil)}, errFilterFailed.Error(), ""},
+		{"modify", []Filter{decide(ModifyHeaders(HeaderEdit{"X-Scanned", "clean"}, HeaderEdit{"Subject", "[checked] hi"}), nil)},
+			"", "X-Scanned: clean"},
+		{"remove", []Filter{decide(ModifyHeaders(HeaderEdit{Name: "Subject"}), nil)}, "", ""},
+		{"bad header name", []Filter{decide(ModifyHeaders(HeaderEdit{"X Bad", "v"}), nil)}, errFilterFailed.Error(), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFilters(t, tc.filters...)
+			out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+			if tc.wantReply != "" {
+				if err == nil || smtpReplyFor(err).Error() != tc.wantReply {
+					t.Fatalf("err = %v, want %s", err, tc.wantReply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Edits are made before signing, so the signature covers them
+			if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+				t.Errorf("verify: %+v", r)
+			}
+			if tc.header != "" && !strings.Contains(string(out), tc.header+"\r\n") {
+				t.Errorf("no %q in %q", tc.header, out)
+			}
+			subject, ok := headerValue(out, "Subject")
+			switch tc.name {
+			case "modify":
+				if subject != "[checked] hi" || strings.Count(string(out), "\nSubject:") != 1 {
+					t.Errorf("Subject not replaced in %q", out)
+				}
+			case "remove":
+				if ok {
+					t.Errorf("Subject %q not removed", subject)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessMailFilterObserveOnly(t *testing.T) {
+	setFlag(t, observeOnly, true)
+	useFilters(t, decide(Reject(550, "5.7.1 No"), nil), decide(Accept(), errors.New("scanner down")))
+	logs := captureLogs(t, slog.LevelInfo, "")
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != string(testMessage) {
+		t.Errorf("delivered %q, want it unmodified", out)
+	}
+	if !strings.Contains(logs.String(), "Would reject message") {
+		t.Errorf("no observe_only log in %s", logs)
+	}
+}
+
+const attachmentMessage = "From: a@example.com\r\nMIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+	"--outer\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+	"--outer\r\nContent-Type: multipart/alternative; boundary=\"inner\"\r\n\r\n" +
+	"--inner\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n" +
+	"--inner\r\nContent-Type: Application/X-MSDownload; name=\"setup.exe\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n\r\nTVqQAAMAAAAEAAAA\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+// nestedParts is a message of multiparts nested depth deep
+func nestedParts(depth int) string {
+	var b strings.Builder
+	for i := 0; i < depth; i++ {
+		fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n", i, i)
+	}
+	return b.String()
+}
+
+func TestContentTypeFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		denied []string
+		msg    string
+		reply  string // empty if accepted
+	}{
+		{"plain", []string{"application/x-msdownload"}, string(testMessage), ""},
+		{"nested attachment", []string{"application/x-msdownload"}, attachmentMessage,
+			"550 5.7.1 Content type application/x-msdownload not accepted"},
+		{"unterminated", []string{"application/x-msdownload"}, strings.TrimSuffix(attachmentMessage, "--inner--\r\n--outer--\r\n"),
+			"550 5.7.1 Content type application/x-msdownload not accepted"},
+		{"wildcard", []string{"text/*"}, attachmentMessage, "550 5.7.1 Content type text/plain not accepted"},
+		{"untyped is text/plain", []string{"text/plain"}, string(testMessage), "550 5.7.1 Content type text/plain not accepted"},
+		{"not listed", []string{"video/*", "application/zip"}, attachmentMessage, ""},
+		{"too deep", []string{"video/*"}, nestedParts(maxMIMEDepth + 2), "550 5.6.0 MIME parts nested too deeply"},
+		{"deep enough", []string{"video/*"}, nestedParts(maxMIMEDepth), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := newContentTypeFilter(tc.denied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := f.Inspect([]byte(tc.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tc.reply == "" && a.verdict != verdictAccept:
+				t.Errorf("%v %v, want accept", a.verdict, a.reply)
+			case tc.reply != "" && (a.verdict != verdictReject || a.reply.Error() != tc.reply):
+				t.Errorf("%v %v, want %s", a.verdict, a.reply, tc.reply)
+			}
+		})
+	}
+
+	for _, bad := range []string{"exe", "application/", "text/plain; charset=utf-8"} {
+		if _, err := newContentTypeFilter([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestSessionFilterRejects(t *testing.T) {
+	f, err := newContentTypeFilter([]string{"application/x-msdownload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	useFilters(t, f)
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	if msg := sendMessage(t, c, 550, attachmentMessage); !strings.Contains(msg, "application/x-msdownload") {
+		t.Errorf("reply %q, want the denied type", msg)
+	}
+	// The session carries on
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 221, "QUIT")
+	if msgs := b.messages(); len(msgs) != 0 {
+		t.Errorf("backend got %q", msgs)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long an implicit-TLS client gets to finish its handshake
+const handshakeTimeout = 10 * time.Second
+
+// Handshake failures logged per minute; scanners and misconfigured clients
+// can fail them far faster than anyone wants to read about it
+const handshakeLogsPerMinute = 10
+
+// finishHandshake completes an implicit-TLS client's handshake before the
+// session starts, so a client that fails it is reported as such rather than
+// as an unexplained read error. It returns false when the handshake failed
+// and the connection should be dropped; plaintext connections pass.
+func finishHandshake(log *slog.Logger, conn net.Conn) bool {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tc.SetDeadline(time.Time{})
+	err := tc.Handshake()
+	if err == nil {
+		return true
+	}
+	reason := handshakeFailure(err)
+	tlsHandshakeFailures.WithLabelValues(reason).Inc()
+	if suppressed, ok := handshakeLogs.allow(time.Now()); ok {
+		attrs := []any{"event", "tls_handshake_failed", "reason", reason, "error", err}
+		if suppressed > 0 {
+			attrs = append(attrs, "suppressed", suppressed)
+		}
+		log.Warn("TLS handshake failed", attrs...)
+	}
+	return false
+}
+
+// handshakeFailure sorts a handshake error into a metric label
+func handshakeFailure(err error) string {
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &recordErr):
+		return "not_tls" // e.g. plaintext SMTP sent to the TLS port
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed):
+		return "closed"
+	default:
+		return "rejected" // no shared version, cipher or group, or a bad client certificate
+	}
+}
+
+// logLimiter lets through a fixed number of log lines a minute, counting
+// the ones it holds back so the next line let through can say how many
+type logLimiter struct {
+	mu         sync.Mutex
+	perMinute  int
+	window     time.Time // start of the current minute
+	logged     int
+	suppressed int
+}
+
+var handshakeLogs = &logLimiter{perMinute: handshakeLogsPerMinute}
+
+// allow reports whether a line may be logged at now, and how many were
+// held back since the last one that was
+func (l *logLimiter) allow(now time.Time) (suppressed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Minute {
+		l.window, l.logged = now, 0
+	}
+	if l.logged >= l.perMinute {
+		l.suppressed++
+		return 0, false
+	}
+	l.logged++
+	suppressed, l.suppressed = l.suppressed, 0
+	return suppressed, true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeFailureLogged(t *testing.T) {
+	old := handshakeLogs
+	handshakeLogs = &logLimiter{perMinute: handshakeLogsPerMinute}
+	t.Cleanup(func() { handshakeLogs = old })
+	startTestBackend(t)
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	logs := captureLogs(t, slog.LevelInfo, "")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}), nil)
+		}
+	}()
+
+	// Plaintext SMTP to the implicit-TLS port
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("EHLO client.example.com\r\n"))
+	<-done
+
+	out := logs.String()
+	for _, want := range []string{`"event":"tls_handshake_failed"`, `"reason":"not_tls"`, `"remote_addr":"` + conn.LocalAddr().String() + `"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %s in:\n%s", want, out)
+		}
+	}
+	// The session never started, so it isn't reported as one that failed
+	for _, not := range []string{`"event":"session_start"`, `"event":"io_error"`} {
+		if strings.Contains(out, not) {
+			t.Errorf("%s logged for a failed handshake:\n%s", not, out)
+		}
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := &logLimiter{perMinute: 2}
+	for i, want := range []bool{true, true, false, false} {
+		if _, ok := l.allow(clock.Now()); ok != want {
+			t.Errorf("line %d: allowed %v, want %v", i, ok, want)
+		}
+		clock.advance(time.Second)
+	}
+	clock.advance(time.Minute)
+	if suppressed, ok := l.allow(clock.Now()); !ok || suppressed != 2 {
+		t.Errorf("next minute: allowed %v, suppressed %d; want true, 2", ok, suppressed)
+	}
+	if suppressed, _ := l.allow(clock.Now()); suppressed != 0 {
+		t.Errorf("suppressed count reported twice: %d", suppressed)
+	}
+}
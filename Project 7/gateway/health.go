@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	healthListen    = flag.String("health-listen", "127.0.0.1:8080", "Address the health, metrics and receipt API server listens on; the default keeps it off the network")
+	healthCert      = flag.String("health-cert", "", "TLS certificate file to serve the health server over HTTPS with, along with -health-key (empty serves plaintext)")
+	healthKey       = flag.String("health-key", "", "TLS key file for -health-cert")
+	healthTokenFile = flag.String("health-token-file", "", "File holding the bearer token /metrics, /stats and /config require; the probes stay open (empty requires none, but /config still takes the -receipt-api-token-file token)")
+)
+
+// How long each dependency gets to answer a readiness check
+const dependencyCheckTimeout = 2 * time.Second
+
+// Limits on health port requests, so idle or trickling clients can't hold
+// connections open
+const (
+	healthReadHeaderTimeout = 5 * time.Second
+	healthReadTimeout       = 30 * time.Second
+	healthWriteTimeout      = 30 * time.Second
+)
+
+// newHealthServer serves probes, metrics, stats, the build and the effective
+// configuration on addr, and the receipt API when -receipt-api is set.
+// Metrics, stats and the configuration are behind token if it isn't empty,
+// the API behind apiToken; so is the configuration, failing token. /drain
+// is served behind the configuration's token, and not at all without one.
+func newHealthServer(addr, token, apiToken string) *http.Server {
+	configToken := token
+	if configToken == "" {
+		configToken = apiToken
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/ready", readyHandler)
+	mux.HandleFunc("/live", liveHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/metrics", requireToken(token, metricsHandler.ServeHTTP))
+	mux.HandleFunc("/stats", requireToken(token, statsHandler))
+	mux.HandleFunc("/config", requireToken(configToken, configHandler))
+	if configToken != "" {
+		mux.HandleFunc("/drain", requireToken(configToken, drainHandler))
+	}
+	if *receiptAPI {
+		mux.HandleFunc("/receipts/", requireToken(apiToken, receiptHandler))
+		mux.HandleFunc("/verify", requireToken(apiToken, verifyHandler))
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: healthReadHeaderTimeout,
+		ReadTimeout:       healthReadTimeout,
+		WriteTimeout:      healthWriteTimeout,
+	}
+}
+
+// serveHealth listens on srv's address and serves it in the background,
+// over TLS with -health-cert and -health-key. It returns the listener, for
+// its address.
+func serveHealth(srv *http.Server) (net.Listener, error) {
+	var certs []tls.Certificate
+	if *healthCert != "" {
+		warnIfExposed(*healthKey)
+		cert, err := tls.LoadX509KeyPair(*healthCert, *healthKey)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	lc := net.ListenConfig{Control: reusePortControl()}
+	ln, err := lc.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		var err error
+		if certs == nil {
+			err = srv.Serve(ln)
+		} else {
+			srv.TLSConfig = &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12}
+			err = srv.ServeTLS(ln, "", "")
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health check server failed", "event", "listen_failed", "error", err)
+		}
+	}()
+	return ln, nil
+}
+
+// loopbackOnly reports whether addr can only be reached from this host
+func loopbackOnly(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dependencyStatus is the outcome of checking one backend
+type dependencyStatus struct {
+	name   string
+	target string
+	err    error
+}
+
+// checkDependencies probes every backend concurrently: a dial for the
+// mail servers and GET /health on the receipts service, when used
+func checkDependencies(ctx context.Context) []dependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, dependencyCheckTimeout)
+	defer cancel()
+
+	var deps []dependencyStatus
+	for _, addr := range splitList(*postfixAddr) {
+		deps = append(deps, dependencyStatus{name: "postfix", target: addr})
+	}
+	if *imapListenAddr != "" {
+		deps = append(deps, dependencyStatus{name: "dovecot", target: *dovecotAddr})
+	}
+	if *receiptStoreKind == "http" {
+		deps = append(deps, dependencyStatus{name: "receipts", target: *receiptsURL})
+	}
+
+	var wg sync.WaitGroup
+	for i := range deps {
+		wg.Add(1)
+		go func(d *dependencyStatus) {
+			defer wg.Done()
+			if d.name == "receipts" {
+				d.err = checkHTTP(ctx, d.target+"/health")
+			} else {
+				d.err = checkDial(ctx, d.target)
+			}
+		}(&deps[i])
+	}
+	wg.Wait()
+	return deps
+}
+
+func checkDial(ctx context.Context, addr string) error {
+	var d net.Dialer
+	network, address := addrNetwork(addr)
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkHTTP(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("returned %s", resp.Status)
+	}
+	return nil
+}
+
+// dependenciesUp reports whether every dependency has at least one of its
+// backends up; sessions fail over between Postfix servers, so one being down
+// isn't an outage
+func dependenciesUp(deps []dependencyStatus) bool {
+	up := map[string]bool{}
+	for _, d := range deps {
+		up[d.name] = up[d.name] || d.err == nil
+	}
+	for _, ok := range up {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// dependencyResponse checks the backends and writes the status code and
+// per-dependency body of /ready
+func dependencyResponse(w http.ResponseWriter, r *http.Request, up, down string) {
+	deps := checkDependencies(r.Context())
+	status := up
+	if !dependenciesUp(deps) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		status = down
+	}
+	fmt.Fprintln(w, status)
+	for _, d := range deps {
+		if d.err != nil {
+			fmt.Fprintf(w, "%s (%s): down: %v\n", d.name, d.target, d.err)
+		} else {
+			fmt.Fprintf(w, "%s (%s): ok\n", d.name, d.target)
+		}
+	}
+}
+
+// healthReport is the /health body: dependency status plus the build and
+// the cryptography the gateway is actually using, so monitoring can check it
+type healthReport struct {
+	Status       string             `json:"status"`
+	Build        buildInfo          `json:"build"`
+	Dependencies []dependencyReport `json:"dependencies"`
+	Signing      signingPosture     `json:"signing"`
+	TLS          tlsPosture         `json:"tls"`
+}
+
+type dependencyReport struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	Status string `json:"status"` // ok or down
+	Error  string `json:"error,omitempty"`
+}
+
+// signingPosture describes the active signing key
+type signingPosture struct {
+	Algorithm      string `json:"algorithm"` // empty with no key loaded
+	Implementation string `json:"implementation"`
+	KeyID          string `json:"key_id"` // empty for a keyless signer
+}
+
+// tlsPosture describes what TLS listeners offer
+type tlsPosture struct {
+	MinVersion  string   `json:"min_version"`
+	KeyExchange []string `json:"key_exchange"` // groups in preference order; empty is crypto/tls's defaults
+	HybridKEM   bool     `json:"hybrid_kem"`   // a post-quantum hybrid group is offered
+	Error       string   `json:"error,omitempty"`
+}
+
+// Health check handler: the healthReport as "key: value" lines, or JSON
+// when the client accepts it
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	deps := checkDependencies(r.Context())
+	report := healthReport{
+		Status:  "healthy",
+		Build:   currentBuild(),
+		Signing: signerPosture(currentSigner()),
+		TLS:     currentTLSPosture(),
+	}
+	code := http.StatusOK
+	if !dependenciesUp(deps) {
+		report.Status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+	for _, d := range deps {
+		dr := dependencyReport{Name: d.name, Target: d.target, Status: "ok"}
+		if d.err != nil {
+			dr.Status, dr.Error = "down", d.err.Error()
+		}
+		report.Dependencies = append(report.Dependencies, dr)
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, code, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	report.writeText(w)
+}
+
+// writeText writes the report one "key: value" line a setting;
+// dependency lines repeat, one a backend
+func (h healthReport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "status: %s\n", h.Status)
+	h.Build.writeText(w)
+	for _, d := range h.Dependencies {
+		status := d.Status
+		if d.Error != "" {
+			status += " (" + d.Error + ")"
+		}
+		fmt.Fprintf(w, "dependency: %s %s %s\n", d.Name, d.Target, status)
+	}
+	fmt.Fprintf(w, "signing_algorithm: %s\n", orNone(h.Signing.Algorithm))
+	fmt.Fprintf(w, "signing_implementation: %s\n", h.Signing.Implementation)
+	fmt.Fprintf(w, "signing_key_id: %s\n", orNone(h.Signing.KeyID))
+	fmt.Fprintf(w, "tls_min_version: %s\n", h.TLS.MinVersion)
+	if h.TLS.Error != "" {
+		fmt.Fprintf(w, "tls_error: %s\n", h.TLS.Error)
+	}
+	groups := "default"
+	if len(h.TLS.KeyExchange) > 0 {
+		groups = strings.Join(h.TLS.KeyExchange, ",")
+	}
+	fmt.Fprintf(w, "tls_key_exchange: %s\n", groups)
+	fmt.Fprintf(w, "tls_hybrid_kem: %t\n", h.TLS.HybridKEM)
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return v
+}
+
+// currentTLSPosture reports the key exchange groups listeners offer. With
+// no hybrid-capable runtime the defaults are classical.
+func currentTLSPosture() tlsPosture {
+	t := tlsPosture{MinVersion: *tlsMinVersion, KeyExchange: []string{}}
+	curves, err := effectiveCurves()
+	if err != nil {
+		t.Error = "invalid -tls-curves: " + err.Error()
+		return t
+	}
+	for _, id := range curves {
+		name := id.String()
+		t.KeyExchange = append(t.KeyExchange, name)
+		t.HybridKEM = t.HybridKEM || strings.Contains(name, "MLKEM")
+	}
+	return t
+}
+
+// signerPosture names the active signing algorithm, implementation and key
+func signerPosture(s Signer) signingPosture {
+	p := signingPosture{Implementation: signerImplementation}
+	if s != nil {
+		p.Algorithm, p.KeyID = s.Algorithm(), s.KeyID()
+	}
+	return p
+}
+
+// Readiness: 503 while any backend is unreachable or the gateway is
+// draining, so a load balancer or Kubernetes stops routing new sessions here
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !draining.started().IsZero() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready\ndraining")
+		return
+	}
+	dependencyResponse(w, r, "ready", "not ready")
+}
+
+// Liveness: the process is serving HTTP. Deliberately ignores backends so a
+// transient outage doesn't get the gateway restarted.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
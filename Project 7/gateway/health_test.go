@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+type keyedSigner struct{ brokenSigner }
+
+func (keyedSigner) Algorithm() string { return "falcon-512" }
+func (keyedSigner) KeyID() string     { return "0123456789abcdef" }
+
+func TestSignerPosture(t *testing.T) {
+	got := signerPosture(keyedSigner{})
+	want := signingPosture{Algorithm: "falcon-512", Implementation: signerImplementation, KeyID: "0123456789abcdef"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := signerPosture(brokenSigner{}); got.KeyID != "" {
+		t.Errorf("keyless signer: %+v", got)
+	}
+}
+
+func TestTLSPostureFollowsCurves(t *testing.T) {
+	old := *tlsCurves
+	t.Cleanup(func() { *tlsCurves = old })
+
+	*tlsCurves = "P256,X25519"
+	if got := currentTLSPosture(); strings.Join(got.KeyExchange, ",") != "CurveP256,X25519" || got.HybridKEM {
+		t.Errorf("got %+v", got)
+	}
+	*tlsCurves = "bogus"
+	if got := currentTLSPosture(); !strings.Contains(got.Error, "invalid -tls-curves") {
+		t.Errorf("got %+v", got)
+	}
+	*tlsCurves = ""
+	if got := currentTLSPosture(); hybridKEMAvailable && (strings.Join(got.KeyExchange, ",") != "X25519MLKEM768,X25519" || !got.HybridKEM) {
+		t.Errorf("default: %+v", got)
+	}
+}
+
+// healthBody fetches /health with the given Accept header, against a
+// reachable Postfix
+func healthBody(t *testing.T, accept string) (int, string) {
+	t.Helper()
+	startTestBackend(t)
+	setFlags(t, map[string]string{"postfix": postfixBackends.addrs[0], "receipt-store": "file", "imap-listen": ""})
+	srv := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/health", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestHealthReportsSigner(t *testing.T) {
+	setFlags(t, map[string]string{"tls-min-version": "1.2"})
+	code, body := healthBody(t, "")
+	if code != http.StatusOK {
+		t.Fatalf("status %d:\n%s", code, body)
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			t.Fatalf("not a key: value line: %q", line)
+		}
+		fields[key] = value
+	}
+	for key, want := range map[string]string{
+		"status":                 "healthy",
+		"version":                version,
+		"signing_algorithm":      currentSigner().Algorithm(),
+		"signing_implementation": signerImplementation,
+		"tls_min_version":        "1.2",
+	} {
+		if fields[key] != want {
+			t.Errorf("%s: %q, want %q", key, fields[key], want)
+		}
+	}
+	if !strings.HasPrefix(fields["dependency"], "postfix ") || !strings.HasSuffix(fields["dependency"], " ok") {
+		t.Errorf("dependency: %q", fields["dependency"])
+	}
+}
+
+func TestHealthJSON(t *testing.T) {
+	_, body := healthBody(t, "application/json")
+	var report healthReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("%v:\n%s", err, body)
+	}
+	if report.Status != "healthy" || report.Signing.Algorithm != currentSigner().Algorithm() ||
+		report.TLS.MinVersion != *tlsMinVersion || len(report.Dependencies) != 1 || report.Build.Version != version {
+		t.Errorf("report: %+v", report)
+	}
+}
+
+func TestHealthServerToken(t *testing.T) {
+	setFlags(t, map[string]string{"receipt-api": "true"})
+	srv := httptest.NewServer(newHealthServer("", "t0ken", "api").Handler)
+	defer srv.Close()
+	for _, tc := range []struct {
+		path, auth string
+		want       int
+	}{
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer t0ken", http.StatusOK},
+		{"/stats", "", http.StatusUnauthorized},
+		{"/stats", "Bearer t0ken", http.StatusOK},
+		{"/config", "Bearer api", http.StatusUnauthorized},
+		{"/config", "Bearer t0ken", http.StatusOK},
+		{"/receipts/x", "Bearer t0ken", http.StatusUnauthorized},
+		// Probes stay open for load balancers and container health checks
+		{"/live", "", http.StatusOK},
+		{"/version", "", http.StatusOK},
+	} {
+		if got := get(t, srv.URL+tc.path, tc.auth); got != tc.want {
+			t.Errorf("%s with %q: %d, want %d", tc.path, tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestServeHealthListensOnLoopback(t *testing.T) {
+	if def := flag.Lookup("health-listen").DefValue; !loopbackOnly(def) {
+		t.Errorf("-health-listen defaults to %q, reachable off-host", def)
+	}
+	srv := newHealthServer("127.0.0.1:0", "", "")
+	ln, err := serveHealth(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("listening on %v", ip)
+	}
+	if got := get(t, "http://"+ln.Addr().String()+"/live", ""); got != http.StatusOK {
+		t.Errorf("/live: %d", got)
+	}
+
+	// Something else has the port
+	if _, err := serveHealth(newHealthServer(ln.Addr().String(), "", "")); err == nil {
+		t.Error("listened on a port already in use")
+	}
+}
+
+func TestServeHealthTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "health.crt"), filepath.Join(dir, "health.key")
+	setFlags(t, map[string]string{"write-cert": "true", "cert": certPath, "key": keyPath})
+	if _, err := selfSignedCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{"health-cert": certPath, "health-key": keyPath})
+
+	srv := newHealthServer("127.0.0.1:0", "", "")
+	ln, err := serveHealth(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("/live over TLS: %d, TLS %v", resp.StatusCode, resp.TLS != nil)
+	}
+	if got := get(t, "http://"+ln.Addr().String()+"/live", ""); got != http.StatusBadRequest {
+		t.Errorf("plaintext /live: %d, want %d", got, http.StatusBadRequest)
+	}
+
+	setFlags(t, map[string]string{"health-key": filepath.Join(dir, "missing.key")})
+	if _, err := serveHealth(newHealthServer("127.0.0.1:0", "", "")); err == nil {
+		t.Error("served without its key")
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.5:8080":  false,
+		"gateway:8080":   false,
+	} {
+		if got := loopbackOnly(addr); got != want {
+			t.Errorf("%s: %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// closedAddr returns an address nothing listens on any more
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestHealthBackends(t *testing.T) {
+	up1, up2 := (&smtptest.Server{}).Start(t), (&smtptest.Server{}).Start(t)
+	down := closedAddr(t)
+	srv := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name             string
+		postfix, dovecot string
+		code             int
+		status           string
+		down             []string
+	}{
+		{"all up", up1, up2, http.StatusOK, "healthy", nil},
+		{"postfix down", down, up2, http.StatusServiceUnavailable, "unhealthy", []string{down}},
+		{"dovecot down", up1, down, http.StatusServiceUnavailable, "unhealthy", []string{down}},
+		// Sessions fail over to the Postfix still up
+		{"one postfix down", down + "," + up1, up2, http.StatusOK, "healthy", []string{down}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"postfix": tc.postfix, "dovecot": tc.dovecot, "imap-listen": ":1143", "receipt-store": "file"})
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/health", nil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var report healthReport
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.code || report.Status != tc.status {
+				t.Fatalf("status %d, %+v; want %d, %s", resp.StatusCode, report, tc.code, tc.status)
+			}
+			var downs []string
+			for _, d := range report.Dependencies {
+				if d.Status == "down" {
+					if d.Error == "" {
+						t.Errorf("%s down without an error", d.Target)
+					}
+					downs = append(downs, d.Target)
+				}
+			}
+			if !slices.Equal(downs, tc.down) {
+				t.Errorf("down: %q, want %q", downs, tc.down)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var imapListenAddr = flag.String("imap-listen", ":1143", "Address for the IMAP proxy to Dovecot, host:port or unix:/path (empty disables)")
+
+// Largest fetched message the IMAP path will buffer to inspect
+const maxInspectedLiteral = 10 << 20
+
+// Handle IMAP proxy connection. Traffic is relayed unchanged; fetched
+// messages are inspected for the gateway's signature on the way past.
+func handleIMAPConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	log := sessionLogger(clientConn, "imap", newSessionID())
+	if !finishHandshake(log, clientConn) {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		sessionDuration.Observe(time.Since(start).Seconds())
+		log.Info("Connection closed", "event", "session_end", "duration", time.Since(start).String())
+	}()
+
+	network, address := addrNetwork(*dovecotAddr)
+	backendConn, err := backendDialer.Dial(network, address)
+	if err != nil {
+		log.Error("Failed to connect to IMAP backend", "event", "backend_dial_failed", "backend", *dovecotAddr, "error", err)
+		connectionsFailed.Inc()
+		backendUnavailable(clientConn, "imap")
+		return
+	}
+	defer backendConn.Close()
+
+	log.Info("New IMAP connection", "event", "session_start", "backend", *dovecotAddr)
+
+	timer := newSessionTimer(log, clientConn, backendConn)
+	timer.touch()
+	fetches := &imapFetchInspector{log: log}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		relay(ctx, timer, clientConn, backendConn, "client", nil)
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		relay(ctx, timer, backendConn, clientConn, "backend", func(p []byte) { fetches.feed(ctx, p) })
+	}()
+
+	<-ctx.Done()
+	clientConn.Close()
+	backendConn.Close()
+	wg.Wait()
+}
+
+// relay copies src to dst unchanged, showing each chunk to observe first
+func relay(ctx context.Context, timer *sessionTimer, src, dst net.Conn, from string, observe func([]byte)) {
+	count := stats.clientBytes
+	to := "backend"
+	if from == "backend" {
+		count = stats.backendBytes
+		to = "client"
+	}
+
+	buf := getReadBuffer()
+	defer putReadBuffer(buf)
+	for {
+		n, err := readSome(src, buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				timer.logReadError(from, err)
+			}
+			return
+		}
+		timer.touch()
+		count(n)
+
+		if observe != nil {
+			observe(buf[:n])
+		}
+
+		dst.SetWriteDeadline(timer.next())
+		if _, err := dst.Write(buf[:n]); err != nil {
+			if ctx.Err() == nil {
+				timer.logError("Error writing to "+to, err)
+			}
+			return
+		}
+	}
+}
+
+// imapFetchInspector picks whole messages out of FETCH responses. A
+// message arrives as a literal: a line ending in "{N}" followed by exactly
+// N bytes.
+type imapFetchInspector struct {
+	log     *slog.Logger
+	line    []byte // response line so far
+	literal []byte // message being collected
+	want    int    // literal bytes still to come
+	keep    bool   // literal is a full message worth inspecting
+}
+
+func (f *imapFetchInspector) feed(ctx context.Context, p []byte) {
+	for len(p) > 0 {
+		if f.want > 0 {
+			n := min(f.want, len(p))
+			if f.keep {
+				f.literal = append(f.literal, p[:n]...)
+			}
+			f.want -= n
+			p = p[n:]
+			if f.want == 0 && f.keep {
+				inspectFetchedMessage(ctx, f.log, f.literal)
+				f.literal = nil
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			f.appendLine(p)
+			return
+		}
+		f.appendLine(p[:i+1])
+		p = p[i+1:]
+		f.startLiteral()
+		f.line = f.line[:0]
+	}
+}
+
+// appendLine buffers response text, keeping only the tail of very long
+// lines since all that matters is whether they end in a literal marker
+func (f *imapFetchInspector) appendLine(p []byte) {
+	f.line = append(f.line, p...)
+	if len(f.line) > 4096 {
+		f.line = append(f.line[:0], f.line[len(f.line)-1024:]...)
+	}
+}
+
+// startLiteral checks whether the completed line announces a literal
+func (f *imapFetchInspector) startLiteral() {
+	line := bytes.TrimRight(f.line, "\r\n")
+	if !bytes.HasSuffix(line, []byte("}")) {
+		return
+	}
+	open := bytes.LastIndexByte(line, '{')
+	if open < 0 {
+		return
+	}
+	n, err := strconv.Atoi(string(bytes.TrimSuffix(line[open+1:len(line)-1], []byte("+"))))
+	if err != nil || n <= 0 {
+		return
+	}
+
+	// Only whole messages carry the header and body needed for a signature
+	item := bytes.ToUpper(line[:open])
+	f.want = n
+	f.keep = n <= maxInspectedLiteral &&
+		(bytes.HasSuffix(item, []byte("BODY[] ")) || bytes.HasSuffix(item, []byte("RFC822 ")))
+	if f.keep {
+		f.literal = make([]byte, 0, n)
+	}
+}
+
+// inspectFetchedMessage verifies a fetched message's X-PQC-Signature
+func inspectFetchedMessage(ctx context.Context, log *slog.Logger, msg []byte) {
+	msgID, _ := headerValue(msg, "Message-ID")
+	result := verifyMessage(ctx, msg)
+	if result.status == verifyNone {
+		log.Debug("Fetched message without X-PQC-Signature", "event", "fetch_unsigned", "message_id", msgID)
+		return
+	}
+	log.Info("Verified fetched message", "event", "signature_verified",
+		"message_id", msgID, "result", result.status, "alg", result.alg, "reason", result.reason)
+}
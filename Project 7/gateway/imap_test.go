@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startIMAPBackend serves a Dovecot stand-in that answers LOGIN, SELECT and
+// LOGOUT, and FETCH n BODY[] with msgs[n-1], writing each response in
+// pieces that arrive in separate reads
+func startIMAPBackend(t *testing.T, msgs ...[]byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() { ln.Close(); <-done })
+	go func() {
+		defer close(done)
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("* OK [CAPABILITY IMAP4rev1] Dovecot ready.\r\n"))
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, cmd, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			var n int
+			switch verb, _, _ := strings.Cut(cmd, " "); verb {
+			case "LOGIN":
+				fmt.Fprintf(c, "%s OK Logged in\r\n", tag)
+			case "SELECT":
+				fmt.Fprintf(c, "* %d EXISTS\r\n%s OK [READ-WRITE] Select completed\r\n", len(msgs), tag)
+			case "FETCH":
+				fmt.Sscanf(cmd, "FETCH %d", &n)
+				msg := string(msgs[n-1])
+				writeSlowly(c, fmt.Sprintf("* %d FETCH (BODY[] {%d}\r\n", n, len(msg)),
+					msg[:10], msg[10:len(msg)/2], msg[len(msg)/2:]+")\r\n"+tag+" OK Fetch completed\r\n")
+			case "LOGOUT":
+				fmt.Fprintf(c, "* BYE Logging out\r\n%s OK Logout completed\r\n", tag)
+				return
+			default:
+				fmt.Fprintf(c, "%s BAD Unknown command\r\n", tag)
+			}
+		}
+	}()
+	setFlags(t, map[string]string{"dovecot": ln.Addr().String()})
+}
+
+// imapCommand sends a tagged command and returns everything up to and
+// including its tagged reply, which must be OK
+func imapCommand(t *testing.T, c net.Conn, r *bufio.Reader, tag, cmd string) string {
+	t.Helper()
+	if _, err := fmt.Fprintf(c, "%s %s\r\n", tag, cmd); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v after %q", cmd, err, out.String())
+		}
+		out.WriteString(line)
+		if strings.HasPrefix(line, tag+" ") {
+			if !strings.HasPrefix(line, tag+" OK") {
+				t.Fatalf("%s: %q", cmd, line)
+			}
+			return out.String()
+		}
+	}
+}
+
+func TestIMAPProxyVerifiesFetch(t *testing.T) {
+	signed := preSigned(t)
+	tampered := []byte(strings.Replace(string(signed), "body", "b0dy", 1))
+	startIMAPBackend(t, signed, tampered)
+	logs := captureLogs(t, slog.LevelInfo, "")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			handleIMAPConnection(conn)
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(c)
+	if greeting, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("greeting %q, %v", greeting, err)
+	}
+
+	imapCommand(t, c, r, "a1", "LOGIN user secret")
+	imapCommand(t, c, r, "a2", "SELECT INBOX")
+	// Relayed unchanged, though it came in several reads
+	want := fmt.Sprintf("* 1 FETCH (BODY[] {%d}\r\n%s)\r\na3 OK Fetch completed\r\n", len(signed), signed)
+	if got := imapCommand(t, c, r, "a3", "FETCH 1 BODY[]"); got != want {
+		t.Errorf("FETCH relayed as %q, want %q", got, want)
+	}
+	imapCommand(t, c, r, "a4", "FETCH 2 BODY[]")
+	imapCommand(t, c, r, "a5", "LOGOUT")
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still running")
+	}
+
+	out := logs.String()
+	pass := strings.Index(out, `"result":"pass","alg":"ml-dsa-65"`)
+	fail := strings.Index(out, `"result":"fail","alg":"ml-dsa-65"`)
+	if pass < 0 || fail < pass || strings.Count(out, `"event":"signature_verified"`) != 2 {
+		t.Errorf("want a pass then a fail verification logged, got:\n%s", out)
+	}
+}
+
+func TestIMAPFetchInspectorSplitLiteral(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo, "")
+	signed := preSigned(t)
+	f := &imapFetchInspector{log: slog.Default()}
+	stream := fmt.Sprintf("* 1 FETCH (FLAGS (\\Seen) BODY[] {%d}\r\n%s)\r\n", len(signed), signed)
+	// A byte at a time, the worst case of a literal split across reads
+	for i := range stream {
+		f.feed(context.Background(), []byte(stream[i:i+1]))
+	}
+	if n := strings.Count(logs.String(), `"result":"pass"`); n != 1 {
+		t.Errorf("%d passing verifications logged, want 1:\n%s", n, logs)
+	}
+}
@@ -0,0 +1,325 @@
+// Package smtptest provides a fake SMTP server to relay to and a runner for
+// client transcripts, for the gateway's tests.
+package smtptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Server is a fake SMTP server. Its zero value greets, answers EHLO with
+// PIPELINING and 8BITMIME, and accepts every command and message, keeping
+// the commands and messages it was given; Inject makes it fail instead.
+// Fields must be set before Start.
+type Server struct {
+	Hostname   string   // named in the greeting and EHLO reply, "smtptest" if empty
+	Greeting   string   // the whole greeting line, "220 <Hostname> ESMTP" if empty
+	Extensions []string // advertised after EHLO, PIPELINING and 8BITMIME if nil
+	// LMTP answers LHLO like EHLO and ends a message's data with a reply
+	// for each recipient accepted, in order, each taking the next "."
+	// fault; the message is kept if any recipient gets the usual reply
+	LMTP bool
+
+	mu       sync.Mutex
+	faults   map[string][]*Fault
+	sessions [][]string
+	msgs     []string
+	conns    []net.Conn
+	wg       sync.WaitGroup
+}
+
+// Fault is an error injected into a Server's sessions
+type Fault struct {
+	Reply  string // sent instead of the usual reply; nothing is sent if empty
+	HangUp bool   // closes the connection after Reply
+	Reset  bool   // with HangUp, resets the TCP connection rather than closing it
+	Times  int    // how many commands it applies to, every one if 0
+}
+
+// Inject makes the server answer commands with verb as f says, taking
+// precedence over faults injected before. The end of a message's data is
+// the verb ".". A DATA reply starting 354 still reads the message.
+func (s *Server) Inject(verb string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.faults == nil {
+		s.faults = make(map[string][]*Fault)
+	}
+	verb = strings.ToUpper(verb)
+	s.faults[verb] = append([]*Fault{&f}, s.faults[verb]...)
+}
+
+// fault returns the fault applying to the next command with verb, if any,
+// and counts it
+func (s *Server) fault(verb string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.faults[verb] {
+		if f.Times < 0 {
+			continue
+		}
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				f.Times = -1
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// Start serves on a loopback port until the test ends and returns the
+// address
+func (s *Server) Start(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Serve(t, ln)
+	return ln.Addr().String()
+}
+
+// Serve serves connections from ln until the test ends, when ln and every
+// session still open are closed
+func (s *Server) Serve(t testing.TB, ln net.Listener) {
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		for _, c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			n := len(s.sessions)
+			s.sessions = append(s.sessions, nil)
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer c.Close()
+				s.serve(c, n)
+			}()
+		}
+	}()
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname == "" {
+		return "smtptest"
+	}
+	return s.Hostname
+}
+
+// serve runs the nth session on c
+func (s *Server) serve(c net.Conn, n int) {
+	greeting := s.Greeting
+	if greeting == "" {
+		greeting = "220 " + s.hostname() + " ESMTP"
+	}
+	fmt.Fprintf(c, "%s\r\n", greeting)
+	r := bufio.NewReader(c)
+	rcpts := 0 // accepted in this transaction
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.sessions[n] = append(s.sessions[n], cmd)
+		s.mu.Unlock()
+
+		verb, _, _ := strings.Cut(cmd, " ")
+		verb = strings.ToUpper(verb)
+		reply := s.reply(verb)
+		f := s.fault(verb)
+		if f != nil {
+			reply = f.Reply
+		}
+		if !s.answer(c, reply, f) {
+			return
+		}
+		switch {
+		case verb == "MAIL" || verb == "RSET":
+			rcpts = 0
+		case verb == "RCPT" && strings.HasPrefix(reply, "2"):
+			rcpts++
+		}
+		if verb == "QUIT" && f == nil {
+			return
+		}
+		if verb != "DATA" || !strings.HasPrefix(reply, "354") {
+			continue
+		}
+
+		msg, err := readData(r)
+		if err != nil {
+			return
+		}
+		replies := 1
+		if s.LMTP {
+			replies, rcpts = rcpts, 0
+		}
+		kept := false
+		for i := 0; i < replies; i++ {
+			reply, f = "250 2.0.0 Ok: queued", s.fault(".")
+			if f != nil {
+				reply = f.Reply
+			} else if !kept {
+				kept = true
+				s.mu.Lock()
+				s.msgs = append(s.msgs, msg)
+				s.mu.Unlock()
+			}
+			if !s.answer(c, reply, f) {
+				return
+			}
+		}
+	}
+}
+
+// reply is the server's usual reply to verb, without its CRLF
+func (s *Server) reply(verb string) string {
+	switch verb {
+	case "EHLO", "LHLO":
+		exts := s.Extensions
+		if exts == nil {
+			exts = []string{"PIPELINING", "8BITMIME"}
+		}
+		lines := append([]string{s.hostname()}, exts...)
+		for i := range lines[:len(lines)-1] {
+			lines[i] = "250-" + lines[i]
+		}
+		lines[len(lines)-1] = "250 " + lines[len(lines)-1]
+		return strings.Join(lines, "\r\n")
+	case "HELO":
+		return "250 " + s.hostname()
+	case "DATA":
+		return "354 End data with <CR><LF>.<CR><LF>"
+	case "QUIT":
+		return "221 2.0.0 Bye"
+	}
+	return "250 2.0.0 Ok"
+}
+
+// answer sends reply and carries out f, reporting whether the session goes
+// on
+func (s *Server) answer(c net.Conn, reply string, f *Fault) bool {
+	if reply != "" {
+		if _, err := fmt.Fprintf(c, "%s\r\n", reply); err != nil {
+			return false
+		}
+	}
+	if f == nil || !f.HangUp {
+		return true
+	}
+	if tc, ok := c.(*net.TCPConn); ok && f.Reset {
+		tc.SetLinger(0)
+	}
+	return false
+}
+
+// readData reads a message up to its terminating dot line, undoing the dot
+// stuffing
+func readData(r *bufio.Reader) (string, error) {
+	var msg strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line == ".\r\n" {
+			return msg.String(), nil
+		}
+		msg.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+// Sessions returns the command lines each connection sent, without CRLF,
+// in order of connection. Message data isn't included.
+func (s *Server) Sessions() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([][]string, len(s.sessions))
+	for i, cmds := range s.sessions {
+		sessions[i] = append([]string(nil), cmds...)
+	}
+	return sessions
+}
+
+// Commands returns the command lines every connection sent, in order of
+// connection
+func (s *Server) Commands() []string {
+	var cmds []string
+	for _, session := range s.Sessions() {
+		cmds = append(cmds, session...)
+	}
+	return cmds
+}
+
+// Messages returns the messages the server accepted, as they were sent
+// after DATA without the terminating dot line
+func (s *Server) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+// Run plays transcript over c, one step per line. "C: line" sends line with
+// CRLF, and "C:" alone an empty line, so a message is sent as it would be
+// after DATA; "S: 250" reads a reply, which must have that code, and
+// "S: 250 2.1.5" one whose text also starts with what follows the code.
+// Blank lines and those starting with "#" are skipped. The replies read are
+// returned as "code text", a multiline one's lines joined with "\n".
+func Run(t testing.TB, c *textproto.Conn, transcript string) []string {
+	t.Helper()
+	var replies []string
+	for i, step := range strings.Split(transcript, "\n") {
+		step = strings.TrimRight(strings.TrimLeft(step, " \t"), "\r")
+		if step == "" || strings.HasPrefix(step, "#") {
+			continue
+		}
+		switch {
+		case step == "C:" || strings.HasPrefix(step, "C: "):
+			if err := c.PrintfLine("%s", strings.TrimPrefix(strings.TrimPrefix(step, "C:"), " ")); err != nil {
+				t.Fatalf("line %d: %v", i+1, err)
+			}
+		case strings.HasPrefix(step, "S: "):
+			want := strings.TrimPrefix(step, "S: ")
+			wantCode, wantText, _ := strings.Cut(want, " ")
+			code, err := strconv.Atoi(wantCode)
+			if err != nil {
+				t.Fatalf("line %d: %q isn't a reply code", i+1, wantCode)
+			}
+			got, text, err := c.ReadResponse(0)
+			if got == 0 {
+				t.Fatalf("line %d: reading reply: %v", i+1, err)
+			}
+			if got != code || !strings.HasPrefix(text, wantText) {
+				t.Fatalf("line %d: got %d %s, want %s", i+1, got, text, want)
+			}
+			replies = append(replies, fmt.Sprintf("%d %s", got, text))
+		default:
+			t.Fatalf("line %d: %q is neither C: nor S:", i+1, step)
+		}
+	}
+	return replies
+}
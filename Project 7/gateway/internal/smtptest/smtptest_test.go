@@ -0,0 +1,273 @@
+package smtptest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// dial connects to s and returns the client side
+func dial(t *testing.T, s *Server) *textproto.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(conn)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// closed reports whether the server has closed c, without reading past
+// what it sent before
+func closed(t *testing.T, c *textproto.Conn) bool {
+	t.Helper()
+	_, err := c.R.ReadByte()
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		t.Fatal("connection still open")
+	}
+	return err != nil
+}
+
+func TestServerAcceptsMessage(t *testing.T) {
+	s := &Server{}
+	c := dial(t, s)
+	replies := Run(t, c, `
+		S: 220 smtptest ESMTP
+		C: EHLO client.example.com
+		S: 250 smtptest
+		C: MAIL FROM:<a@example.com>
+		S: 250 2.0.0
+		C: RCPT TO:<b@example.com>
+		S: 250
+		C: DATA
+		S: 354
+		C: Subject: hi
+		C:
+		C: ..leading dot
+		C: .
+		S: 250 2.0.0 Ok: queued
+		C: QUIT
+		S: 221
+	`)
+	if want := "250 smtptest\nPIPELINING\n8BITMIME"; replies[1] != want {
+		t.Errorf("EHLO reply %q, want %q", replies[1], want)
+	}
+	if got, want := s.Messages(), []string{"Subject: hi\r\n\r\n.leading dot\r\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages %q, want %q", got, want)
+	}
+	want := []string{"EHLO client.example.com", "MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "DATA", "QUIT"}
+	if got := s.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands %q, want %q", got, want)
+	}
+	if !closed(t, c) {
+		t.Error("connection open after QUIT")
+	}
+}
+
+func TestServerConfigured(t *testing.T) {
+	s := &Server{Hostname: "mx.example.com", Greeting: "220-mx.example.com\r\n220 welcome", Extensions: []string{"SIZE 1000", "CHUNKING"}}
+	c := dial(t, s)
+	replies := Run(t, c, `
+		S: 220 mx.example.com
+		C: EHLO client.example.com
+		S: 250 mx.example.com
+		C: HELO client.example.com
+		S: 250 mx.example.com
+	`)
+	want := []string{"220 mx.example.com\nwelcome", "250 mx.example.com\nSIZE 1000\nCHUNKING", "250 mx.example.com"}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies %q, want %q", replies, want)
+	}
+}
+
+func TestServerInject(t *testing.T) {
+	s := &Server{}
+	s.Inject("rcpt", Fault{Reply: "550 5.1.1 No such user", Times: 1})
+	s.Inject("DATA", Fault{Reply: "451 4.3.0 Try later"})
+	s.Inject("DATA", Fault{Reply: "354 go ahead", Times: 1})
+	s.Inject(".", Fault{Reply: "554 5.7.1 Rejected", Times: 1})
+	c := dial(t, s)
+	Run(t, c, `
+		S: 220
+		C: MAIL FROM:<a@example.com>
+		S: 250
+		C: RCPT TO:<b@example.com>
+		S: 550 5.1.1
+		# Only the first time
+		C: RCPT TO:<b@example.com>
+		S: 250
+		# The later DATA fault takes precedence until used up
+		C: DATA
+		S: 354 go ahead
+		C: reject me
+		C: .
+		S: 554 5.7.1
+		C: DATA
+		S: 451 4.3.0
+		C: DATA
+		S: 451 4.3.0
+	`)
+	if msgs := s.Messages(); len(msgs) != 0 {
+		t.Errorf("messages %q kept", msgs)
+	}
+}
+
+func TestServerLMTP(t *testing.T) {
+	s := &Server{LMTP: true}
+	s.Inject("RCPT", Fault{Reply: "550 5.1.1 No such user", Times: 1})
+	s.Inject(".", Fault{Reply: "452 4.2.2 Mailbox full", Times: 1})
+	c := dial(t, s)
+	Run(t, c, `
+		S: 220
+		C: LHLO client.example.com
+		S: 250 smtptest
+		C: MAIL FROM:<a@example.com>
+		S: 250
+		C: RCPT TO:<nobody@example.com>
+		S: 550
+		C: RCPT TO:<b@example.com>
+		S: 250
+		C: RCPT TO:<c@example.com>
+		S: 250
+		C: DATA
+		S: 354
+		C: hi
+		C: .
+		# One reply each for the accepted recipients
+		S: 452 4.2.2
+		S: 250 2.0.0 Ok: queued
+		C: MAIL FROM:<a@example.com>
+		S: 250
+		C: RCPT TO:<b@example.com>
+		S: 250
+		C: DATA
+		S: 354
+		C: again
+		C: .
+		S: 250
+		C: QUIT
+		S: 221
+	`)
+	if got, want := s.Messages(), []string{"hi\r\n", "again\r\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages %q, want %q", got, want)
+	}
+}
+
+func TestServerHangUp(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		verb  string
+		fault Fault
+		steps string
+	}{
+		{"after reply", "MAIL", Fault{Reply: "421 4.3.0 Bye", HangUp: true}, "C: MAIL FROM:<a@example.com>\nS: 421"},
+		{"silently", "MAIL", Fault{HangUp: true}, "C: MAIL FROM:<a@example.com>"},
+		{"reset", "DATA", Fault{Reply: "354 go ahead", HangUp: true, Reset: true}, "C: DATA\nS: 354"},
+		{"end of data", ".", Fault{HangUp: true}, "C: DATA\nS: 354\nC: body\nC: ."},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			s.Inject(tc.verb, tc.fault)
+			c := dial(t, s)
+			Run(t, c, "S: 220\n"+tc.steps)
+			if !closed(t, c) {
+				t.Error("connection still open")
+			}
+			if msgs := s.Messages(); len(msgs) != 0 {
+				t.Errorf("messages %q kept", msgs)
+			}
+		})
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	s := &Server{}
+	addr := s.Start(t)
+	for _, helo := range []string{"EHLO one", "EHLO two"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := textproto.NewConn(conn)
+		Run(t, c, "S: 220\nC: "+helo+"\nS: 250\nC: QUIT\nS: 221")
+		c.Close()
+	}
+	want := [][]string{{"EHLO one", "QUIT"}, {"EHLO two", "QUIT"}}
+	if got := s.Sessions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sessions %q, want %q", got, want)
+	}
+}
+
+// failingTB is a testing.TB that records a failure instead of ending the
+// test, for checking Run fails when it should
+type failingTB struct {
+	testing.TB
+	msg string
+}
+
+func (f *failingTB) Helper() {}
+
+func (f *failingTB) Fatalf(format string, args ...any) {
+	f.msg = fmt.Sprintf(format, args...)
+	panic(f)
+}
+
+// runFails returns the message Run fails with, or "" if it doesn't
+func runFails(t *testing.T, c *textproto.Conn, transcript string) (msg string) {
+	f := &failingTB{TB: t}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != f {
+				panic(r)
+			}
+			msg = f.msg
+		}
+	}()
+	Run(f, c, transcript)
+	return ""
+}
+
+func TestRunFails(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		transcript string
+	}{
+		{"wrong code", "S: 250"},
+		{"wrong text", "S: 220 elsewhere"},
+		{"not a code", "S: ok"},
+		{"unknown step", "X: 220"},
+		{"closed", "S: 220\nC: QUIT\nS: 221\nS: 250"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := dial(t, &Server{})
+			if runFails(t, c, tc.transcript) == "" {
+				t.Errorf("%q passed", tc.transcript)
+			}
+		})
+	}
+}
+
+func TestRunSendsLines(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		c := textproto.NewConn(client)
+		defer c.Close()
+		Run(t, c, "C: EHLO x\n\t\tC:\n# skipped\n\nC:  folded")
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "EHLO x\r\n\r\n folded\r\n"; string(got) != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
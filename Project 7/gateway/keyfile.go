@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var keyEnv = flag.String("key-env", "", "Environment variable holding the PEM TLS key, read instead of -key (for secrets injected into a container's environment)")
+
+// loadKeyPair loads -cert with its key from the -key-env variable when set,
+// or from -key otherwise
+func loadKeyPair() (tls.Certificate, error) {
+	if *keyEnv == "" {
+		warnIfExposed(*keyFile)
+		return tls.LoadX509KeyPair(*certFile, *keyFile)
+	}
+	// Set but empty is a mistake in the deployment, not a cue to fall back
+	// to a key file that might be stale
+	keyPEM := os.Getenv(*keyEnv)
+	if keyPEM == "" {
+		return tls.Certificate{}, fmt.Errorf("-key-env: $%s is not set", *keyEnv)
+	}
+	certPEM, err := os.ReadFile(*certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, []byte(keyPEM))
+}
+
+// warnIfExposed logs a warning when the key file at path can be read by
+// any user on the host
+func warnIfExposed(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return // reading it reports the problem
+	}
+	if perm := fi.Mode().Perm(); perm&0o004 != 0 {
+		slog.Warn("Key file is world-readable", "event", "key_file_exposed", "path", path, "mode", fmt.Sprintf("%04o", perm))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyPair writes a certificate to -cert and its key to -key with mode
+// perm, or nowhere if perm is 0, returning both as PEM
+func writeKeyPair(t *testing.T, perm os.FileMode) (certPEM, keyPEM []byte) {
+	t.Helper()
+	c := newTestCA(t, "ca").issue(t, "gateway")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	dir := t.TempDir()
+	setFlags(t, map[string]string{"cert": filepath.Join(dir, "server.crt"), "key": filepath.Join(dir, "server.key")})
+	if err := os.WriteFile(*certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if perm != 0 {
+		if err := os.WriteFile(*keyFile, keyPEM, perm); err != nil {
+			t.Fatal(err)
+		}
+		// WriteFile's mode is subject to the umask
+		os.Chmod(*keyFile, perm)
+	}
+	return certPEM, keyPEM
+}
+
+func TestKeyFromEnv(t *testing.T) {
+	certPEM, keyPEM := writeKeyPair(t, 0)
+	t.Setenv("PQC_TEST_TLS_KEY", string(keyPEM))
+	setFlags(t, map[string]string{"key-env": "PQC_TEST_TLS_KEY"})
+
+	cert, err := loadKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], mustDecodePEM(t, certPEM)) {
+		t.Error("loaded the wrong certificate")
+	}
+}
+
+func TestKeyFromUnsetEnv(t *testing.T) {
+	writeKeyPair(t, 0o600)
+	t.Setenv("PQC_TEST_TLS_KEY", "")
+	setFlags(t, map[string]string{"key-env": "PQC_TEST_TLS_KEY"})
+	// The key file is there, but -key-env says not to use it
+	if _, err := loadKeyPair(); err == nil || !strings.Contains(err.Error(), "PQC_TEST_TLS_KEY") {
+		t.Errorf("loaded with $PQC_TEST_TLS_KEY empty: %v", err)
+	}
+}
+
+func TestKeyFilePermissions(t *testing.T) {
+	for mode, warned := range map[os.FileMode]bool{0o600: false, 0o640: false, 0o644: true} {
+		writeKeyPair(t, mode)
+		logs := captureLogs(t, slog.LevelWarn, "")
+		if _, err := loadKeyPair(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(logs.String(), "key_file_exposed"); got != warned {
+			t.Errorf("mode %04o: warned %v, want %v:\n%s", mode, got, warned, logs.String())
+		}
+	}
+}
+
+func mustDecodePEM(t *testing.T, b []byte) []byte {
+	t.Helper()
+	block, _ := pem.Decode(b)
+	if block == nil {
+		t.Fatal("no PEM block")
+	}
+	return block.Bytes
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var sigKeyPoll = flag.Duration("sig-key-poll", 30*time.Second, "How often to check -sig-key and -sig-pubkey for a new key (0 disables; SIGHUP always reloads, along with the TLS certificate)")
+
+// Keys kept after being replaced, so mail signed just before a rotation
+// still verifies
+const maxRetiredKeys = 4
+
+// keyRing holds the active signing key and the ones it replaced. A reload
+// swaps in a fully constructed signer under the lock, so a message is
+// always signed with either the old key or the new one, never a mix.
+type keyRing struct {
+	mu      sync.RWMutex
+	active  Signer
+	retired []Signer // most recent first
+}
+
+// Signing keys, set up in main and replaced by reloadSigner
+var signingKeys keyRing
+
+// currentSigner returns the active key. Callers keep the snapshot for a
+// whole message so alg=, kid= and sig= come from the same key.
+func currentSigner() Signer {
+	return signingKeys.current()
+}
+
+func (k *keyRing) current() Signer {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// rotate makes s the active key, retiring the previous one
+func (k *keyRing) rotate(s Signer) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.active != nil {
+		k.retired = append([]Signer{k.active}, k.retired...)
+		if len(k.retired) > maxRetiredKeys {
+			k.retired = k.retired[:maxRetiredKeys]
+		}
+	}
+	k.active = s
+}
+
+// verifier returns the Verifier for a kid= value, or nil when no loaded key
+// matches or the key can't verify. Signatures without kid= predate rotation
+// and are checked against the active key.
+func (k *keyRing) verifier(kid string) Verifier {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, s := range append([]Signer{k.active}, k.retired...) {
+		if s != nil && (kid == "" || s.KeyID() == kid) {
+			v, _ := s.(Verifier)
+			return v
+		}
+	}
+	return nil
+}
+
+// keyID names a key pair for kid=: a truncated SHA-256 of the public key,
+// so verifiers holding it can work the ID out themselves. The secret key is
+// never hashed: kid= is published in every message.
+func keyID(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// reloadSigner loads the key files again and makes the result active. A
+// key that fails to load (e.g. still being written) leaves the old one in
+// place.
+func reloadSigner(reason string) error {
+	s, err := newSigner(*sigAlg)
+	if err != nil {
+		slog.Error("Failed to reload signing key, keeping the current one", "event", "signer_reload_failed",
+			"reason", reason, "error", err)
+		return err
+	}
+	old := currentSigner()
+	if old != nil && old.KeyID() == s.KeyID() {
+		slog.Debug("Signing key unchanged", "event", "signer_reload", "reason", reason, "kid", s.KeyID())
+		return nil
+	}
+	signingKeys.rotate(s)
+	oldKID := ""
+	if old != nil {
+		oldKID = old.KeyID()
+	}
+	slog.Info("Signing key rotated", "event", "signer_rotated", "reason", reason,
+		"alg", s.Algorithm(), "old_kid", oldKID, "kid", s.KeyID())
+	return nil
+}
+
+// watchSigningKey reloads the key on SIGHUP and, every interval, when the
+// -sig-key or -sig-pubkey file has changed; the -sig-domain-keys ones are
+// reloaded on SIGHUP. watchCertificate listens for
+// SIGHUP too, so one signal reloads both; whichever hasn't changed stays
+// as it is.
+func watchSigningKey(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 && *sigKeyFile != "" {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	stamp := fileStamp(*sigKeyFile, *sigPubKeyFile)
+	for {
+		select {
+		case <-hup:
+			reloadSigner("sighup")
+			if err := loadSenderKeys("sighup"); err != nil {
+				slog.Error("Failed to reload sender domain signing keys, keeping the current ones", "event", "signer_reload_failed",
+					"reason", "sighup", "error", err)
+			}
+			stamp = fileStamp(*sigKeyFile, *sigPubKeyFile)
+		case <-tick:
+			// Only a successful load consumes the change, so a file caught
+			// mid-write is retried on the next tick
+			if s := fileStamp(*sigKeyFile, *sigPubKeyFile); s != stamp && reloadSigner("file_changed") == nil {
+				stamp = s
+			}
+		}
+	}
+}
+
+// fileStamp summarizes the size and modification time of the named files,
+// changing whenever one of them is rewritten
+func fileStamp(paths ...string) string {
+	var stamp string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", path, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			stamp += path + ":missing;"
+		}
+	}
+	return stamp
+}
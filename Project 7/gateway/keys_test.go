@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+)
+
+// testKey signs with a digest of its public key and the data, so only the
+// same key verifies, and is named by keyID like a real key pair
+type testKey struct{ public string }
+
+func (k testKey) Algorithm() string { return "ml-dsa-65" }
+func (k testKey) KeyID() string     { return keyID([]byte(k.public)) }
+
+func (k testKey) Sign(ctx context.Context, data []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("%x", sha256.Sum256(append([]byte(k.public), data...)))), nil
+}
+
+func (k testKey) Verify(ctx context.Context, data, sig []byte) error {
+	want, _ := k.Sign(ctx, data)
+	if string(want) != string(sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+func TestKeyID(t *testing.T) {
+	a, b := keyID([]byte("public key A")), keyID([]byte("public key B"))
+	if len(a) != 16 || a == b {
+		t.Errorf("keyID: %q, %q", a, b)
+	}
+	if keyID([]byte("public key A")) != a {
+		t.Error("keyID is not stable")
+	}
+}
+
+func TestKeyRingRetiresOldestKey(t *testing.T) {
+	var ring keyRing
+	keys := make([]testKey, maxRetiredKeys+2)
+	for i := range keys {
+		keys[i] = testKey{fmt.Sprintf("key %d", i)}
+		ring.rotate(keys[i])
+	}
+	if ring.current() != keys[len(keys)-1] {
+		t.Fatal("last key is not active")
+	}
+	if ring.verifier(keys[0].KeyID()) != nil {
+		t.Error("key past maxRetiredKeys still verifies")
+	}
+	for _, k := range keys[1:] {
+		if ring.verifier(k.KeyID()) == nil {
+			t.Errorf("kid %s no longer verifies", k.KeyID())
+		}
+	}
+	if ring.verifier("0000000000000000") != nil {
+		t.Error("unknown kid has a verifier")
+	}
+}
+
+func TestRotationKeepsOldSignaturesValid(t *testing.T) {
+	oldKey, newKey := testKey{"old public key"}, testKey{"new public key"}
+	useSigner(t, oldKey)
+	before, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKeys.rotate(newKey)
+	after, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, msg := range map[string][]byte{"old kid": before, "new kid": after} {
+		if r := verifyMessage(context.Background(), msg); r.status != verifyPass {
+			t.Errorf("%s: %+v", name, r)
+		}
+	}
+	_, value, _ := lastSignature(after)
+	if tags, _ := parseSignatureHeader(value); tags["kid"] != newKey.KeyID() {
+		t.Errorf("signed after rotation with kid=%s, want %s", tags["kid"], newKey.KeyID())
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	maxConns    = flag.Int("max-conns", 1000, "Maximum concurrent sessions across all listeners (0 disables)")
+	ipRate      = flag.Int("ip-rate", 60, "New connections allowed per minute from one source IP (0 disables)")
+	ipBurst     = flag.Int("ip-burst", 20, "Connections one source IP may open at once before -ip-rate applies")
+	limitAction = flag.String("limit-action", "reply", "What to do with connections over a limit: reply (421 / BYE, then close) or drop")
+)
+
+// How long a refused client gets to take its refusal, TLS handshake included
+const refusalTimeout = time.Second
+
+// Sent to a refused client before closing when -limit-action=reply
+var refusalGreetings = map[string]string{
+	"smtp": "421 4.7.0 Too many connections, try again later\r\n",
+	"imap": "* BYE Too many connections, try again later\r\n",
+}
+
+// connLimiter caps concurrent sessions and rate-limits new connections per
+// source IP with a token bucket
+type connLimiter struct {
+	slots chan struct{} // one per running session; nil when unlimited
+
+	mu        sync.Mutex
+	rate      float64 // tokens per second; 0 disables
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time // time.Now, except in tests
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Shared by every listener, set up in main
+var limiter *connLimiter
+
+func newConnLimiter(maxConns, perMinute, burst int) *connLimiter {
+	l := &connLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(max(burst, 1)),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+	if maxConns > 0 {
+		l.slots = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+// admit decides whether to serve a new connection. On success the caller
+// must call release when the session ends; otherwise reason says which
+// limit refused it.
+func (l *connLimiter) admit(conn net.Conn) (release func(), reason string) {
+	if !l.allow(remoteIP(conn), l.now()) {
+		return nil, "rate_limit"
+	}
+	if l.slots == nil {
+		return func() {}, ""
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, ""
+	default:
+		return nil, "max_conns"
+	}
+}
+
+// allow takes a token from ip's bucket, refilling it for the time elapsed
+func (l *connLimiter) allow(ip string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets buckets that have refilled completely, which behave the
+// same as a new one
+func (l *connLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// refuse turns away a connection over a limit or the access list without
+// holding up the accept loop. attrs add detail to the log line.
+func refuse(conn net.Conn, proto, reason string, attrs ...any) {
+	connectionsRejected.WithLabelValues(reason).Inc()
+	attrs = append([]any{"event", "connection_refused", "proto", proto,
+		"remote_addr", conn.RemoteAddr().String(), "reason", reason}, attrs...)
+	slog.Info("Refused connection", attrs...)
+	if *limitAction != "reply" {
+		conn.Close()
+		return
+	}
+	greeting := closingGreeting(refusalGreetings, proto)
+	if reason == "access_denied" {
+		greeting = []byte(deniedGreetings[proto])
+	}
+	go func() {
+		defer conn.Close()
+		// Reads too: on an implicit-TLS listener the write starts the
+		// handshake, and a client that never sends its hello must not hold
+		// the goroutine and socket open
+		conn.SetDeadline(time.Now().Add(refusalTimeout))
+		conn.Write(greeting)
+	}()
+}
+
+// remoteIP is the client's address without the port
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// unixPeer reports whether conn came in over a Unix socket, which has no
+// client address: the socket file's permissions decide who may connect
+func unixPeer(conn net.Conn) bool {
+	return conn.RemoteAddr().Network() == "unix"
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// remoteConn is a connection that only knows its peer address
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func connFrom(ip string) net.Conn {
+	return remoteConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := newConnLimiter(0, 60, 3) // one token a second, three at once
+	l.now = clock.Now
+
+	admitted := func(ip string) bool {
+		release, _ := l.admit(connFrom(ip))
+		if release != nil {
+			release()
+		}
+		return release != nil
+	}
+	for i := 0; i < 3; i++ {
+		if !admitted("192.0.2.1") {
+			t.Fatalf("connection %d of the burst refused", i+1)
+		}
+	}
+	if admitted("192.0.2.1") {
+		t.Fatal("connection past the burst admitted")
+	}
+	if !admitted("192.0.2.2") {
+		t.Fatal("another address shares the bucket")
+	}
+
+	clock.advance(999 * time.Millisecond)
+	if admitted("192.0.2.1") {
+		t.Fatal("admitted before a token refilled")
+	}
+	clock.advance(time.Millisecond)
+	if !admitted("192.0.2.1") {
+		t.Fatal("refused after a token refilled")
+	}
+
+	// Idle long enough to refill, the bucket is forgotten
+	clock.advance(2 * time.Minute)
+	admitted("192.0.2.3")
+	if _, ok := l.buckets["192.0.2.1"]; ok {
+		t.Error("full bucket not swept")
+	}
+}
+
+func TestTokenBucketDisabled(t *testing.T) {
+	l := newConnLimiter(0, 0, 1)
+	for i := 0; i < 100; i++ {
+		if !l.allow("192.0.2.1", time.Now()) {
+			t.Fatal("refused with -ip-rate=0")
+		}
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	l := newConnLimiter(2, 0, 0)
+	r1, _ := l.admit(connFrom("192.0.2.1"))
+	r2, _ := l.admit(connFrom("192.0.2.2"))
+	if r1 == nil || r2 == nil {
+		t.Fatal("refused under the limit")
+	}
+	if _, reason := l.admit(connFrom("192.0.2.3")); reason != "max_conns" {
+		t.Fatalf("reason %q, want max_conns", reason)
+	}
+	r1()
+	if r3, _ := l.admit(connFrom("192.0.2.3")); r3 == nil {
+		t.Fatal("slot not released")
+	}
+}
+
+// A client that opens a TLS connection and never sends its hello must not
+// keep the refusal goroutine waiting on the handshake
+func TestRefuseSilentTLSClient(t *testing.T) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refuse(conn, "smtp", "max_conns")
+
+	// The gateway gives up on the handshake and closes the socket
+	client.SetReadDeadline(time.Now().Add(refusalTimeout + 2*time.Second))
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("connection not closed by the gateway: %v", err)
+	}
+}
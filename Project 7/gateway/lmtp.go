@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+)
+
+var lmtpMode = flag.Bool("lmtp", false, "Speak LMTP to the -postfix backends, e.g. a Dovecot LMTP socket (unix:/path or host:port)")
+
+// lmtpReply collects one recipient's LMTP reply to the end of DATA. SMTP
+// has a single reply for the whole message, so once every recipient has
+// answered the client gets the first temporary failure (it retries, and
+// recipients already served may see the message twice), else the first
+// permanent failure, else success. Returns what to relay, if anything yet.
+func (s *smtpSession) lmtpReply(raw []byte) []byte {
+	head := &s.inflight[0]
+	rcpt := head.lmtpRcpts[0]
+	head.lmtpRcpts = head.lmtpRcpts[1:]
+	reply := append([]byte(nil), raw...)
+	s.lmtpReplies = append(s.lmtpReplies, reply)
+	if reply[0] == '2' {
+		s.log.Debug("Delivered to recipient", "event", "lmtp_delivery", "recipient", rcpt,
+			"reply", string(bytes.TrimRight(reply, "\r\n")))
+	} else {
+		s.log.Warn("Recipient refused message", "event", "lmtp_delivery", "recipient", rcpt,
+			"reply", string(bytes.TrimRight(reply, "\r\n")))
+	}
+	if len(head.lmtpRcpts) > 0 {
+		return nil
+	}
+
+	out := lmtpOutcome(s.lmtpReplies)
+	for _, r := range s.lmtpReplies {
+		if r[0] == '2' {
+			// Delivered to at least one recipient
+			s.messageDelivered()
+			break
+		}
+	}
+	s.delivered = nil
+	s.inflight = s.inflight[1:]
+	s.lmtpReplies = nil
+	s.resetTransaction()
+	return out
+}
+
+// lmtpOutcome picks the client's reply from the per-recipient replies
+func lmtpOutcome(replies [][]byte) []byte {
+	var permanent []byte
+	for _, r := range replies {
+		switch r[0] {
+		case '4':
+			return r
+		case '5':
+			if permanent == nil {
+				permanent = r
+			}
+		}
+	}
+	if permanent != nil {
+		return permanent
+	}
+	return replies[len(replies)-1]
+}
+
+// heloReply condenses the multi-line LHLO response into a HELO reply
+func heloReply(lines [][]byte) []byte {
+	if len(lines) == 0 || !bytes.HasPrefix(lines[0], []byte("250")) {
+		return rewriteEHLO(lines, ehloPolicy{})
+	}
+	text := ""
+	if len(lines[0]) > 4 {
+		text = string(lines[0][4:])
+	}
+	return []byte("250 " + text + "\r\n")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+func TestLMTPDataReplies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		replies []string // the backend's, recipient by recipient; then 250
+		code    int
+		text    string
+	}{
+		{"temporary first", []string{"550 5.1.1 <b@example.com> unknown", "451 4.2.0 <c@example.com> try later"}, 451, "4.2.0 <c@example.com>"},
+		{"permanent", []string{"250 2.0.0 <b@example.com> delivered", "552 5.2.2 <c@example.com> over quota"}, 552, "5.2.2 <c@example.com>"},
+		{"all delivered", []string{"250 2.0.0 <b@example.com> delivered", "250 2.0.0 <c@example.com> delivered", "250 2.0.0 <d@example.com> delivered"}, 250, "2.0.0 <d@example.com>"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlag(t, lmtpMode, true)
+			b := &smtptest.Server{LMTP: true}
+			// Later faults are taken first
+			for i := len(tc.replies) - 1; i >= 0; i-- {
+				b.Inject(".", smtptest.Fault{Reply: tc.replies[i], Times: 1})
+			}
+			startFakeBackend(t, b)
+
+			c := dialGateway(t)
+			command(t, c, 250, "EHLO client.example.com")
+			command(t, c, 250, "MAIL FROM:<a@example.com>")
+			for _, rcpt := range []string{"b@example.com", "c@example.com", "d@example.com"} {
+				command(t, c, 250, "RCPT TO:<"+rcpt+">")
+			}
+			command(t, c, 354, "DATA")
+			w := c.DotWriter()
+			w.Write([]byte(testBody))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if text := expect(t, c, tc.code); !strings.HasPrefix(text, tc.text) {
+				t.Errorf("got %d %s, want %d %s", tc.code, text, tc.code, tc.text)
+			}
+
+			// Every recipient's reply was read: the next transaction's
+			// replies are its own
+			command(t, c, 250, "MAIL FROM:<a@example.com>")
+			command(t, c, 250, "RCPT TO:<b@example.com>")
+			command(t, c, 354, "DATA")
+			w = c.DotWriter()
+			w.Write([]byte(testBody))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			expect(t, c, 250)
+			command(t, c, 221, "QUIT")
+
+			if cmds := b.Commands(); !strings.HasPrefix(cmds[0], "LHLO ") {
+				t.Errorf("backend got %q, want LHLO", cmds[0])
+			}
+		})
+	}
+}
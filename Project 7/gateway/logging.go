@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+)
+
+var (
+	logLevel = flag.String("log-level", "info", "Log level: debug, info, warn, error")
+	traceIP  = flag.String("trace-ip", "", "Log sessions from these comma-separated addresses or CIDR networks at debug level, whatever -log-level is")
+)
+
+// Networks from -trace-ip, set up in main
+var verboseSources []netip.Prefix
+
+// Takes every level, for sessions from verboseSources; the default logger
+// is the same handler filtered to -log-level
+var verboseHandler slog.Handler
+
+// setupLogging switches the default logger to JSON lines on stderr at the
+// given level. Each line has msg and an event name for grouping, plus
+// fields such as session_id, remote_addr and error where they apply.
+func setupLogging(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log level %q: %w", level, err)
+	}
+	useLogHandler(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}), l)
+	return nil
+}
+
+// useLogHandler logs through h, which must take every level: at level and
+// above by default, and at every level for sessions from verboseSources
+func useLogHandler(h slog.Handler, level slog.Level) {
+	verboseHandler = h
+	slog.SetDefault(slog.New(levelHandler{h, level}))
+}
+
+// levelHandler drops records below level before they reach its handler
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// newSessionID returns a fresh ID for a connection, logged with every line
+// of it
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// sessionLogger returns a logger that tags every line with the session's
+// ID and the client's address, so one connection's lines can be grouped.
+// Sessions from -trace-ip log at debug level.
+func sessionLogger(conn net.Conn, proto, id string) *slog.Logger {
+	log := slog.Default()
+	if verboseHandler != nil && verboseSource(conn) {
+		log = slog.New(verboseHandler).With("traced", true)
+	}
+	return log.With(
+		"session_id", id,
+		"proto", proto,
+		"remote_addr", conn.RemoteAddr().String(),
+	)
+}
+
+// verboseSource reports whether conn's client is in -trace-ip
+func verboseSource(conn net.Conn) bool {
+	if len(verboseSources) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(remoteIP(conn))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, p := range verboseSources {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fatal logs an error that prevents startup and exits
+func fatal(event, msg string, err error) {
+	slog.Error(msg, "event", event, "error", err)
+	os.Exit(1)
+}
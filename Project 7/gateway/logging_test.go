@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for a handler's concurrent writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends logs at level to a buffer for the rest of the test,
+// with sessions from the trace list logged at every level
+func captureLogs(t *testing.T, level slog.Level, trace string) *syncBuffer {
+	t.Helper()
+	oldDefault, oldVerbose, oldSources := slog.Default(), verboseHandler, verboseSources
+	t.Cleanup(func() {
+		slog.SetDefault(oldDefault)
+		verboseHandler, verboseSources = oldVerbose, oldSources
+	})
+	var err error
+	if verboseSources, err = parsePrefixes(trace); err != nil {
+		t.Fatal(err)
+	}
+	buf := &syncBuffer{}
+	useLogHandler(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}), level)
+	return buf
+}
+
+func TestTraceIP(t *testing.T) {
+	buf := captureLogs(t, slog.LevelInfo, "192.0.2.7,2001:db8::/32")
+
+	for _, ip := range []string{"192.0.2.8", "198.51.100.1", "192.0.2.7", "::ffff:192.0.2.7", "2001:db8::1"} {
+		log := sessionLogger(connFrom(ip), "smtp", newSessionID())
+		log.Debug("debug line", "event", "test_debug", "ip", ip)
+		log.Info("info line", "event", "test_info", "ip", ip)
+	}
+	slog.Debug("global debug line", "event", "test_debug")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var debug []string
+	for _, line := range lines {
+		if strings.Contains(line, `"level":"DEBUG"`) {
+			debug = append(debug, line)
+		}
+	}
+	if len(lines)-len(debug) != 5 {
+		t.Errorf("%d info lines, want one per session", len(lines)-len(debug))
+	}
+	if len(debug) != 3 {
+		t.Fatalf("debug lines %q, want the traced sessions' only", debug)
+	}
+	for i, ip := range []string{"192.0.2.7", "::ffff:192.0.2.7", "2001:db8::1"} {
+		if !strings.Contains(debug[i], `"ip":"`+ip+`"`) || !strings.Contains(debug[i], `"traced":true`) {
+			t.Errorf("debug line %q, want one for %s", debug[i], ip)
+		}
+	}
+}
+
+func TestTraceIPOff(t *testing.T) {
+	buf := captureLogs(t, slog.LevelWarn, "")
+	log := sessionLogger(connFrom("192.0.2.7"), "smtp", newSessionID())
+	log.Info("info line", "event", "test_info")
+	log.Debug("debug line", "event", "test_debug")
+	if buf.String() != "" {
+		t.Errorf("logged %q below -log-level", buf.String())
+	}
+	if verboseSource(connFrom("192.0.2.7")) {
+		t.Error("traced with no -trace-ip")
+	}
+	verboseSources = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	if verboseSource(remoteConn{addr: &net.UnixAddr{Name: "@", Net: "unix"}}) {
+		t.Error("traced a connection without an IP address")
+	}
+}
@@ -1,180 +1,911 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Configuration
 var (
-	listenAddr  = flag.String("listen", ":2525", "Address to listen on")
-	postfixAddr = flag.String("postfix", "postfix:25", "Postfix server address")
-	dovecotAddr = flag.String("dovecot", "dovecot:143", "Dovecot server address")
+	listenAddr  = flag.String("listen", ":2525", "Address to listen on: host:port, or unix:/path for a socket")
+	postfixAddr = flag.String("postfix", "postfix:25", "Postfix server address, or a comma-separated list to fail over between")
+	dovecotAddr = flag.String("dovecot", "dovecot:143", "Dovecot server address, or unix:/path")
 	receiptsURL = flag.String("receipts", "http://receipts:6000", "Receipts service URL")
 	certFile    = flag.String("cert", "server.crt", "TLS certificate file")
 	keyFile     = flag.String("key", "server.key", "TLS key file")
-	debug       = flag.Bool("debug", true, "Enable debug logging")
+	writeCert   = flag.Bool("write-cert", false, "Save a generated self-signed certificate to -cert/-key")
+	startTLS    = flag.Bool("starttls", false, "Listen in plaintext and offer STARTTLS instead of implicit TLS")
+	requireTLS  = flag.Bool("require-tls", true, "Refuse to start when TLS can't be set up (false serves plaintext instead, for demos)")
+	observeOnly = flag.Bool("observe", false, "Verify and sign as usual for logs and metrics, but deliver every message unmodified")
+
+	maxMessageSize = flag.Int("max-message-size", 25<<20, "Largest message accepted in bytes, refused with 552 (0 disables)")
+	maxHeaderSize  = flag.Int("max-header-size", 1<<20, "Largest message header block accepted in bytes, refused with 552 (0 disables)")
+	maxLineLength  = flag.Int("max-line-length", 512, "Longest SMTP command line accepted in bytes, CRLF included, refused with 500 (RFC 5321 4.5.3.1.4); AUTH lines may reach 12288")
+	maxLongLines   = flag.Int("max-long-lines", 3, "Over-long command lines a session may send before it is closed with 421 (0 never closes)")
+	bufferSize     = flag.Int("buffer-size", 32<<10, "Bytes read from a client or backend at a time, per direction of every session; at least the longest command line, 16384 or -max-line-length")
+
+	shutdownGrace = flag.Duration("shutdown-grace", 30*time.Second, "How long to wait for in-flight sessions on SIGINT/SIGTERM")
+
+	idleTimeout    = flag.Duration("idle-timeout", 5*time.Minute, "Close a session after this long without traffic (0 disables)")
+	sessionTimeout = flag.Duration("session-timeout", 30*time.Minute, "Maximum total session duration (0 disables)")
 )
 
-// Simulated PQC functions (in production, these would use liboqs/oqs-openssl)
-func getHybridTLSConfig() *tls.Config {
-	// In a real implementation, this would configure oqs-openssl with hybrid X25519 + ML-KEM768
-	// For this demo, we'll use standard TLS with a note about the hybrid config
-	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+// Milter for email signing. data is one complete, already un-stuffed message
+// as received between DATA and its terminating dot. An *smtpError refuses
+// the message with that reply. delivered, when not nil, is to be called once
+// the backend has accepted the message; it stores the receipt.
+func processMail(ctx context.Context, log *slog.Logger, env envelope, data []byte) (msg []byte, delivered func(), err error) {
+	// Under -observe this is what gets delivered, byte for byte
+	original := data
+
+	// The receipt is keyed by Message-ID, so make sure the delivered
+	// message carries the same one
+	msgID, ok := headerValue(data, "Message-ID")
+	if !ok {
+		msgID = newMessageID()
+		data = insertHeader(data, "Message-ID", msgID)
+	}
+
+	// Results claiming to be ours can only be forged; ours is added below
+	data, forged := removeOwnAuthResults(data)
+	if forged > 0 {
+		log.Warn("Removed Authentication-Results claiming to be from this gateway", "event", "auth_results_removed",
+			"message_id", msgID, "count", forged)
+	}
+
+	// Mail signed by an upstream gateway is checked before we add our own
+	result := checkReplay(log, msgID, verifyMessage(ctx, data))
+	if result.status != verifyNone {
+		log.Info("Verified inbound signature", "event", "signature_verified",
+			"message_id", msgID, "result", result.status, "alg", result.alg, "reason", result.reason)
+		if result.status == verifyFail && *rejectOnBadSig {
+			if !*observeOnly {
+				return nil, nil, &smtpError{550, "5.7.1 PQC signature verification failed"}
+			}
+			log.Info("Would reject message", "event", "observe_only", "message_id", msgID,
+				"reason", "PQC signature verification failed")
+		}
+		data = insertHeader(data, "Authentication-Results", result.header())
+	}
+	// Filters see what would be signed, so their header changes are covered
+	if data, err = runFilters(log, msgID, data); err != nil {
+		return nil, nil, err
+	}
+	data, resign := applyResignPolicy(log, msgID, data, result)
+	if !resign {
+		// Nothing of ours to vouch for, so no receipt
+		if *observeOnly {
+			return original, nil, nil
+		}
+		return data, nil, nil
+	}
+
+	signer := signerFor(env.mailFrom)
+	nonce := newNonce()
+	modified, signed, sig, err := signMessage(ctx, signer, msgID, nonce, data)
 	if err != nil {
-		// For demo purposes, generate a self-signed cert if files don't exist
-		log.Printf("Warning: Could not load TLS cert/key, would generate self-signed in production: %v", err)
-		// In production: Use oqs-openssl to generate hybrid certificates
+		log.Error("Failed to sign message", "event", "sign_failed", "message_id", msgID, "error", err)
+		stats.signingFailed()
+		switch {
+		case *observeOnly:
+			return original, nil, nil
+		case *failClosed:
+			return nil, nil, fmt.Errorf("%w: %w", errSigningFailed, err)
+		}
+		// Deliver unsigned rather than dropping the message
+		return data, nil, nil
 	}
+	log.Debug("Signed message", "event", "message_signed", "message_id", msgID,
+		"alg", signer.Algorithm(), "kid", signer.KeyID(), "format", *signatureFormat)
+	stats.messageSigned()
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			// In production: Would include hybrid cipher suites from oqs-openssl
-		},
-		MinVersion: tls.VersionTLS12,
+	// The signature isn't in the delivered message, so there is nothing for
+	// a receipt to vouch for
+	if *observeOnly {
+		log.Info("Delivering message unmodified", "event", "observe_only", "message_id", msgID)
+		return original, nil, nil
 	}
-}
 
-// Simulated ML-DSA (Dilithium) signature function
-func signWithDilithium(data []byte) []byte {
-	// In production: Would use liboqs to generate a Dilithium signature
-	// For demo, simulate with a placeholder
-	return []byte(fmt.Sprintf("DILITHIUM-SIGNATURE-%x", data[:8]))
+	r := messageReceipt(signer, msgID, nonce, env, sha256.Sum256(signed), sig)
+	delivered, err = vouch(ctx, log, msgID, env, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return modified, delivered, nil
 }
 
-// Milter for email signing
-func processMail(data []byte) []byte {
-	// Simple milter that adds a signature header to outgoing emails
-	lines := strings.Split(string(data), "\r\n")
-	hasSubject := false
-	modified := []string{}
+// vouch records the receipt of a signed message. Fail-closed waits for the
+// store so the client hears if it couldn't be kept; otherwise the receipt is
+// stored by the returned follow-up once the backend accepts the message.
+func vouch(ctx context.Context, log *slog.Logger, msgID string, env envelope, r Receipt) (delivered func(), err error) {
+	if audit != nil {
+		if err := audit.Record(r); err != nil {
+			log.Error("Failed to write audit log", "event", "audit_failed", "message_id", msgID, "error", err)
+		}
+	}
+	log.Debug("Storing receipt", "event", "receipt_store", "message_id", msgID, "hash", r.Hash,
+		"recipients", len(env.recipients))
 
-	for _, line := range lines {
-		modified = append(modified, line)
-		if strings.HasPrefix(line, "Subject:") {
-			hasSubject = true
+	// A receipt queued for retry counts as kept
+	if *failClosed {
+		if err := receipts.Store(ctx, r); err != nil {
+			log.Error("Failed to store receipt, refusing message", "event", "receipt_failed_closed",
+				"message_id", msgID, "error", err)
+			return nil, fmt.Errorf("%w: %w", errReceiptFailed, err)
 		}
+		return nil, nil
 	}
+	return func() { storeDeliveredReceipt(ctx, log, r) }, nil
+}
 
-	if hasSubject {
-		// Add PQC signature header after subject
-		sig := signWithDilithium(data)
-		modified = append(modified, fmt.Sprintf("X-PQC-Signature: %s", sig))
-		
-		// Store receipt
-		go storeReceipt(data, sig)
+// signMessage signs data as -signature-format says, returning the message
+// to deliver along with the bytes its receipt vouches for and their
+// signature. With both formats the header signature, made last, covers the
+// multipart/signed wrapping too; both carry nonce. A -dkim-key signature
+// is added before the header signature.
+func signMessage(ctx context.Context, signer Signer, msgID, nonce string, data []byte) (msg, signed, sig []byte, err error) {
+	msg = data
+	if *signatureFormat != formatHeader {
+		if msg, signed, sig, err = signMultipart(ctx, signer, msgID, nonce, msg); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	// DKIM goes on the message as delivered, for the header signature to
+	// cover in turn
+	if dkim != nil {
+		if msg, err = dkim.sign(msg, signedHeaderList()); err != nil {
+			return nil, nil, nil, fmt.Errorf("DKIM: %w", err)
+		}
+	}
+	if *signatureFormat == formatMultipart {
+		return msg, signed, sig, nil
 	}
 
-	return []byte(strings.Join(modified, "\r\n"))
+	// Sign the canonical form so transport munging doesn't break it
+	signedHeaders := signedHeaderList()
+	if signed, err = canonicalize(msg, canonRelaxed, signedHeaders); err != nil {
+		return nil, nil, nil, err
+	}
+	if sig, err = sign(ctx, signer, msgID, bindNonce(signed, nonce)); err != nil {
+		return nil, nil, nil, err
+	}
+	// Added at the end of the header block
+	header, err := formatSignatureHeader(signer.Algorithm(), signer.KeyID(), nonce, canonRelaxed, "", signedHeaders, sig)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("malformed signature header: %w", err)
+	}
+	return insertHeader(msg, "X-PQC-Signature", header), signed, sig, nil
+}
+
+// sign has signer sign data, traced and timed
+func sign(ctx context.Context, signer Signer, msgID string, data []byte) ([]byte, error) {
+	_, span := tracer.Start(ctx, "message.sign", trace.WithAttributes(
+		attrMessageID.String(msgID), attrAlgorithm.String(signer.Algorithm())))
+	start := time.Now()
+	sig, err := signer.Sign(ctx, data)
+	endSpan(span, err)
+	signingDuration.WithLabelValues(signer.Algorithm()).Observe(time.Since(start).Seconds())
+	return sig, err
 }
 
-// Store receipt in the receipts service
-func storeReceipt(data []byte, signature []byte) {
-	// In production: Would make an HTTP request to the receipts service
-	if *debug {
-		log.Printf("Would store receipt for email with signature: %s", signature)
+// messageReceipt builds the receipt for a signed message, given the
+// SHA-256 of the bytes it vouches for
+func messageReceipt(signer Signer, msgID, nonce string, env envelope, sum [sha256.Size]byte, signature []byte) Receipt {
+	r := receiptForSum(sum, signature, signer.Algorithm())
+	r.KeyID = signer.KeyID()
+	r.Nonce = nonce
+	r.MessageID = msgID
+	r.ClientIdentity = env.client
+	r.TLS = env.tls
+	r.Sender = env.mailFrom
+	for _, rcpt := range env.recipients {
+		r.Recipients = append(r.Recipients, rcpt)
+		r.RecipientStatus[rcpt] = recipientAccepted
+	}
+	for _, rcpt := range env.rejected {
+		r.RecipientStatus[rcpt] = recipientRejected
+	}
+	if receiptKey != nil {
+		r.MAC = r.mac(receiptKey)
+	}
+	return r
+}
+
+// Longest a delivered message's receipt is retried inline before it is
+// left to the retry queue
+const receiptStoreTimeout = time.Minute
+
+// Receipts of delivered messages still being stored, waited for on shutdown
+var receiptsInFlight sync.WaitGroup
+
+// storeDeliveredReceipt stores the receipt of a message the backend has
+// accepted. The session may be over by now, so the store is detached from
+// it with a deadline of its own.
+func storeDeliveredReceipt(ctx context.Context, log *slog.Logger, r Receipt) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), receiptStoreTimeout)
+	defer cancel()
+	if err := receipts.Store(ctx, r); err != nil {
+		log.Error("Failed to store receipt, dropping it", "event", "receipt_dropped",
+			"message_id", r.MessageID, "hash", r.Hash, "error", err)
 	}
-	
-	// Simple HTTP POST to receipts service (not implemented in this demo)
-	// client := &http.Client{Timeout: 5 * time.Second}
-	// _, err := client.Post(*receiptsURL + "/receipts", "application/json", bytes.NewBuffer(receiptData))
-	// if err != nil {
-	// 	log.Printf("Failed to store receipt: %v", err)
-	// }
 }
 
 // Handle SMTP proxy connection
-func handleConnection(clientConn net.Conn) {
+func handleConnection(clientConn net.Conn, startTLSConfig *tls.Config) {
 	defer clientConn.Close()
 
-	// Connect to backend Postfix server
-	backendConn, err := net.Dial("tcp", *postfixAddr)
+	// Every span of the session hangs off this one
+	sessionCtx, sessionSpan := tracer.Start(context.Background(), "smtp.session",
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer sessionSpan.End()
+
+	sessionID := newSessionID()
+	log := traceLogger(sessionCtx, sessionLogger(clientConn, "smtp", sessionID))
+	if !finishHandshake(log, clientConn) {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		sessionDuration.Observe(time.Since(start).Seconds())
+		log.Info("Connection closed", "event", "session_end", "duration", time.Since(start).String())
+	}()
+
+	// Connect to a backend Postfix server, the one routed for the TLS
+	// server name if there is one
+	pool, serverName := postfixBackends, ""
+	if router != nil {
+		serverName = clientServerName(clientConn)
+		if p := router.lookup(serverName); p != nil {
+			pool = p
+		}
+	}
+	_, dialSpan := tracer.Start(sessionCtx, "backend.dial")
+	conn, backend, reused, err := pool.connect(log)
+	dialSpan.SetAttributes(attrBackend.String(backend))
+	endSpan(dialSpan, err)
 	if err != nil {
-		log.Printf("Failed to connect to backend: %v", err)
+		log.Error("Failed to connect to backend", "event", "backend_dial_failed", "backend", *postfixAddr, "error", err)
+		connectionsFailed.Inc()
+		backendUnavailable(clientConn, "smtp")
 		return
 	}
-	defer backendConn.Close()
+	var greeting, xclientCmd []byte
+	if cmd := xclientCommand(clientConn); cmd != nil {
+		accepted := false
+		if greeting, accepted, err = sendXCLIENT(log, conn, cmd, reused); err != nil {
+			log.Error("Failed to pass client address to backend", "event", "backend_dial_failed", "backend", backend, "error", err)
+			conn.Close()
+			connectionsFailed.Inc()
+			backendUnavailable(clientConn, "smtp")
+			return
+		}
+		if accepted {
+			xclientCmd = cmd
+		}
+	}
+	if *greetingBanner != "" && !reused {
+		if greeting, err = ownGreeting(conn, greeting); err != nil {
+			log.Error("Failed to read backend greeting", "event", "backend_dial_failed", "backend", backend, "error", err)
+			conn.Close()
+			connectionsFailed.Inc()
+			backendUnavailable(clientConn, "smtp")
+			return
+		}
+	}
+	backendConn := newBackendLink(conn)
+
+	log.Info("New connection", "event", "session_start", "backend", backend, "reused", reused)
+
+	timer := newSessionTimer(log, clientConn, backendConn)
+	timer.touch()
+	writer := newBackendWriter(backendConn, timer)
+	session := newSMTPSession(log, clientConn, writer, timer, startTLSConfig)
+	session.span, session.id = sessionSpan, sessionID
+	session.link, session.pool, session.serverName = backendConn, pool, serverName
+	session.xclientCmd = xclientCmd
+	defer reportTraffic(log, clientConn, session)
+	if reused {
+		greeting = gatewayGreeting()
+	}
+	if greeting != nil {
+		if err := session.writeClient(greeting); err != nil {
+			if reused {
+				pool.put(conn)
+			} else {
+				conn.Close()
+			}
+			return
+		}
+	}
+
+	// The copy directions and the backend writer share one context; whichever
+	// stops first cancels the others so none of them outlives the session.
+	ctx, cancel := context.WithCancel(sessionCtx)
+	defer cancel()
 
-	log.Printf("New connection from %s", clientConn.RemoteAddr())
+	var wg sync.WaitGroup
+	wg.Add(3)
 
-	// Bidirectional copy with mail processing
 	go func() {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := clientConn.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading from client: %v", err)
-				}
-				break
+		defer wg.Done()
+		defer cancel()
+		if err := writer.run(ctx); err != nil && ctx.Err() == nil {
+			timer.logError("Error writing to backend", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		proxyClientToBackend(ctx, timer, session)
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		proxyBackendToClient(ctx, timer, session, backendConn)
+	}()
+
+	// Closing both sides unblocks whichever Read is still pending. With
+	// -backend-pool the backend read is interrupted instead, so a later
+	// session can have the connection.
+	<-ctx.Done()
+	clientConn.Close()
+	if pooling() {
+		backendConn.interrupt()
+		wg.Wait()
+		if conn := session.idleBackend(); conn != nil {
+			session.pool.put(conn)
+		} else {
+			backendConn.Close()
+		}
+	} else {
+		backendConn.Close()
+		wg.Wait()
+	}
+	if session.quit {
+		session.finalize()
+	}
+}
+
+// Copy client requests to the backend, applying the milter
+func proxyClientToBackend(ctx context.Context, timer *sessionTimer, session *smtpSession) {
+	buf := getReadBuffer()
+	defer putReadBuffer(buf)
+	for {
+		// The connection changes underneath us after STARTTLS
+		n, err := readSome(session.clientConn(), buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				timer.logReadError("client", err)
 			}
+			return
+		}
+		timer.touch()
+		stats.clientBytes(n)
 
-			// Process outgoing mail (apply milter)
-			processed := processMail(buf[:n])
-			
-			// Forward to backend
-			_, err = backendConn.Write(processed)
-			if err != nil {
-				log.Printf("Error writing to backend: %v", err)
-				break
+		// The session forwards commands and signed messages itself
+		if err := session.clientData(ctx, buf[:n]); err != nil {
+			if ctx.Err() == nil && !errors.Is(err, errSessionQuit) {
+				timer.logError("Error handling client data", err)
 			}
+			return
 		}
-	}()
+	}
+}
+
+// Copy backend responses to the client
+func proxyBackendToClient(ctx context.Context, timer *sessionTimer, session *smtpSession, backendConn net.Conn) {
+	buf := getReadBuffer()
+	defer putReadBuffer(buf)
+	for {
+		n, err := readSome(backendConn, buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				timer.logReadError("backend", err)
+			}
+			return
+		}
+		timer.touch()
+		stats.backendBytes(n)
+
+		// The session relays complete responses to the client itself
+		if err := session.backendData(buf[:n]); err != nil {
+			if ctx.Err() == nil && !errors.Is(err, errSessionQuit) {
+				timer.logError("Error handling backend data", err)
+			}
+			return
+		}
+	}
+}
+
+// Read buffers are pooled: every session needs two, and under connection
+// churn allocating them fresh dominates the garbage produced
+var readBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, *bufferSize)
+		return &buf
+	},
+}
+
+func getReadBuffer() []byte {
+	// One pooled before -buffer-size changed, in benchmarks, is dropped
+	if buf := *readBuffers.Get().(*[]byte); len(buf) == *bufferSize {
+		return buf
+	}
+	return make([]byte, *bufferSize)
+}
+
+func putReadBuffer(buf []byte) {
+	if len(buf) == *bufferSize {
+		readBuffers.Put(&buf)
+	}
+}
+
+// Idle and total-session deadlines shared by both copy directions
+type sessionTimer struct {
+	log         *slog.Logger
+	clientConn  net.Conn
+	backendConn net.Conn
+	idle        time.Duration
+	expires     time.Time // zero when there is no session limit
+}
+
+func newSessionTimer(log *slog.Logger, clientConn, backendConn net.Conn) *sessionTimer {
+	t := &sessionTimer{
+		log:         log,
+		clientConn:  clientConn,
+		backendConn: backendConn,
+		idle:        *idleTimeout,
+	}
+	if *sessionTimeout > 0 {
+		t.expires = time.Now().Add(*sessionTimeout)
+	}
+	return t
+}
+
+// next returns the deadline for the next I/O operation
+func (t *sessionTimer) next() time.Time {
+	var d time.Time
+	if t.idle > 0 {
+		d = time.Now().Add(t.idle)
+	}
+	if !t.expires.IsZero() && (d.IsZero() || t.expires.Before(d)) {
+		d = t.expires
+	}
+	return d
+}
+
+// touch refreshes the read deadline on both sides. Traffic in either
+// direction counts as activity, so a client streaming DATA doesn't trip the
+// idle timeout on the (silent) backend side.
+func (t *sessionTimer) touch() {
+	d := t.next()
+	t.clientConn.SetReadDeadline(d)
+	t.backendConn.SetReadDeadline(d)
+}
+
+// Zero-length reads in a row after which a connection is given up on, as
+// bufio does
+const maxEmptyReads = 100
+
+// readSome reads from r into buf, retrying reads that return nothing and
+// no error: they say nothing about the connection and mustn't count as
+// activity. One that keeps returning them fails with io.ErrNoProgress.
+func readSome(r io.Reader, buf []byte) (int, error) {
+	for i := 0; i < maxEmptyReads; i++ {
+		if n, err := r.Read(buf); n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.ErrNoProgress
+}
+
+// abruptClose reports whether err is peer ending the connection without a
+// clean close: a TCP reset or abort, or a TLS record cut short
+func abruptClose(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-	// Copy responses from backend to client
-	io.Copy(clientConn, backendConn)
+// logReadError reports why reading from peer, "client" or "backend",
+// stopped. A clean close is how sessions end, and a reset how plenty of
+// clients and load balancer checks leave, so neither is a warning;
+// timeouts and anything else are logError's.
+func (t *sessionTimer) logReadError(peer string, err error) {
+	switch {
+	case errors.Is(err, io.EOF):
+		t.log.Debug("Connection closed", "event", "connection_closed", "peer", peer)
+	case abruptClose(err):
+		t.log.Info("Connection reset", "event", "connection_reset", "peer", peer, "error", err)
+	default:
+		t.logError("Error reading from "+peer, err)
+	}
 }
 
-// Health check handler
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "PQC Gateway healthy\n")
-	fmt.Fprintf(w, "Using hybrid TLS: X25519 + ML-KEM768 (simulated)\n")
-	fmt.Fprintf(w, "Using ML-DSA (Dilithium) for signatures (simulated)\n")
+// logError reports a copy error, calling out deadline expiry explicitly
+func (t *sessionTimer) logError(msg string, err error) {
+	if errors.Is(err, errBackendStalled) {
+		backendStalls.Inc()
+		t.log.Warn("Closing connection", "event", "backend_stalled", "reason", err.Error(),
+			"timeout", backendStallTimeout.String())
+		return
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		reason := "idle timeout"
+		if !t.expires.IsZero() && !time.Now().Before(t.expires) {
+			reason = "session timeout"
+		}
+		t.log.Info("Closing connection", "event", "timeout", "reason", reason)
+		return
+	}
+	t.log.Warn(msg, "event", "io_error", "error", err)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(currentBuild())
+		return
+	}
+
+	if _, err := loadConfig(flag.CommandLine, *configFile); err != nil {
+		fatal("config_invalid", "Invalid configuration", err)
+	}
+	if err := setupLogging(*logLevel); err != nil {
+		fatal("config_invalid", "Invalid configuration", err)
+	}
+
+	s, err := newSigner(*sigAlg)
+	if err != nil {
+		fatal("signer_failed", "Failed to set up signer", err)
+	}
+	signingKeys.rotate(s)
+	if err := loadSenderKeys("startup"); err != nil {
+		fatal("signer_failed", "Failed to load sender domain signing keys", err)
+	}
+	go watchSigningKey(*sigKeyPoll)
+
+	shutdownTracing, err := setupTracing(context.Background(), *otelEndpoint)
+	if err != nil {
+		fatal("config_invalid", "Failed to set up tracing", err)
+	}
+
+	limiter = newConnLimiter(*maxConns, *ipRate, *ipBurst)
+	if *quotaLimit > 0 {
+		quota = newMemoryQuota(*quotaLimit, *quotaWindow)
+	}
+	verifyResults = newVerifyCache(*verifyCacheSize, *verifyCacheTTL)
+	replays = newReplayGuard(*replayWindow)
+	blocklists = newDNSBLChecker(splitList(*dnsblZones), net.DefaultResolver, *dnsblCacheTTL)
+	if recipientChecks, err = loadRecipientChecker(); err != nil {
+		fatal("config_invalid", "Invalid configuration", err)
+	}
+	acl, err := loadAccessList()
+	if err != nil {
+		fatal("config_invalid", "Invalid configuration", err)
+	}
+	clientACL.Store(acl)
+	if *aclFile != "" {
+		go watchAccessList(*aclPoll)
+	}
+	if proxySources, err = parsePrefixes(*proxyTrusted); err != nil {
+		fatal("config_invalid", "Invalid configuration", fmt.Errorf("-proxy-trusted: %w", err))
+	}
+	if verboseSources, err = parsePrefixes(*traceIP); err != nil {
+		fatal("config_invalid", "Invalid configuration", fmt.Errorf("-trace-ip: %w", err))
+	}
+	if *authUsers != "" {
+		users, err := loadAuthUsers(*authUsers)
+		if err != nil {
+			fatal("config_invalid", "Failed to load -auth-users", err)
+		}
+		authenticator = users
+	}
+	backendDialer = newBackendDialer()
+	if backendTLSConfig, err = newBackendTLSConfig(*backendTLS, *backendCA, *backendVerify); err != nil {
+		fatal("config_invalid", "Invalid configuration", err)
+	}
+	if backendTLSConfig != nil && *backendVerify == verifyNoCert {
+		slog.Warn("Backend certificates aren't checked, so relayed mail can be intercepted", "event", "backend_tls_unverified")
+	}
+	postfixBackends = newBackendPool(*postfixAddr)
+	if router, err = newBackendRouter(*backendRoutes); err != nil {
+		fatal("config_invalid", "Invalid configuration", fmt.Errorf("-routes: %w", err))
+	}
+	if *receiptKeyFile != "" {
+		if receiptKey, err = loadReceiptKey(*receiptKeyFile); err != nil {
+			fatal("config_invalid", "Failed to load -receipt-key", err)
+		}
+	}
+	if *receiptStoreKind == "file" {
+		store, err := openFileReceiptStore(*receiptFile)
+		if err != nil {
+			fatal("config_invalid", "Failed to open -receipt-file", err)
+		}
+		receipts = store
+	} else {
+		client := newReceiptClient(*receiptsURL)
+		go client.retryPending(*receiptRetry)
+		receipts = client
+	}
+
+	if types := splitList(*denyContentTypes); len(types) > 0 {
+		f, err := newContentTypeFilter(types)
+		if err != nil {
+			fatal("config_invalid", "Invalid configuration", fmt.Errorf("-deny-content-types: %w", err))
+		}
+		filters = append(filters, f)
+	}
+	if *dkimKeyFile != "" {
+		if dkim, err = loadDKIMSigner(*dkimKeyFile, *dkimDomain, *dkimSelector); err != nil {
+			fatal("config_invalid", "Failed to load -dkim-key", err)
+		}
+		slog.Info("Adding DKIM signatures", "event", "dkim_enabled", "domain", dkim.domain, "selector", dkim.selector,
+			"alg", dkim.alg, "record", dkim.record())
+	}
+	if *auditLogPath != "" {
+		if audit, err = openAuditLog(*auditLogPath); err != nil {
+			fatal("config_invalid", "Failed to open -audit-log", err)
+		}
+	}
 
 	// Start health check HTTP server
-	go func() {
-		http.HandleFunc("/health", healthHandler)
-		log.Printf("Health check server listening on :8080")
-		http.ListenAndServe(":8080", nil)
-	}()
+	var healthToken, apiToken string
+	if *healthTokenFile != "" {
+		if healthToken, err = loadAPIToken(*healthTokenFile); err != nil {
+			fatal("config_invalid", "Failed to load -health-token-file", err)
+		}
+	} else if !loopbackOnly(*healthListen) {
+		slog.Warn("Metrics and configuration served off-host without a token", "event", "health_open",
+			"addr", *healthListen)
+	}
+	if *receiptAPITokenFile != "" {
+		if apiToken, err = loadAPIToken(*receiptAPITokenFile); err != nil {
+			fatal("config_invalid", "Failed to load -receipt-api-token-file", err)
+		}
+	} else if *receiptAPI {
+		slog.Warn("Receipt API served without a token", "event", "receipt_api_open")
+	}
+	healthServer := newHealthServer(*healthListen, healthToken, apiToken)
+	healthListener, err := serveHealth(healthServer)
+	if err != nil {
+		fatal("listen_failed", "Failed to start health check server", err)
+	}
+	slog.Info("Health check server listening", "event", "listening", "addr", healthListener.Addr().String(),
+		"tls", *healthCert != "", "receipt_api", *receiptAPI)
 
 	// Create TLS listener
-	config := getHybridTLSConfig()
-	listener, err := tls.Listen("tcp", *listenAddr, config)
+	config, err := serverTLSConfig()
 	if err != nil {
-		// Fallback to non-TLS for demo purposes
-		log.Printf("Warning: Failed to create TLS listener, falling back to non-TLS: %v", err)
-		listener, err = net.Listen("tcp", *listenAddr)
-		if err != nil {
-			log.Fatalf("Failed to create listener: %v", err)
+		fatal("tls_unavailable", "Failed to set up TLS", err)
+	}
+	if config != nil {
+		go watchCertificate(*certPoll)
+		if !config.SessionTicketsDisabled && *tlsTicketRotation > 0 {
+			tickets, err := newTicketKeys(config)
+			if err != nil {
+				fatal("tls_unavailable", "Failed to generate a TLS session ticket key", err)
+			}
+			go tickets.run(*tlsTicketRotation)
 		}
 	}
+	// Client certificates are only asked of SMTP submission, not IMAP
+	smtpConfig := config
+	if *clientCA != "" {
+		if config == nil {
+			fatal("tls_unavailable", "-client-ca requires TLS", errors.New("no TLS certificate configured"))
+		}
+		if smtpConfig, err = requireClientCerts(config, *clientCA); err != nil {
+			fatal("config_invalid", "Failed to load client CA", err)
+		}
+	}
+
+	var listener net.Listener
+	var startTLSConfig *tls.Config
+	if *startTLS {
+		// Plaintext submission; clients upgrade with STARTTLS
+		listener = listen(*listenAddr)
+		if smtpConfig == nil {
+			slog.Warn("STARTTLS will not be offered", "event", "tls_unavailable")
+		}
+		startTLSConfig = smtpConfig
+	} else {
+		listener = listenTLS(*listenAddr, smtpConfig)
+	}
+
+	slog.Info("PQC Email Gateway listening", "event", "listening", "addr", *listenAddr, "backend", *postfixAddr,
+		"version", version, "commit", currentBuild().Commit)
+
+	draining.add(listener)
+	var servers sync.WaitGroup
+	servers.Add(1)
+	go func() {
+		defer servers.Done()
+		serve(listener, "smtp", smtpHandler(startTLSConfig))
+	}()
+
+	if *imapListenAddr != "" {
+		imapListener := listenTLS(*imapListenAddr, onlyALPN(config, alpnIMAP))
+		slog.Info("IMAP proxy listening", "event", "listening", "addr", *imapListenAddr, "backend", *dovecotAddr)
+		draining.add(imapListener)
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			serve(imapListener, "imap", handleIMAPConnection)
+		}()
+	}
+
+	// Stop accepting on SIGINT/SIGTERM and let in-flight sessions finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	signalled := stopOnSignal(stop)
+
+	servers.Wait()
+	// After a POST /drain the gateway waits, answering probes, to be told
+	// to exit
+	<-signalled
+	drainConnections(*shutdownGrace)
+	// Sessions are done, so no more receipts: deliver what is outstanding
+	receiptCtx, cancelReceipts := context.WithTimeout(context.Background(), *receiptDrain)
+	shutdownReceipts(receiptCtx)
+	cancelReceipts()
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			slog.Error("Failed to close audit log", "event", "audit_failed", "error", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "event", "tracing_flush_failed", "error", err)
+	}
+}
+
+// smtpHandler handles connections to the SMTP listener: implicit-TLS ones
+// that negotiated imap with -tls-alpn go to the IMAP proxy, the rest are
+// SMTP sessions
+func smtpHandler(startTLSConfig *tls.Config) func(net.Conn) {
+	handle := func(conn net.Conn) { handleConnection(conn, startTLSConfig) }
+	if protos, _ := parseALPN(*tlsALPN); *startTLS || !slices.Contains(protos, alpnIMAP) {
+		return handle
+	}
+	return byALPN(handle, map[string]func(net.Conn){alpnIMAP: handleIMAPConnection})
+}
+
+// Create an implicit-TLS listener, or a plaintext one when -require-tls=false
+// let startup continue without TLS
+func listenTLS(addr string, config *tls.Config) net.Listener {
+	if config == nil {
+		slog.Warn("No TLS configuration, falling back to non-TLS", "event", "tls_unavailable", "addr", addr)
+		return listen(addr)
+	}
+	return tls.NewListener(listen(addr), config)
+}
+
+// Create a plain TCP or Unix socket listener, reading PROXY headers first if
+// configured. TLS, when used, is layered on top so the header precedes the
+// handshake. A Unix listener removes its socket file when closed.
+func listen(addr string) net.Listener {
+	network, address := addrNetwork(addr)
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+	lc := net.ListenConfig{KeepAlive: *tcpKeepAlive, Control: reusePortControl()}
+	listener, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		fatal("listen_failed", "Failed to create listener", err)
+	}
+	if *proxyProtocol {
+		listener = newProxyListener(listener, proxySources)
+	}
+	return listener
+}
 
-	log.Printf("PQC Email Gateway listening on %s", *listenAddr)
-	log.Printf("Forwarding to Postfix at %s", *postfixAddr)
+// removeStaleSocket deletes a socket file left behind by a gateway that
+// didn't shut down cleanly, which would otherwise make listening fail. One
+// that is still answering, or a file that isn't a socket, is left for
+// Listen to report.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode().Type() != os.ModeSocket {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	if err := os.Remove(path); err == nil {
+		slog.Info("Removed stale socket", "event", "stale_socket_removed", "path", path)
+	}
+}
 
-	// Accept connections
+// Active proxied sessions, drained on shutdown
+var activeConns sync.WaitGroup
+
+// Accept connections until the listener is closed, turning away those over
+// the connection limits
+func serve(listener net.Listener, proto string, handle func(net.Conn)) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Error accepting connection", "event", "accept_failed", "error", err)
+			continue
+		}
+
+		if rule := clientACL.Load().denied(conn); rule != "" {
+			refuse(conn, proto, "access_denied", "rule", rule)
+			continue
+		}
+		release, reason := limiter.admit(conn)
+		if release == nil {
+			refuse(conn, proto, reason)
 			continue
 		}
-		go handleConnection(conn)
+
+		stats.connectionOpened()
+		activeConns.Add(1)
+		go func() {
+			defer activeConns.Done()
+			defer stats.connectionClosed()
+			defer release()
+			handle(conn)
+		}()
+	}
+}
+
+// stopOnSignal starts draining when a signal arrives on sigs, returning a
+// channel closed once it has
+func stopOnSignal(sigs <-chan os.Signal) <-chan struct{} {
+	signalled := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		if draining.start() {
+			slog.Info("No longer accepting connections", "event", "shutdown", "signal", sig.String())
+		}
+		close(signalled)
+	}()
+	return signalled
+}
+
+// Wait up to grace for in-flight sessions to finish
+func drainConnections(grace time.Duration) {
+	n := stats.active()
+	slog.Info("Draining active connections", "event", "drain_start", "active", n, "grace", grace.String())
+
+	done := make(chan struct{})
+	go func() {
+		activeConns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("Drained connections, shutting down", "event", "drain_done", "drained", n)
+	case <-time.After(grace):
+		slog.Warn("Grace period expired, shutting down", "event", "drain_timeout", "active", stats.active())
 	}
-}
\ No newline at end of file
+}
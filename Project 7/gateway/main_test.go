@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s, err := newSigner("ml-dsa-65")
+	if err != nil {
+		panic(err)
+	}
+	signingKeys.rotate(s)
+	receipts = &memReceiptStore{}
+	backendDialer = newBackendDialer()
+	os.Exit(m.Run())
+}
+
+// memReceiptStore keeps receipts in memory, or fails every Store with err.
+// Each Store call is also sent on calls, when set, so a test can wait for
+// receipts stored in the background.
+type memReceiptStore struct {
+	mu     sync.Mutex
+	byID   map[string]Receipt
+	err    error
+	ctxErr error
+	calls  chan Receipt
+}
+
+func (m *memReceiptStore) Store(ctx context.Context, r Receipt) error {
+	m.mu.Lock()
+	m.ctxErr = ctx.Err()
+	m.mu.Unlock()
+	if m.calls != nil {
+		defer func() { m.calls <- r }()
+	}
+	if m.err != nil {
+		return m.err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.byID == nil {
+		m.byID = map[string]Receipt{}
+	}
+	m.byID[r.MessageID] = r
+	return nil
+}
+
+// lastErr is the state of the context the last Store was given
+func (m *memReceiptStore) lastErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ctxErr
+}
+
+func (m *memReceiptStore) Get(ctx context.Context, id string) (Receipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.byID[id]; ok {
+		return r, nil
+	}
+	return Receipt{}, errReceiptNotFound
+}
+
+// brokenSigner fails every signature, like a signer whose key store is down
+type brokenSigner struct{}
+
+func (brokenSigner) Sign(ctx context.Context, data []byte) ([]byte, error) {
+	return nil, errors.New("signer unavailable")
+}
+func (brokenSigner) Algorithm() string { return "ml-dsa-65" }
+func (brokenSigner) KeyID() string     { return "" }
+
+// useSigner makes s the active key for the rest of the test
+func useSigner(t *testing.T, s Signer) {
+	old := currentSigner()
+	signingKeys.rotate(s)
+	t.Cleanup(func() { signingKeys.rotate(old) })
+}
+
+// useReceipts swaps the receipt store for the rest of the test, once
+// receipts from earlier sessions are stored
+func useReceipts(t *testing.T, store ReceiptStore) {
+	receiptsInFlight.Wait()
+	old := receipts
+	receipts = store
+	t.Cleanup(func() {
+		receiptsInFlight.Wait()
+		receipts = old
+	})
+}
+
+// setFlag sets a boolean flag for the rest of the test
+func setFlag(t *testing.T, flag *bool, v bool) {
+	old := *flag
+	*flag = v
+	t.Cleanup(func() { *flag = old })
+}
+
+var testMessage = []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+
+func TestProcessMailSigns(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, delivered, err := processMail(ctx, slog.Default(), envelope{mailFrom: "a@example.com"}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := headerValue(out, "X-PQC-Signature"); !ok {
+		t.Fatalf("no signature header in %q", out)
+	}
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Fatalf("signed message does not verify: %+v", r)
+	}
+	select {
+	case <-store.calls:
+		t.Fatal("receipt stored before the backend accepted the message")
+	default:
+	}
+
+	// The session may end as soon as the client has its 250
+	cancel()
+	delivered()
+	id, _ := headerValue(out, "Message-ID")
+	if r := <-store.calls; r.MessageID != id {
+		t.Errorf("receipt for %q, want %q", r.MessageID, id)
+	}
+	if err := store.lastErr(); err != nil {
+		t.Errorf("store saw %v", err)
+	}
+}
+
+func TestProcessMailSigningFailure(t *testing.T) {
+	useSigner(t, brokenSigner{})
+
+	t.Run("fail open", func(t *testing.T) {
+		setFlag(t, failClosed, false)
+		out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+		if err != nil {
+			t.Fatalf("fail-open refused the message: %v", err)
+		}
+		if _, ok := headerValue(out, "X-PQC-Signature"); ok {
+			t.Error("unsigned message carries a signature header")
+		}
+		if !bytes.HasSuffix(out, []byte("\r\n\r\nbody\r\n")) {
+			t.Errorf("body changed: %q", out)
+		}
+	})
+	t.Run("fail closed", func(t *testing.T) {
+		setFlag(t, failClosed, true)
+		_, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+		if !errors.Is(err, errSigningFailed) {
+			t.Fatalf("got %v, want errSigningFailed", err)
+		}
+		if r := smtpReplyFor(err); r.code != 451 || r.text[:5] != "4.7.0" {
+			t.Errorf("reply %d %s, want 451 4.7.0", r.code, r.text)
+		}
+	})
+}
+
+func TestProcessMailReceiptFailure(t *testing.T) {
+	useReceipts(t, &memReceiptStore{err: errors.New("receipt queue full (1)")})
+	setFlag(t, failClosed, true)
+
+	_, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if !errors.Is(err, errReceiptFailed) {
+		t.Fatalf("got %v, want errReceiptFailed", err)
+	}
+	if r := smtpReplyFor(err); r.code != 451 || r.text[:5] != "4.3.0" {
+		t.Errorf("reply %d %s, want 451 4.3.0", r.code, r.text)
+	}
+}
+
+// signingSamples reads how many Sign calls the latency histogram has seen
+// for alg
+func signingSamples(alg string) uint64 {
+	families, _ := metricsRegistry.Gather()
+	for _, f := range families {
+		if f.GetName() != "pqc_gateway_signing_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "algorithm" && l.GetValue() == alg {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestSigningDurationObserved(t *testing.T) {
+	before := signingSamples("ml-dsa-65")
+	if _, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if got := signingSamples("ml-dsa-65") - before; got != 1 {
+		t.Errorf("signing histogram gained %d samples for one message, want 1", got)
+	}
+}
+
+func TestObserveOnlyDeliversUnmodified(t *testing.T) {
+	setFlag(t, observeOnly, true)
+	b := &smtptest.Server{}
+	startFakeBackend(t, b)
+	signed, samples := stats.Snapshot().MessagesSigned, signingSamples("ml-dsa-65")
+
+	// Including a line the client had to dot-stuff
+	body := "From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\n\r\n.hidden\r\nbody\r\n"
+	c := dialGateway(t)
+	sendMessage(t, c, 250, body)
+	command(t, c, 221, "QUIT")
+
+	messages := b.Messages()
+	if len(messages) != 1 || messages[0] != body {
+		t.Fatalf("backend got %q, want exactly %q", messages, body)
+	}
+	if got := stats.Snapshot().MessagesSigned - signed; got != 1 {
+		t.Errorf("messages signed went up by %d, want 1", got)
+	}
+	if got := signingSamples("ml-dsa-65") - samples; got != 1 {
+		t.Errorf("signing histogram gained %d samples, want 1", got)
+	}
+}
+
+func TestSmallestBufferSize(t *testing.T) {
+	setFlags(t, map[string]string{"buffer-size": fmt.Sprint(maxCommandLine)})
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	// The longest line accepted takes two reads at most
+	auth := "AUTH PLAIN " + strings.Repeat("A", maxCommandLine-len("AUTH PLAIN \r\n"))
+	command(t, c, 250, auth)
+	body := testBody + strings.Repeat(strings.Repeat("x", 76)+"\r\n", 3*maxCommandLine/78)
+	sendMessage(t, c, 250, body)
+
+	if cmds := b.commands(); len(cmds) == 0 || cmds[0] != auth {
+		t.Error("AUTH line not relayed whole")
+	}
+	if msgs := b.messages(); len(msgs) != 1 || !strings.HasSuffix(msgs[0], body[len(testBody)-len("body\r\n"):]) {
+		t.Errorf("message not relayed whole")
+	}
+}
+
+// Read buffer sizes compared by BenchmarkBufferSize
+var benchBufferSizes = []int{16 << 10, 32 << 10, 64 << 10, 128 << 10, 256 << 10}
+
+// useBufferSize sets -buffer-size for the rest of the benchmark
+func useBufferSize(b *testing.B, size int) {
+	old := *bufferSize
+	*bufferSize = size
+	b.Cleanup(func() { *bufferSize = old })
+}
+
+// BenchmarkBufferSize measures throughput at each -buffer-size over
+// loopback: whole 1 MiB messages through an SMTP session to a backend, and
+// bytes relayed as the IMAP proxy does. Run with
+//
+//	go test -run '^$' -bench BufferSize -benchtime 3s
+//
+// On a single-core x86-64 VM, SMTP throughput is the same at every size
+// within run-to-run noise, signing and canonicalizing each message costing
+// far more than reading it. The relay gains a few percent at 64 and 128
+// KiB over 32 KiB and about 30% at 256 KiB. 32 KiB stays the default: the
+// two buffers of each session come to 64 MiB at -max-conns 1000, against
+// 512 MiB at 256 KiB, for no gain on the SMTP path.
+func BenchmarkBufferSize(b *testing.B) {
+	line := strings.Repeat("x", 76) + "\r\n"
+	msg := "From: a@example.com\r\nTo: b@example.com\r\nSubject: bench\r\n\r\n" +
+		strings.Repeat(line, (1<<20)/len(line)) + ".\r\n"
+
+	for _, size := range benchBufferSizes {
+		b.Run(fmt.Sprintf("smtp/%dKiB", size>>10), func(b *testing.B) {
+			useBufferSize(b, size)
+			backend := startTestBackend(b)
+			backend.forgets = true
+			conn := dialGatewayConn(b)
+			conn.SetDeadline(time.Time{})
+			c := textproto.NewConn(conn)
+			expect(b, c, 220)
+			command(b, c, 250, "EHLO client.example.com")
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				command(b, c, 250, "MAIL FROM:<a@example.com>")
+				command(b, c, 250, "RCPT TO:<b@example.com>")
+				command(b, c, 354, "DATA")
+				if _, err := io.WriteString(conn, msg); err != nil {
+					b.Fatal(err)
+				}
+				expect(b, c, 250)
+			}
+		})
+	}
+
+	chunk := bytes.Repeat([]byte(line), (1<<20)/len(line))
+	for _, size := range benchBufferSizes {
+		b.Run(fmt.Sprintf("relay/%dKiB", size>>10), func(b *testing.B) {
+			useBufferSize(b, size)
+			src, feed := loopbackPair(b)
+			dst, drain := loopbackPair(b)
+			go func() {
+				defer feed.Close()
+				for i := 0; i < b.N; i++ {
+					if _, err := feed.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+			done := make(chan int64)
+			go func() {
+				n, _ := io.Copy(io.Discard, drain)
+				done <- n
+			}()
+			timer := newSessionTimer(slog.Default(), src, dst)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			relay(context.Background(), timer, src, dst, "client", nil)
+			dst.Close()
+			if n := <-done; n != int64(b.N*len(chunk)) {
+				b.Fatalf("relayed %d bytes, want %d", n, b.N*len(chunk))
+			}
+		})
+	}
+}
+
+// loopbackPair returns the two ends of a loopback TCP connection
+func loopbackPair(b *testing.B) (net.Conn, net.Conn) {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { dialed.Close(); accepted.Close() })
+	return accepted, dialed
+}
+
+// emptyReader returns nothing, and no error, empties times before each of
+// its chunks
+type emptyReader struct {
+	empties int
+	chunks  []string
+	reads   int
+}
+
+func (r *emptyReader) Read(p []byte) (int, error) {
+	r.reads++
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if r.reads <= r.empties {
+		return 0, nil
+	}
+	r.reads = 0
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestReadSome(t *testing.T) {
+	buf := make([]byte, 16)
+	r := &emptyReader{empties: 3, chunks: []string{"EHLO", "QUIT"}}
+	for _, want := range []string{"EHLO", "QUIT"} {
+		if n, err := readSome(r, buf); err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %q, %v; want %q", buf[:n], err, want)
+		}
+	}
+	if _, err := readSome(r, buf); err != io.EOF {
+		t.Errorf("at the end: %v, want EOF", err)
+	}
+
+	stuck := &emptyReader{empties: maxEmptyReads + 1, chunks: []string{"never"}}
+	if _, err := readSome(stuck, buf); !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("reader stuck returning nothing: %v, want io.ErrNoProgress", err)
+	}
+}
+
+// endSession runs a gateway session in front of the test backend, has the
+// client end it with end, and returns what was logged once it is over
+func endSession(t *testing.T, end func(t *testing.T, c *textproto.Conn, conn *net.TCPConn)) string {
+	t.Helper()
+	startTestBackend(t)
+	logs := captureLogs(t, slog.LevelDebug, "")
+	c, conn, done := runSession(t)
+	expect(t, c, 220)
+	command(t, c, 250, "EHLO client.example.com")
+	end(t, c, conn)
+	waitSession(t, done)
+	return logs.String()
+}
+
+// runSession starts a gateway session on a connection of its own, like
+// dialGatewayConn, returning a channel closed when handleConnection returns
+func runSession(t *testing.T) (*textproto.Conn, *net.TCPConn, <-chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(conn, nil)
+		}
+	}()
+	t.Cleanup(func() { <-done })
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return textproto.NewConn(conn), conn.(*net.TCPConn), done
+}
+
+// waitSession fails unless the session ends soon
+func waitSession(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still running")
+	}
+}
+
+func TestSessionEndLogged(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		end   func(t *testing.T, c *textproto.Conn, conn *net.TCPConn)
+		event string // logged as the session ends; "" for none
+		level string
+	}{
+		{"quit", func(t *testing.T, c *textproto.Conn, conn *net.TCPConn) {
+			command(t, c, 221, "QUIT")
+		}, "", ""},
+		{"closed", func(t *testing.T, c *textproto.Conn, conn *net.TCPConn) {
+			conn.Close()
+		}, `"event":"connection_closed","peer":"client"`, "DEBUG"},
+		{"reset", func(t *testing.T, c *textproto.Conn, conn *net.TCPConn) {
+			conn.SetLinger(0)
+			conn.Close()
+		}, `"event":"connection_reset","peer":"client"`, "INFO"},
+		{"timeout", func(t *testing.T, c *textproto.Conn, conn *net.TCPConn) {
+			io.Copy(io.Discard, conn) // until the gateway gives up
+		}, `"event":"timeout","reason":"idle timeout"`, "INFO"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"idle-timeout": "100ms"})
+			out := endSession(t, tc.end)
+			for _, line := range strings.Split(out, "\n") {
+				if strings.Contains(line, `"level":"WARN"`) || strings.Contains(line, `"level":"ERROR"`) {
+					t.Errorf("logged %s", line)
+				}
+			}
+			if tc.event == "" {
+				return
+			}
+			i := strings.Index(out, tc.event)
+			if i < 0 {
+				t.Fatalf("no %s in:\n%s", tc.event, out)
+			}
+			start := strings.LastIndex(out[:i], "\n") + 1
+			if line := out[start:i]; !strings.Contains(line, `"level":"`+tc.level+`"`) {
+				t.Errorf("%s logged at the wrong level: %s", tc.event, line)
+			}
+		})
+	}
+}
+
+func TestBackendKilledMidStream(t *testing.T) {
+	b := &smtptest.Server{}
+	b.Inject("DATA", smtptest.Fault{Reply: "354 go ahead", HangUp: true, Reset: true})
+	startFakeBackend(t, b)
+	goroutines := runtime.NumGoroutine()
+
+	c, _, done := runSession(t)
+	expect(t, c, 220)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	// The backend is gone while the message streams in
+	w := c.DotWriter()
+	w.Write([]byte(testBody + strings.Repeat("more body\r\n", 1000)))
+	w.Close()
+	if code, msg, err := c.ReadResponse(0); err == nil || code/100 == 2 {
+		t.Errorf("got %d %s, %v after the backend went away; want the connection closed", code, msg, err)
+	}
+	waitSession(t, done)
+
+	// Neither copy direction nor the backend writer outlives the session
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines after the session, %d before", n, goroutines)
+	}
+}
+
+func TestIdleTimeoutClosesSession(t *testing.T) {
+	setFlags(t, map[string]string{"idle-timeout": "200ms"})
+	startTestBackend(t)
+	c, _, done := runSession(t)
+	expect(t, c, 220)
+
+	// Traffic keeps the session open past the timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		command(t, c, 250, "NOOP")
+	}
+	idle := time.Now()
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("read %v, want the gateway to close the connection", err)
+	}
+	if d := time.Since(idle); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Errorf("closed after %v idle, want 200ms", d)
+	}
+	waitSession(t, done)
+}
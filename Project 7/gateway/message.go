@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var myHostname = flag.String("myhostname", "", "Hostname the gateway names itself by, in the headers it adds, its own greetings and its 421 replies (default the system hostname)")
+
+// unstuffDots reverses SMTP transparency (RFC 5321 4.5.2): a line that
+// starts with "." had an extra dot prepended by the client, which we strip.
+// Bare LFs, which SMTP doesn't allow but some clients send anyway, become
+// CRLF so the header block ends where the header code looks for it.
+func unstuffDots(raw []byte) []byte {
+	var u dotUnstuffer
+	return u.unstuff(make([]byte, 0, len(raw)), raw)
+}
+
+// stuffDots re-applies SMTP transparency before a message goes back on the
+// wire, leaving room for the terminator the caller appends
+func stuffDots(msg []byte) []byte {
+	var st dotStuffer
+	return st.stuff(make([]byte, 0, len(msg)+len(msg)/64+len(".\r\n")), msg)
+}
+
+// dotUnstuffer is unstuffDots for a message arriving in pieces: it carries
+// where the last piece left off into the next
+type dotUnstuffer struct {
+	midLine bool // the last byte wasn't a line break
+	lastCR  bool // the last byte kept was a CR
+}
+
+// unstuff appends raw, unstuffed, to out
+func (u *dotUnstuffer) unstuff(out, raw []byte) []byte {
+	for _, c := range raw {
+		if !u.midLine && c == '.' {
+			u.midLine, u.lastCR = true, false
+			continue
+		}
+		if c == '\n' && !u.lastCR {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+		u.midLine, u.lastCR = c != '\n', c == '\r'
+	}
+	return out
+}
+
+// dotStuffer is stuffDots for a message sent in pieces
+type dotStuffer struct {
+	midLine bool // the last byte wasn't a line break
+}
+
+// stuff appends msg, stuffed, to out
+func (st *dotStuffer) stuff(out, msg []byte) []byte {
+	for _, c := range msg {
+		if !st.midLine && c == '.' {
+			out = append(out, '.')
+		}
+		out = append(out, c)
+		st.midLine = c != '\n'
+	}
+	return out
+}
+
+// headerEnd returns the offset just past the last header line, i.e. where the
+// blank separator line (if any) begins. A message with no body has its whole
+// length as the header block.
+func headerEnd(msg []byte) int {
+	if bytes.HasPrefix(msg, crlf) {
+		return 0
+	}
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		return i + len(crlf)
+	}
+	return len(msg)
+}
+
+// Header lines are folded to stay within this many characters where the
+// value has whitespace to break at (RFC 5322 2.1.1)
+const maxHeaderLine = 78
+
+// insertHeader adds a header line at the end of the message's header block.
+// Control characters in value, CR and LF included, become spaces so the
+// value can't end the field and start a header of its own, and long values
+// are folded.
+func insertHeader(msg []byte, name, value string) []byte {
+	end := headerEnd(msg)
+	var b bytes.Buffer
+	b.Grow(len(msg) + len(name) + len(value) + len(value)/maxHeaderLine*len(crlf) + 4)
+	b.Write(msg[:end])
+	if end > 0 && !bytes.HasSuffix(msg[:end], crlf) {
+		// Header-only message missing its final line break
+		b.Write(crlf)
+	}
+	writeFoldedHeader(&b, name, sanitizeHeaderValue(value))
+	b.Write(msg[end:])
+	return b.Bytes()
+}
+
+// sanitizeHeaderValue replaces control characters other than tab with
+// spaces. It goes byte by byte, so UTF-8 (RFC 6532), or any other 8-bit
+// text a client sent, comes through exactly as it was.
+func sanitizeHeaderValue(value string) string {
+	b := []byte(value)
+	for i, c := range b {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+// writeFoldedHeader writes "name: value" and its CRLF, breaking before a
+// space whenever the line would otherwise run past maxHeaderLine octets. A
+// word longer than a line is left whole rather than split, so a UTF-8
+// character is never cut.
+func writeFoldedHeader(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	b.WriteString(":")
+	col := len(name) + 1
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && col+1+len(word) > maxHeaderLine && col > 1 {
+			b.Write(crlf)
+			col = 0
+		}
+		b.WriteByte(' ')
+		b.WriteString(word)
+		col += 1 + len(word)
+	}
+	b.Write(crlf)
+}
+
+// headerField is one header from a message's header block
+type headerField struct {
+	Name  string
+	Raw   []byte // the whole field including continuation lines and CRLF
+	Start int    // offset of Raw in the message
+}
+
+// Value returns the unfolded field body with surrounding whitespace removed.
+// Only ASCII whitespace counts: a UTF-8 value keeps a trailing no-break
+// space, which bytes.TrimSpace would take.
+func (f headerField) Value() string {
+	// Name has any whitespace before the colon trimmed, so find the colon
+	v := f.Raw[bytes.IndexByte(f.Raw, ':')+1:]
+	v = bytes.ReplaceAll(v, crlf, nil)
+	return string(bytes.Trim(v, " \t\r\n"))
+}
+
+// parseHeaders splits a message's header block into fields, joining folded
+// continuation lines (those starting with a space or tab) onto their field
+func parseHeaders(msg []byte) []headerField {
+	block := msg[:headerEnd(msg)]
+	var fields []headerField
+	for offset := 0; len(block) > 0; {
+		n := bytes.Index(block, crlf)
+		if n < 0 {
+			n = len(block)
+		} else {
+			n += len(crlf)
+		}
+		line := block[:n]
+		block = block[n:]
+		start := offset
+		offset += n
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.Raw = last.Raw[:len(last.Raw)+len(line)]
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			// Not a header; keep going rather than guess at the boundary
+			continue
+		}
+		fields = append(fields, headerField{
+			Name:  string(bytes.TrimRight(line[:colon], " \t")),
+			Raw:   line,
+			Start: start,
+		})
+	}
+	return fields
+}
+
+// headerValue returns the first header with the given name (case-insensitive)
+func headerValue(msg []byte, name string) (string, bool) {
+	for _, f := range parseHeaders(msg) {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value(), true
+		}
+	}
+	return "", false
+}
+
+// removeHeader returns msg without the given field
+func removeHeader(msg []byte, f headerField) []byte {
+	out := make([]byte, 0, len(msg)-len(f.Raw))
+	out = append(out, msg[:f.Start]...)
+	return append(out, msg[f.Start+len(f.Raw):]...)
+}
+
+// newMessageID generates a Message-ID for messages that arrive without one
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b[:]), gatewayHostname())
+}
+
+// gatewayHostname names this gateway in headers it generates and, with
+// -rewrite-helo, to the backend
+func gatewayHostname() string {
+	if *myHostname != "" {
+		return *myHostname
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "pqc-gateway"
+	}
+	return host
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestUnstuffDots(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"a\r\n..b\r\n", "a\r\n.b\r\n"},
+		{".leading\r\n", "leading\r\n"},
+		{"mid.dle\r\n", "mid.dle\r\n"},
+		{"bare\nlf\n\nbody\n", "bare\r\nlf\r\n\r\nbody\r\n"},
+		{"mixed\r\nends\n..dot\n", "mixed\r\nends\r\n.dot\r\n"},
+	} {
+		if got := string(unstuffDots([]byte(tc.in))); got != tc.want {
+			t.Errorf("unstuffDots(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestInsertHeaderBareLF(t *testing.T) {
+	msg := unstuffDots([]byte("From: a@x\nSubject: hi\n\nbody line\n"))
+	out := insertHeader(msg, "X-PQC-Signature", "alg=ml-dsa-65; sig=abc")
+
+	want := "From: a@x\r\nSubject: hi\r\nX-PQC-Signature: alg=ml-dsa-65; sig=abc\r\n\r\nbody line\r\n"
+	if string(out) != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+	if v, ok := headerValue(out, "Subject"); !ok || v != "hi" {
+		t.Errorf("Subject = %q, %v", v, ok)
+	}
+}
+
+func TestInsertHeader(t *testing.T) {
+	for _, tc := range []struct{ name, in, want string }{
+		{"body", "A: 1\r\n\r\nbody\r\n", "A: 1\r\nX: v\r\n\r\nbody\r\n"},
+		{"no body", "A: 1\r\n", "A: 1\r\nX: v\r\n"},
+		{"no final CRLF", "A: 1", "A: 1\r\nX: v\r\n"},
+		{"no headers", "\r\nbody\r\n", "X: v\r\n\r\nbody\r\n"},
+	} {
+		if got := string(insertHeader([]byte(tc.in), "X", "v")); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseHeadersFolded(t *testing.T) {
+	msg := []byte("Subject: one\r\n two\r\nTo: b@x\r\n\r\nSubject: not a header\r\n")
+	fields := parseHeaders(msg)
+	if len(fields) != 2 {
+		t.Fatalf("got %d fields, want 2", len(fields))
+	}
+	if v := fields[0].Value(); v != "one two" {
+		t.Errorf("folded value = %q", v)
+	}
+	if got := removeHeader(msg, fields[0]); !bytes.HasPrefix(got, []byte("To: b@x\r\n")) {
+		t.Errorf("removeHeader left %q", got)
+	}
+}
+
+func TestHeaderValueSpaceBeforeColon(t *testing.T) {
+	msg := []byte("Subject : hello\r\nTo:\tb@x\r\n\r\n")
+	if v, ok := headerValue(msg, "Subject"); !ok || v != "hello" {
+		t.Errorf("Subject = %q, %v", v, ok)
+	}
+	if v, _ := headerValue(msg, "To"); v != "b@x" {
+		t.Errorf("To = %q", v)
+	}
+}
+
+// largeMessage is a message of about size bytes with dot-stuffed lines and
+// runs of whitespace, as a mail client might send
+func largeMessage(size int) []byte {
+	var b bytes.Buffer
+	b.WriteString("From: a@example.com\r\nTo: b@example.com\r\nSubject:  a   large\r\n\tmessage\r\n\r\n")
+	for b.Len() < size {
+		b.WriteString("..a stuffed line with  some \t whitespace runs, as quoted text has  \r\n")
+	}
+	return b.Bytes()
+}
+
+func BenchmarkUnstuffDots(b *testing.B) {
+	raw := largeMessage(1 << 20)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		unstuffDots(raw)
+	}
+}
+
+func TestInsertHeaderInjection(t *testing.T) {
+	msg := []byte("From: a@x\r\nSubject: hi\r\n\r\nbody\r\n")
+	for _, value := range []string{
+		"v\r\nBcc: victim@example.com",
+		"v\nBcc: victim@example.com",
+		"v\rBcc: victim@example.com",
+		"v\r\n\r\ninjected body",
+		"v\x00\x7f",
+	} {
+		out := insertHeader(msg, "X-PQC-Signature", value)
+		fields := parseHeaders(out)
+		if len(fields) != 3 || fields[2].Name != "X-PQC-Signature" {
+			t.Errorf("%q: header block became %q", value, out[:headerEnd(out)])
+			continue
+		}
+		unfolded := bytes.ReplaceAll(bytes.TrimSuffix(fields[2].Raw, crlf), []byte("\r\n "), []byte(" "))
+		if bytes.ContainsAny(unfolded, "\r\n\x00\x7f") {
+			t.Errorf("%q: control characters kept in %q", value, fields[2].Raw)
+		}
+		if !bytes.HasSuffix(out, []byte("\r\n\r\nbody\r\n")) {
+			t.Errorf("%q: body changed: %q", value, out)
+		}
+	}
+}
+
+func TestInsertHeaderFoldsLongValue(t *testing.T) {
+	sig := chunkSignature([]byte(strings.Repeat("QUJD", 200)))
+	out := insertHeader([]byte("From: a@x\r\n\r\nbody\r\n"), "X-PQC-Signature", "alg=ml-dsa-65; sig="+sig)
+	for _, line := range strings.Split(string(out[:headerEnd(out)]), "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("%d-character line %q", len(line), line)
+		}
+	}
+	v, _ := headerValue(out, "X-PQC-Signature")
+	if tags, err := parseSignatureHeader(v); err != nil || tags["sig"] != strings.Repeat("QUJD", 200) {
+		t.Errorf("folded signature doesn't parse back: %v", err)
+	}
+}
+
+func TestInsertHeaderUTF8(t *testing.T) {
+	msg := []byte("From: =?utf-8?q?J=C3=BCrgen?= <jürgen@bücher.example>\r\nSubject: Grüße – 你好\u00a0\r\n\r\nbody\r\n")
+	// Latin-1 too, which isn't UTF-8 but mustn't be turned into U+FFFD
+	value := strings.Repeat("Grüße 你好 ", 12) + "caf\xe9\u00a0"
+	out := insertHeader(msg, "X-Test", value)
+	if !bytes.HasPrefix(out, msg[:headerEnd(msg)]) {
+		t.Errorf("headers before changed: %q", out)
+	}
+	if got, _ := headerValue(out, "X-Test"); got != value {
+		t.Errorf("value %q, want %q", got, value)
+	}
+	for _, line := range strings.Split(string(out[:headerEnd(out)]), "\r\n") {
+		if !utf8.ValidString(strings.TrimSuffix(line, "caf\xe9\u00a0")) {
+			t.Errorf("folded inside a character: %q", line)
+		}
+	}
+	if v, _ := headerValue(out, "Subject"); v != "Grüße – 你好\u00a0" {
+		t.Errorf("Subject = %q", v)
+	}
+	if got := sanitizeHeaderValue("Grüße\r\n\x00你好\xe9"); got != "Grüße   你好\xe9" {
+		t.Errorf("sanitized to %q", got)
+	}
+}
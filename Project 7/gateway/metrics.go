@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus registry served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricsFactory = promauto.With(metricsRegistry)
+
+	connectionsRejected = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_connections_rejected_total",
+		Help: "Client connections refused by a limit, by reason (max_conns, rate_limit).",
+	}, []string{"reason"})
+	connectionsFailed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "pqc_gateway_connections_failed_total",
+		Help: "Client connections dropped because the backend was unreachable.",
+	})
+	backendQueueFull = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "pqc_gateway_backend_queue_full_total",
+		Help: "Times a session had to wait for room in its backend write queue.",
+	})
+	backendPoolConns = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_backend_pool_connections_total",
+		Help: "Pooled backend connections, by what became of them (reused, evicted after a failed RSET, expired).",
+	}, []string{"result"})
+	backendResends = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_backend_resends_total",
+		Help: "Messages whose backend connection failed before their end was written, by result (resent, failed); see -retry-backend.",
+	}, []string{"result"})
+	backendStalls = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "pqc_gateway_backend_stalls_total",
+		Help: "Sessions closed because the backend stopped accepting data.",
+	})
+	clientBytes = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_client_bytes_total",
+		Help: "SMTP bytes exchanged with clients, by client (see -client-bytes-metric) and direction (in, out).",
+	}, []string{"client", "direction"})
+	signatureVerifications = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_signature_verifications_total",
+		Help: "X-PQC-Signature headers checked, by result (pass, fail, permerror).",
+	}, []string{"result"})
+	verifyCacheLookups = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_verify_cache_lookups_total",
+		Help: "Verification cache lookups, by result (hit, miss).",
+	}, []string{"result"})
+	tlsHandshakeFailures = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_tls_handshake_failures_total",
+		Help: "Implicit-TLS client handshakes that failed, by reason (not_tls, timeout, closed, rejected).",
+	}, []string{"reason"})
+	signatureReplays = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "pqc_gateway_signature_replays_total",
+		Help: "Inbound signatures whose nonce was already seen within -replay-window.",
+	})
+	dnsblLookups = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_dnsbl_lookups_total",
+		Help: "Client DNS blocklist checks, by result (listed, clean, cached, error); see -dnsbl.",
+	}, []string{"result"})
+	recipientCallouts = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_recipient_callouts_total",
+		Help: "Recipient checks with the backend, by result (accepted, rejected, cached, error); see -recipient-callout.",
+	}, []string{"result"})
+	receiptFailures = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "pqc_gateway_receipt_store_failures_total",
+		Help: "Receipts that could not be stored after exhausting retries.",
+	})
+	filterActions = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "pqc_gateway_filter_actions_total",
+		Help: "Messages inspected by content filters, by filter and action (accept, reject, modify, error).",
+	}, []string{"filter", "action"})
+	receiptBreakerState = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "pqc_gateway_receipt_breaker_state",
+		Help: "Receipts service circuit breaker: 0 closed, 1 open (receipts queued without trying), 2 half-open (probing); see -receipt-breaker-failures.",
+	})
+	sessionDuration = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pqc_gateway_session_duration_seconds",
+		Help:    "Duration of proxied SMTP sessions.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 60, 300, 1800},
+	})
+	// PQC signing runs from well under a millisecond (ML-DSA, Falcon) to
+	// tens of milliseconds and more (SPHINCS+)
+	signingDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pqc_gateway_signing_duration_seconds",
+		Help:    "Time taken by each Sign call, by algorithm.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2.5, 12), // 100µs to ~2.4s
+	}, []string{"algorithm"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		statsCollector{stats},
+	)
+}
+
+// Metrics handler for the health server
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+var signatureFormat = flag.String("signature-format", formatHeader, "How the signature is attached: header (X-PQC-Signature), multipart (wrap the message as multipart/signed with a detached signature part) or both")
+
+// -signature-format values
+const (
+	formatHeader    = "header"
+	formatMultipart = "multipart"
+	formatBoth      = "both"
+)
+
+// Content type of the detached signature part, and the multipart/signed
+// protocol= naming it (RFC 1847)
+const pqcSignatureType = "application/pqc-signature"
+
+// signMultipart wraps data as multipart/signed (RFC 1847). The first part
+// is the original body with the Content-* headers that described it, byte
+// for byte, and is what the signature covers, with c=simple and nonce; the
+// second holds the signature in X-PQC-Signature's format. It returns the
+// wrapped message along with the signed part and the signature.
+func signMultipart(ctx context.Context, signer Signer, msgID, nonce string, data []byte) (msg, part, sig []byte, err error) {
+	end := headerEnd(data)
+	outer, inner := splitContentHeaders(data)
+	inner = append(inner, crlf...)
+	inner = append(inner, bytes.TrimPrefix(data[end:], crlf)...)
+	part = inner
+
+	if sig, err = sign(ctx, signer, msgID, bindNonce(part, nonce)); err != nil {
+		return nil, nil, nil, err
+	}
+	value, err := formatSignatureHeader(signer.Algorithm(), signer.KeyID(), nonce, canonSimple, "", nil, sig)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("malformed signature part: %w", err)
+	}
+	boundary, err := newBoundary(part)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	head, err := multipartHead(outer, signer.Algorithm(), boundary)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	head = append(head, part...)
+	return append(head, multipartTail(boundary, value)...), part, sig, nil
+}
+
+// splitContentHeaders splits a message's header fields between the
+// multipart/signed wrapper and its first part: the Content-* fields
+// describe the body and go with it, MIME-Version is dropped for the
+// wrapper's own, and the rest stay outside. inner, if not empty, ends in a
+// line break.
+func splitContentHeaders(data []byte) (outer, inner []byte) {
+	var o, i bytes.Buffer
+	for _, f := range parseHeaders(data) {
+		name := strings.ToLower(f.Name)
+		switch {
+		case strings.HasPrefix(name, "content-"):
+			i.Write(f.Raw)
+		case name != "mime-version":
+			o.Write(f.Raw)
+		}
+	}
+	if n := i.Len(); n > 0 && !bytes.HasSuffix(i.Bytes(), crlf) {
+		// Header-only message missing its final line break
+		i.Write(crlf)
+	}
+	return o.Bytes(), i.Bytes()
+}
+
+// multipartHead is the multipart/signed wrapper up to its first part: the
+// outer header fields, the wrapper's MIME headers and the first delimiter
+func multipartHead(outer []byte, alg, boundary string) ([]byte, error) {
+	contentType := mime.FormatMediaType("multipart/signed", map[string]string{
+		"protocol": pqcSignatureType,
+		"micalg":   strings.ToLower(alg),
+		"boundary": boundary,
+	})
+	if contentType == "" {
+		return nil, fmt.Errorf("algorithm %q can't be a micalg parameter", alg)
+	}
+
+	b := bytes.NewBuffer(append([]byte(nil), outer...))
+	if n := b.Len(); n > 0 && !bytes.HasSuffix(b.Bytes(), crlf) {
+		b.Write(crlf)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	writeFoldedHeader(b, "Content-Type", contentType)
+	b.WriteString("\r\nThis is a PQC-signed message in MIME format.\r\n\r\n--" + boundary + "\r\n")
+	return b.Bytes(), nil
+}
+
+// multipartTail ends the first part and adds the signature part holding
+// value
+func multipartTail(boundary, value string) []byte {
+	var b bytes.Buffer
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	b.WriteString("Content-Type: " + pqcSignatureType + "\r\n")
+	b.WriteString("Content-Disposition: attachment; filename=\"signature.pqc\"\r\n\r\n")
+	writeFoldedHeader(&b, "X-PQC-Signature", value)
+	b.WriteString("\r\n--" + boundary + "--\r\n")
+	return b.Bytes()
+}
+
+// newBoundary returns a random multipart boundary that doesn't occur in part
+func newBoundary(part []byte) (string, error) {
+	for {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		boundary := "pqc-" + hex.EncodeToString(b)
+		if !bytes.Contains(part, []byte("--"+boundary)) {
+			return boundary, nil
+		}
+	}
+}
+
+// signedPart finds the detached signature of a multipart/signed message
+// signMultipart made, returning the signed first part exactly as it
+// appears and the signature's X-PQC-Signature value
+func signedPart(msg []byte) (part []byte, value string, ok bool) {
+	ct, _ := headerValue(msg, "Content-Type")
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || mediaType != "multipart/signed" || !strings.EqualFold(params["protocol"], pqcSignatureType) || params["boundary"] == "" {
+		return nil, "", false
+	}
+	// Each part follows a delimiter line; the CRLF before a delimiter
+	// belongs to it, not to the part
+	delim := []byte("\r\n--" + params["boundary"])
+	line := append(delim, crlf...)
+	body := msg[headerEnd(msg):]
+	i := bytes.Index(body, line)
+	if i < 0 {
+		return nil, "", false
+	}
+	body = body[i+len(line):]
+	if i = bytes.Index(body, line); i < 0 {
+		return nil, "", false
+	}
+	part, sigPart := body[:i], body[i+len(line):]
+	if i = bytes.Index(sigPart, delim); i < 0 {
+		return nil, "", false
+	}
+	sigPart = sigPart[:i]
+
+	if ct, _ := headerValue(sigPart, "Content-Type"); !strings.EqualFold(strings.TrimSpace(ct), pqcSignatureType) {
+		return nil, "", false
+	}
+	value, ok = headerValue(bytes.TrimPrefix(sigPart[headerEnd(sigPart):], crlf), "X-PQC-Signature")
+	return part, value, ok
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+// useSignatureFormat sets -signature-format for the rest of the test
+func useSignatureFormat(t *testing.T, format string) {
+	old := *signatureFormat
+	*signatureFormat = format
+	t.Cleanup(func() { *signatureFormat = old })
+}
+
+const mimeBody = "line one  \r\n\r\n.leading dot\r\n=E2=9C=93 trailing\t\r\n"
+
+var mimeMessage = []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: mime\r\nMessage-ID: <mime@example.com>\r\n" +
+	"MIME-Version: 1.0\r\nContent-Type: text/plain;\r\n charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+	mimeBody)
+
+func TestSignMultipart(t *testing.T) {
+	useSignatureFormat(t, formatMultipart)
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	out, delivered, err := processMail(context.Background(), slog.Default(), envelope{}, mimeMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := headerValue(out, "X-PQC-Signature"); ok {
+		t.Error("signature header added with -signature-format multipart")
+	}
+	if n := bytes.Count(out, []byte("MIME-Version:")); n != 1 {
+		t.Errorf("%d MIME-Version headers", n)
+	}
+	if s, _ := headerValue(out, "Subject"); s != "mime" {
+		t.Errorf("Subject %q", s)
+	}
+	ct, _ := headerValue(out, "Content-Type")
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || mediaType != "multipart/signed" || params["protocol"] != pqcSignatureType ||
+		params["micalg"] != currentSigner().Algorithm() {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	parts := multipart.NewReader(bytes.NewReader(out[headerEnd(out):]), params["boundary"])
+	first, err := parts.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := first.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("first part Content-Type %q", ct)
+	}
+	if cte := first.Header.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Errorf("first part Content-Transfer-Encoding %q", cte)
+	}
+	if body, _ := io.ReadAll(first); string(body) != mimeBody {
+		t.Errorf("first part body %q, want %q", body, mimeBody)
+	}
+	second, err := parts.NextRawPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := second.Header.Get("Content-Type"); ct != pqcSignatureType {
+		t.Errorf("signature part Content-Type %q", ct)
+	}
+	if _, err := parts.NextRawPart(); err != io.EOF {
+		t.Errorf("more than two parts: %v", err)
+	}
+
+	part, _, ok := signedPart(out)
+	if !ok {
+		t.Fatal("signed part not found")
+	}
+	want := "Content-Type: text/plain;\r\n charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" + mimeBody
+	if string(part) != want {
+		t.Errorf("signed part %q, want %q", part, want)
+	}
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Errorf("verify: %+v", r)
+	}
+
+	// The receipt vouches for the signed part
+	delivered()
+	sum := sha256.Sum256(part)
+	if r := <-store.calls; r.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("receipt hash %s, want the signed part's", r.Hash)
+	}
+}
+
+func TestSignMultipartTampered(t *testing.T) {
+	useSignatureFormat(t, formatMultipart)
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, mimeMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(out, []byte("line one"), []byte("line 0ne"), 1)
+	if r := verifyMessage(context.Background(), tampered); r.status != verifyFail {
+		t.Errorf("tampered body part: %+v", r)
+	}
+}
+
+func TestSignMultipartPlainMessage(t *testing.T) {
+	useSignatureFormat(t, formatMultipart)
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No Content-* headers to carry over: the part starts with its blank line
+	if part, _, ok := signedPart(out); !ok || string(part) != "\r\nbody\r\n" {
+		t.Errorf("signed part %q", part)
+	}
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Errorf("verify: %+v", r)
+	}
+}
+
+func TestSignBothFormats(t *testing.T) {
+	useSignatureFormat(t, formatBoth)
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, mimeMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, _ := headerValue(out, "Content-Type"); !strings.HasPrefix(ct, "multipart/signed;") {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	// The header signature covers the wrapped message
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Errorf("header signature: %+v", r)
+	}
+	part, value, ok := signedPart(out)
+	if !ok {
+		t.Fatal("signed part not found")
+	}
+	if r := checkSignature(context.Background(), part, value); r.status != verifyPass {
+		t.Errorf("detached signature: %+v", r)
+	}
+}
+
+func TestSignedPartRejects(t *testing.T) {
+	for name, msg := range map[string]string{
+		"not multipart":  "Content-Type: text/plain\r\n\r\nbody\r\n",
+		"other protocol": "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=b\r\n\r\n--b\r\n\r\nbody\r\n--b\r\nContent-Type: application/pqc-signature\r\n\r\nX-PQC-Signature: alg=x; sig=y\r\n--b--\r\n",
+		"no second part": "Content-Type: multipart/signed; protocol=\"application/pqc-signature\"; boundary=b\r\n\r\n--b\r\n\r\nbody\r\n--b--\r\n",
+		"unterminated":   "Content-Type: multipart/signed; protocol=\"application/pqc-signature\"; boundary=b\r\n\r\n--b\r\n\r\nbody\r\n--b\r\nContent-Type: application/pqc-signature\r\n\r\nX-PQC-Signature: alg=x; sig=y\r\n",
+	} {
+		if _, _, ok := signedPart([]byte(msg)); ok {
+			t.Errorf("%s: signed part found", name)
+		}
+	}
+}
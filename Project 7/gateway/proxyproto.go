@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	proxyProtocol = flag.Bool("proxy-protocol", false, "Require a PROXY protocol v1/v2 header on SMTP and IMAP connections (behind a load balancer)")
+	proxyTrusted  = flag.String("proxy-trusted", "", "Comma-separated networks allowed to send PROXY headers, i.e. the load balancers (empty trusts any source)")
+)
+
+// Networks from -proxy-trusted, set up in main
+var proxySources []netip.Prefix
+
+// How long a client gets to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// PROXY protocol v2 signature (haproxy proxy-protocol.txt section 2.2)
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads the PROXY header of each accepted connection before
+// handing it out, so RemoteAddr reports the real client for logging and rate
+// limiting. Headers are read concurrently so one slow client can't hold up
+// the accept loop; connections with a malformed header are closed, as are
+// connections from outside trusted, which could otherwise claim any address.
+type proxyListener struct {
+	net.Listener
+	trusted   []netip.Prefix // empty trusts every source
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(ln net.Listener, trusted []netip.Prefix) net.Listener {
+	l := &proxyListener{
+		Listener: ln,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("Error accepting connection", "event", "accept_failed", "error", err)
+			continue
+		}
+		go func() {
+			if !l.trusts(conn) {
+				slog.Warn("Closing connection from untrusted PROXY source", "event", "proxy_source_untrusted",
+					"remote_addr", conn.RemoteAddr().String())
+				conn.Close()
+				return
+			}
+			pc, err := readProxyHeader(conn)
+			if err != nil {
+				slog.Warn("Closing connection with invalid PROXY header", "event", "proxy_header_invalid",
+					"remote_addr", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- pc:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// trusts reports whether conn may tell us who the client is
+func (l *proxyListener) trusts(conn net.Conn) bool {
+	if len(l.trusted) == 0 || unixPeer(conn) {
+		return true
+	}
+	addr, err := netip.ParseAddr(remoteIP(conn))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, p := range l.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection whose PROXY header has been consumed
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader // holds anything read past the header
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from conn. LOCAL and
+// UNKNOWN headers (health checks from the balancer itself) keep the
+// connection's own address.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	var remote net.Addr
+	var err error
+	if sig, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(sig, proxyV2Signature) {
+		remote, err = readProxyV2(r)
+	} else {
+		remote, err = readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6 src dst sport dport\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		return nil, errors.New("PROXY v1 header too long or not CRLF-terminated")
+	}
+
+	fields := strings.Split(string(line[:len(line)-len(crlf)]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("missing PROXY header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || net.ParseIP(fields[3]) == nil || err != nil {
+		return nil, errors.New("malformed PROXY v1 addresses")
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("PROXY %s header with address %s", fields[1], ip)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header: signature, version/command,
+// family/protocol, address length, then the addresses
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read PROXY header: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("read PROXY header: %w", err)
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %#x", hdr[12]&0x0f)
+	}
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// UDP or unix sockets: nothing useful to report
+		return nil, nil
+	}
+}
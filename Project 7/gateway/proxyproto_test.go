@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// headerConn is a connection whose peer sends in, then stops
+type headerConn struct {
+	remoteConn
+	r *bytes.Reader
+}
+
+func (c *headerConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *headerConn) SetReadDeadline(time.Time) error    { return nil }
+func (c *headerConn) Close() error                       { return nil }
+func (c *headerConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *headerConn) SetDeadline(t time.Time) error      { return nil }
+func (c *headerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func balancerConn(sent string) net.Conn {
+	return &headerConn{
+		remoteConn: remoteConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 50000}},
+		r:          bytes.NewReader([]byte(sent)),
+	}
+}
+
+// proxyV2 builds a v2 header with the given command, family and address block
+func proxyV2(cmd, fam byte, addrs []byte) string {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x20|cmd, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return string(append(h, addrs...))
+}
+
+func v4Block(src string, port uint16) []byte {
+	b := append(net.ParseIP(src).To4(), net.ParseIP("192.0.2.1").To4()...)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return binary.BigEndian.AppendUint16(b, 25)
+}
+
+func v6Block(src string, port uint16) []byte {
+	b := append(net.ParseIP(src).To16(), net.ParseIP("2001:db8::1").To16()...)
+	b = binary.BigEndian.AppendUint16(b, port)
+	return binary.BigEndian.AppendUint16(b, 25)
+}
+
+func TestReadProxyV1(t *testing.T) {
+	for _, tc := range []struct {
+		name, header, remote, err string
+	}{
+		{"tcp4", "PROXY TCP4 203.0.113.7 192.0.2.1 40001 25\r\n", "203.0.113.7:40001", ""},
+		{"tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 40001 25\r\n", "[2001:db8::7]:40001", ""},
+		{"unknown", "PROXY UNKNOWN\r\n", "10.0.0.5:50000", ""},
+		{"no header", "EHLO client.example.com\r\n", "", "missing PROXY header"},
+		{"bare LF", "PROXY TCP4 203.0.113.7 192.0.2.1 40001 25\n", "", "not CRLF-terminated"},
+		{"too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "too long"},
+		{"family mismatch", "PROXY TCP4 2001:db8::7 192.0.2.1 40001 25\r\n", "", "TCP4 header with address"},
+		{"bad port", "PROXY TCP4 203.0.113.7 192.0.2.1 70000 25\r\n", "", "malformed PROXY v1 addresses"},
+		{"missing field", "PROXY TCP4 203.0.113.7 192.0.2.1 40001\r\n", "", "malformed PROXY v1 header"},
+		{"udp", "PROXY UDP4 203.0.113.7 192.0.2.1 40001 25\r\n", "", "unsupported PROXY protocol"},
+		{"truncated", "PROXY TCP4 203.0.1", "", "EOF"},
+	} {
+		checkProxyHeader(t, tc.name, tc.header, tc.remote, tc.err)
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	full := proxyV2(0x1, 0x11, v4Block("203.0.113.7", 40001))
+	for _, tc := range []struct {
+		name, header, remote, err string
+	}{
+		{"tcp4", full, "203.0.113.7:40001", ""},
+		{"tcp6", proxyV2(0x1, 0x21, v6Block("2001:db8::7", 40001)), "[2001:db8::7]:40001", ""},
+		{"tlvs after addresses", proxyV2(0x1, 0x11, append(v4Block("203.0.113.7", 40001), 0x04, 0, 1, 'x')), "203.0.113.7:40001", ""},
+		{"local", proxyV2(0x0, 0x00, nil), "10.0.0.5:50000", ""},
+		{"udp", proxyV2(0x1, 0x12, v4Block("203.0.113.7", 40001)), "10.0.0.5:50000", ""},
+		{"truncated header", full[:14], "", "EOF"},
+		{"truncated addresses", full[:len(full)-4], "", "EOF"},
+		{"short ipv4 block", proxyV2(0x1, 0x11, make([]byte, 8)), "", "short PROXY v2 IPv4"},
+		{"short ipv6 block", proxyV2(0x1, 0x21, make([]byte, 12)), "", "short PROXY v2 IPv6"},
+		{"bad command", proxyV2(0x2, 0x11, v4Block("203.0.113.7", 40001)), "", "unsupported PROXY v2 command"},
+		{"bad version", strings.Replace(full, "\x21\x11", "\x11\x11", 1), "", "unsupported PROXY version 1"},
+	} {
+		checkProxyHeader(t, tc.name, tc.header, tc.remote, tc.err)
+	}
+}
+
+func checkProxyHeader(t *testing.T, name, header, remote, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		// Nothing follows, so a truncated header can't borrow bytes
+		_, err := readProxyHeader(balancerConn(header))
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: got %v, want error containing %q", name, err, wantErr)
+		}
+		return
+	}
+	conn, err := readProxyHeader(balancerConn(header + "EHLO x\r\n"))
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if got := conn.RemoteAddr().String(); got != remote {
+		t.Errorf("%s: remote %s, want %s", name, got, remote)
+	}
+	// The SMTP conversation after the header is left for the session
+	rest := make([]byte, 8)
+	if n, _ := conn.Read(rest); string(rest[:n]) != "EHLO x\r\n" {
+		t.Errorf("%s: left %q after the header", name, rest[:n])
+	}
+}
+
+func TestProxyListenerTrust(t *testing.T) {
+	l := &proxyListener{trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}}
+	for _, tc := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.5", true},
+		{"::ffff:10.0.0.5", true},
+		{"10.0.1.5", false},
+		{"203.0.113.7", false},
+		{"2001:db8::7", false},
+	} {
+		if got := l.trusts(connFrom(tc.ip)); got != tc.want {
+			t.Errorf("trusts(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+	if !(&proxyListener{}).trusts(connFrom("203.0.113.7")) {
+		t.Error("an empty -proxy-trusted should trust every source")
+	}
+}
+
+func TestProxyListenerClosesUntrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := newProxyListener(ln, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	defer pl.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 40001 25\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+		t.Fatalf("untrusted connection not closed: %d, %v", n, err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
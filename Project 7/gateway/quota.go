@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	quotaLimit  = flag.Int("quota", 0, "Messages each authenticated identity may send per -quota-window before MAIL FROM gets 452 (0 disables)")
+	quotaWindow = flag.Duration("quota-window", 24*time.Hour, "Rolling window -quota counts messages over")
+)
+
+// How long a quota check or update may take before the session goes on
+// without it
+const quotaTimeout = 5 * time.Second
+
+// Quota counts the messages each identity sends over a rolling window.
+// Allow and Record are separate calls, so sessions racing for an identity's
+// last message may each get one through.
+type Quota interface {
+	// Allow reports whether identity may send another message
+	Allow(ctx context.Context, identity string) (bool, error)
+	// Record counts a message sent by identity
+	Record(ctx context.Context, identity string) error
+}
+
+// Quota for -quota, set up in main; nil doesn't limit anyone
+var quota Quota
+
+// memoryQuota keeps each identity's send times in memory
+type memoryQuota struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time // time.Now, except in tests
+
+	mu        sync.Mutex
+	sent      map[string][]time.Time // oldest first
+	lastSweep time.Time
+}
+
+func newMemoryQuota(limit int, window time.Duration) *memoryQuota {
+	return &memoryQuota{
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+		sent:   map[string][]time.Time{},
+	}
+}
+
+func (q *memoryQuota) Allow(_ context.Context, identity string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.recent(identity, q.now())) < q.limit, nil
+}
+
+func (q *memoryQuota) Record(_ context.Context, identity string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.sweep(now)
+	q.sent[identity] = append(q.recent(identity, now), now)
+	return nil
+}
+
+// recent drops identity's sends that have left the window and returns the rest
+func (q *memoryQuota) recent(identity string, now time.Time) []time.Time {
+	times := q.sent[identity]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= q.window {
+		i++
+	}
+	if i == len(times) {
+		delete(q.sent, identity)
+		return nil
+	}
+	times = times[i:]
+	q.sent[identity] = times
+	return times
+}
+
+// sweep forgets identities with nothing left in the window, at most once a
+// minute
+func (q *memoryQuota) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < time.Minute {
+		return
+	}
+	q.lastSweep = now
+	for identity := range q.sent {
+		q.recent(identity, now)
+	}
+}
+
+// Reply to MAIL from an identity that has used up its -quota
+var errQuotaExceeded = &smtpError{452, "4.7.1 Message quota exceeded, try again later"}
+
+// overQuota reports whether the session's identity has used up its quota.
+// Unauthenticated sessions have no identity to count against, and a quota
+// that can't be checked lets the message through.
+func (s *smtpSession) overQuota(ctx context.Context) bool {
+	identity := s.clientIdentity()
+	if quota == nil || identity == "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, quotaTimeout)
+	defer cancel()
+	ok, err := quota.Allow(ctx, identity)
+	if err != nil {
+		s.log.Warn("Failed to check quota, allowing message", "event", "quota_failed", "client_identity", identity, "error", err)
+		return false
+	}
+	if !ok {
+		s.log.Info("Refusing message over quota", "event", "quota_exceeded", "client_identity", identity)
+	}
+	return !ok
+}
+
+// countMessage records a message the backend accepted against the
+// session's identity
+func (s *smtpSession) countMessage() {
+	identity := s.clientIdentity()
+	if quota == nil || identity == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), quotaTimeout)
+	defer cancel()
+	if err := quota.Record(ctx, identity); err != nil {
+		s.log.Warn("Failed to count message against quota", "event", "quota_failed", "client_identity", identity, "error", err)
+	}
+}
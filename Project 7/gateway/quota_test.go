@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestMemoryQuota(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	q := newMemoryQuota(2, time.Hour)
+	q.now = clock.Now
+	ctx := context.Background()
+
+	allowed := func(identity string) bool {
+		ok, err := q.Allow(ctx, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	q.Record(ctx, "alice")
+	clock.advance(30 * time.Minute)
+	q.Record(ctx, "alice")
+	if allowed("alice") {
+		t.Error("third message allowed within the window")
+	}
+	if !allowed("bob") {
+		t.Error("quota shared between identities")
+	}
+	// The first message leaves the window; the second hasn't yet
+	clock.advance(30 * time.Minute)
+	if !allowed("alice") {
+		t.Error("not allowed once the oldest message left the window")
+	}
+	q.Record(ctx, "alice")
+	if allowed("alice") {
+		t.Error("allowed past the quota in the rolling window")
+	}
+
+	clock.advance(2 * time.Hour)
+	q.Record(ctx, "bob")
+	if _, ok := q.sent["alice"]; ok {
+		t.Error("idle identity not swept")
+	}
+}
+
+// failingQuota can't be reached
+type failingQuota struct{}
+
+func (failingQuota) Allow(context.Context, string) (bool, error) {
+	return false, errors.New("quota store down")
+}
+func (failingQuota) Record(context.Context, string) error { return errors.New("quota store down") }
+
+func useQuota(t *testing.T, q Quota) {
+	old := quota
+	quota = q
+	t.Cleanup(func() { quota = old })
+}
+
+// authedSession is a session through STARTTLS, authenticated as alice
+func authedSession(t *testing.T) *textproto.Conn {
+	t.Helper()
+	c, conn := dialGatewaySTARTTLS(t)
+	c = upgrade(t, c, conn)
+	command(t, c, 235, "AUTH PLAIN "+b64("\x00alice\x00secret"))
+	return c
+}
+
+func TestSessionQuota(t *testing.T) {
+	users, err := loadAuthUsers(usersFile(t, "alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAuthenticator(t, users)
+	useQuota(t, newMemoryQuota(2, time.Hour))
+	b := startTestBackend(t)
+
+	c := authedSession(t)
+	for i := 0; i < 2; i++ {
+		sendMessage(t, c, 250, testBody)
+	}
+	// The third is refused before its envelope reaches the backend
+	command(t, c, 452, "MAIL FROM:<alice@example.com>")
+	command(t, c, 221, "QUIT")
+
+	// Counted per identity, across sessions
+	c = authedSession(t)
+	command(t, c, 452, "MAIL FROM:<alice@example.com>")
+	command(t, c, 221, "QUIT")
+
+	// Anonymous sessions aren't counted
+	c = dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+
+	if n := len(b.messages()); n != 3 {
+		t.Errorf("backend got %d messages, want 3", n)
+	}
+}
+
+func TestSessionQuotaRefusedMessageNotCounted(t *testing.T) {
+	users, err := loadAuthUsers(usersFile(t, "alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAuthenticator(t, users)
+	useQuota(t, newMemoryQuota(1, time.Hour))
+	startTestBackend(t)
+
+	c := authedSession(t)
+	sendMessage(t, c, 554, "Subject: reject me\r\n\r\nbody\r\n")
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 452, "MAIL FROM:<alice@example.com>")
+}
+
+func TestSessionQuotaUnavailable(t *testing.T) {
+	users, err := loadAuthUsers(usersFile(t, "alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useAuthenticator(t, users)
+	useQuota(t, failingQuota{})
+	startTestBackend(t)
+
+	c := authedSession(t)
+	sendMessage(t, c, 250, testBody)
+}
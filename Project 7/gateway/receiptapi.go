@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	receiptAPI          = flag.Bool("receipt-api", false, "Serve GET /receipts/ and POST /verify on the health port")
+	receiptAPITokenFile = flag.String("receipt-api-token-file", "", "File holding the bearer token -receipt-api requires (empty requires none)")
+)
+
+// Largest message POST /verify reads when -max-message-size is 0
+const maxVerifyBody = 64 << 20
+
+// loadAPIToken reads the receipt API's bearer token from path
+func loadAPIToken(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s: empty token", path)
+	}
+	return token, nil
+}
+
+// requireToken lets requests through to h only with "Authorization: Bearer
+// token". An empty token lets everything through.
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pqc-gateway"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// receiptHandler serves GET /receipts/{message-id}, looking the receipt up
+// in the receipt store. The angle brackets of the Message-ID are
+// optional.
+func receiptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/receipts/")
+	if id == "" {
+		http.Error(w, "missing message ID", http.StatusBadRequest)
+		return
+	}
+	receipt, err := receipts.Get(r.Context(), normalizeMessageID(id))
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, receipt.stored())
+}
+
+// verifyReport is the POST /verify response
+type verifyReport struct {
+	MessageID string `json:"message_id,omitempty"`
+	Signature string `json:"signature"` // pass, fail, none or permerror
+	Algorithm string `json:"algorithm,omitempty"`
+	Receipt   string `json:"receipt,omitempty"` // match, mismatch, tampered, not_found or unavailable; unset when unsigned
+	Valid     bool   `json:"valid"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// verifyHandler serves POST /verify: the body is a raw message as
+// delivered, and the report says whether its X-PQC-Signature validates and
+// matches the receipt stored when the gateway signed it
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := int64(maxVerifyBody)
+	if *maxMessageSize > 0 {
+		limit = int64(*maxMessageSize) + addedHeaderAllowance
+	}
+	msg, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	msg = normalizeLineEndings(msg)
+
+	result := verifyMessage(r.Context(), msg)
+	report := verifyReport{Signature: result.status, Algorithm: result.alg, Reason: result.reason}
+	report.MessageID, _ = headerValue(msg, "Message-ID")
+	if result.status == verifyNone {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	report.Receipt = "not_found"
+	if report.MessageID != "" {
+		report.Receipt = matchReceipt(r, msg, report.MessageID)
+	}
+	report.Valid = result.status == verifyPass && report.Receipt == "match"
+	writeJSON(w, http.StatusOK, report)
+}
+
+// matchReceipt compares the message's signature with its stored receipt:
+// the receipt records the hash of the signed canonical bytes, the signature
+// itself and its nonce. With -receipt-key, a receipt whose MAC doesn't check
+// out was altered or written by someone else, and is reported tampered.
+func matchReceipt(r *http.Request, msg []byte, msgID string) string {
+	receipt, err := receipts.Get(r.Context(), msgID)
+	switch {
+	case errors.Is(err, errReceiptNotFound):
+		return "not_found"
+	case err != nil:
+		slog.Warn("Failed to fetch receipt", "event", "receipt_fetch_failed", "message_id", msgID, "error", err)
+		return "unavailable"
+	}
+	if receiptKey != nil && !receipt.authentic(receiptKey) {
+		slog.Warn("Stored receipt fails its MAC", "event", "receipt_tampered", "message_id", msgID)
+		return "tampered"
+	}
+
+	data, value, _ := messageSignature(msg)
+	tags, err := parseSignatureHeader(value)
+	if err != nil {
+		return "mismatch"
+	}
+	signed, err := canonicalize(data, tags["c"], parseHeaderList(tags["h"]))
+	if err != nil {
+		return "mismatch"
+	}
+	sum := sha256.Sum256(signed)
+	if receipt.Hash != hex.EncodeToString(sum[:]) || receipt.Signature != tags["sig"] || receipt.Nonce != tags["n"] {
+		return "mismatch"
+	}
+	return "match"
+}
+
+// normalizeMessageID adds the angle brackets a Message-ID is stored with
+func normalizeMessageID(id string) string {
+	if !strings.HasPrefix(id, "<") {
+		id = "<" + id + ">"
+	}
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false) // Message-IDs are <...>
+	enc.Encode(v)
+}
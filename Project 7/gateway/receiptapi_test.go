@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// healthAPI serves the health port's handlers with the receipt API on
+// and one stored receipt
+func healthAPI(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+	setFlag(t, receiptAPI, true)
+	store := &memReceiptStore{}
+	store.Store(context.Background(), testReceipt())
+	useReceipts(t, store)
+	srv := httptest.NewServer(newHealthServer("", "", token).Handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, url, auth string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReceiptAPIOptIn(t *testing.T) {
+	srv := healthAPI(t, "")
+	if got := get(t, srv.URL+"/receipts/1@example.com", ""); got != http.StatusOK {
+		t.Errorf("with -receipt-api: %d", got)
+	}
+
+	setFlag(t, receiptAPI, false)
+	off := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer off.Close()
+	if got := get(t, off.URL+"/receipts/1@example.com", ""); got != http.StatusNotFound {
+		t.Errorf("without -receipt-api: %d", got)
+	}
+	if got := get(t, off.URL+"/live", ""); got != http.StatusOK {
+		t.Errorf("/live: %d", got)
+	}
+}
+
+func TestReceiptAPIToken(t *testing.T) {
+	srv := healthAPI(t, "s3cret")
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		if got := get(t, srv.URL+"/receipts/1@example.com", tc.auth); got != tc.want {
+			t.Errorf("Authorization %q: %d, want %d", tc.auth, got, tc.want)
+		}
+	}
+	// Probes stay open for the orchestrator
+	if got := get(t, srv.URL+"/live", ""); got != http.StatusOK {
+		t.Errorf("/live: %d", got)
+	}
+}
+
+func TestVerifyBodyLimit(t *testing.T) {
+	srv := healthAPI(t, "")
+	old := *maxMessageSize
+	*maxMessageSize = 1024
+	t.Cleanup(func() { *maxMessageSize = old })
+
+	for _, tc := range []struct {
+		size int
+		want int
+	}{
+		{100, http.StatusOK},
+		{1024 + addedHeaderAllowance + 1, http.StatusRequestEntityTooLarge},
+	} {
+		body := "Subject: hi\r\n\r\n" + strings.Repeat("x", tc.size)
+		resp, err := http.Post(srv.URL+"/verify", "message/rfc822", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%d byte body: %d, want %d", tc.size, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestHealthServerTimeouts(t *testing.T) {
+	s := newHealthServer(":8080", "", "")
+	for name, d := range map[string]time.Duration{
+		"ReadHeaderTimeout": s.ReadHeaderTimeout,
+		"ReadTimeout":       s.ReadTimeout,
+		"WriteTimeout":      s.WriteTimeout,
+	} {
+		if d <= 0 {
+			t.Errorf("%s unset", name)
+		}
+	}
+}
+
+func TestLoadAPIToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	os.WriteFile(path, []byte("s3cret\n"), 0o600)
+	if token, err := loadAPIToken(path); err != nil || token != "s3cret" {
+		t.Errorf("got %q, %v", token, err)
+	}
+	os.WriteFile(path, []byte("\n"), 0o600)
+	if _, err := loadAPIToken(path); err == nil {
+		t.Error("empty token accepted")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	receiptBatchSize     = flag.Int("receipt-batch-size", 0, "Receipts sent per POST /receipts/batch (0 sends each receipt on its own)")
+	receiptBatchInterval = flag.Duration("receipt-batch-interval", time.Second, "Longest a receipt waits for its batch to fill before it is sent anyway")
+)
+
+// Returned by add once the batcher has been closed for shutdown
+var errBatcherClosed = errors.New("receipt batcher closed")
+
+// receiptBatcher collects receipts and posts them together, when a batch
+// fills or when its oldest receipt has waited -receipt-batch-interval.
+// Only one batch is in flight at a time and the buffer holds one batch, so
+// while the service is slow, Store blocks and sessions slow down with it
+// instead of receipts piling up in memory.
+type receiptBatcher struct {
+	c        *receiptClient
+	size     int
+	interval time.Duration
+	in       chan Receipt
+	kick     chan struct{} // send what is batched now
+
+	mu     sync.RWMutex // held for reading while sending on in
+	closed bool
+	stop   context.Context // bounds the last flush, from close
+	done   chan struct{}   // closed when run has flushed everything
+	last   int             // receipts the last flush stored, once done
+}
+
+func newReceiptBatcher(c *receiptClient, size int, interval time.Duration) *receiptBatcher {
+	return &receiptBatcher{
+		c:        c,
+		size:     size,
+		interval: interval,
+		in:       make(chan Receipt, size),
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// add hands r to the next batch, waiting while the batcher is backed up. If
+// the session ends first, r goes to the retry queue like an undelivered
+// receipt would.
+func (b *receiptBatcher) add(ctx context.Context, r Receipt) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return errBatcherClosed
+	}
+	select {
+	case b.in <- r:
+		return nil
+	case <-ctx.Done():
+		slog.Debug("Session ended before receipt was batched, queueing", "event", "receipt_deferred",
+			"message_id", r.MessageID)
+		return b.c.enqueue(r)
+	}
+}
+
+// run collects batches until close, then sends what is left
+func (b *receiptBatcher) run() {
+	defer close(b.done)
+
+	batch := make([]Receipt, 0, b.size)
+	// A fresh timer per batch, so a stale tick can't cut the next one short
+	var timer *time.Timer
+	var due <-chan time.Time // set while a batch is waiting
+	for {
+		select {
+		case r, ok := <-b.in:
+			if !ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				b.last = b.flush(b.stop, batch)
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) == 1 {
+				timer = time.NewTimer(b.interval)
+				due = timer.C
+			}
+			if len(batch) < b.size {
+				continue
+			}
+			timer.Stop()
+		case <-b.kick:
+			// Receipts added before the flush was asked for may still be
+			// buffered
+			for n := len(b.in); n > 0 && len(batch) < b.size; n-- {
+				batch = append(batch, <-b.in)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-due:
+		}
+		timer, due = nil, nil
+		b.flush(context.Background(), batch)
+		batch = batch[:0]
+	}
+}
+
+// flush posts batch with the usual retry budget, giving up when ctx ends,
+// and queues its receipts for retryPending if the service stays
+// unavailable. It returns how many receipts it stored.
+func (b *receiptBatcher) flush(ctx context.Context, batch []Receipt) int {
+	if len(batch) == 0 {
+		return 0
+	}
+	err := b.c.withRetry(ctx, func(ctx context.Context) error {
+		return b.c.postBatch(ctx, batch)
+	})
+	if err == nil {
+		slog.Debug("Receipt batch stored", "event", "receipt_batch_stored", "count", len(batch))
+		return len(batch)
+	}
+	switch {
+	case errors.Is(err, errReceiptRejected):
+		receiptFailures.Add(float64(len(batch)))
+		b.c.drop(batch, err)
+		return 0
+	case errors.Is(err, errBreakerOpen):
+		slog.Debug("Receipts service circuit open, queueing batch", "event", "receipt_deferred", "count", len(batch))
+		b.c.hold(batch)
+		return 0
+	}
+	slog.Warn("Failed to store receipt batch, queueing", "event", "receipt_failed",
+		"count", len(batch), "attempts", b.c.attempts, "error", err)
+	receiptFailures.Add(float64(len(batch)))
+	b.c.requeue(batch)
+	return 0
+}
+
+// flushNow has the receipts batched so far sent without waiting for the
+// batch to fill
+func (b *receiptBatcher) flushNow() {
+	select {
+	case b.kick <- struct{}{}:
+	default:
+		// A flush is already due
+	}
+}
+
+// close stops accepting receipts and sends the last batch, partly filled
+// as it may be, trying no longer than ctx allows; what isn't stored by then
+// is queued. It returns how many receipts the last batch stored.
+func (b *receiptBatcher) close(ctx context.Context) int {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		b.stop = ctx
+		close(b.in)
+	}
+	b.mu.Unlock()
+	<-b.done
+	return b.last
+}
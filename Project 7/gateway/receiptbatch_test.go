@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchService is a receipts service recording the size of each batch
+// posted to it, answering with status, for a client batching size receipts
+// for up to interval
+func batchService(t *testing.T, status int, size, interval string) (*receiptClient, func() []int) {
+	t.Helper()
+	setFlags(t, map[string]string{"receipt-batch-size": size, "receipt-batch-interval": interval})
+	var mu sync.Mutex
+	var batches []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payloads []receiptPayload
+		if r.URL.Path != "/receipts/batch" || json.NewDecoder(r.Body).Decode(&payloads) != nil {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+		mu.Lock()
+		batches = append(batches, len(payloads))
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	c, _ := receiptService(t, status, "")
+	c.url = srv.URL
+	return c, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), batches...)
+	}
+}
+
+func TestShutdownFlushesPartialBatch(t *testing.T) {
+	c, batches := batchService(t, http.StatusCreated, "10", "1h")
+	logs := captureLogs(t, slog.LevelInfo, "")
+	for i := 0; i < 3; i++ {
+		if err := c.Store(context.Background(), testReceipt()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := batches(); len(got) != 0 {
+		t.Fatalf("batches %v posted before shutdown", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := batches(); len(got) != 1 || got[0] != 3 {
+		t.Errorf("batches %v, want one of 3", got)
+	}
+	if !strings.Contains(logs.String(), `"event":"receipts_flushed","flushed":3,"dropped":0`) {
+		t.Errorf("no receipts_flushed log in %s", logs)
+	}
+}
+
+func TestShutdownDropsBatchAtDeadline(t *testing.T) {
+	c, batches := batchService(t, http.StatusServiceUnavailable, "10", "1h")
+	// The retries alone would outlast the deadline
+	c.backoff = time.Hour
+	logs := captureLogs(t, slog.LevelInfo, "")
+	for i := 0; i < 3; i++ {
+		if err := c.Store(context.Background(), testReceipt()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want the deadline", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Shutdown took %v", d)
+	}
+	if got := batches(); len(got) == 0 || got[0] != 3 {
+		t.Errorf("batches %v, want the 3 tried", got)
+	}
+	if !strings.Contains(logs.String(), `"event":"receipts_unsent","flushed":0,"dropped":3`) {
+		t.Errorf("no receipts_unsent log in %s", logs)
+	}
+}
+
+// waitBatches waits for the service to have been posted n batches
+func waitBatches(t *testing.T, batches func() []int, n int) []int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(batches()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return batches()
+}
+
+func TestBatchFlushesWhenFull(t *testing.T) {
+	c, batches := batchService(t, http.StatusCreated, "3", "1h")
+	for i := 0; i < 7; i++ {
+		if err := c.Store(context.Background(), testReceipt()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := waitBatches(t, batches, 2); !slices.Equal(got, []int{3, 3}) {
+		t.Fatalf("batches %v, want two full ones", got)
+	}
+	// The seventh waits for its batch to fill, or the hour to pass
+	time.Sleep(50 * time.Millisecond)
+	if got := batches(); len(got) != 2 {
+		t.Errorf("batches %v, want the partial one held back", got)
+	}
+}
+
+func TestBatchFlushesAtInterval(t *testing.T) {
+	c, batches := batchService(t, http.StatusCreated, "10", "50ms")
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := c.Store(context.Background(), testReceipt()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := waitBatches(t, batches, 1); !slices.Equal(got, []int{2}) {
+		t.Fatalf("batches %v, want the 2 receipts sent", got)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("batch sent after %v, before the interval", d)
+	}
+
+	// The timer starts again with the next batch's first receipt
+	if err := c.Store(context.Background(), testReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if got := waitBatches(t, batches, 2); !slices.Equal(got, []int{2, 1}) {
+		t.Errorf("batches %v, want the third receipt sent on its own", got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	receiptBreakerFailures = flag.Int("receipt-breaker-failures", 5, "Consecutive failed requests to the receipts service that open its circuit breaker, so receipts wait in the in-memory -receipt-queue without trying it, lost if the gateway restarts meanwhile (0 disables)")
+	receiptBreakerCooldown = flag.Duration("receipt-breaker-cooldown", 30*time.Second, "How long the receipts circuit breaker stays open before one request is let through to probe the service")
+)
+
+// Returned instead of trying the receipts service while its breaker is open.
+// The receipt then waits in the client's in-memory retry queue: with
+// -receipt-store=http there is no local store to fall back to.
+var errBreakerOpen = errors.New("receipts service circuit breaker open")
+
+// Circuit breaker states, as the pqc_gateway_receipt_breaker_state gauge
+// reports them
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // requests go through
+	breakerOpen                         // requests fail fast until the cooldown ends
+	breakerHalfOpen                     // one probe request is out
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops receipts going to a service that keeps failing:
+// after threshold failures in a row it opens, and every request fails fast
+// with errBreakerOpen for the cooldown. The first request after that is
+// the probe: its success closes the breaker, its failure opens it again.
+// The retry queue's periodic pass means the probe comes even with no mail.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time // time.Now, except in tests
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive, while closed
+	openedAt time.Time // when it last opened
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	receiptBreakerState.Set(float64(breakerClosed))
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a request may be made, errBreakerOpen if not
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return errBreakerOpen
+		}
+		b.set(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// Only the probe goes through
+		return errBreakerOpen
+	}
+	return nil
+}
+
+// record takes the outcome of a request allow let through. failed is
+// false for one the service answered, even with a rejection.
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !failed:
+		if b.state != breakerClosed {
+			slog.Info("Receipts service is back, closing circuit breaker", "event", "receipt_breaker_closed")
+		}
+		b.failures = 0
+		b.set(breakerClosed)
+	case b.state == breakerHalfOpen:
+		b.open()
+	default:
+		if b.failures++; b.failures >= b.threshold {
+			b.open()
+		}
+	}
+}
+
+// abandon takes back a request allow let through that ended with its
+// caller rather than an answer: it says nothing about the service, but a
+// probe cut short is owed another
+func (b *circuitBreaker) abandon() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		// Still past the cooldown, so the next request probes
+		b.set(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) open() {
+	if b.state == breakerClosed {
+		slog.Warn("Receipts service keeps failing, opening circuit breaker", "event", "receipt_breaker_open",
+			"failures", b.failures, "cooldown", b.cooldown.String())
+	}
+	b.failures = 0
+	b.openedAt = b.now()
+	b.set(breakerOpen)
+}
+
+func (b *circuitBreaker) set(s breakerState) {
+	b.state = s
+	receiptBreakerState.Set(float64(s))
+}
+
+// current returns the breaker's state
+func (b *circuitBreaker) current() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = clock.Now
+
+	check := func(want breakerState) {
+		t.Helper()
+		if got := b.current(); got != want {
+			t.Fatalf("state %v, want %v", got, want)
+		}
+	}
+
+	// A success in between starts the count again
+	for _, failed := range []bool{true, true, false, true, true} {
+		if err := b.allow(); err != nil {
+			t.Fatalf("allow = %v while closed", err)
+		}
+		b.record(failed)
+	}
+	check(breakerClosed)
+	b.record(true)
+	check(breakerOpen)
+
+	clock.advance(time.Minute - time.Second)
+	if err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("allow = %v during the cooldown", err)
+	}
+	clock.advance(time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow = %v after the cooldown", err)
+	}
+	check(breakerHalfOpen)
+	if err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("allow = %v with the probe out", err)
+	}
+
+	// A failed probe starts another cooldown
+	b.record(true)
+	check(breakerOpen)
+	if err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("allow = %v after a failed probe", err)
+	}
+
+	// A probe cut short leaves the next request to probe
+	clock.advance(time.Minute)
+	b.allow()
+	b.abandon()
+	check(breakerOpen)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow = %v after an abandoned probe", err)
+	}
+	b.record(false)
+	check(breakerClosed)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.record(true)
+	}
+	if err := b.allow(); err != nil {
+		t.Errorf("allow = %v with the breaker disabled", err)
+	}
+}
+
+func TestReceiptClientBreaker(t *testing.T) {
+	var posts atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	setFlags(t, map[string]string{"receipt-breaker-failures": "3", "receipt-breaker-cooldown": "1m"})
+	c, _ := receiptService(t, 201, `{}`)
+	c.url = srv.URL
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	c.breaker.now = clock.Now
+
+	// The first receipt's attempts open the breaker; the second isn't tried
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if err := c.Store(context.Background(), testReceipt()); err != nil {
+			t.Fatalf("Store = %v", err)
+		}
+		if i == 1 && time.Since(start) > 50*time.Millisecond {
+			t.Errorf("Store took %v with the breaker open", time.Since(start))
+		}
+	}
+	if got := posts.Load(); got != 3 {
+		t.Errorf("%d POSTs, want 3", got)
+	}
+	if got := len(c.pending); got != 2 {
+		t.Fatalf("%d queued, want 2", got)
+	}
+
+	// The service recovers, but nothing goes to it until the cooldown ends
+	status.Store(http.StatusCreated)
+	if c.drainPending(context.Background()) {
+		t.Error("queue drained with the breaker open")
+	}
+	if got := posts.Load(); got != 3 {
+		t.Errorf("%d POSTs during the cooldown, want 3", got)
+	}
+	for i := 0; i < 2; i++ {
+		r := <-c.pending
+		if r.retries != 0 {
+			t.Errorf("held receipt counted %d retries", r.retries)
+		}
+		c.pending <- r
+	}
+
+	clock.advance(time.Minute)
+	if !c.drainPending(context.Background()) {
+		t.Fatal("queue not drained after the cooldown")
+	}
+	if got := posts.Load(); got != 5 {
+		t.Errorf("%d POSTs, want 5", got)
+	}
+	if got := c.breaker.current(); got != breakerClosed {
+		t.Errorf("breaker %v after the probe succeeded, want closed", got)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useReceiptKey authenticates receipts with key for the test
+func useReceiptKey(t *testing.T, key string) {
+	old := receiptKey
+	receiptKey = []byte(key)
+	t.Cleanup(func() { receiptKey = old })
+}
+
+// verifyReceipt posts msg to /verify and returns the report
+func verifyReceipt(t *testing.T, msg []byte) verifyReport {
+	t.Helper()
+	setFlag(t, receiptAPI, true)
+	srv := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/verify", "message/rfc822", bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report verifyReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestReceiptMAC(t *testing.T) {
+	r := testReceipt()
+	r.MAC = r.mac([]byte("0123456789abcdef"))
+	if !r.authentic([]byte("0123456789abcdef")) {
+		t.Error("receipt fails its own MAC")
+	}
+	if r.authentic([]byte("another key, same length")) {
+		t.Error("MAC checks out under another key")
+	}
+	stored := r.stored().receipt()
+	if !stored.authentic([]byte("0123456789abcdef")) {
+		t.Error("MAC lost in the stored form")
+	}
+	stored.Sender = "forger@example.com"
+	if stored.authentic([]byte("0123456789abcdef")) {
+		t.Error("altered receipt checks out")
+	}
+	if r := testReceipt(); r.authentic([]byte("0123456789abcdef")) {
+		t.Error("receipt without a MAC checks out")
+	}
+}
+
+func TestVerifyTamperedReceipt(t *testing.T) {
+	useReceiptKey(t, "0123456789abcdef")
+	setFlag(t, failClosed, true)
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	store, err := openFileReceiptStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Shutdown(context.Background()) })
+	useReceipts(t, store)
+
+	msg := []byte("Message-ID: <mac@example.com>\r\nFrom: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	env := envelope{mailFrom: "a@example.com", recipients: []string{"b@example.com"}}
+	out, _, err := processMail(context.Background(), slog.Default(), env, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := verifyReceipt(t, out); report.Receipt != "match" || !report.Valid {
+		t.Fatalf("untouched receipt: %+v", report)
+	}
+
+	// Redirect the receipt to another recipient, as someone with write
+	// access to the store might
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := bytes.ReplaceAll(b, []byte("b@example.com"), []byte("c@example.com"))
+	if bytes.Equal(forged, b) {
+		t.Fatalf("recipient not in stored receipt %q", b)
+	}
+	if err := os.WriteFile(path, forged, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if report := verifyReceipt(t, out); report.Receipt != "tampered" || report.Valid {
+		t.Errorf("tampered receipt: %+v", report)
+	}
+
+	// Nor does stripping the MAC help
+	stripped := bytes.ReplaceAll(b, []byte(`"mac":`), []byte(`"xmac":`))
+	if err := os.WriteFile(path, stripped, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if report := verifyReceipt(t, out); report.Receipt != "tampered" || report.Valid {
+		t.Errorf("receipt without MAC: %+v", report)
+	}
+}
+
+func TestLoadReceiptKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("0123456789abcdef\n"), 0o600)
+	if key, err := loadReceiptKey(path); err != nil || string(key) != "0123456789abcdef" {
+		t.Errorf("got %q, %v", key, err)
+	}
+	os.WriteFile(path, []byte("short\n"), 0o600)
+	if _, err := loadReceiptKey(path); err == nil {
+		t.Error("short key accepted")
+	}
+}
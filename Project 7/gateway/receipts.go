@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	receiptTimeout  = flag.Duration("receipt-timeout", 5*time.Second, "Per-request timeout for the receipts service")
+	receiptAttempts = flag.Int("receipt-attempts", 4, "POST attempts per receipt before it is queued for later")
+	receiptBackoff  = flag.Duration("receipt-backoff", 500*time.Millisecond, "Initial delay between receipt attempts (doubles each retry)")
+	receiptQueue    = flag.Int("receipt-queue", 1000, "Receipts held in memory while the receipts service is unavailable")
+	receiptRetry    = flag.Duration("receipt-retry-interval", 30*time.Second, "How often queued receipts are retried")
+	receiptRetries  = flag.Int("receipt-max-retries", 20, "Background retries of a queued receipt before it is dropped")
+	receiptDrain    = flag.Duration("receipt-drain-timeout", 10*time.Second, "How long shutdown keeps trying to deliver queued receipts")
+)
+
+// Wrapped by errors for a 4xx from the receipts service: the receipt itself
+// was refused, so sending it again won't help
+var errReceiptRejected = errors.New("receipt rejected")
+
+// Receipt records that the gateway signed a message
+type Receipt struct {
+	MessageID  string
+	Sender     string   // MAIL FROM path
+	Recipients []string // RCPT TO paths the message was accepted for
+	Hash       string   // hex SHA-256 of the signed message
+	Signature  string
+	Algorithm  string
+	KeyID      string // kid= of the signing key, if it has one
+	Nonce      string // n= of the signature, which covers it along with what Hash is of
+	Timestamp  time.Time
+
+	// Outcome of every RCPT TO in the transaction, so each recipient's
+	// copy can be proven independently
+	RecipientStatus map[string]string
+
+	ClientIdentity string // client certificate or AUTH username, if any
+
+	TLS *ReceiptTLS // the client connection's TLS; nil for a plaintext session
+
+	// Hash of the receipt before this one in the store's hash chain; set
+	// by the store
+	PreviousHash string
+
+	MAC string // hex HMAC-SHA256 under -receipt-key, if one is set
+
+	retries int // background attempts made from the retry queue
+}
+
+// ReceiptTLS is the TLS a message was submitted over, as negotiated with
+// the client, so a receipt shows whether the channel was quantum-safe
+type ReceiptTLS struct {
+	Version     string `json:"version"`                // e.g. "TLS 1.3"
+	CipherSuite string `json:"cipher_suite"`           // e.g. "TLS_AES_128_GCM_SHA256"
+	KeyExchange string `json:"key_exchange,omitempty"` // e.g. "X25519MLKEM768"; empty if the runtime can't say
+}
+
+// receiptTLS records cs for a receipt
+func receiptTLS(cs tls.ConnectionState) *ReceiptTLS {
+	r := &ReceiptTLS{Version: tls.VersionName(cs.Version), CipherSuite: tls.CipherSuiteName(cs.CipherSuite)}
+	if group := negotiatedGroup(cs); group != "unknown" {
+		r.KeyExchange = group
+	}
+	return r
+}
+
+// RecipientStatus values
+const (
+	recipientAccepted = "accepted"
+	recipientRejected = "rejected"
+)
+
+// receiptPayload is the receipts service's ReceiptCreate model
+type receiptPayload struct {
+	ID           string          `json:"id,omitempty"`
+	DocumentHash string          `json:"document_hash"`
+	Signature    string          `json:"signature"`
+	Timestamp    string          `json:"timestamp"`
+	Type         string          `json:"type"`
+	Metadata     receiptMetadata `json:"metadata"`
+}
+
+// storedReceipt is a receipt as the receipts service returns it
+type storedReceipt struct {
+	receiptPayload
+	PreviousHash string `json:"previous_hash,omitempty"`
+}
+
+type receiptMetadata struct {
+	MessageID       string            `json:"message_id,omitempty"`
+	Sender          string            `json:"sender,omitempty"`
+	Recipients      []string          `json:"recipients"`
+	RecipientStatus map[string]string `json:"recipient_status,omitempty"`
+	Algorithm       string            `json:"algorithm"`
+	KeyID           string            `json:"key_id,omitempty"`
+	Nonce           string            `json:"nonce,omitempty"`
+	ClientIdentity  string            `json:"client_identity,omitempty"`
+	TLS             *ReceiptTLS       `json:"tls,omitempty"` // absent for a plaintext session
+	MAC             string            `json:"mac,omitempty"`
+}
+
+func newReceipt(data, signature []byte, alg string) Receipt {
+	return receiptForSum(sha256.Sum256(data), signature, alg)
+}
+
+// receiptForSum is newReceipt for bytes already hashed, such as a message
+// signed as it streamed through
+func receiptForSum(sum [sha256.Size]byte, signature []byte, alg string) Receipt {
+	return Receipt{
+		Hash:       hex.EncodeToString(sum[:]),
+		Signature:  string(signature),
+		Algorithm:  alg,
+		Timestamp:  signingClock.Now().UTC(),
+		Recipients: []string{},
+
+		RecipientStatus: map[string]string{},
+	}
+}
+
+// receipt turns a stored receipt back into the gateway's form
+func (s storedReceipt) receipt() Receipt {
+	r := Receipt{
+		MessageID:       s.Metadata.MessageID,
+		Sender:          s.Metadata.Sender,
+		Recipients:      s.Metadata.Recipients,
+		Hash:            s.DocumentHash,
+		Signature:       s.Signature,
+		Algorithm:       s.Metadata.Algorithm,
+		KeyID:           s.Metadata.KeyID,
+		Nonce:           s.Metadata.Nonce,
+		RecipientStatus: s.Metadata.RecipientStatus,
+		ClientIdentity:  s.Metadata.ClientIdentity,
+		TLS:             s.Metadata.TLS,
+		PreviousHash:    s.PreviousHash,
+		MAC:             s.Metadata.MAC,
+	}
+	if r.MessageID == "" {
+		r.MessageID = s.ID
+	}
+	r.Timestamp, _ = time.Parse(time.RFC3339, s.Timestamp)
+	return r
+}
+
+// stored renders a receipt the way the receipts service returns it
+func (r Receipt) stored() storedReceipt {
+	return storedReceipt{receiptPayload: r.payload(), PreviousHash: r.PreviousHash}
+}
+
+func (r Receipt) payload() receiptPayload {
+	return receiptPayload{
+		ID:           r.MessageID,
+		DocumentHash: r.Hash,
+		Signature:    r.Signature,
+		Timestamp:    r.Timestamp.Format(time.RFC3339),
+		Type:         "email",
+		Metadata: receiptMetadata{
+			MessageID:       r.MessageID,
+			Sender:          r.Sender,
+			Recipients:      r.Recipients,
+			RecipientStatus: r.RecipientStatus,
+			Algorithm:       r.Algorithm,
+			KeyID:           r.KeyID,
+			Nonce:           r.Nonce,
+			ClientIdentity:  r.ClientIdentity,
+			TLS:             r.TLS,
+			MAC:             r.MAC,
+		},
+	}
+}
+
+// receiptClient delivers receipts to the receipts service. Receipts that
+// still fail after the retry budget wait in a bounded queue and are retried
+// in the background until the service comes back.
+type receiptClient struct {
+	url      string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	pending  chan Receipt
+	batch    *receiptBatcher // nil when receipts are sent one at a time
+	breaker  *circuitBreaker // nil when -receipt-breaker-failures is 0
+}
+
+func newReceiptClient(url string) *receiptClient {
+	c := &receiptClient{
+		url:      url,
+		client:   &http.Client{Timeout: *receiptTimeout},
+		attempts: max(*receiptAttempts, 1),
+		backoff:  *receiptBackoff,
+		pending:  make(chan Receipt, max(*receiptQueue, 1)),
+		breaker:  newCircuitBreaker(*receiptBreakerFailures, *receiptBreakerCooldown),
+	}
+	if *receiptBatchSize > 0 {
+		c.batch = newReceiptBatcher(c, *receiptBatchSize, *receiptBatchInterval)
+		go c.batch.run()
+	}
+	return c
+}
+
+// Store delivers a receipt, queueing it if the service stays unavailable.
+// Retrying stops when ctx (the message's session) ends; the queue picks the
+// receipt up from there. It fails only when the queue is full too. With
+// batching the receipt is handed to the batcher instead.
+func (c *receiptClient) Store(ctx context.Context, r Receipt) error {
+	if c.batch != nil {
+		return c.batch.add(ctx, r)
+	}
+	err := c.withRetry(ctx, func(ctx context.Context) error { return c.post(ctx, r) })
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errReceiptRejected):
+		slog.Error("Receipts service refused receipt, dropping it", "event", "receipt_rejected",
+			"message_id", r.MessageID, "error", err)
+		receiptFailures.Inc()
+		return err
+	case errors.Is(err, errBreakerOpen):
+		slog.Debug("Receipts service circuit open, queueing", "event", "receipt_deferred",
+			"message_id", r.MessageID)
+	case ctx.Err() != nil:
+		slog.Debug("Session ended before receipt was stored, queueing", "event", "receipt_deferred",
+			"message_id", r.MessageID, "error", err)
+	default:
+		slog.Warn("Failed to store receipt, queueing", "event", "receipt_failed",
+			"message_id", r.MessageID, "attempts", c.attempts, "error", err)
+		receiptFailures.Inc()
+	}
+	return c.enqueue(r)
+}
+
+// withRetry calls send up to -receipt-attempts times with backoff. A
+// rejected receipt isn't retried, nor is one the open breaker stopped.
+func (c *receiptClient) withRetry(ctx context.Context, send func(context.Context) error) error {
+	var err error
+	delay := c.backoff
+	for attempt := 1; attempt <= c.attempts; attempt++ {
+		if err = send(ctx); err == nil || errors.Is(err, errReceiptRejected) || errors.Is(err, errBreakerOpen) {
+			return err
+		}
+		if attempt < c.attempts {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// post makes a single attempt to store a receipt
+func (c *receiptClient) post(ctx context.Context, r Receipt) (err error) {
+	ctx, span := tracer.Start(ctx, "receipt.post", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrMessageID.String(r.MessageID)))
+	defer func() { endSpan(span, err) }()
+	return c.postJSON(ctx, "/receipts", r.payload())
+}
+
+// postBatch makes a single attempt to store receipts with one request
+func (c *receiptClient) postBatch(ctx context.Context, rs []Receipt) (err error) {
+	ctx, span := tracer.Start(ctx, "receipt.post_batch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrReceipts.Int(len(rs))))
+	defer func() { endSpan(span, err) }()
+
+	payloads := make([]receiptPayload, len(rs))
+	for i, r := range rs {
+		payloads[i] = r.payload()
+	}
+	return c.postJSON(ctx, "/receipts/batch", payloads)
+}
+
+// postJSON makes one request to the receipts service, unless its breaker
+// is open
+func (c *receiptClient) postJSON(ctx context.Context, path string, v any) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	err := c.request(ctx, path, v)
+	if err != nil && ctx.Err() != nil {
+		c.breaker.abandon()
+	} else {
+		c.breaker.record(err != nil && !errors.Is(err, errReceiptRejected))
+	}
+	return err
+}
+
+func (c *receiptClient) request(ctx context.Context, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *receiptTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	case resp.StatusCode/100 == 4:
+		detail := rejectionDetail(resp.Body)
+		// The Message-ID is the receipt ID, so a message sent again, or a
+		// receipt whose first response was lost, is already stored
+		if resp.StatusCode == http.StatusConflict || strings.Contains(detail, "already exists") {
+			slog.Debug("Receipt already stored", "event", "receipt_exists", "detail", detail)
+			return nil
+		}
+		return fmt.Errorf("%w: receipts service returned %s: %s", errReceiptRejected, resp.Status, detail)
+	default:
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("receipts service returned %s", resp.Status)
+	}
+}
+
+// rejectionDetail reads the detail of a FastAPI error response, or the
+// start of the body if it isn't one
+func rejectionDetail(body io.Reader) string {
+	b, _ := io.ReadAll(io.LimitReader(body, 1024))
+	var e struct {
+		Detail any `json:"detail"`
+	}
+	if json.Unmarshal(b, &e) == nil && e.Detail != nil {
+		if s, ok := e.Detail.(string); ok {
+			return s
+		}
+		d, _ := json.Marshal(e.Detail)
+		return string(d)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Get looks up a stored receipt by ID (the message's Message-ID)
+func (c *receiptClient) Get(ctx context.Context, id string) (Receipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, *receiptTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/receipts/"+url.PathEscape(id), nil)
+	if err != nil {
+		return Receipt{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Receipt{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return Receipt{}, errReceiptNotFound
+	case resp.StatusCode/100 != 2:
+		return Receipt{}, fmt.Errorf("receipts service returned %s", resp.Status)
+	}
+	var r storedReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return Receipt{}, fmt.Errorf("decode receipt: %w", err)
+	}
+	return r.receipt(), nil
+}
+
+// enqueue holds a receipt for retryPending, failing when the queue is full
+func (c *receiptClient) enqueue(r Receipt) error {
+	select {
+	case c.pending <- r:
+		return nil
+	default:
+		return fmt.Errorf("receipt queue full (%d)", cap(c.pending))
+	}
+}
+
+// retryPending periodically drains the queue, stopping at the first failure
+// so a still-down service isn't hammered. With batching, queued receipts
+// are resent in batches too.
+func (c *receiptClient) retryPending(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.drainPending(context.Background())
+	}
+}
+
+// drainPending makes one pass over the queue, reporting whether it got
+// through without the service failing
+func (c *receiptClient) drainPending(ctx context.Context) bool {
+	for n := len(c.pending); n > 0; {
+		k := 1
+		if c.batch != nil {
+			k = min(n, c.batch.size)
+		}
+		n -= k
+		rs := c.take(k)
+		if len(rs) == 0 {
+			// Drained by someone else meanwhile
+			return true
+		}
+		if err := c.send(ctx, rs); err != nil {
+			switch {
+			case errors.Is(err, errReceiptRejected):
+				c.drop(rs, err)
+				continue
+			case errors.Is(err, errBreakerOpen):
+				// Not tried, so not a retry
+				c.hold(rs)
+			default:
+				c.requeue(rs)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// take dequeues up to k receipts without waiting
+func (c *receiptClient) take(k int) []Receipt {
+	rs := make([]Receipt, 0, k)
+	for len(rs) < k {
+		select {
+		case r := <-c.pending:
+			rs = append(rs, r)
+		default:
+			return rs
+		}
+	}
+	return rs
+}
+
+// send makes a single attempt to store rs, which holds one receipt unless
+// batching
+func (c *receiptClient) send(ctx context.Context, rs []Receipt) error {
+	if c.batch != nil {
+		return c.postBatch(ctx, rs)
+	}
+	return c.post(ctx, rs[0])
+}
+
+// requeue puts receipts that failed again back on the queue, dropping those
+// that no longer fit or have used up -receipt-max-retries
+func (c *receiptClient) requeue(rs []Receipt) {
+	for _, r := range rs {
+		if r.retries++; r.retries > *receiptRetries {
+			c.drop([]Receipt{r}, fmt.Errorf("gave up after %d retries", *receiptRetries))
+			continue
+		}
+		if err := c.enqueue(r); err != nil {
+			c.drop([]Receipt{r}, err)
+		}
+	}
+}
+
+// hold puts receipts back on the queue as they were, dropping those that
+// no longer fit
+func (c *receiptClient) hold(rs []Receipt) {
+	for _, r := range rs {
+		if err := c.enqueue(r); err != nil {
+			c.drop([]Receipt{r}, err)
+		}
+	}
+}
+
+// drop logs receipts that will never be stored
+func (c *receiptClient) drop(rs []Receipt, err error) {
+	for _, r := range rs {
+		slog.Error("Dropping receipt", "event", "receipt_dropped",
+			"message_id", r.MessageID, "hash", r.Hash, "error", err)
+	}
+}
+
+// Flush sends the receipts batched so far, for a session that has ended
+func (c *receiptClient) Flush() {
+	if c.batch != nil {
+		c.batch.flushNow()
+	}
+}
+
+// Shutdown sends any receipts still being batched, then keeps retrying the
+// queue with backoff until it is empty or ctx ends. Receipts still queued
+// then are lost with the process, so they are counted in the log.
+func (c *receiptClient) Shutdown(ctx context.Context) error {
+	stored := 0
+	if c.batch != nil {
+		stored = c.batch.close(ctx)
+	}
+	queued := len(c.pending)
+	delay := c.backoff
+	for len(c.pending) > 0 && !c.drainPending(ctx) {
+		select {
+		case <-time.After(delay):
+			delay = min(delay*2, maxShutdownBackoff)
+		case <-ctx.Done():
+			left := len(c.pending)
+			slog.Error("Receipts still queued at shutdown", "event", "receipts_unsent",
+				"flushed", stored+max(queued-left, 0), "dropped", left)
+			return ctx.Err()
+		}
+	}
+	if stored+queued > 0 {
+		slog.Info("Flushed receipts at shutdown", "event", "receipts_flushed", "flushed", stored+queued, "dropped", 0)
+	}
+	return nil
+}
+
+// Longest pause between retries of the queue during shutdown
+const maxShutdownBackoff = 2 * time.Second
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receiptService answers every POST with status and body, counting them
+func receiptService(t *testing.T, status int, body string) (*receiptClient, *atomic.Int32) {
+	t.Helper()
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	oldAttempts, oldBackoff := *receiptAttempts, *receiptBackoff
+	*receiptAttempts, *receiptBackoff = 3, time.Millisecond
+	t.Cleanup(func() { *receiptAttempts, *receiptBackoff = oldAttempts, oldBackoff })
+	return newReceiptClient(srv.URL), &posts
+}
+
+func testReceipt() Receipt {
+	r := newReceipt([]byte("message"), []byte("sig"), "ml-dsa-65")
+	r.MessageID = "<1@example.com>"
+	return r
+}
+
+func TestReceiptStoreStatuses(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		wantErr error
+		posts   int32
+		queued  int
+	}{
+		{"created", 201, `{}`, nil, 1, 0},
+		{"duplicate", 400, `{"detail":"Receipt with ID <1@example.com> already exists"}`, nil, 1, 0},
+		{"conflict", 409, `{"detail":"exists"}`, nil, 1, 0},
+		{"invalid", 422, `{"detail":[{"msg":"field required"}]}`, errReceiptRejected, 1, 0},
+		{"unavailable", 503, `{"detail":"down"}`, nil, 3, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, posts := receiptService(t, tc.status, tc.body)
+			err := c.Store(context.Background(), testReceipt())
+			if tc.wantErr == nil && err != nil || tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("Store = %v, want %v", err, tc.wantErr)
+			}
+			if got := posts.Load(); got != tc.posts {
+				t.Errorf("%d POSTs, want %d", got, tc.posts)
+			}
+			if got := len(c.pending); got != tc.queued {
+				t.Errorf("%d queued, want %d", got, tc.queued)
+			}
+		})
+	}
+}
+
+func TestRequeueGivesUp(t *testing.T) {
+	c, _ := receiptService(t, 503, `{}`)
+	old := *receiptRetries
+	*receiptRetries = 2
+	t.Cleanup(func() { *receiptRetries = old })
+
+	r := testReceipt()
+	for i := 0; i < 3; i++ {
+		c.requeue([]Receipt{r})
+		if len(c.pending) == 0 {
+			if i != 2 {
+				t.Fatalf("dropped after %d retries, want 2", i)
+			}
+			return
+		}
+		r = <-c.pending
+	}
+	t.Fatal("receipt never dropped")
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Down for the first few attempts, as if restarting
+		if posts.Add(1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(srv.Close)
+	c, _ := receiptService(t, 201, `{}`)
+	c.url = srv.URL
+
+	for i := 0; i < 2; i++ {
+		c.pending <- testReceipt()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if n := len(c.pending); n != 0 {
+		t.Errorf("%d receipts left queued", n)
+	}
+}
+
+func TestShutdownGivesUpAtDeadline(t *testing.T) {
+	c, _ := receiptService(t, 503, `{}`)
+	c.pending <- testReceipt()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want deadline exceeded", err)
+	}
+}
+
+func TestRejectionDetail(t *testing.T) {
+	c, _ := receiptService(t, 400, `{"detail":"bad timestamp"}`)
+	err := c.post(context.Background(), testReceipt())
+	if !errors.Is(err, errReceiptRejected) || err.Error() != "receipt rejected: receipts service returned 400 Bad Request: bad timestamp" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestReceiptTLS(t *testing.T) {
+	t.Run("starttls", func(t *testing.T) {
+		store := &memReceiptStore{calls: make(chan Receipt, 1)}
+		useReceipts(t, store)
+		startTestBackend(t)
+		c, conn := dialGatewaySTARTTLS(t)
+		command(t, c, 250, "EHLO client.example.com")
+		command(t, c, 220, "STARTTLS")
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		c = textproto.NewConn(tc)
+		sendMessage(t, c, 250, testBody)
+		command(t, c, 221, "QUIT")
+
+		r := <-store.calls
+		if want := receiptTLS(tc.ConnectionState()); r.TLS == nil || *r.TLS != *want {
+			t.Fatalf("receipt TLS %+v, want %+v", r.TLS, want)
+		}
+		if r.TLS.Version != "TLS 1.3" || !strings.HasPrefix(r.TLS.CipherSuite, "TLS_") {
+			t.Errorf("receipt TLS %+v, want TLS 1.3 and its cipher suite", r.TLS)
+		}
+		if got := r.stored().receipt(); got.TLS == nil || *got.TLS != *r.TLS {
+			t.Errorf("TLS %+v after a round trip through the store, want %+v", got.TLS, r.TLS)
+		}
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		store := &memReceiptStore{calls: make(chan Receipt, 1)}
+		useReceipts(t, store)
+		startTestBackend(t)
+		c := dialGateway(t)
+		sendMessage(t, c, 250, testBody)
+		command(t, c, 221, "QUIT")
+
+		r := <-store.calls
+		if r.TLS != nil {
+			t.Errorf("receipt TLS %+v for a plaintext session", r.TLS)
+		}
+		b, err := json.Marshal(r.payload())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), `"tls"`) {
+			t.Errorf("plaintext receipt carries TLS metadata: %s", b)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+var (
+	receiptStoreKind = flag.String("receipt-store", "http", "Where receipts are kept: http (the -receipts service) or file (-receipt-file)")
+	receiptFile      = flag.String("receipt-file", "receipts.jsonl", "Append-only JSON Lines file for -receipt-store=file")
+)
+
+// ReceiptStore keeps the receipt of every signed message, keyed by
+// Message-ID
+type ReceiptStore interface {
+	Store(ctx context.Context, r Receipt) error
+	Get(ctx context.Context, id string) (Receipt, error)
+}
+
+// Receipt store, set up in main
+var receipts ReceiptStore
+
+// Returned by Get when the store has no receipt with that ID
+var errReceiptNotFound = errors.New("receipt not found")
+
+// fileReceiptStore appends receipts to a JSON Lines file, one stored receipt
+// per line in the receipts service's format, for deployments without that
+// service. Like the service it chains receipts: each records the document
+// hash of the one before. Lines are never rewritten; a later receipt for
+// the same ID shadows the earlier one.
+type fileReceiptStore struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	last string               // document hash of the newest receipt
+	byID map[string]lineRange // where each ID's newest receipt is in the file
+}
+
+type lineRange struct {
+	off int64
+	n   int
+}
+
+// openFileReceiptStore opens or creates path and indexes the receipts
+// already in it
+func openFileReceiptStore(path string) (*fileReceiptStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileReceiptStore{f: f, byID: map[string]lineRange{}}
+	if err := s.load(path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load indexes the file. A line that doesn't parse, such as one cut short
+// by a crash, is skipped; if it is the last line it is terminated so the
+// next receipt starts on a line of its own.
+func (s *fileReceiptStore) load(path string) error {
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, 1<<62))
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var stored storedReceipt
+			if jerr := json.Unmarshal(line, &stored); jerr != nil || stored.ID == "" {
+				slog.Warn("Skipping unreadable receipt line", "event", "receipt_line_invalid", "file", path, "line", n)
+			} else {
+				s.byID[stored.ID] = lineRange{off: s.size, n: len(line)}
+				s.last = stored.DocumentHash
+			}
+			s.size += int64(len(line))
+		}
+		if err == io.EOF {
+			if len(line) > 0 && !bytes.HasSuffix(line, []byte("\n")) {
+				if _, err := s.f.Write([]byte("\n")); err != nil {
+					return err
+				}
+				s.size++
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+	}
+}
+
+// Store appends r and syncs it to disk before returning
+func (s *fileReceiptStore) Store(ctx context.Context, r Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.PreviousHash = s.last
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // keep Message-IDs readable
+	if err := enc.Encode(r.stored()); err != nil {
+		return err
+	}
+	line := buf.Bytes()
+	if _, err := s.f.Write(line); err != nil {
+		return fmt.Errorf("append receipt: %w", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("sync receipts: %w", err)
+	}
+	s.byID[r.MessageID] = lineRange{off: s.size, n: len(line)}
+	s.size += int64(len(line))
+	s.last = r.Hash
+	return nil
+}
+
+// Shutdown closes the file; receipts are already on disk
+func (s *fileReceiptStore) Shutdown(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// shutdownReceipts waits, until ctx ends, for receipts of delivered
+// messages to be stored, then lets the store finish: the HTTP client
+// flushes its batch and queue, the file store closes its file
+func shutdownReceipts(ctx context.Context) {
+	stored := make(chan struct{})
+	go func() {
+		receiptsInFlight.Wait()
+		close(stored)
+	}()
+	select {
+	case <-stored:
+	case <-ctx.Done():
+		slog.Warn("Receipts still being stored at shutdown", "event", "receipts_in_flight")
+	}
+	if s, ok := receipts.(interface{ Shutdown(context.Context) error }); ok {
+		s.Shutdown(ctx)
+	}
+}
+
+func (s *fileReceiptStore) Get(ctx context.Context, id string) (Receipt, error) {
+	s.mu.Lock()
+	pos, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok {
+		return Receipt{}, errReceiptNotFound
+	}
+	line := make([]byte, pos.n)
+	if _, err := s.f.ReadAt(line, pos.off); err != nil {
+		return Receipt{}, fmt.Errorf("read receipt: %w", err)
+	}
+	var stored storedReceipt
+	if err := json.Unmarshal(line, &stored); err != nil {
+		return Receipt{}, fmt.Errorf("decode receipt: %w", err)
+	}
+	return stored.receipt(), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestStore opens the file store at path, closing it when the test ends
+func openTestStore(t *testing.T, path string) *fileReceiptStore {
+	t.Helper()
+	s, err := openFileReceiptStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// receiptFor is a receipt for message id
+func receiptFor(id string) Receipt {
+	r := newReceipt([]byte("message "+id), []byte("sig"), "ml-dsa-65")
+	r.MessageID = id
+	return r
+}
+
+func TestFileReceiptStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	ctx := context.Background()
+	s := openTestStore(t, path)
+	for _, id := range []string{"<1@example.com>", "<2@example.com>"} {
+		if err := s.Store(ctx, receiptFor(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := s.Get(ctx, "<1@example.com>")
+	if err != nil || first.Hash != receiptFor("<1@example.com>").Hash || first.PreviousHash != "" {
+		t.Fatalf("first receipt %+v, %v", first, err)
+	}
+	second, err := s.Get(ctx, "<2@example.com>")
+	if err != nil || second.PreviousHash != first.Hash {
+		t.Errorf("second receipt %+v, %v; want it chained to the first", second, err)
+	}
+	if _, err := s.Get(ctx, "<3@example.com>"); !errors.Is(err, errReceiptNotFound) {
+		t.Errorf("unknown ID: %v", err)
+	}
+}
+
+func TestFileReceiptStoreRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.jsonl")
+	ctx := context.Background()
+	s := openTestStore(t, path)
+	if err := s.Store(ctx, receiptFor("<1@example.com>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// A crash left half a line behind
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"document_hash":"cut sh`)
+	f.Close()
+
+	s = openTestStore(t, path)
+	first, err := s.Get(ctx, "<1@example.com>")
+	if err != nil || first.Hash != receiptFor("<1@example.com>").Hash {
+		t.Fatalf("receipt after restart %+v, %v", first, err)
+	}
+	// The chain carries on from the last receipt read back
+	if err := s.Store(ctx, receiptFor("<2@example.com>")); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown(ctx)
+
+	s = openTestStore(t, path)
+	for _, id := range []string{"<1@example.com>", "<2@example.com>"} {
+		if _, err := s.Get(ctx, id); err != nil {
+			t.Errorf("%s after the second restart: %v", id, err)
+		}
+	}
+	if second, _ := s.Get(ctx, "<2@example.com>"); second.PreviousHash != first.Hash {
+		t.Errorf("previous hash %q, want the first receipt's %q", second.PreviousHash, first.Hash)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	recipientMapFile    = flag.String("recipient-map", "", "File of the recipients accepted, one a line: an address, @domain for any at the domain, or /regexp/ matched against the whole address; others get 550 to RCPT TO")
+	recipientCallout    = flag.Bool("recipient-callout", false, "Ask the recipient's backend, on a connection of its own, whether it accepts each RCPT TO before accepting it; those it refuses get 550")
+	recipientCalloutTTL = flag.Duration("recipient-callout-ttl", time.Minute, "How long a callout's answer is reused for the same recipient")
+)
+
+// How long a recipient callout may take before the recipient is passed on
+// unchecked
+const calloutTimeout = 10 * time.Second
+
+// recipientMap is the recipients -recipient-map accepts
+type recipientMap struct {
+	addrs    map[string]bool // lower case
+	domains  map[string]bool // lower case, without the @
+	patterns []*regexp.Regexp
+}
+
+// parseRecipientMap reads a -recipient-map file. Blank lines and those
+// starting with # are skipped; patterns are case-insensitive, like the
+// rest.
+func parseRecipientMap(b []byte) (*recipientMap, error) {
+	m := &recipientMap{addrs: map[string]bool{}, domains: map[string]bool{}}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/"):
+			re, err := regexp.Compile("(?i)^(?:" + line[1:len(line)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			m.patterns = append(m.patterns, re)
+		case strings.HasPrefix(line, "@"):
+			m.domains[routeName(line[1:])] = true
+		case strings.Contains(line, "@"):
+			m.addrs[strings.ToLower(line)] = true
+		default:
+			return nil, fmt.Errorf("line %d: %q is not an address, @domain or /regexp/", n, line)
+		}
+	}
+	return m, sc.Err()
+}
+
+// accepts reports whether the map lists addr
+func (m *recipientMap) accepts(addr string) bool {
+	if m.addrs[strings.ToLower(addr)] || m.domains[routeName(recipientDomain(addr))] {
+		return true
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientChecker decides which recipients are refused at RCPT TO, by
+// -recipient-map and -recipient-callout; with both, a recipient must pass
+// each. Callout answers are remembered for a while, so a busy recipient
+// doesn't cost a backend connection per message. Callouts that fail, or get
+// a temporary reply, aren't remembered and don't refuse anyone: the
+// recipient is left to its backend.
+type recipientChecker struct {
+	known   *recipientMap // nil accepts anyone the callout does
+	callout func(log *slog.Logger, pool *backendPool, addr string) (bool, error)
+	ttl     time.Duration
+	now     func() time.Time // time.Now, except in tests
+
+	mu        sync.Mutex
+	results   map[calloutKey]calloutResult
+	lastSweep time.Time
+}
+
+// calloutKey is a recipient as asked of a set of backends
+type calloutKey struct {
+	pool *backendPool
+	addr string // lower case
+}
+
+type calloutResult struct {
+	accepted bool
+	expires  time.Time
+}
+
+// Recipient checks, set up in main; nil refuses nobody
+var recipientChecks *recipientChecker
+
+// loadRecipientChecker sets up the checks the flags ask for, or returns nil
+// if there are none
+func loadRecipientChecker() (*recipientChecker, error) {
+	if *recipientMapFile == "" && !*recipientCallout {
+		return nil, nil
+	}
+	c := &recipientChecker{ttl: *recipientCalloutTTL, now: time.Now, results: map[calloutKey]calloutResult{}}
+	if *recipientMapFile != "" {
+		b, err := os.ReadFile(*recipientMapFile)
+		if err != nil {
+			return nil, fmt.Errorf("-recipient-map: %w", err)
+		}
+		if c.known, err = parseRecipientMap(b); err != nil {
+			return nil, fmt.Errorf("-recipient-map: %s: %w", *recipientMapFile, err)
+		}
+	}
+	if *recipientCallout {
+		c.callout = calloutRecipient
+	}
+	return c, nil
+}
+
+// accepts reports whether addr, for the backends in pool, is to be accepted
+func (c *recipientChecker) accepts(log *slog.Logger, pool *backendPool, addr string) bool {
+	// Every domain must take mail for its postmaster (RFC 5321 section 4.5.1)
+	if strings.EqualFold(addr, "postmaster") {
+		return true
+	}
+	if c.known != nil && !c.known.accepts(addr) {
+		log.Info("Refusing recipient not in the recipient map", "event", "recipient_unknown", "rcpt", addr)
+		return false
+	}
+	if c.callout == nil {
+		return true
+	}
+
+	key := calloutKey{pool: pool, addr: strings.ToLower(addr)}
+	now := c.now()
+	c.mu.Lock()
+	r, ok := c.results[key]
+	c.mu.Unlock()
+	if ok && now.Before(r.expires) {
+		recipientCallouts.WithLabelValues("cached").Inc()
+	} else {
+		accepted, err := c.callout(log, pool, addr)
+		if err != nil {
+			recipientCallouts.WithLabelValues("error").Inc()
+			log.Warn("Recipient callout failed, passing recipient on", "event", "recipient_callout_failed", "rcpt", addr, "error", err)
+			return true
+		}
+		if accepted {
+			recipientCallouts.WithLabelValues("accepted").Inc()
+		} else {
+			recipientCallouts.WithLabelValues("rejected").Inc()
+		}
+		r = calloutResult{accepted: accepted, expires: now.Add(c.ttl)}
+		c.mu.Lock()
+		c.sweep(now)
+		c.results[key] = r
+		c.mu.Unlock()
+	}
+	if !r.accepted {
+		log.Info("Refusing recipient its backend doesn't accept", "event", "recipient_unknown", "rcpt", addr)
+	}
+	return r.accepted
+}
+
+// sweep forgets expired results, at most once a minute
+func (c *recipientChecker) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for key, r := range c.results {
+		if !now.Before(r.expires) {
+			delete(c.results, key)
+		}
+	}
+}
+
+// calloutRecipient asks a backend in pool whether it would take mail for
+// addr, with a null sender so nothing is ever delivered, and hangs up
+// before DATA. A 5xx reply to RCPT TO refuses the recipient; anything but
+// a 2xx or 5xx one is an error.
+func calloutRecipient(log *slog.Logger, pool *backendPool, addr string) (bool, error) {
+	conn, _, err := pool.dial(log)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(calloutTimeout))
+
+	hello := "EHLO "
+	if *lmtpMode {
+		hello = "LHLO "
+	}
+	r := bufio.NewReader(conn)
+	for _, cmd := range []string{"", hello + gatewayHostname(), "MAIL FROM:<>", "RCPT TO:<" + addr + ">"} {
+		if cmd != "" {
+			if _, err := conn.Write([]byte(cmd + "\r\n")); err != nil {
+				return false, err
+			}
+		}
+		reply, err := readReply(r)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case reply[0] == '2':
+			continue
+		case reply[0] == '5' && strings.HasPrefix(cmd, "RCPT"):
+			conn.Write([]byte("QUIT\r\n"))
+			return false, nil
+		}
+		if cmd == "" {
+			cmd = "greeting"
+		}
+		return false, fmt.Errorf("%s: %s", cmd, bytes.TrimRight(reply, "\r\n"))
+	}
+	conn.Write([]byte("QUIT\r\n"))
+	return true, nil
+}
+
+// refusesRecipient reports whether the recipient of cmd, a RCPT TO, is to
+// be refused
+func (s *smtpSession) refusesRecipient(cmd []byte) bool {
+	if recipientChecks == nil || s.mailCmd == nil {
+		return false
+	}
+	addr := commandArg(cmd)
+	if addr == "" {
+		return false // malformed, which the backend will say
+	}
+	return !recipientChecks.accepts(s.log, s.routeFor(recipientDomain(addr)), addr)
+}
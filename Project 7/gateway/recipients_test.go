@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+// useRecipientChecks loads the recipient checks the flags ask for, for the
+// rest of the test
+func useRecipientChecks(t *testing.T, flags map[string]string) *recipientChecker {
+	t.Helper()
+	setFlags(t, flags)
+	c, err := loadRecipientChecker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := recipientChecks
+	recipientChecks = c
+	t.Cleanup(func() { recipientChecks = old })
+	return c
+}
+
+// countCommands returns how many of cmds are cmd
+func countCommands(cmds []string, cmd string) int {
+	n := 0
+	for _, c := range cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func TestParseRecipientMap(t *testing.T) {
+	m, err := parseRecipientMap([]byte("# accepted\nalice@example.com\n\n@Tenant.Example\n/(sales|support)\\+[a-z]+@example\\.org/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"alice@example.com":         true,
+		"ALICE@Example.com":         true,
+		"bob@example.com":           false,
+		"anyone@tenant.example":     true,
+		"anyone@sub.tenant.example": false,
+		"sales+eu@example.org":      true,
+		"sales+eu@example.org.evil": false,
+		"sales@example.org":         false,
+	} {
+		if got := m.accepts(addr); got != want {
+			t.Errorf("%s: %v, want %v", addr, got, want)
+		}
+	}
+
+	for _, bad := range []string{"alice\n", "/(unclosed/\n"} {
+		if _, err := parseRecipientMap([]byte("a@example.com\n" + bad)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: %v, want an error on line 2", bad, err)
+		}
+	}
+}
+
+func TestRecipientMap(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(file, []byte("b@example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	useRecipientChecks(t, map[string]string{"recipient-map": file})
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	if reply := command(t, c, 550, "RCPT TO:<nobody@example.com>"); !strings.HasPrefix(reply, "5.1.1 <nobody@example.com>") {
+		t.Errorf("reply %q", reply)
+	}
+	command(t, c, 250, "RCPT TO:<Postmaster>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 221, "QUIT")
+
+	for _, cmd := range b.commands() {
+		if strings.Contains(cmd, "nobody@") {
+			t.Errorf("backend got %q", cmd)
+		}
+	}
+}
+
+func TestRecipientCallout(t *testing.T) {
+	useRecipientChecks(t, map[string]string{"recipient-callout": "true"})
+	logs := captureLogs(t, slog.LevelInfo, "")
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	for i := 0; i < 2; i++ {
+		command(t, c, 250, "MAIL FROM:<a@example.com>")
+		command(t, c, 250, "RCPT TO:<b@example.com>")
+		command(t, c, 550, "RCPT TO:<bad@example.com>")
+		command(t, c, 250, "RSET")
+	}
+	command(t, c, 221, "QUIT")
+
+	cmds := b.commands()
+	// One callout for each recipient, the second message's answered from
+	// the cache; only the gateway's probe asked about the unknown one
+	if n := countCommands(cmds, "MAIL FROM:<>"); n != 2 {
+		t.Errorf("%d callouts in %q, want 2", n, cmds)
+	}
+	if n := countCommands(cmds, "RCPT TO:<bad@example.com>"); n != 1 {
+		t.Errorf("%d RCPT TO:<bad@example.com> in %q, want the callout's", n, cmds)
+	}
+	if n := countCommands(cmds, "RCPT TO:<b@example.com>"); n != 3 {
+		t.Errorf("%d RCPT TO:<b@example.com> in %q, want the callout's and both sessions'", n, cmds)
+	}
+	if !strings.Contains(logs.String(), `"event":"recipient_unknown","rcpt":"bad@example.com"`) {
+		t.Errorf("no recipient_unknown log in %s", logs)
+	}
+}
+
+func TestRecipientCalloutCache(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	var asked int
+	var err error
+	c := &recipientChecker{ttl: time.Minute, now: clock.Now, results: map[calloutKey]calloutResult{},
+		callout: func(*slog.Logger, *backendPool, string) (bool, error) {
+			asked++
+			return false, err
+		}}
+	log := slog.Default()
+	pool := newBackendPool("backend:25")
+
+	if c.accepts(log, pool, "x@example.com") || c.accepts(log, pool, "X@example.com") || asked != 1 {
+		t.Fatalf("accepted, or asked %d times; want refused after one callout", asked)
+	}
+	clock.advance(time.Minute)
+	if c.accepts(log, pool, "x@example.com") || asked != 2 {
+		t.Errorf("asked %d times, want the expired answer asked again", asked)
+	}
+	c.accepts(log, newBackendPool("other:25"), "x@example.com")
+	if asked != 3 {
+		t.Errorf("asked %d times, want other backends asked for themselves", asked)
+	}
+
+	// A failed callout lets the recipient through and isn't remembered
+	err = errors.New("connection refused")
+	if !c.accepts(log, pool, "y@example.com") || !c.accepts(log, pool, "y@example.com") || asked != 5 {
+		t.Errorf("refused, or asked %d times; want accepted and asked twice", asked)
+	}
+}
+
+func TestCalloutRecipient(t *testing.T) {
+	accepting, refusing, busy := &smtptest.Server{}, &smtptest.Server{}, &smtptest.Server{}
+	refusing.Inject("RCPT", smtptest.Fault{Reply: "550 5.1.1 User unknown"})
+	busy.Inject("MAIL", smtptest.Fault{Reply: "451 4.3.0 Try again later"})
+	for _, tc := range []struct {
+		name     string
+		server   *smtptest.Server
+		accepted bool
+		err      string
+	}{
+		{"accepted", accepting, true, ""},
+		{"refused", refusing, false, ""},
+		{"busy", busy, false, "MAIL FROM:<>: 451 4.3.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			accepted, err := calloutRecipient(slog.Default(), newBackendPool(tc.server.Start(t)), "b@example.com")
+			if accepted != tc.accepted || (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+				t.Errorf("%v, %v; want %v, %q", accepted, err, tc.accepted, tc.err)
+			}
+			if cmds := tc.server.Commands(); len(cmds) < 2 || !strings.HasPrefix(cmds[0], "EHLO ") || slices.Contains(cmds, "DATA") {
+				t.Errorf("callout sent %q", cmds)
+			}
+		})
+	}
+}
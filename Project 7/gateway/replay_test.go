@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useReplayGuard(t *testing.T, g *replayGuard) {
+	old := replays
+	replays = g
+	t.Cleanup(func() { replays = old })
+}
+
+func TestReplayFlagged(t *testing.T) {
+	useReplayGuard(t, newReplayGuard(time.Hour))
+	msg := preSigned(t)
+	first := checkReplay(slog.Default(), "", verifyMessage(context.Background(), msg))
+	if first.status != verifyPass || first.nonce == "" {
+		t.Fatalf("first delivery: %+v", first)
+	}
+	second := checkReplay(slog.Default(), "", verifyMessage(context.Background(), msg))
+	if second.status != verifyFail || !strings.Contains(second.reason, "replay") {
+		t.Errorf("second delivery: %+v, want a replay failure", second)
+	}
+
+	// A message signed again gets a nonce of its own
+	if r := checkReplay(slog.Default(), "", verifyMessage(context.Background(), preSigned(t))); r.status != verifyPass {
+		t.Errorf("freshly signed message: %+v", r)
+	}
+}
+
+func TestReplayInProcessMail(t *testing.T) {
+	useReplayGuard(t, newReplayGuard(time.Hour))
+	setFlags(t, map[string]string{"reject-on-bad-sig": "true"})
+	msg := preSigned(t)
+	if _, _, err := processMail(context.Background(), slog.Default(), envelope{}, msg); err != nil {
+		t.Fatalf("first delivery refused: %v", err)
+	}
+	logs := captureLogs(t, slog.LevelWarn, "")
+	if _, _, err := processMail(context.Background(), slog.Default(), envelope{}, msg); err == nil {
+		t.Error("replayed message accepted under -reject-on-bad-sig")
+	}
+	if !strings.Contains(logs.String(), `"event":"signature_replayed"`) {
+		t.Errorf("replay not logged:\n%s", logs.String())
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	g := newReplayGuard(time.Hour)
+	g.clock = clock
+	if g.replayed("1700000000.00") {
+		t.Fatal("first sighting flagged")
+	}
+	clock.advance(59 * time.Minute)
+	if !g.replayed("1700000000.00") {
+		t.Error("replay within the window missed")
+	}
+	clock.advance(2 * time.Minute)
+	if g.replayed("1700000000.00") {
+		t.Error("nonce remembered past the window")
+	}
+}
+
+func TestNonceCovered(t *testing.T) {
+	msg := string(preSigned(t))
+	tags := signatureTags(t, []byte(msg))
+	if tags["n"] == "" {
+		t.Fatal("no n= in the signature")
+	}
+	for name, tampered := range map[string]string{
+		"changed":  strings.Replace(msg, "n="+tags["n"], "n=1.00", 1),
+		"stripped": strings.Replace(msg, "n="+tags["n"]+";", "", 1),
+	} {
+		if r := verifyMessage(context.Background(), []byte(tampered)); r.status != verifyFail {
+			t.Errorf("nonce %s: %+v", name, r)
+		}
+	}
+}
+
+func TestReceiptRecordsNonce(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	out, delivered, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered()
+	if r := <-store.calls; r.Nonce == "" || r.Nonce != signatureTags(t, out)["n"] {
+		t.Errorf("receipt nonce %q, signature's %q", r.Nonce, signatureTags(t, out)["n"])
+	}
+}
+
+func signatureTags(t *testing.T, msg []byte) map[string]string {
+	t.Helper()
+	value, ok := headerValue(msg, "X-PQC-Signature")
+	if !ok {
+		t.Fatal("no X-PQC-Signature")
+	}
+	tags, err := parseSignatureHeader(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tags
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+)
+
+var (
+	failClosed = flag.Bool("fail-closed", false,
+		"Refuse a message with 451 when it can't be signed or its receipt can't be stored, instead of delivering it unsigned")
+	annotateBackend = flag.Bool("annotate-backend-errors", false,
+		"Mark 4xx/5xx replies relayed from the backend so clients can tell them from the gateway's own")
+)
+
+// Pipeline failures processMail reports under -fail-closed, wrapped
+// around the underlying error
+var (
+	errSigningFailed = errors.New("message could not be signed")
+	errReceiptFailed = errors.New("receipt could not be stored")
+)
+
+// SMTP replies for the pipeline failures. Both are temporary: the client
+// keeps the message and tries again once the signer or receipt store is
+// back.
+var pipelineReplies = []struct {
+	err   error
+	reply *smtpError
+}{
+	{errSigningFailed, &smtpError{451, "4.7.0 Message could not be signed, try again later"}},
+	{errReceiptFailed, &smtpError{451, "4.3.0 Delivery receipt could not be recorded, try again later"}},
+}
+
+// Reply to a failure with no more specific one
+var errProcessingFailed = &smtpError{451, "4.3.0 Message could not be processed"}
+
+// smtpReplyFor picks the reply refusing a message processMail failed on:
+// the *smtpError it returned, else the reply for its pipeline failure
+func smtpReplyFor(err error) *smtpError {
+	var rejected *smtpError
+	if errors.As(err, &rejected) {
+		return rejected
+	}
+	for _, r := range pipelineReplies {
+		if errors.Is(err, r.err) {
+			return r.reply
+		}
+	}
+	return errProcessingFailed
+}
+
+// Appended to backend error replies under -annotate-backend-errors
+const backendAnnotation = " (relayed from backend)"
+
+// annotateReply marks the last line of a 4xx/5xx backend reply. Other
+// replies, and continuation lines, are returned as they are.
+func annotateReply(raw []byte) []byte {
+	if !*annotateBackend || len(raw) < 3 || (raw[0] != '4' && raw[0] != '5') {
+		return raw
+	}
+	line := bytes.TrimRight(raw, "\r\n")
+	if len(line) > 3 && line[3] == '-' {
+		return raw
+	}
+	out := make([]byte, 0, len(line)+len(backendAnnotation)+len(crlf))
+	out = append(out, line...)
+	out = append(out, backendAnnotation...)
+	return append(out, crlf...)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+)
+
+var resignPolicy = flag.String("resign-policy", resignAdd, "What to do with mail already carrying a valid PQC signature: add ours alongside it, skip signing it again, or replace its X-PQC-Signature with ours")
+
+// -resign-policy values
+const (
+	resignAdd     = "add"
+	resignSkip    = "skip"
+	resignReplace = "replace"
+)
+
+// applyResignPolicy decides what becomes of data, whose upstream signature
+// verified as result, returning the message to go on with and whether to
+// sign it. Only a passing signature is honoured: one that fails or can't be
+// checked is recorded in Authentication-Results and signed over as usual.
+func applyResignPolicy(log *slog.Logger, msgID string, data []byte, result verifyResult) ([]byte, bool) {
+	if result.status != verifyPass {
+		return data, true
+	}
+	switch *resignPolicy {
+	case resignSkip:
+		log.Info("Message already signed, not signing it again", "event", "resign_skipped",
+			"message_id", msgID, "alg", result.alg)
+		return data, false
+	case resignReplace:
+		// A multipart/signed body has no header to drop; it is signed
+		// over, wrapping and all
+		if stripped, _, ok := lastSignature(data); ok {
+			data = stripped
+		}
+		log.Info("Replacing upstream signature", "event", "resign_replaced", "message_id", msgID, "alg", result.alg)
+	default:
+		log.Info("Adding a signature to an already signed message", "event", "resign_added", "message_id", msgID, "alg", result.alg)
+	}
+	return data, true
+}
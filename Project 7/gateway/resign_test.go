@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// preSigned is testMessage as signed by an upstream hop
+func preSigned(t *testing.T) []byte {
+	t.Helper()
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func signatureCount(msg []byte) int {
+	return bytes.Count(msg, []byte("X-PQC-Signature:"))
+}
+
+func TestResignPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy     string
+		signatures int
+		receipt    bool
+		event      string
+	}{
+		{resignAdd, 2, true, "resign_added"},
+		{resignSkip, 1, false, "resign_skipped"},
+		{resignReplace, 1, true, "resign_replaced"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			in := preSigned(t)
+			setFlags(t, map[string]string{"resign-policy": tc.policy})
+			logs := captureLogs(t, slog.LevelInfo, "")
+			out, delivered, err := processMail(context.Background(), slog.Default(), envelope{}, in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := signatureCount(out); n != tc.signatures {
+				t.Errorf("%d signatures, want %d", n, tc.signatures)
+			}
+			if (delivered != nil) != tc.receipt {
+				t.Errorf("receipt stored: %v, want %v", delivered != nil, tc.receipt)
+			}
+			if !strings.Contains(logs.String(), `"event":"`+tc.event+`"`) {
+				t.Errorf("decision not logged as %s:\n%s", tc.event, logs.String())
+			}
+			if ar, _ := headerValue(out, "Authentication-Results"); !strings.Contains(ar, "pqc=pass") {
+				t.Errorf("Authentication-Results %q", ar)
+			}
+			if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+				t.Errorf("verify: %+v", r)
+			}
+		})
+	}
+}
+
+func TestResignSkipUnmodified(t *testing.T) {
+	in := preSigned(t)
+	setFlags(t, map[string]string{"resign-policy": resignSkip})
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the verification result is added
+	ar, _ := headerValue(out, "Authentication-Results")
+	if want := insertHeader(in, "Authentication-Results", ar); !bytes.Equal(out, want) {
+		t.Errorf("skipped message changed:\n%q\nwant\n%q", out, want)
+	}
+}
+
+func TestResignBadSignature(t *testing.T) {
+	in := bytes.Replace(preSigned(t), []byte("body"), []byte("b0dy"), 1)
+	for _, policy := range []string{resignSkip, resignReplace} {
+		setFlags(t, map[string]string{"resign-policy": policy})
+		out, _, err := processMail(context.Background(), slog.Default(), envelope{}, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The failed signature stays as evidence, and ours is added
+		if n := signatureCount(out); n != 2 {
+			t.Errorf("%s: %d signatures on a message whose signature failed, want 2", policy, n)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"syscall"
+)
+
+// -reuse-port lets a new gateway take over the listening ports of a running
+// one, for deploys that drop no connections:
+//
+//  1. The running gateway listens with -reuse-port.
+//  2. The new one is started, with -reuse-port, on the same addresses;
+//     the kernel now spreads new connections across both.
+//  3. Once the new one's /ready answers, the old one is sent SIGTERM: it
+//     stops accepting, lets its sessions finish within -shutdown-grace, and
+//     exits.
+//
+// Both must run as the same user. On Linux, connections still waiting in the
+// old gateway's accept queue when it stops are reset rather than handed to
+// the new one; clients retry them like any other dropped connection. Unix
+// socket listeners can't be shared this way.
+var reusePort = flag.Bool("reuse-port", false, "Listen with SO_REUSEPORT, so a new gateway can bind the same TCP ports while this one drains; see reuseport.go for the handoff")
+
+// reusePortControl returns the socket control function for listeners,
+// setting SO_REUSEPORT on TCP ones with -reuse-port, or nil without it
+func reusePortControl() func(network, address string, c syscall.RawConn) error {
+	if !*reusePort {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			return setReusePort(c)
+		}
+		return nil
+	}
+}
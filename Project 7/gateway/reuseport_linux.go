@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+// SO_REUSEPORT, which syscall only has for some Linux architectures
+const soReusePort = 0xf
@@ -0,0 +1,14 @@
+//go:build !((linux && !(mips || mipsle || mips64 || mips64le)) || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// setReusePort fails: there is no SO_REUSEPORT here
+func setReusePort(syscall.RawConn) error {
+	return fmt.Errorf("-reuse-port isn't supported on %s", runtime.GOOS)
+}
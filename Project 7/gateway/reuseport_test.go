@@ -0,0 +1,50 @@
+//go:build (linux && !(mips || mipsle || mips64 || mips64le)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: reusePortControl()}
+	first, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if ln, err := lc.Listen(context.Background(), "tcp", first.Addr().String()); err == nil {
+		ln.Close()
+		t.Fatal("bound a port in use without -reuse-port")
+	}
+
+	setFlag(t, reusePort, true)
+	first.Close()
+	first = listen("127.0.0.1:0")
+	defer first.Close()
+	// A new gateway taking over while this one drains
+	second := listen(first.Addr().String())
+	defer second.Close()
+	for _, ln := range []net.Listener{first, second} {
+		go func(ln net.Listener) {
+			if conn, err := ln.Accept(); err == nil {
+				conn.Close()
+			}
+		}(ln)
+	}
+	conn, err := net.Dial("tcp", first.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// Unix sockets are left alone: binding one fails with SO_REUSEPORT on some
+// systems
+func TestReusePortUnixSocket(t *testing.T) {
+	setFlag(t, reusePort, true)
+	ln := listen("unix:" + t.TempDir() + "/gateway.sock")
+	ln.Close()
+}
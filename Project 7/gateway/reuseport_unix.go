@@ -0,0 +1,22 @@
+//go:build (linux && !(mips || mipsle || mips64 || mips64le)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setReusePort sets SO_REUSEPORT on the socket c, before it is bound
+func setReusePort(c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("SO_REUSEPORT: %w", err)
+	}
+	return nil
+}
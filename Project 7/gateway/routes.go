@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var backendRoutes = flag.String("routes", "", "Backends by recipient domain or TLS server name, as name=backends;name=backends with backends a -postfix style list (other names use -postfix)")
+
+// backendRouter maps recipient domains and TLS server names to the
+// backends serving them
+type backendRouter map[string]*backendPool
+
+// Routes from -routes, set up in main; nil sends everything to postfixBackends
+var router backendRouter
+
+// parseRoutes reads a -routes value into name -> backend list
+func parseRoutes(spec string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, backends, ok := strings.Cut(entry, "=")
+		name = routeName(name)
+		if !ok || name == "" || len(splitList(backends)) == 0 {
+			return nil, fmt.Errorf("route %q must be name=backends", entry)
+		}
+		routes[name] = strings.TrimSpace(backends)
+	}
+	return routes, nil
+}
+
+// formatRoutes is the inverse of parseRoutes
+func formatRoutes(routes map[string]string) string {
+	entries := make([]string, 0, len(routes))
+	for name, backends := range routes {
+		entries = append(entries, name+"="+backends)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ";")
+}
+
+func newBackendRouter(spec string) (backendRouter, error) {
+	routes, err := parseRoutes(spec)
+	if err != nil || len(routes) == 0 {
+		return nil, err
+	}
+	r := backendRouter{}
+	for name, backends := range routes {
+		r[name] = newBackendPool(backends)
+	}
+	return r, nil
+}
+
+// routeName normalizes a domain or server name for lookup
+func routeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// lookup returns the backends routed for name, or nil
+func (r backendRouter) lookup(name string) *backendPool {
+	if name == "" {
+		return nil
+	}
+	return r[routeName(name)]
+}
+
+// recipientDomain returns the domain of a RCPT TO path
+func recipientDomain(path string) string {
+	if i := strings.LastIndexByte(path, '@'); i >= 0 {
+		return path[i+1:]
+	}
+	return ""
+}
+
+// clientServerName is the server name an implicit-TLS client asked for in
+// the handshake finishHandshake completed. Plaintext clients have none.
+func clientServerName(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	return tc.ConnectionState().ServerName
+}
+
+// routeFor returns the backends for a recipient domain, else for the
+// client's TLS server name, else the default ones
+func (s *smtpSession) routeFor(domain string) *backendPool {
+	if p := router.lookup(domain); p != nil {
+		return p
+	}
+	if p := router.lookup(s.serverName); p != nil {
+		return p
+	}
+	return postfixBackends
+}
+
+// routeRecipient picks the transaction's backend at its first RCPT, and
+// reports whether it dealt with cmd itself: by refusing a recipient that
+// routes elsewhere than the ones before it, or by holding the command until
+// the session has moved to the backend it routes to.
+func (s *smtpSession) routeRecipient(cmd []byte) bool {
+	if router == nil || s.link == nil || s.mailCmd == nil {
+		return false
+	}
+	pool := s.routeFor(recipientDomain(commandArg(cmd)))
+	if pool == s.failedPool {
+		s.reply("RCPT", 451, "4.4.1 Recipient's mail server not responding, try again later")
+		return true
+	}
+	if pool != s.pool && authenticator == nil && s.authed {
+		// The backend checked the credentials; another one hasn't seen them
+		s.log.Warn("Not routing recipient of a session authenticated by its backend", "event", "route_skipped",
+			"domain", recipientDomain(commandArg(cmd)))
+		pool = s.pool
+	}
+	switch {
+	case s.txnPool == nil:
+		s.txnPool = pool
+	case pool != s.txnPool:
+		s.reply("RCPT", 452, "4.5.3 Recipient is served by another backend, send it in a new transaction")
+		return true
+	}
+	if pool == s.pool {
+		return false
+	}
+	// Read no further until every reply from the current backend is in;
+	// the command is read again once the session has switched
+	s.line = append(append([]byte(nil), cmd...), s.line...)
+	s.reroute = pool
+	s.inflight = append(s.inflight, pendingReply{route: pool})
+	return true
+}
+
+// finishReroute moves the session to the held transaction's backend once
+// the old one has answered everything, then lets commands be read again
+func (s *smtpSession) finishReroute(pool *backendPool) {
+	s.reroute, s.resume = nil, true
+	if err := s.switchBackend(pool); err != nil {
+		s.log.Warn("Failed to switch to routed backend", "event", "backend_route_failed", "error", err)
+		s.failedPool, s.txnPool = pool, nil
+	}
+}
+
+// switchBackend connects to a backend from pool and brings it to where the
+// current one is, greeted and in the client's transaction, before swapping
+// it in
+func (s *smtpSession) switchBackend(pool *backendPool) error {
+	conn, addr, err := pool.dial(s.log)
+	if err != nil {
+		return err
+	}
+	if err := replaySession(conn, s.xclientCmd, s.heloCmd, s.mailCmd); err != nil {
+		conn.Close()
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	s.link.swap(conn)
+	s.pool = pool
+	s.log.Info("Switched backend for recipient domain", "event", "backend_routed", "backend", addr)
+	return nil
+}
+
+// replaySession waits for a new backend's greeting, then sends it the
+// client's commands so far, e.g. XCLIENT, EHLO and MAIL, each of which it
+// must accept. DATA must be answered with 354.
+func replaySession(conn net.Conn, cmds ...[]byte) error {
+	conn.SetDeadline(time.Now().Add(*backendDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	if _, _, err := r.ReadResponse(220); err != nil {
+		return fmt.Errorf("greeting: %w", err)
+	}
+	for _, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		if _, err := conn.Write(cmd); err != nil {
+			return err
+		}
+		expect := 2
+		if commandVerb(cmd) == "DATA" {
+			expect = 3
+		}
+		if _, _, err := r.ReadResponse(expect); err != nil {
+			return fmt.Errorf("%s: %w", commandVerb(cmd), err)
+		}
+	}
+	return nil
+}
+
+// backendLink is a session's backend connection, which a routed
+// transaction or a resent message can replace. The session only switches
+// once the old backend has answered everything, or can answer nothing more,
+// so whatever is read from a replaced connection afterwards is dropped.
+type backendLink struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	gen      int       // bumped by every swap
+	deadline time.Time // read deadline, carried over to a new connection
+	closed   bool
+	stopped  bool // reads interrupted for good
+	// holding is set while a message write that may be resent is
+	// outstanding: a read error then waits to see if the connection is
+	// replaced rather than ending the session
+	holding bool
+	settled sync.Cond // signalled when holding is cleared or the link closes
+}
+
+func newBackendLink(conn net.Conn) *backendLink {
+	l := &backendLink{conn: conn}
+	l.settled.L = &l.mu
+	return l
+}
+
+// hold makes read errors wait for release
+func (l *backendLink) hold() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holding = true
+}
+
+func (l *backendLink) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holding = false
+	l.settled.Broadcast()
+}
+
+func (l *backendLink) current() (net.Conn, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conn, l.gen
+}
+
+// swap makes conn the backend connection and closes the old one
+func (l *backendLink) swap(conn net.Conn) {
+	l.mu.Lock()
+	old := l.conn
+	l.conn = conn
+	l.gen++
+	conn.SetReadDeadline(l.deadline)
+	l.mu.Unlock()
+
+	old.SetWriteDeadline(time.Now().Add(time.Second))
+	old.Write([]byte("QUIT\r\n"))
+	old.Close()
+}
+
+// interrupt ends a pending Read, and fails any later one, without closing
+// the connection
+func (l *backendLink) interrupt() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	l.conn.SetReadDeadline(time.Now())
+	l.settled.Broadcast()
+}
+
+func (l *backendLink) Read(p []byte) (int, error) {
+	for {
+		conn, gen := l.current()
+		n, err := conn.Read(p)
+		l.mu.Lock()
+		for err != nil && gen == l.gen && l.holding && !l.closed && !l.stopped {
+			l.settled.Wait()
+		}
+		stale := gen != l.gen && !l.closed
+		l.mu.Unlock()
+		if !stale {
+			return n, err
+		}
+	}
+}
+
+func (l *backendLink) Write(p []byte) (int, error) {
+	conn, _ := l.current()
+	return conn.Write(p)
+}
+
+func (l *backendLink) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.settled.Broadcast()
+	return l.conn.Close()
+}
+
+func (l *backendLink) SetReadDeadline(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deadline = t
+	if l.stopped {
+		return nil
+	}
+	return l.conn.SetReadDeadline(t)
+}
+
+func (l *backendLink) SetWriteDeadline(t time.Time) error {
+	conn, _ := l.current()
+	return conn.SetWriteDeadline(t)
+}
+
+func (l *backendLink) SetDeadline(t time.Time) error {
+	if err := l.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return l.SetWriteDeadline(t)
+}
+
+func (l *backendLink) LocalAddr() net.Addr {
+	conn, _ := l.current()
+	return conn.LocalAddr()
+}
+
+func (l *backendLink) RemoteAddr() net.Addr {
+	conn, _ := l.current()
+	return conn.RemoteAddr()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useRoutes routes name to a new test backend for each name, for the test
+func useRoutes(t *testing.T, names ...string) map[string]*testBackend {
+	t.Helper()
+	backends := map[string]*testBackend{}
+	var spec []string
+	for _, name := range names {
+		b, addr := listenTestBackend(t)
+		backends[name] = b
+		spec = append(spec, name+"="+addr)
+	}
+	setRoutes(t, strings.Join(spec, ";"))
+	return backends
+}
+
+func setRoutes(t *testing.T, spec string) {
+	t.Helper()
+	old := router
+	r, err := newBackendRouter(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router = r
+	t.Cleanup(func() { router = old })
+}
+
+// sendTo runs one transaction to rcpt, past an EHLO already sent
+func sendTo(t *testing.T, c *textproto.Conn, rcpt, body string) {
+	t.Helper()
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<"+rcpt+">")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 250)
+}
+
+// holds reports whether b got exactly one message, containing marker
+func holds(b *testBackend, marker string) bool {
+	msgs := b.messages()
+	return len(msgs) == 1 && strings.Contains(msgs[0], marker)
+}
+
+func TestRoutesByRecipientDomain(t *testing.T) {
+	def := startTestBackend(t)
+	routed := useRoutes(t, "a.example", "b.example")
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	sendTo(t, c, "x@a.example", "Subject: for a\r\n\r\nbody\r\n")
+	sendTo(t, c, "y@B.Example", "Subject: for b\r\n\r\nbody\r\n")
+	sendTo(t, c, "z@other.example", "Subject: for default\r\n\r\nbody\r\n")
+	command(t, c, 221, "QUIT")
+
+	if !holds(routed["a.example"], "for a") {
+		t.Errorf("a.example backend got %q", routed["a.example"].messages())
+	}
+	if !holds(routed["b.example"], "for b") {
+		t.Errorf("b.example backend got %q", routed["b.example"].messages())
+	}
+	if !holds(def, "for default") {
+		t.Errorf("default backend got %q", def.messages())
+	}
+}
+
+func TestRoutesMixedTransaction(t *testing.T) {
+	startTestBackend(t)
+	routed := useRoutes(t, "a.example", "b.example")
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<x@a.example>")
+	command(t, c, 452, "RCPT TO:<y@b.example>")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte("Subject: for a\r\n\r\nbody\r\n"))
+	w.Close()
+	expect(t, c, 250)
+
+	if !holds(routed["a.example"], "for a") || len(routed["b.example"].messages()) != 0 {
+		t.Errorf("a.example got %q, b.example got %q", routed["a.example"].messages(), routed["b.example"].messages())
+	}
+}
+
+func TestRoutesPipelined(t *testing.T) {
+	startTestBackend(t)
+	routed := useRoutes(t, "a.example")
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<x@a.example>\r\nRCPT TO:<y@a.example>\r\nDATA")
+	expect(t, c, 250)
+	expect(t, c, 250)
+	expect(t, c, 250)
+	expect(t, c, 354)
+	w := c.DotWriter()
+	w.Write([]byte("Subject: pipelined\r\n\r\nbody\r\n"))
+	w.Close()
+	expect(t, c, 250)
+
+	if !holds(routed["a.example"], "pipelined") {
+		t.Errorf("a.example backend got %q", routed["a.example"].messages())
+	}
+}
+
+func TestRouteUnavailable(t *testing.T) {
+	def := startTestBackend(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	setRoutes(t, "down.example="+down)
+
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 451, "RCPT TO:<x@down.example>")
+	command(t, c, 250, "RCPT TO:<y@other.example>")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte("Subject: still delivered\r\n\r\nbody\r\n"))
+	w.Close()
+	expect(t, c, 250)
+
+	if !holds(def, "still delivered") {
+		t.Errorf("default backend got %q", def.messages())
+	}
+}
+
+func TestRouteByServerName(t *testing.T) {
+	startTestBackend(t)
+	routed := useRoutes(t, "b.example")
+	dir := t.TempDir()
+	oldCert, oldKey := *certFile, *keyFile
+	*certFile, *keyFile = filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")
+	t.Cleanup(func() { *certFile, *keyFile = oldCert, oldKey })
+	config, err := getHybridTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(tls.Server(conn, config), nil)
+		}
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "B.example", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(conn)
+	t.Cleanup(func() { c.Close() })
+	expect(t, c, 220)
+	command(t, c, 250, "EHLO client.example.com")
+	sendTo(t, c, "x@example.com", "Subject: by name\r\n\r\nbody\r\n")
+
+	if !holds(routed["b.example"], "by name") {
+		t.Errorf("b.example backend got %q", routed["b.example"].messages())
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	got, err := parseRoutes(" A.example. = mx1:25,mx2:25 ; b.example=unix:/run/b ;")
+	want := map[string]string{"a.example": "mx1:25,mx2:25", "b.example": "unix:/run/b"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, %v; want %q", got, err, want)
+	}
+	if s := formatRoutes(map[string]string{"b": "mx:25", "a": "mx:26"}); s != "a=mx:26;b=mx:25" {
+		t.Errorf("formatRoutes = %q", s)
+	}
+	for _, spec := range []string{"a.example", "=mx:25", "a.example=", "a.example= , "} {
+		if _, err := parseRoutes(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var sigDomainKeys = flag.String("sig-domain-keys", "", "File of signing keys by sender domain, a line each of \"domain secret-key-file public-key-file\" (# starts a comment); mail from other senders is signed with -sig-key. Reloaded on SIGHUP (liboqs builds only)")
+
+// senderKeyring holds a key ring per sender domain, for tenants that sign
+// with keys of their own. Each domain's ring keeps the keys it replaced,
+// like signingKeys, so its mail signed before a reload still verifies.
+type senderKeyring struct {
+	mu    sync.RWMutex
+	rings map[string]*keyRing // by routeName of the domain
+}
+
+// Signing keys by sender domain, from -sig-domain-keys
+var senderKeys senderKeyring
+
+// signerFor returns the key to sign mail from sender, a MAIL FROM path,
+// with: its domain's if it has one, else the active default key. As with
+// currentSigner, callers keep it for the whole message.
+func signerFor(sender string) Signer {
+	if s := senderKeys.signer(recipientDomain(sender)); s != nil {
+		return s
+	}
+	return currentSigner()
+}
+
+// keyVerifier returns the Verifier for a kid= value from any loaded key,
+// the default ones first, or nil if none matches
+func keyVerifier(kid string) Verifier {
+	if v := signingKeys.verifier(kid); v != nil || kid == "" {
+		return v
+	}
+	return senderKeys.verifier(kid)
+}
+
+func (k *senderKeyring) signer(domain string) Signer {
+	if domain == "" {
+		return nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if ring := k.rings[routeName(domain)]; ring != nil {
+		return ring.current()
+	}
+	return nil
+}
+
+func (k *senderKeyring) verifier(kid string) Verifier {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, ring := range k.rings {
+		if v := ring.verifier(kid); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// set makes keys the domains' active keys. A domain no longer listed stops
+// being signed for at once, its mail falling back to the default key, but
+// its keys still verify until they would have been retired.
+func (k *senderKeyring) set(keys map[string]Signer) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.rings == nil {
+		k.rings = map[string]*keyRing{}
+	}
+	for domain, ring := range k.rings {
+		if _, ok := keys[domain]; !ok && ring.current() != nil {
+			ring.rotate(nil)
+		}
+	}
+	for domain, s := range keys {
+		ring := k.rings[domain]
+		if ring == nil {
+			ring = &keyRing{}
+			k.rings[domain] = ring
+		}
+		if old := ring.current(); old == nil || old.KeyID() != s.KeyID() {
+			ring.rotate(s)
+		}
+	}
+}
+
+// domainKeyFiles is a -sig-domain-keys entry
+type domainKeyFiles struct {
+	key, publicKey string
+}
+
+// parseDomainKeys reads a -sig-domain-keys file. Blank lines and those
+// starting with # are skipped.
+func parseDomainKeys(b []byte) (map[string]domainKeyFiles, error) {
+	files := map[string]domainKeyFiles{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || routeName(fields[0]) == "" {
+			return nil, fmt.Errorf("line %d: %q is not \"domain secret-key-file public-key-file\"", n, line)
+		}
+		domain := routeName(fields[0])
+		if _, dup := files[domain]; dup {
+			return nil, fmt.Errorf("line %d: %s is listed twice", n, domain)
+		}
+		files[domain] = domainKeyFiles{key: fields[1], publicKey: fields[2]}
+	}
+	return files, sc.Err()
+}
+
+// loadSenderKeys loads the -sig-domain-keys key pairs and makes them
+// active. Nothing changes unless every one loads, so a key being replaced
+// on disk leaves that domain, and the rest, as they were.
+func loadSenderKeys(reason string) error {
+	if *sigDomainKeys == "" {
+		return nil
+	}
+	b, err := os.ReadFile(*sigDomainKeys)
+	if err != nil {
+		return fmt.Errorf("-sig-domain-keys: %w", err)
+	}
+	files, err := parseDomainKeys(b)
+	if err != nil {
+		return fmt.Errorf("-sig-domain-keys: %s: %w", *sigDomainKeys, err)
+	}
+	keys := map[string]Signer{}
+	for domain, f := range files {
+		if keys[domain], err = loadSigner(*sigAlg, f.key, f.publicKey); err != nil {
+			return fmt.Errorf("-sig-domain-keys: %s: %w", domain, err)
+		}
+	}
+	senderKeys.set(keys)
+
+	domains := make([]string, 0, len(keys))
+	for domain := range keys {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	slog.Info("Loaded sender domain signing keys", "event", "signer_domain_keys", "reason", reason, "domains", domains)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSenderKeys makes keys the sender domain keys for the rest of the test
+func useSenderKeys(t *testing.T, keys map[string]Signer) {
+	senderKeys.mu.Lock()
+	old := senderKeys.rings
+	senderKeys.rings = nil
+	senderKeys.mu.Unlock()
+	senderKeys.set(keys)
+	t.Cleanup(func() {
+		senderKeys.mu.Lock()
+		senderKeys.rings = old
+		senderKeys.mu.Unlock()
+	})
+}
+
+func TestParseDomainKeys(t *testing.T) {
+	files, err := parseDomainKeys([]byte("# tenants\nTenant-A.example. /keys/a.key /keys/a.pub\n\ntenant-b.example\t/keys/b.key  /keys/b.pub\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]domainKeyFiles{
+		"tenant-a.example": {"/keys/a.key", "/keys/a.pub"},
+		"tenant-b.example": {"/keys/b.key", "/keys/b.pub"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %v, want %v", files, want)
+	}
+	for domain, f := range want {
+		if files[domain] != f {
+			t.Errorf("%s: %+v, want %+v", domain, files[domain], f)
+		}
+	}
+
+	for _, bad := range []string{"tenant-c.example /keys/c.key\n", "TENANT-A.example /keys/x.key /keys/x.pub\n"} {
+		if _, err := parseDomainKeys([]byte("tenant-a.example /keys/a.key /keys/a.pub\n" + bad)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: %v, want an error on line 2", bad, err)
+		}
+	}
+}
+
+func TestSignerForSenderDomain(t *testing.T) {
+	defaultKey, keyA, keyB := testKey{"default public key"}, testKey{"tenant A public key"}, testKey{"tenant B public key"}
+	useSigner(t, defaultKey)
+	useSenderKeys(t, map[string]Signer{"tenant-a.example": keyA, "tenant-b.example": keyB})
+
+	for sender, want := range map[string]testKey{
+		"alice@tenant-a.example": keyA,
+		"bob@Tenant-B.Example":   keyB,
+		"carol@other.example":    defaultKey,
+		"":                       defaultKey, // null sender, a bounce
+	} {
+		store := &memReceiptStore{calls: make(chan Receipt, 1)}
+		useReceipts(t, store)
+		out, delivered, err := processMail(context.Background(), slog.Default(), envelope{mailFrom: sender}, testMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivered()
+		if kid := signatureTags(t, out)["kid"]; kid != want.KeyID() {
+			t.Errorf("%q signed with kid=%s, want %s", sender, kid, want.KeyID())
+		}
+		if r := <-store.calls; r.KeyID != want.KeyID() {
+			t.Errorf("%q receipt names kid %s, want %s", sender, r.KeyID, want.KeyID())
+		}
+		if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+			t.Errorf("%q: signed message doesn't verify: %+v", sender, r)
+		}
+	}
+}
+
+func TestSenderKeysReload(t *testing.T) {
+	useSigner(t, testKey{"default public key"})
+	oldA, newA, keyB := testKey{"tenant A old key"}, testKey{"tenant A new key"}, testKey{"tenant B key"}
+	useSenderKeys(t, map[string]Signer{"tenant-a.example": oldA, "tenant-b.example": keyB})
+
+	senderKeys.set(map[string]Signer{"tenant-a.example": newA})
+	if s := signerFor("alice@tenant-a.example"); s != newA {
+		t.Errorf("tenant A signs with %v, want the new key", s)
+	}
+	if s := signerFor("bob@tenant-b.example"); s != currentSigner() {
+		t.Errorf("tenant B, no longer listed, signs with %v, want the default key", s)
+	}
+	// Mail signed before the reload still verifies
+	for _, k := range []testKey{oldA, newA, keyB} {
+		if keyVerifier(k.KeyID()) == nil {
+			t.Errorf("kid %s no longer verifies", k.KeyID())
+		}
+	}
+	if keyVerifier("0000000000000000") != nil {
+		t.Error("unknown kid has a verifier")
+	}
+}
+
+func TestLoadSenderKeysInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "domain-keys")
+	if err := os.WriteFile(file, []byte("tenant-a.example a.key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{"sig-domain-keys": file})
+	if err := loadSenderKeys("test"); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("got %v, want an error naming line 1", err)
+	}
+}
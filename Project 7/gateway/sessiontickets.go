@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"time"
+)
+
+var (
+	tlsSessionTickets = flag.Bool("tls-session-tickets", true, "Let clients resume TLS sessions with tickets (false makes every connection a full handshake, for strict forward secrecy)")
+	tlsTicketRotation = flag.Duration("tls-ticket-rotation", time.Hour, "How often a new session ticket key is generated; a ticket stays valid for two rotations (0 leaves keys to crypto/tls, which rotates daily)")
+)
+
+// Ticket keys in use: the newest encrypts new tickets, the previous one
+// still decrypts tickets it issued
+const ticketKeysKept = 2
+
+// ticketKeys rotates the keys session tickets are encrypted with. They are
+// only ever held in memory, so a restart invalidates every ticket.
+type ticketKeys struct {
+	config *tls.Config
+	keys   [][32]byte // newest first
+}
+
+// newTicketKeys installs a fresh key on config
+func newTicketKeys(config *tls.Config) (*ticketKeys, error) {
+	t := &ticketKeys{config: config}
+	return t, t.rotate()
+}
+
+// rotate starts encrypting tickets with a new key, dropping the oldest
+func (t *ticketKeys) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	t.keys = append([][32]byte{key}, t.keys...)
+	if len(t.keys) > ticketKeysKept {
+		t.keys = t.keys[:ticketKeysKept]
+	}
+	// Per-connection configs are cloned from config, so they pick the keys
+	// up from their next handshake
+	t.config.SetSessionTicketKeys(t.keys)
+	return nil
+}
+
+// run rotates the keys every interval
+func (t *ticketKeys) run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if err := t.rotate(); err != nil {
+			slog.Error("Failed to rotate TLS session ticket key", "event", "tls_ticket_key_failed", "error", err)
+			continue
+		}
+		slog.Debug("Rotated TLS session ticket key", "event", "tls_ticket_key_rotated")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ticketConfig is the gateway's TLS config with -tls-session-tickets set to
+// enabled
+func ticketConfig(t *testing.T, enabled bool) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	oldCert, oldKey, oldTickets := *certFile, *keyFile, *tlsSessionTickets
+	*certFile, *keyFile = filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")
+	*tlsSessionTickets = enabled
+	t.Cleanup(func() { *certFile, *keyFile, *tlsSessionTickets = oldCert, oldKey, oldTickets })
+	config, err := getHybridTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// resumed connects to config with a client keeping its tickets in cache,
+// reporting whether the server resumed the session
+func resumed(t *testing.T, config *tls.Config, cache tls.ClientSessionCache) bool {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+
+	done := make(chan error, 1)
+	go func() {
+		c := tls.Client(client, &tls.Config{InsecureSkipVerify: true, ServerName: "gateway", ClientSessionCache: cache})
+		// Reading processes the tickets the server sends after the handshake
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	s := tls.Server(server, config)
+	if err := s.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if _, err := s.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	return s.ConnectionState().DidResume
+}
+
+func TestSessionResumption(t *testing.T) {
+	config := ticketConfig(t, true)
+	if _, err := newTicketKeys(config); err != nil {
+		t.Fatal(err)
+	}
+	cache := tls.NewLRUClientSessionCache(4)
+	if resumed(t, config, cache) {
+		t.Fatal("first connection resumed")
+	}
+	if !resumed(t, config, cache) {
+		t.Error("session not resumed")
+	}
+}
+
+func TestSessionResumptionDisabled(t *testing.T) {
+	config := ticketConfig(t, false)
+	cache := tls.NewLRUClientSessionCache(4)
+	resumed(t, config, cache)
+	if resumed(t, config, cache) {
+		t.Error("session resumed with -tls-session-tickets=false")
+	}
+}
+
+func TestTicketKeyRotation(t *testing.T) {
+	config := ticketConfig(t, true)
+	keys, err := newTicketKeys(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := tls.NewLRUClientSessionCache(4)
+	resumed(t, config, cache)
+
+	// A ticket outlives one rotation, but not two
+	keys.rotate()
+	if !resumed(t, config, cache) {
+		t.Error("ticket from the previous key refused")
+	}
+	keys.rotate()
+	keys.rotate()
+	if resumed(t, config, cache) {
+		t.Error("ticket resumed after its key was dropped")
+	}
+	if len(keys.keys) != ticketKeysKept {
+		t.Errorf("%d keys kept, want %d", len(keys.keys), ticketKeysKept)
+	}
+}
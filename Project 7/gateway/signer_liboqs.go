@@ -0,0 +1,217 @@
+//go:build liboqs
+
+package main
+
+/*
+#cgo LDFLAGS: -loqs
+#include <stdlib.h>
+#include <oqs/oqs.h>
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+// Names the signing implementation in /health
+const signerImplementation = "liboqs"
+
+// PQC signer backed by liboqs
+type oqsSigner struct {
+	alg       string // -sig-alg name
+	kid       string
+	sig       *C.OQS_SIG
+	secretKey []byte
+	publicKey []byte
+}
+
+func newSigner(alg string) (Signer, error) {
+	alg = strings.ToLower(alg)
+	oqsName, err := lookupSigAlg(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if *sigKeyFile == "" {
+		// Demo convenience: an ephemeral key signs fine but nobody can
+		// verify its signatures after a restart
+		slog.Warn("No -sig-key given, generating an ephemeral key pair", "event", "signer_ephemeral_key", "alg", oqsName)
+		return generateOQSSigner(alg, oqsName)
+	}
+	// kid= is derived from the public key, and liboqs can't recover it
+	// from the secret key for every algorithm
+	if *sigPubKeyFile == "" {
+		return nil, errors.New("-sig-key requires -sig-pubkey")
+	}
+	return loadSigner(alg, *sigKeyFile, *sigPubKeyFile)
+}
+
+// loadSigner reads a key pair for alg from keyFile and pubKeyFile, and
+// checks they belong together
+func loadSigner(alg, keyFile, pubKeyFile string) (Signer, error) {
+	alg = strings.ToLower(alg)
+	oqsName, err := lookupSigAlg(alg)
+	if err != nil {
+		return nil, err
+	}
+	warnIfExposed(keyFile)
+	secretKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %w", err)
+	}
+	publicKey, err := os.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	s, err := newOQSSigner(alg, oqsName, secretKey, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	// Catch a key pair replaced one file at a time before signing with it
+	probe := []byte("pqc-gateway key check")
+	sig, err := s.Sign(context.Background(), probe)
+	if err == nil {
+		err = s.Verify(context.Background(), probe, sig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s does not match %s: %w", pubKeyFile, keyFile, err)
+	}
+	return s, nil
+}
+
+// loadVerifier reads a public key for alg from pubKeyFile, to check
+// signatures without the secret key; the Signer it returns can't sign
+func loadVerifier(alg, pubKeyFile string) (Signer, error) {
+	alg = strings.ToLower(alg)
+	oqsName, err := lookupSigAlg(alg)
+	if err != nil {
+		return nil, err
+	}
+	if pubKeyFile == "" {
+		return nil, errors.New("verifying needs the signer's public key")
+	}
+	publicKey, err := os.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %w", err)
+	}
+	sig, err := newOQSSig(oqsName)
+	if err != nil {
+		return nil, err
+	}
+	if len(publicKey) != int(sig.length_public_key) {
+		C.OQS_SIG_free(sig)
+		return nil, fmt.Errorf("%s public key must be %d bytes, got %d", oqsName, sig.length_public_key, len(publicKey))
+	}
+	return &oqsSigner{alg: alg, kid: keyID(publicKey), sig: sig, publicKey: publicKey}, nil
+}
+
+// newOQSSigner wraps an existing key pair
+func newOQSSigner(alg, oqsName string, secretKey, publicKey []byte) (*oqsSigner, error) {
+	sig, err := newOQSSig(oqsName)
+	if err != nil {
+		return nil, err
+	}
+	if len(secretKey) != int(sig.length_secret_key) {
+		C.OQS_SIG_free(sig)
+		return nil, fmt.Errorf("%s secret key must be %d bytes, got %d", oqsName, sig.length_secret_key, len(secretKey))
+	}
+	if len(publicKey) != int(sig.length_public_key) {
+		C.OQS_SIG_free(sig)
+		return nil, fmt.Errorf("%s public key must be %d bytes, got %d", oqsName, sig.length_public_key, len(publicKey))
+	}
+	return &oqsSigner{alg: alg, kid: keyID(publicKey), sig: sig, secretKey: secretKey, publicKey: publicKey}, nil
+}
+
+// generateOQSSigner creates a signer with a fresh key pair
+func generateOQSSigner(alg, oqsName string) (*oqsSigner, error) {
+	sig, err := newOQSSig(oqsName)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := make([]byte, sig.length_public_key)
+	secretKey := make([]byte, sig.length_secret_key)
+	if C.OQS_SIG_keypair(sig, bytesPtr(publicKey), bytesPtr(secretKey)) != C.OQS_SUCCESS {
+		C.OQS_SIG_free(sig)
+		return nil, fmt.Errorf("%s key generation failed", oqsName)
+	}
+	return &oqsSigner{alg: alg, kid: keyID(publicKey), sig: sig, secretKey: secretKey, publicKey: publicKey}, nil
+}
+
+func newOQSSig(alg string) (*C.OQS_SIG, error) {
+	name := C.CString(alg)
+	defer C.free(unsafe.Pointer(name))
+	sig := C.OQS_SIG_new(name)
+	if sig == nil {
+		return nil, fmt.Errorf("liboqs does not support %s (disabled at build time?)", alg)
+	}
+	return sig, nil
+}
+
+func (s *oqsSigner) Algorithm() string {
+	return s.alg
+}
+
+func (s *oqsSigner) KeyID() string {
+	return s.kid
+}
+
+// Sign returns the base64-encoded signature over data
+func (s *oqsSigner) Sign(ctx context.Context, data []byte) ([]byte, error) {
+	// liboqs calls can't be interrupted, but don't start one for a dead session
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.secretKey == nil {
+		return nil, errors.New("no secret key loaded")
+	}
+	sig := make([]byte, s.sig.length_signature)
+	var sigLen C.size_t
+	rc := C.OQS_SIG_sign(s.sig, bytesPtr(sig), &sigLen,
+		bytesPtr(data), C.size_t(len(data)), bytesPtr(s.secretKey))
+	if rc != C.OQS_SUCCESS {
+		return nil, errors.New("liboqs signing failed")
+	}
+
+	out := make([]byte, base64.StdEncoding.EncodedLen(int(sigLen)))
+	base64.StdEncoding.Encode(out, sig[:sigLen])
+	return out, nil
+}
+
+// Verify checks a base64-encoded signature produced by Sign
+func (s *oqsSigner) Verify(ctx context.Context, data, signature []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.publicKey == nil {
+		return errNoVerifyKey
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(signature))
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	// length_signature is the maximum; Falcon's are usually shorter
+	if len(raw) == 0 || len(raw) > int(s.sig.length_signature) {
+		return fmt.Errorf("%d-byte signature, want at most %d", len(raw), s.sig.length_signature)
+	}
+	rc := C.OQS_SIG_verify(s.sig, bytesPtr(data), C.size_t(len(data)),
+		bytesPtr(raw), C.size_t(len(raw)), bytesPtr(s.publicKey))
+	if rc != C.OQS_SUCCESS {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// bytesPtr returns a C pointer to b's backing array, or nil when b is empty
+func bytesPtr(b []byte) *C.uint8_t {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.uint8_t)(unsafe.Pointer(&b[0]))
+}
@@ -0,0 +1,62 @@
+//go:build liboqs
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestFalconSignVerify(t *testing.T) {
+	for _, alg := range []string{"falcon-512", "falcon-1024"} {
+		t.Run(alg, func(t *testing.T) {
+			oqsName, err := lookupSigAlg(alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := generateOQSSigner(alg, oqsName)
+			if err != nil {
+				t.Skip(err)
+			}
+			useSigner(t, s)
+
+			for i := 0; i < 8; i++ {
+				msg := fmt.Appendf(nil, "From: a@example.com\r\nSubject: message %d\r\n\r\nbody\r\n", i)
+				out, _, err := processMail(context.Background(), slog.Default(), envelope{}, msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, line := range strings.Split(string(out[:headerEnd(out)]), "\r\n") {
+					if len(line) > maxHeaderLine {
+						t.Errorf("%d-character header line %q", len(line), line)
+					}
+				}
+				v, _ := headerValue(out, "X-PQC-Signature")
+				tags, err := parseSignatureHeader(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, err := base64.StdEncoding.DecodeString(tags["sig"])
+				if err != nil || len(raw) == 0 || len(raw) > int(s.sig.length_signature) {
+					t.Errorf("%d-byte signature (%v), want 1 to %d", len(raw), err, s.sig.length_signature)
+				}
+				if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+					t.Errorf("signed message: %v", r)
+				}
+				tampered := []byte(strings.Replace(string(out), "body", "b0dy", 1))
+				if r := verifyMessage(context.Background(), tampered); r.status != verifyFail {
+					t.Errorf("tampered message: %v", r)
+				}
+			}
+
+			long := []byte(strings.Repeat("QUJD", int(s.sig.length_signature)))
+			if err := s.Verify(context.Background(), []byte("data"), long); err == nil {
+				t.Error("verified a signature over the maximum length")
+			}
+		})
+	}
+}
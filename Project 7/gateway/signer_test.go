@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestFormatSignatureHeader(t *testing.T) {
+	sig := []byte(strings.Repeat("QUJD", 40) + "==")
+	value, err := formatSignatureHeader("ml-dsa-65", "0123456789abcdef", "1700000000.0123456789abcdef", canonRelaxed, "", []string{"From", "Subject"}, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := parseSignatureHeader(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[string]string{
+		"alg": "ml-dsa-65", "kid": "0123456789abcdef", "n": "1700000000.0123456789abcdef", "c": canonRelaxed, "h": "From:Subject", "sig": string(sig),
+	} {
+		if tags[tag] != want {
+			t.Errorf("%s=%q, want %q", tag, tags[tag], want)
+		}
+	}
+
+	value, _ = formatSignatureHeader("ml-dsa-65", "", "", canonRelaxed, "", nil, []byte("c2ln"))
+	if value != "alg=ml-dsa-65; c=relaxed/relaxed; sig=c2ln" {
+		t.Errorf("keyless, all headers: %q", value)
+	}
+}
+
+func TestFormatSignatureHeaderInjection(t *testing.T) {
+	sig := []byte("c2ln")
+	for _, tc := range []struct {
+		name                   string
+		alg, kid, nonce, canon string
+		headers                []string
+		sig                    []byte
+	}{
+		{"CRLF in alg", "ml-dsa-65\r\nBcc: victim@example.com", "", "", canonRelaxed, nil, sig},
+		{"bare LF in kid", "ml-dsa-65", "abc\nX-Evil: 1", "", canonRelaxed, nil, sig},
+		{"tag smuggled in kid", "ml-dsa-65", "abc; alg=none", "", canonRelaxed, nil, sig},
+		{"tag smuggled in n", "ml-dsa-65", "", "1700000000; alg=none", canonRelaxed, nil, sig},
+		{"tag smuggled in c", "ml-dsa-65", "", "", "simple; sig=forged", nil, sig},
+		{"semicolon in h", "ml-dsa-65", "", "", canonRelaxed, []string{"From; sig=forged"}, sig},
+		{"colon in h name", "ml-dsa-65", "", "", canonRelaxed, []string{"From:To"}, sig},
+		{"space in h name", "ml-dsa-65", "", "", canonRelaxed, []string{"From To"}, sig},
+		{"CR in sig", "ml-dsa-65", "", "", canonRelaxed, nil, []byte("c2ln\rX")},
+		{"semicolon in sig", "ml-dsa-65", "", "", canonRelaxed, nil, []byte("c2ln;kid=x")},
+		{"NUL in sig", "ml-dsa-65", "", "", canonRelaxed, nil, []byte("c2ln\x00")},
+		{"non-ASCII in alg", "ml-dsa-65é", "", "", canonRelaxed, nil, sig},
+		{"empty sig", "ml-dsa-65", "", "", canonRelaxed, nil, nil},
+	} {
+		if v, err := formatSignatureHeader(tc.alg, tc.kid, tc.nonce, tc.canon, "", tc.headers, tc.sig); err == nil {
+			t.Errorf("%s: accepted as %q", tc.name, v)
+		}
+	}
+}
+
+func TestChunkSignature(t *testing.T) {
+	sig := []byte(strings.Repeat("A", 2*sigChunk+10))
+	chunks := strings.Split(chunkSignature(sig), " ")
+	if len(chunks) != 3 || len(chunks[0]) != sigChunk || len(chunks[2]) != 10 {
+		t.Errorf("chunks of %d, %d, %d", len(chunks[0]), len(chunks[1]), len(chunks[len(chunks)-1]))
+	}
+	if got := chunkSignature([]byte("short")); got != "short" {
+		t.Errorf("short signature chunked: %q", got)
+	}
+}
+
+func TestFalconSizedSignaturesFold(t *testing.T) {
+	// Compressed Falcon signatures vary in length from message to message;
+	// these span Falcon-512's typical sizes to Falcon-1024's maximum
+	for _, size := range []int{617, 652, 666, 690, 752, 1270, 1462} {
+		raw := make([]byte, size)
+		rand.Read(raw)
+		sig := []byte(base64.StdEncoding.EncodeToString(raw))
+		value, err := formatSignatureHeader("falcon-512", "0123456789abcdef", "", canonRelaxed, "", signedHeaderList(), sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := insertHeader([]byte("From: a@x\r\nSubject: hi\r\n\r\nbody\r\n"), "X-PQC-Signature", value)
+		for _, line := range strings.Split(string(msg[:headerEnd(msg)]), "\r\n") {
+			if len(line) > maxHeaderLine {
+				t.Errorf("%d-byte signature: %d-character line %q", size, len(line), line)
+			}
+		}
+		v, _ := headerValue(msg, "X-PQC-Signature")
+		tags, err := parseSignatureHeader(v)
+		if err != nil || tags["sig"] != string(sig) {
+			t.Errorf("%d-byte signature doesn't parse back: %v", size, err)
+		}
+	}
+}
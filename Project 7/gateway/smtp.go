@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SMTP session phases
+type smtpPhase int
+
+const (
+	phaseCommand      smtpPhase = iota // relaying commands
+	phaseDataPending                   // DATA received, waiting on earlier replies to answer it
+	phaseData                          // accumulating the message body
+	phaseDataDiscard                   // message over -max-message-size, skipping to its end
+	phaseChunk                         // reading a BDAT chunk
+	phaseChunkPending                  // BDAT LAST read, waiting on earlier replies to hand the message on
+	phaseDataStream                    // passing a message over -stream-above on as it arrives
+)
+
+var crlf = []byte("\r\n")
+
+// Longest AUTH line accepted: they can legitimately reach 12288 octets
+// (RFC 4954 section 4), whatever -max-line-length says
+const maxCommandLine = 16 * 1024
+
+// pendingReply is a command still owed a reply, in the order the client
+// sent it. Most are answered by the backend; commands the gateway handles
+// itself carry their reply in local so it can be sent in sequence.
+type pendingReply struct {
+	verb  string
+	arg   string // command argument, e.g. the RCPT TO path
+	cmd   []byte // RCPT line as sent, replayed if the message is resent
+	local []byte
+	// decide builds the reply once every earlier one has been sent, for
+	// commands whose answer depends on them
+	decide func() []byte
+	// hidden marks a backend reply the session consumes itself
+	hidden bool
+	// lmtpRcpts are the recipients still owed an LMTP reply to the end of
+	// DATA; the client gets one reply once all have arrived
+	lmtpRcpts []string
+	// route holds the session's commands until every reply before it is
+	// in, then moves the session to a backend from this pool
+	route *backendPool
+	// chunks holds the session's commands the same way until the message
+	// BDAT LAST completed has been handed on
+	chunks bool
+}
+
+// envelope is what the SMTP transaction says about a message: who
+// submitted it and the RCPT TO outcomes, recorded in its receipt
+type envelope struct {
+	client     string      // client certificate or AUTH username, if known
+	tls        *ReceiptTLS // nil for a plaintext session
+	mailFrom   string
+	recipients []string // accepted by the backend
+	rejected   []string // refused by the backend
+}
+
+// smtpError is a rejection the gateway sends the client itself
+type smtpError struct {
+	code int
+	text string // enhanced status code and message
+}
+
+func (e *smtpError) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.text)
+}
+
+// smtpSession follows one client's SMTP conversation so the milter only ever
+// sees complete messages. Client bytes pass through clientData and backend
+// bytes through backendData; both may be called from different goroutines.
+//
+// The session owns writes to both sides under mu: backend responses and
+// gateway-generated replies are interleaved in command order, and DATA is
+// answered by the gateway so a message can still be refused after its body
+// arrives. The backend only sees DATA once the message has been accepted,
+// and the message itself once the backend's 354 comes back.
+type smtpSession struct {
+	mu      sync.Mutex
+	log     *slog.Logger
+	id      string   // session ID, as logged
+	client  net.Conn // current client connection, replaced after STARTTLS
+	backend *backendWriter
+	timer   *sessionTimer
+
+	tlsConfig *tls.Config // non-nil when STARTTLS may be offered
+	tls       bool        // client connection is encrypted
+
+	clientHELO string // hostname the client last greeted with
+	extended   bool   // it greeted with EHLO
+	xclientCmd []byte // XCLIENT the backend accepted, replayed to a new one
+
+	phase     smtpPhase
+	line      []byte // partial client command line carried between reads
+	skipLine  bool   // dropping the rest of an over-long command line
+	longLines int    // over-long command lines refused
+	closing   bool   // closing on the client, whose input is ignored
+	resp      []byte // partial backend response line carried between reads
+	held      []byte // lines of a multiline response relayed once it is complete
+	inflight  []pendingReply
+	ehlo      [][]byte // EHLO response lines collected until the final one
+	body      []byte   // DATA accumulated so far
+	scanned   int      // bytes of body already searched for the terminator
+	discard   error    // why the message being skipped is refused
+
+	chunked   bool  // the transaction's message is arriving by BDAT
+	chunkSize int64 // size of the current BDAT chunk
+	chunkLeft int64 // bytes of it still to read
+	lastChunk bool  // the current chunk is BDAT ... LAST
+
+	// Envelope of the current transaction as accepted by the backend
+	mailFrom   string
+	recipients []string
+	rejected   []string // RCPT paths the backend refused
+	rcptCmds   [][]byte // RCPT lines the backend accepted, as sent
+
+	toBackend []byte // client bytes not yet written to the backend
+	message   []byte // accepted message waiting for the backend's 354
+	delivered func() // processMail's follow-up once the backend accepts the message
+
+	stream    *streamSigner // signing the message being streamed, if any
+	streamEnv envelope      // and its envelope as of DATA
+	streamLog *slog.Logger
+
+	lmtpReplies [][]byte // per-recipient replies to the current message so far
+
+	span        trace.Span // the session's root span
+	dataSpan    trace.Span // DATA being received
+	messageSpan trace.Span // accepted message on its way to the backend
+
+	bytesIn  int64 // read from the client
+	bytesOut int64 // written to the client
+
+	auth     *authExchange // AUTH exchange in progress
+	authed   bool          // AUTH succeeded
+	authUser string        // username it succeeded with, when known
+
+	// Routing by recipient domain, with -routes
+	ctx        context.Context // the session's, for commands read again after a switch
+	link       *backendLink
+	pool       *backendPool // backends the session is connected to
+	serverName string       // TLS server name the client asked for
+	heloCmd    []byte       // last HELO/EHLO as sent, replayed to a new backend
+	mailCmd    []byte       // MAIL of the current transaction as sent
+	txnPool    *backendPool // backends the transaction's recipients route to
+	failedPool *backendPool // backends the transaction couldn't switch to
+	reroute    *backendPool // commands held until the switch to these
+	resume     bool         // switch done; read the held commands
+
+	quit    bool           // session over: QUIT answered, or the client cut off
+	storing sync.WaitGroup // receipts of delivered messages being stored
+}
+
+func newSMTPSession(log *slog.Logger, clientConn net.Conn, backend *backendWriter, timer *sessionTimer, tlsConfig *tls.Config) *smtpSession {
+	_, isTLS := clientConn.(*tls.Conn)
+	return &smtpSession{
+		log:       log,
+		client:    clientConn,
+		backend:   backend,
+		timer:     timer,
+		tlsConfig: tlsConfig,
+		tls:       isTLS,
+		span:      trace.SpanFromContext(context.Background()),
+	}
+}
+
+// clientConn returns the connection to read client bytes from
+func (s *smtpSession) clientConn() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// clientData consumes bytes read from the client. Commands are forwarded to
+// the backend untouched; a message body is held back until its terminator
+// arrives and is then forwarded signed. ctx is the session's, and bounds the
+// signing and receipt work for any message completed here.
+func (s *smtpSession) clientData(ctx context.Context, p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	s.bytesIn += int64(len(p))
+	if err := s.input(ctx, p); err != nil {
+		return err
+	}
+	return s.ended()
+}
+
+// Returned once a client that sent QUIT has its reply, so the session closes
+// then and there rather than when a side hangs up. With -backend-pool the
+// backend connection is kept and never would.
+var errSessionQuit = errors.New("client quit")
+
+func (s *smtpSession) ended() error {
+	if s.quit {
+		return errSessionQuit
+	}
+	return nil
+}
+
+// input is clientData with mu held
+func (s *smtpSession) input(ctx context.Context, p []byte) error {
+	if s.closing {
+		return nil
+	}
+	for len(p) > 0 {
+		if s.phase == phaseData {
+			s.body = append(s.body, p...)
+			p = nil
+			end := findDataEnd(s.body, s.scanned)
+			if end < 0 {
+				s.scanned = len(s.body)
+				if err := s.oversized(s.body); err != nil {
+					// Stop buffering; only the terminator matters now
+					s.phase, s.discard = phaseDataDiscard, err
+					s.body = dataTail(s.body)
+					break
+				}
+				if err := s.startStream(ctx); err != nil {
+					return err
+				}
+				break
+			}
+			// Anything after the terminator is the next (pipelined) command
+			p = s.body[end:]
+			s.endDataSpan(end, nil)
+			if err := s.oversized(s.body[:end]); err != nil {
+				s.rejectMessage(err)
+				continue
+			}
+			if err := s.finishData(ctx, unstuffDots(s.body[:end-len(".\r\n")])); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.phase == phaseDataStream {
+			s.body = append(s.body, p...)
+			p = nil
+			i := bytes.Index(s.body, []byte("\r\n.\r\n"))
+			if i < 0 {
+				n := len(s.body) - streamHold
+				if n <= 0 {
+					break
+				}
+				err := s.streamData(s.body[:n])
+				s.body = append(s.body[:0], s.body[n:]...)
+				if err != nil {
+					return err
+				}
+				break
+			}
+			p = s.body[i+len("\r\n.\r\n"):]
+			s.endDataSpan(0, nil)
+			if err := s.finishStream(ctx, s.body[:i+len(crlf)]); err != nil {
+				return err
+			}
+			if s.closing {
+				break
+			}
+			continue
+		}
+		if s.phase == phaseDataDiscard {
+			s.body = append(s.body, p...)
+			p = nil
+			i := bytes.Index(s.body, []byte("\r\n.\r\n"))
+			if i < 0 {
+				s.body = dataTail(s.body)
+				break
+			}
+			p = s.body[i+len("\r\n.\r\n"):]
+			s.endDataSpan(0, s.discard)
+			s.rejectMessage(s.discard)
+			continue
+		}
+
+		if s.phase == phaseChunk {
+			n := min(int64(len(p)), s.chunkLeft)
+			s.addChunk(p[:n])
+			p, s.chunkLeft = p[n:], s.chunkLeft-n
+			if s.chunkLeft == 0 {
+				s.endChunk()
+			}
+			continue
+		}
+		if s.phase == phaseChunkPending {
+			// Read once the message has been handed on
+			s.line = append(s.line, p...)
+			break
+		}
+
+		if s.skipLine {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				break
+			}
+			p, s.skipLine = p[i+1:], false
+			continue
+		}
+
+		// Commands are split on line breaks, however the client's writes
+		// fell: a pipelined group can arrive in one read, and a single
+		// command over several
+		s.line = append(s.line, p...)
+		p = nil
+		for s.reroute == nil && (s.phase == phaseCommand || s.phase == phaseDataPending) {
+			i := bytes.IndexByte(s.line, '\n')
+			if i < 0 {
+				break
+			}
+			cmd := s.line[:i+1]
+			s.line = s.line[i+1:]
+
+			if len(cmd) > s.lineLimit(cmd) {
+				s.refuseLongLine()
+				continue
+			}
+			if s.auth != nil && !s.auth.done {
+				s.authLine(ctx, cmd)
+				continue
+			}
+			switch commandVerb(cmd) {
+			case "STARTTLS":
+				if !s.canStartTLS() {
+					// Never let the backend start its own TLS under us
+					s.reply("STARTTLS", 454, "4.7.0 TLS not available")
+					continue
+				}
+				// Anything pipelined after STARTTLS is discarded
+				// (RFC 3207 section 5, CVE-2011-0411)
+				s.line = nil
+				if err := s.flushBackend(); err != nil {
+					return err
+				}
+				return s.startTLS()
+			case "MAIL":
+				if *clientCA != "" && !s.tls {
+					// The client certificate is the submission credential
+					s.reply("MAIL", 530, "5.7.0 Must issue a STARTTLS command first")
+					continue
+				}
+				if *requireAuth && !s.authenticated() {
+					s.reply("MAIL", 530, "5.7.0 Authentication required")
+					continue
+				}
+				if zone := s.blocklisted(ctx); zone != "" {
+					s.reply("MAIL", 554, fmt.Sprintf("5.7.1 Client host [%s] blocked using %s", remoteIP(s.client), zone))
+					continue
+				}
+				if size, ok := mailSize(cmd); ok && s.tooLarge(size) {
+					s.reply("MAIL", 552, errMessageTooLarge.text)
+					continue
+				}
+				if s.overQuota(ctx) {
+					s.replyError("MAIL", errQuotaExceeded)
+					continue
+				}
+				s.toBackend = append(s.toBackend, cmd...)
+				s.command(cmd)
+				s.mailCmd = append([]byte(nil), cmd...)
+				s.txnPool, s.failedPool = nil, nil
+			case "RCPT":
+				if s.refusesRecipient(cmd) {
+					s.reply("RCPT", 550, fmt.Sprintf("5.1.1 <%s>: Recipient address rejected: User unknown", commandArg(cmd)))
+					continue
+				}
+				if s.routeRecipient(cmd) {
+					continue
+				}
+				s.toBackend = append(s.toBackend, cmd...)
+				s.command(cmd)
+				s.inflight[len(s.inflight)-1].cmd = append([]byte(nil), cmd...)
+			case "RSET":
+				s.abandonTransaction()
+				s.toBackend = append(s.toBackend, cmd...)
+				s.command(cmd)
+			case "AUTH":
+				s.startAuth(ctx, cmd)
+			case "QUIT":
+				// Anything after QUIT is ignored
+				s.line = nil
+				if !pooling() {
+					s.toBackend = append(s.toBackend, cmd...)
+					s.command(cmd)
+					continue
+				}
+				// The backend connection outlives the session
+				s.inflight = append(s.inflight, pendingReply{verb: "QUIT", decide: s.answerQuit})
+			case "BDAT":
+				s.startChunk(cmd)
+			case "DATA":
+				if s.chunked {
+					s.reply("DATA", 503, "5.5.1 DATA not allowed after BDAT")
+					continue
+				}
+				// Answered here; the backend gets DATA with the finished message
+				s.inflight = append(s.inflight, pendingReply{verb: "DATA", decide: s.answerData})
+				s.phase = phaseDataPending
+			case "HELO", "EHLO":
+				sent := heloCommand(cmd)
+				s.clientHELO = strings.TrimSpace(string(cmd[len("EHLO"):]))
+				s.extended = commandVerb(cmd) == "EHLO"
+				if *rewriteHELO {
+					s.log.Info("Greeting backend with gateway hostname", "event", "helo_rewritten",
+						"client_helo", s.clientHELO)
+				}
+				s.toBackend = append(s.toBackend, sent...)
+				s.command(cmd)
+				s.heloCmd = sent
+				s.abandonTransaction()
+			default:
+				// NOOP, VRFY and the like leave the transaction as it is
+				s.toBackend = append(s.toBackend, cmd...)
+				s.command(cmd)
+			}
+		}
+		if s.phase == phaseChunk || s.phase == phaseChunkPending {
+			// The chunk follows its command line directly
+			p, s.line = s.line, nil
+			continue
+		}
+		if s.reroute == nil && len(s.line) > s.lineLimit(s.line) {
+			// Don't buffer the rest of it
+			s.refuseLongLine()
+			s.line, s.skipLine = nil, !s.closing
+		}
+		// Keep the partial line in a buffer we own
+		s.line = append([]byte(nil), s.line...)
+	}
+	if err := s.flushBackend(); err != nil {
+		return err
+	}
+	if err := s.flushLocal(); err != nil {
+		return err
+	}
+	return s.resumeCommands()
+}
+
+// resumeCommands reads the commands held for a backend switch once it is done
+func (s *smtpSession) resumeCommands() error {
+	if !s.resume {
+		return nil
+	}
+	s.resume = false
+	if s.phase == phaseChunkPending {
+		if err := s.finishChunks(); err != nil {
+			return err
+		}
+	}
+	held := s.line
+	s.line = nil
+	return s.input(s.ctx, held)
+}
+
+// command records a complete client command line forwarded to the backend
+func (s *smtpSession) command(line []byte) {
+	verb := commandVerb(line)
+	s.inflight = append(s.inflight, pendingReply{verb: verb, arg: commandArg(line)})
+}
+
+// lineLimit is the longest command line accepted, CRLF included, for one
+// starting like line
+func (s *smtpSession) lineLimit(line []byte) int {
+	if (s.auth != nil && !s.auth.done) || commandVerb(line) == "AUTH" {
+		return max(*maxLineLength, maxCommandLine)
+	}
+	return *maxLineLength
+}
+
+// refuseLongLine answers an over-long command line with 500, or once the
+// client has sent -max-long-lines of them, with 421 and the end of the
+// session
+func (s *smtpSession) refuseLongLine() {
+	s.longLines++
+	if *maxLongLines == 0 || s.longLines < *maxLongLines {
+		s.reply("", 500, "5.5.2 Line too long")
+		return
+	}
+	s.log.Warn("Closing session", "event", "line_too_long", "reason", "repeated over-long command lines",
+		"count", s.longLines)
+	s.closing, s.line = true, nil
+	s.inflight = append(s.inflight, pendingReply{decide: func() []byte {
+		s.quit = true
+		return []byte(withHostname("421 4.7.0 Too many long lines, closing connection\r\n"))
+	}})
+}
+
+// reply queues a gateway-generated reply behind any outstanding ones
+func (s *smtpSession) reply(verb string, code int, text string) {
+	s.inflight = append(s.inflight, pendingReply{
+		verb:  verb,
+		local: []byte(fmt.Sprintf("%d %s\r\n", code, text)),
+	})
+}
+
+// replyError queues the reply for a message the gateway refused
+func (s *smtpSession) replyError(verb string, err error) {
+	rejected := smtpReplyFor(err)
+	s.reply(verb, rejected.code, rejected.text)
+}
+
+// flushLocal writes gateway replies that have reached the head of the queue
+func (s *smtpSession) flushLocal() error {
+	return s.writeClient(s.takeLocal())
+}
+
+// takeLocal dequeues gateway replies up to the next one owed by the backend
+func (s *smtpSession) takeLocal() []byte {
+	var out []byte
+	for len(s.inflight) > 0 {
+		head := s.inflight[0]
+		switch {
+		case head.local != nil:
+			out = append(out, head.local...)
+		case head.decide != nil:
+			out = append(out, head.decide()...)
+		case head.route != nil:
+			s.finishReroute(head.route)
+		case head.chunks:
+			s.resume = true
+		default:
+			return out
+		}
+		s.inflight = s.inflight[1:]
+	}
+	return out
+}
+
+// answerData replies to DATA now that the RCPT replies before it are known
+func (s *smtpSession) answerData() []byte {
+	if len(s.recipients) == 0 {
+		s.phase = phaseCommand
+		return []byte("554 5.5.1 No valid recipients\r\n")
+	}
+	s.phase = phaseData
+	s.body, s.scanned = nil, 0
+	_, s.dataSpan = tracer.Start(trace.ContextWithSpan(context.Background(), s.span), "smtp.data")
+	return []byte("354 End data with <CR><LF>.<CR><LF>\r\n")
+}
+
+// endDataSpan finishes the DATA span once the terminator has arrived
+func (s *smtpSession) endDataSpan(size int, err error) {
+	if s.dataSpan == nil {
+		return
+	}
+	if size > 0 {
+		s.dataSpan.SetAttributes(attrBytes.Int(size))
+	}
+	endSpan(s.dataSpan, err)
+	s.dataSpan = nil
+}
+
+// abandonTransaction drops what the session keeps of a transaction the
+// client ended with RSET or a new greeting: its MAIL, its route and any
+// BDAT chunks. The envelope goes once the backend has answered, since
+// replies to commands before this one may still add to it.
+func (s *smtpSession) abandonTransaction() {
+	s.mailCmd = nil
+	s.txnPool, s.failedPool = nil, nil
+	s.abandonChunks()
+}
+
+func (s *smtpSession) resetTransaction() {
+	s.mailFrom = ""
+	s.recipients = nil
+	s.rejected = nil
+	s.rcptCmds = nil
+}
+
+func (s *smtpSession) writeClient(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	s.client.SetWriteDeadline(s.timer.next())
+	n, err := s.client.Write(p)
+	s.bytesOut += int64(n)
+	return err
+}
+
+// flushBackend writes queued client bytes, unless a message is waiting on
+// the backend's 354: anything the client pipelined after it has to follow
+// the message.
+func (s *smtpSession) flushBackend() error {
+	if s.message != nil || len(s.toBackend) == 0 {
+		return nil
+	}
+	// The writer owns the buffer from here
+	err := s.backend.write(s.toBackend)
+	s.toBackend = nil
+	return err
+}
+
+// clientIdentity names the submitter: the verified client certificate's
+// identity, else the AUTH username, else empty
+func (s *smtpSession) clientIdentity() string {
+	if conn, ok := s.client.(*tls.Conn); ok {
+		if id := certIdentity(conn.ConnectionState()); id != "" {
+			return id
+		}
+	}
+	return s.authUser
+}
+
+// clientTLS describes the client connection's TLS, or is nil if it has none
+func (s *smtpSession) clientTLS() *ReceiptTLS {
+	if conn, ok := s.client.(*tls.Conn); ok {
+		return receiptTLS(conn.ConnectionState())
+	}
+	return nil
+}
+
+func (s *smtpSession) canStartTLS() bool {
+	return s.tlsConfig != nil && !s.tls && s.phase == phaseCommand
+}
+
+// startTLS answers STARTTLS and upgrades the client connection. The backend
+// never sees the command; it keeps talking plaintext to the gateway.
+func (s *smtpSession) startTLS() error {
+	if len(s.inflight) > 0 {
+		// Replies can't be interleaved with a handshake
+		s.reply("STARTTLS", 503, "5.5.1 STARTTLS must be the last command in a group")
+		return s.flushLocal()
+	}
+	if err := s.writeClient([]byte("220 2.0.0 Ready to start TLS\r\n")); err != nil {
+		return err
+	}
+
+	conn := tls.Server(s.client, s.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("STARTTLS handshake: %w", err)
+	}
+	s.client = conn
+	s.tls = true
+	s.serverName = conn.ConnectionState().ServerName
+	// Nothing learned before the handshake carries over (RFC 3207 section 4.2)
+	s.authed, s.authUser = false, ""
+	return nil
+}
+
+// Reply to a message over -max-message-size
+var errMessageTooLarge = &smtpError{552, "5.3.4 Message size exceeds fixed maximum message size"}
+
+// tooLarge reports whether n bytes of DATA exceed -max-message-size
+func (s *smtpSession) tooLarge(n int64) bool {
+	return *maxMessageSize > 0 && n > int64(*maxMessageSize)
+}
+
+// Reply to a message whose header block is over -max-header-size
+var errHeaderTooLarge = &smtpError{552, "5.3.4 Message header size exceeds fixed maximum"}
+
+// oversized returns the reply refusing DATA received so far, if it is
+// already over a size limit
+func (s *smtpSession) oversized(body []byte) error {
+	if s.tooLarge(int64(len(body))) {
+		return errMessageTooLarge
+	}
+	if headersTooLarge(body) {
+		return errHeaderTooLarge
+	}
+	return nil
+}
+
+// headersTooLarge reports whether raw DATA has more than -max-header-size
+// bytes of header before the blank line ending them. Only the first
+// -max-header-size bytes and a line break are searched, so checking a
+// growing body stays cheap.
+func headersTooLarge(body []byte) bool {
+	limit := *maxHeaderSize
+	if limit <= 0 || len(body) <= limit {
+		return false
+	}
+	if body[0] == '\n' || bytes.HasPrefix(body, crlf) {
+		return false
+	}
+	head := body
+	if n := limit + len("\n\r\n"); len(head) > n {
+		head = head[:n]
+	}
+	// Header lines may end in a bare LF, which unstuffDots fixes later
+	i := bytes.Index(head, []byte("\n\r\n"))
+	if j := bytes.Index(head, []byte("\n\n")); j >= 0 && (i < 0 || j < i) {
+		i = j
+	}
+	return i < 0 || i+1 > limit
+}
+
+// dataTail keeps just enough of a discarded body to spot a terminator
+// split across reads
+func dataTail(body []byte) []byte {
+	keep := len("\r\n.\r\n") - 1
+	if len(body) <= keep {
+		return body
+	}
+	return append([]byte(nil), body[len(body)-keep:]...)
+}
+
+// rejectMessage queues the reply refusing the current message and closes
+// the transaction on the backend, which still has the envelope open
+func (s *smtpSession) rejectMessage(err error) {
+	s.phase = phaseCommand
+	s.body, s.scanned = nil, 0
+	s.replyError(".", err)
+	s.resetTransaction()
+	s.abandonTransaction()
+	s.toBackend = append(s.toBackend, "RSET\r\n"...)
+	s.inflight = append(s.inflight, pendingReply{verb: "RSET", hidden: true})
+}
+
+// finishData signs a complete message and opens the backend's DATA for it,
+// or queues the rejection if the gateway refuses it
+func (s *smtpSession) finishData(ctx context.Context, data []byte) error {
+	env, log := s.messageEnvelope()
+	msg, delivered, err := processMail(ctx, log, env, data)
+	if err != nil {
+		s.rejectMessage(err)
+		return nil
+	}
+	s.delivered = delivered
+	s.phase = phaseCommand
+	s.body, s.scanned = nil, 0
+	if err := s.openBackendData(ctx); err != nil {
+		return err
+	}
+	s.message = append(append(s.receivedHeader(), stuffDots(msg)...), ".\r\n"...)
+	return nil
+}
+
+// messageEnvelope returns the current transaction's envelope, and the
+// session's logger with the client identity it carries
+func (s *smtpSession) messageEnvelope() (envelope, *slog.Logger) {
+	env := envelope{
+		client:     s.clientIdentity(),
+		tls:        s.clientTLS(),
+		mailFrom:   s.mailFrom,
+		recipients: s.recipients,
+		rejected:   s.rejected,
+	}
+	log := s.log
+	if env.client != "" {
+		log = log.With("client_identity", env.client)
+	}
+	return env, log
+}
+
+// openBackendData sends the backend DATA for an accepted message, which is
+// then held in s.message until the 354 comes back
+func (s *smtpSession) openBackendData(ctx context.Context) error {
+	_, s.messageSpan = tracer.Start(ctx, "backend.write")
+
+	// The backend's 354 is consumed here; its reply to the message is the
+	// client's reply to the end of DATA
+	s.toBackend = append(s.toBackend, "DATA\r\n"...)
+	end := pendingReply{verb: "."}
+	if *lmtpMode {
+		end.lmtpRcpts = s.recipients
+	}
+	s.inflight = append(s.inflight, pendingReply{verb: "DATA", hidden: true}, end)
+	return s.flushBackend()
+}
+
+// backendData relays bytes read from the backend to the client. The session
+// sees each response before the client does, so it is already in the DATA
+// phase by the time the client reads the 354. Responses are relayed whole:
+// the lines of a multiline one are held until its final line arrives,
+// however the backend's writes fell.
+func (s *smtpSession) backendData(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []byte
+	s.resp = append(s.resp, p...)
+	for {
+		i := bytes.IndexByte(s.resp, '\n')
+		if i < 0 {
+			break
+		}
+		raw := s.resp[:i+1]
+		relay, err := s.response(raw)
+		if err != nil {
+			return err
+		}
+		s.resp = s.resp[i+1:]
+		if continuesReply(bytes.TrimRight(raw, "\r\n")) {
+			s.held = append(s.held, relay...)
+			continue
+		}
+		out = append(out, s.held...)
+		out = append(out, relay...)
+		s.held = nil
+		// Gateway replies queued behind that one can go now
+		out = append(out, s.takeLocal()...)
+	}
+	s.resp = append([]byte(nil), s.resp...)
+	if err := s.writeClient(out); err != nil {
+		return err
+	}
+	if err := s.resumeCommands(); err != nil {
+		return err
+	}
+	return s.ended()
+}
+
+// continuesReply reports whether a response line, without its CRLF, is
+// followed by more of the same reply ("250-...")
+func continuesReply(line []byte) bool {
+	return len(line) < 3 || (len(line) > 3 && line[3] == '-')
+}
+
+// response records a single backend response line and returns what to relay
+func (s *smtpSession) response(raw []byte) ([]byte, error) {
+	line := bytes.TrimRight(raw, "\r\n")
+	// The greeting arrives before any command
+	if len(s.inflight) == 0 {
+		return raw, nil
+	}
+	head := s.inflight[0]
+	// LMTP has no HELO, so both are sent as LHLO
+	isEHLO := head.verb == "EHLO" || (*lmtpMode && head.verb == "HELO")
+	if isEHLO {
+		s.ehlo = append(s.ehlo, append([]byte(nil), line...))
+	}
+	// Replies to the gateway's own commands aren't relayed, except a
+	// refused DATA
+	swallow := head.hidden && (head.verb != "DATA" || bytes.HasPrefix(line, []byte("354")))
+
+	if continuesReply(line) {
+		if isEHLO || swallow || head.lmtpRcpts != nil || (head.hidden && s.stream != nil) {
+			return nil, nil
+		}
+		return raw, nil
+	}
+	if len(head.lmtpRcpts) > 0 {
+		return annotateReply(s.lmtpReply(raw)), nil
+	}
+	s.inflight = s.inflight[1:]
+	success := line[0] == '2'
+
+	switch {
+	case head.hidden && head.verb != "DATA":
+		return nil, nil
+	case head.hidden:
+		if swallow {
+			return nil, s.releaseMessage()
+		}
+		if s.messageSpan != nil {
+			endSpan(s.messageSpan, fmt.Errorf("backend refused DATA: %s", bytes.TrimRight(line, "\r\n")))
+			s.messageSpan = nil
+		}
+		if s.stream != nil {
+			// The client is still sending; it hears once it has finished
+			s.inflight = s.inflight[1:]
+			s.refuseStream(line)
+			return nil, nil
+		}
+		// The backend refused DATA; that stands in for its reply to the
+		// message it will now never see. Reset it ahead of anything the
+		// client pipelined meanwhile.
+		s.inflight = append([]pendingReply{{verb: "RSET", hidden: true}}, s.inflight[1:]...)
+		s.toBackend = append([]byte("RSET\r\n"), s.toBackend...)
+		s.message, s.delivered = nil, nil
+		s.resetTransaction()
+		return annotateReply(raw), s.flushBackend()
+	case head.verb == "MAIL" && success:
+		s.mailFrom = head.arg
+	case head.verb == "RCPT" && success:
+		s.recipients = append(s.recipients, head.arg)
+		s.rcptCmds = append(s.rcptCmds, head.cmd)
+	case head.verb == "RCPT":
+		s.rejected = append(s.rejected, head.arg)
+	case head.verb == "AUTH":
+		s.authReply(line)
+	case head.verb == ".":
+		if success {
+			s.messageDelivered()
+		}
+		s.delivered = nil
+		s.resetTransaction()
+	case head.verb == "RSET" || head.verb == "HELO" || isEHLO:
+		s.resetTransaction()
+	case head.verb == "QUIT":
+		s.quit = true
+	}
+
+	if head.verb == "HELO" && isEHLO {
+		out := heloReply(s.ehlo)
+		s.ehlo = nil
+		return out, nil
+	}
+	if isEHLO {
+		out := rewriteEHLO(s.ehlo, ehloPolicy{
+			startTLS:  s.tlsConfig != nil && !s.tls,
+			maxSize:   int64(*maxMessageSize),
+			localAuth: authenticator != nil,
+			offerAuth: authenticator != nil && s.tls,
+		})
+		s.ehlo = nil
+		return out, nil
+	}
+	return annotateReply(raw), nil
+}
+
+// messageDelivered runs processMail's follow-up for a message the backend
+// has accepted. The client is free to QUIT once it has the 250, so the
+// receipt is stored in the background.
+func (s *smtpSession) messageDelivered() {
+	if delivered := s.delivered; delivered != nil {
+		receiptsInFlight.Add(1)
+		s.storing.Add(1)
+		go func() {
+			defer receiptsInFlight.Done()
+			defer s.storing.Done()
+			delivered()
+		}()
+		s.delivered = nil
+	}
+	s.countMessage()
+}
+
+// finalize completes a session the client ended with QUIT: the receipts of
+// its messages are stored, and any batched are sent now rather than when
+// the batch fills
+func (s *smtpSession) finalize() {
+	s.storing.Wait()
+	if f, ok := receipts.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+	s.log.Debug("Session finalized", "event", "session_quit")
+}
+
+// releaseMessage sends the accepted message, followed by anything the
+// client pipelined behind it
+func (s *smtpSession) releaseMessage() error {
+	if s.stream != nil {
+		// Still arriving; the rest follows as it does
+		err := s.backend.write(s.message)
+		s.message = nil
+		return err
+	}
+	retry := s.resendPlan(len(s.message))
+	s.toBackend = append(s.message, s.toBackend...)
+	s.message = nil
+	err := s.backend.writeMessage(queuedWrite{p: s.toBackend, span: s.messageSpan, retry: retry})
+	s.toBackend, s.messageSpan = nil, nil
+	return err
+}
+
+// resendPlan lets the message of size bytes be resent on a new connection,
+// with -retry-backend, should writing it fail. The new backend is taken
+// through the transaction as the client left it: a fresh connection has no
+// transaction to RSET, so that is EHLO, MAIL, the accepted RCPTs and DATA.
+// A session the backend authenticated can't be moved: another backend
+// hasn't seen the credentials.
+func (s *smtpSession) resendPlan(size int) *resendPlan {
+	if !*retryBackend || s.link == nil || s.pool == nil || (s.authed && authenticator == nil) {
+		return nil
+	}
+	cmds := append([][]byte{s.xclientCmd, s.heloCmd, s.mailCmd}, s.rcptCmds...)
+	cmds = append(cmds, []byte("DATA\r\n"))
+	pool, link, log := s.pool, s.link, s.log
+	link.hold()
+	return &resendPlan{
+		within: size,
+		reconnect: func(cause error) error {
+			log.Warn("Backend connection failed mid-message, resending it on a new one", "event", "backend_resend",
+				"error", cause)
+			conn, addr, err := pool.dial(log)
+			if err == nil {
+				if err = replaySession(conn, cmds...); err != nil {
+					conn.Close()
+					err = fmt.Errorf("%s: %w", addr, err)
+				}
+			}
+			if err != nil {
+				log.Error("Failed to resend message", "event", "backend_resend_failed", "error", err)
+				backendResends.WithLabelValues("failed").Inc()
+				return err
+			}
+			link.swap(conn)
+			backendResends.WithLabelValues("resent").Inc()
+			log.Info("Resending message to new backend connection", "event", "backend_resent", "backend", addr)
+			return nil
+		},
+		settled: link.release,
+	}
+}
+
+// findDataEnd returns the offset just past the DATA terminator in body, or -1.
+// body starts immediately after the 354, so a leading ".\r\n" is an empty
+// message. The first scanned bytes are known not to hold a terminator; the
+// search backs up over their last few so one split across reads (e.g. "\r\n."
+// then "\r\n") is still found, without rescanning a large body every read.
+func findDataEnd(body []byte, scanned int) int {
+	if bytes.HasPrefix(body, []byte(".\r\n")) {
+		return len(".\r\n")
+	}
+	from := max(scanned-len("\r\n.\r\n")+1, 0)
+	if i := bytes.Index(body[from:], []byte("\r\n.\r\n")); i >= 0 {
+		return from + i + len("\r\n.\r\n")
+	}
+	return -1
+}
+
+// commandVerb returns the upper-cased first word of a command line
+func commandVerb(line []byte) string {
+	line = bytes.TrimRight(line, "\r\n")
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(string(line))
+}
+
+// mailSize returns the SIZE= parameter of a MAIL FROM command
+func mailSize(line []byte) (int64, bool) {
+	for _, param := range mailParams(line) {
+		name, value, ok := strings.Cut(param, "=")
+		if ok && strings.EqualFold(name, "SIZE") {
+			n, err := strconv.ParseInt(value, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// mailParams returns the parameters after the path of a MAIL FROM or RCPT
+// TO command. They are split on spaces only, and looked for only past the
+// path, so an internationalized address (RFC 6531) with other whitespace in
+// it isn't taken apart. A path without its angle brackets is taken to end
+// at the first space.
+func mailParams(line []byte) []string {
+	s := string(bytes.TrimRight(line, "\r\n"))
+	isSpace := func(r rune) bool { return r == ' ' }
+	open := strings.IndexByte(s, '<')
+	end := strings.IndexByte(s[max(open, 0):], '>')
+	if open < 0 || end < 0 {
+		fields := strings.FieldsFunc(s, isSpace)
+		if len(fields) < 2 {
+			return nil
+		}
+		return fields[2:]
+	}
+	return strings.FieldsFunc(s[open+end+1:], isSpace)
+}
+
+// commandArg returns the path argument of MAIL FROM:<...> or RCPT TO:<...>,
+// or "" for other commands
+func commandArg(line []byte) string {
+	s := string(bytes.TrimRight(line, "\r\n"))
+	open := strings.IndexByte(s, '<')
+	if open < 0 || !strings.Contains(strings.ToUpper(s[:open]), ":") {
+		return ""
+	}
+	end := strings.IndexByte(s[open:], '>')
+	if end < 0 {
+		return ""
+	}
+	return s[open+1 : open+end]
+}
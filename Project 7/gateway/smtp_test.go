@@ -0,0 +1,989 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pqc-gateway/internal/smtptest"
+)
+
+// testBackend is a minimal Postfix stand-in: it accepts everything except
+// recipients containing "bad" and messages containing "reject me", and
+// records the messages it is given
+type testBackend struct {
+	mu    sync.Mutex
+	msgs  []string
+	helos []string // HELO and EHLO lines received
+	cmds  []string // every command line received, without CRLF
+	conns []net.Conn
+
+	lingers        bool        // stays connected after answering QUIT
+	refusesXCLIENT bool        // doesn't trust the gateway with XCLIENT
+	forgets        bool        // keeps no messages, for benchmarks
+	startTLS       *tls.Config // offers STARTTLS with this certificate
+}
+
+func startTestBackend(t testing.TB) *testBackend {
+	t.Helper()
+	b, addr := listenTestBackend(t)
+	old := postfixBackends
+	postfixBackends = newBackendPool(addr)
+	t.Cleanup(func() { postfixBackends = old })
+	return b
+}
+
+// listenTestBackend starts a test backend and returns it with its address
+func listenTestBackend(t testing.TB) (*testBackend, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestBackend(t, ln), ln.Addr().String()
+}
+
+// serveTestBackend runs a test backend on ln until the test ends
+func serveTestBackend(t testing.TB, ln net.Listener) *testBackend {
+	t.Cleanup(func() { ln.Close() })
+	b := &testBackend{}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *testBackend) serve(c net.Conn) {
+	defer c.Close()
+	b.mu.Lock()
+	b.conns = append(b.conns, c)
+	b.mu.Unlock()
+	r := bufio.NewReader(c)
+	c.Write([]byte("220 backend ESMTP\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.cmds = append(b.cmds, strings.TrimSuffix(line, "\r\n"))
+		b.mu.Unlock()
+		verb, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			b.mu.Lock()
+			b.helos = append(b.helos, strings.TrimSpace(line))
+			b.mu.Unlock()
+			if strings.ToUpper(verb) == "HELO" {
+				c.Write([]byte("250 backend\r\n"))
+				continue
+			}
+			b.mu.Lock()
+			startTLS := b.startTLS
+			b.mu.Unlock()
+			if startTLS != nil {
+				c.Write([]byte("250-backend\r\n250-STARTTLS\r\n250 8BITMIME\r\n"))
+				continue
+			}
+			c.Write([]byte("250-backend\r\n250-PIPELINING\r\n250 8BITMIME\r\n"))
+		case "STARTTLS":
+			c.Write([]byte("220 2.0.0 Ready to start TLS\r\n"))
+			b.mu.Lock()
+			tc := tls.Server(c, b.startTLS)
+			b.mu.Unlock()
+			if tc.Handshake() != nil {
+				return
+			}
+			c, r = tc, bufio.NewReader(tc)
+		case "RCPT":
+			if strings.Contains(line, "bad") {
+				c.Write([]byte("550 5.1.1 No such user\r\n"))
+			} else {
+				c.Write([]byte("250 2.1.5 Ok\r\n"))
+			}
+		case "DATA":
+			c.Write([]byte("354 End data with <CR><LF>.<CR><LF>\r\n"))
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			if strings.Contains(msg.String(), "reject me") {
+				c.Write([]byte("554 5.7.1 Rejected\r\n"))
+				continue
+			}
+			b.mu.Lock()
+			if !b.forgets {
+				b.msgs = append(b.msgs, msg.String())
+			}
+			b.mu.Unlock()
+			c.Write([]byte("250 2.0.0 Ok: queued\r\n"))
+		case "XCLIENT":
+			b.mu.Lock()
+			refuses := b.refusesXCLIENT
+			b.mu.Unlock()
+			if refuses {
+				c.Write([]byte("550 5.7.0 Error: insufficient authorization\r\n"))
+				continue
+			}
+			// Postfix greets the client it now stands for
+			c.Write([]byte("220 backend ESMTP\r\n"))
+		case "QUIT":
+			c.Write([]byte("221 2.0.0 Bye\r\n"))
+			b.mu.Lock()
+			lingers := b.lingers
+			b.mu.Unlock()
+			if !lingers {
+				return
+			}
+		default:
+			c.Write([]byte("250 2.0.0 Ok\r\n"))
+		}
+	}
+}
+
+// connections returns how many sessions the backend has accepted
+func (b *testBackend) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// hangUp closes every connection the backend has accepted
+func (b *testBackend) hangUp() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+}
+
+func (b *testBackend) commands() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.cmds...)
+}
+
+func (b *testBackend) greetings() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.helos...)
+}
+
+func (b *testBackend) messages() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.msgs...)
+}
+
+// dialGateway runs a plaintext gateway session in front of the test
+// backend and returns the client side, past the greeting
+func dialGateway(t testing.TB) *textproto.Conn {
+	t.Helper()
+	c := textproto.NewConn(dialGatewayConn(t))
+	t.Cleanup(func() { c.Close() })
+	expect(t, c, 220)
+	return c
+}
+
+// dialGatewayConn is dialGateway without the greeting read, for tests that
+// look at how the bytes arrive
+func dialGatewayConn(t testing.TB) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The session ends with the test, before the flags it ran under are
+	// put back
+	done := make(chan struct{})
+	t.Cleanup(func() { <-done })
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(conn, nil)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expect reads a reply and fails unless it has the given code
+func expect(t testing.TB, c *textproto.Conn, code int) string {
+	t.Helper()
+	got, msg, err := c.ReadResponse(0)
+	if err != nil {
+		var perr textproto.ProtocolError
+		if !errors.As(err, &perr) && got == 0 {
+			t.Fatalf("reading reply: %v", err)
+		}
+	}
+	if got != code {
+		t.Fatalf("got %d %s, want %d", got, msg, code)
+	}
+	return msg
+}
+
+// command sends a command and returns its reply, which must have code
+func command(t testing.TB, c *textproto.Conn, code int, line string) string {
+	t.Helper()
+	if err := c.PrintfLine("%s", line); err != nil {
+		t.Fatal(err)
+	}
+	return expect(t, c, code)
+}
+
+// sendMessage runs one transaction and returns the reply to the end of DATA
+func sendMessage(t *testing.T, c *textproto.Conn, code int, body string) string {
+	t.Helper()
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return expect(t, c, code)
+}
+
+const testBody = "From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\n\r\nbody\r\n"
+
+func TestSessionSignsMessage(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+	<-store.calls
+	// The session is gone, but the receipt's context must not be
+	if err := store.lastErr(); err != nil {
+		t.Errorf("receipt stored with %v", err)
+	}
+
+	msgs := b.messages()
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "X-PQC-Signature: ") {
+		t.Fatalf("backend got %q, want one signed message", msgs)
+	}
+}
+
+func TestSessionBackendRefusesMessage(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	startTestBackend(t)
+	c := dialGateway(t)
+	sendMessage(t, c, 554, "Subject: reject me\r\n\r\nbody\r\n")
+	command(t, c, 221, "QUIT")
+
+	receiptsInFlight.Wait()
+	select {
+	case r := <-store.calls:
+		t.Fatalf("receipt %s stored for a refused message", r.MessageID)
+	default:
+	}
+}
+
+func TestSessionSigningFailure(t *testing.T) {
+	useSigner(t, brokenSigner{})
+
+	t.Run("fail open", func(t *testing.T) {
+		setFlag(t, failClosed, false)
+		b := startTestBackend(t)
+		c := dialGateway(t)
+		sendMessage(t, c, 250, testBody)
+		command(t, c, 221, "QUIT")
+		msgs := b.messages()
+		if len(msgs) != 1 || strings.Contains(msgs[0], "X-PQC-Signature") {
+			t.Fatalf("backend got %q, want the message unsigned", msgs)
+		}
+	})
+	t.Run("fail closed", func(t *testing.T) {
+		setFlag(t, failClosed, true)
+		b := startTestBackend(t)
+		c := dialGateway(t)
+		if msg := sendMessage(t, c, 451, testBody); !strings.HasPrefix(msg, "4.7.0 ") {
+			t.Errorf("reply %q, want enhanced code 4.7.0", msg)
+		}
+		// The transaction is over; the session carries on
+		command(t, c, 250, "RSET")
+		command(t, c, 221, "QUIT")
+		if msgs := b.messages(); len(msgs) != 0 {
+			t.Fatalf("backend got %q, want nothing", msgs)
+		}
+	})
+}
+
+func TestSessionReceiptFailure(t *testing.T) {
+	store := &memReceiptStore{err: errors.New("receipt queue full (1)"), calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+
+	t.Run("fail open", func(t *testing.T) {
+		setFlag(t, failClosed, false)
+		b := startTestBackend(t)
+		c := dialGateway(t)
+		sendMessage(t, c, 250, testBody)
+		<-store.calls
+		if len(b.messages()) != 1 {
+			t.Fatal("message not delivered")
+		}
+	})
+	t.Run("fail closed", func(t *testing.T) {
+		setFlag(t, failClosed, true)
+		b := startTestBackend(t)
+		c := dialGateway(t)
+		if msg := sendMessage(t, c, 451, testBody); !strings.HasPrefix(msg, "4.3.0 ") {
+			t.Errorf("reply %q, want enhanced code 4.3.0", msg)
+		}
+		<-store.calls
+		if len(b.messages()) != 0 {
+			t.Fatal("message delivered without its receipt")
+		}
+	})
+}
+
+func TestAnnotateBackendErrors(t *testing.T) {
+	for _, annotate := range []bool{false, true} {
+		setFlag(t, annotateBackend, annotate)
+		startTestBackend(t)
+		c := dialGateway(t)
+		command(t, c, 250, "EHLO client.example.com")
+		ok := command(t, c, 250, "MAIL FROM:<a@example.com>")
+		refused := command(t, c, 550, "RCPT TO:<bad@example.com>")
+
+		if strings.HasSuffix(ok, backendAnnotation) {
+			t.Errorf("annotate=%v: success reply %q annotated", annotate, ok)
+		}
+		if got := strings.HasSuffix(refused, backendAnnotation); got != annotate {
+			t.Errorf("annotate=%v: refusal %q", annotate, refused)
+		}
+	}
+}
+
+func TestAnnotateReply(t *testing.T) {
+	setFlag(t, annotateBackend, true)
+	for _, tc := range []struct{ in, want string }{
+		{"550 5.1.1 No such user\r\n", "550 5.1.1 No such user" + backendAnnotation + "\r\n"},
+		{"451-4.3.0 first\r\n", "451-4.3.0 first\r\n"},
+		{"250 2.0.0 Ok\r\n", "250 2.0.0 Ok\r\n"},
+		{"", ""},
+	} {
+		if got := string(annotateReply([]byte(tc.in))); got != tc.want {
+			t.Errorf("annotateReply(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+// scanChunks feeds stream to findDataEnd size bytes at a time, as reads
+// would deliver it, and returns where the terminator was found
+func scanChunks(stream []byte, size int) int {
+	var body []byte
+	scanned := 0
+	for len(stream) > 0 {
+		n := min(size, len(stream))
+		body, stream = append(body, stream[:n]...), stream[n:]
+		if end := findDataEnd(body, scanned); end >= 0 {
+			return end
+		}
+		scanned = len(body)
+	}
+	return -1
+}
+
+func TestFindDataEndSplitReads(t *testing.T) {
+	for _, tc := range []struct {
+		name, stream string
+		end          int
+	}{
+		{"message", "Subject: hi\r\n\r\nbody\r\n.\r\nQUIT\r\n", len("Subject: hi\r\n\r\nbody\r\n.\r\n")},
+		{"empty message", ".\r\nQUIT\r\n", 3},
+		{"dot-stuffed line", "a\r\n..\r\nb\r\n.\r\n", len("a\r\n..\r\nb\r\n.\r\n")},
+		{"no terminator", "a\r\n.b\r\n", -1},
+	} {
+		for size := 1; size <= len(tc.stream); size++ {
+			if got := scanChunks([]byte(tc.stream), size); got != tc.end {
+				t.Errorf("%s in %d-byte reads: end %d, want %d", tc.name, size, got, tc.end)
+			}
+		}
+	}
+}
+
+func TestSessionTerminatorSplitAcrossWrites(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	for _, part := range []string{testBody[:len(testBody)-1], "\n.", "\r", "\n"} {
+		c.W.WriteString(part)
+		c.W.Flush()
+		time.Sleep(20 * time.Millisecond)
+	}
+	expect(t, c, 250)
+	command(t, c, 221, "QUIT")
+	if msgs := b.messages(); len(msgs) != 1 {
+		t.Fatalf("backend got %d messages, want 1", len(msgs))
+	}
+}
+
+// headerBlock is a header section of exactly size bytes, without the
+// blank line after it
+func headerBlock(size int) string {
+	const first = "Subject: big\r\n"
+	pad := size - len(first) - len("X: \r\n")
+	return first + "X: " + strings.Repeat("a", pad) + "\r\n"
+}
+
+func TestHeadersTooLarge(t *testing.T) {
+	old := *maxHeaderSize
+	*maxHeaderSize = 100
+	t.Cleanup(func() { *maxHeaderSize = old })
+
+	for _, tc := range []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"at limit", headerBlock(100) + "\r\nbody\r\n", false},
+		{"over limit", headerBlock(101) + "\r\nbody\r\n", true},
+		{"bare LF at limit", strings.ReplaceAll(headerBlock(100), "\r\n", "\n") + "x\n\nbody\n", false},
+		{"over limit, no blank line yet", headerBlock(101), true},
+		{"short, no blank line yet", headerBlock(60), false},
+		{"no headers", "\r\n" + strings.Repeat("a", 200), false},
+		{"large body", "Subject: hi\r\n\r\n" + strings.Repeat("a", 200), false},
+	} {
+		if got := headersTooLarge([]byte(tc.body)); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSessionRefusesLargeHeaders(t *testing.T) {
+	old := *maxHeaderSize
+	*maxHeaderSize = 1024
+	t.Cleanup(func() { *maxHeaderSize = old })
+	b := startTestBackend(t)
+	c := dialGateway(t)
+
+	sendMessage(t, c, 552, headerBlock(1025)+"\r\nbody\r\n")
+	sendMessage(t, c, 250, headerBlock(1024)+"\r\nbody\r\n")
+	command(t, c, 221, "QUIT")
+	if msgs := b.messages(); len(msgs) != 1 {
+		t.Errorf("backend got %d messages, want the one within the limit", len(msgs))
+	}
+}
+
+func TestSessionRefusesEndlessHeaders(t *testing.T) {
+	old := *maxHeaderSize
+	*maxHeaderSize = 1024
+	t.Cleanup(func() { *maxHeaderSize = old })
+	startTestBackend(t)
+	c := dialGateway(t)
+
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	// Folded header lines sent one write at a time, never ending the block
+	w := c.DotWriter()
+	w.Write([]byte("X-Folded: start\r\n"))
+	for i := 0; i < 200; i++ {
+		w.Write([]byte("\tcontinued folded header line\r\n"))
+	}
+	w.Close()
+	expect(t, c, 552)
+	command(t, c, 250, "RSET")
+}
+
+// write sends raw client bytes in one write
+func write(t *testing.T, c *textproto.Conn, s string) {
+	t.Helper()
+	if _, err := c.W.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startScriptedBackend runs serve for each connection to the backend
+func startScriptedBackend(t *testing.T, serve func(c net.Conn, r *bufio.Reader)) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c, bufio.NewReader(c))
+			}()
+		}
+	}()
+	old := postfixBackends
+	postfixBackends = newBackendPool(ln.Addr().String())
+	t.Cleanup(func() { postfixBackends = old })
+}
+
+// startFakeBackend relays to s for the rest of the test
+func startFakeBackend(t *testing.T, s *smtptest.Server) {
+	t.Helper()
+	addr := s.Start(t)
+	old := postfixBackends
+	postfixBackends = newBackendPool(addr)
+	t.Cleanup(func() { postfixBackends = old })
+}
+
+// writeSlowly writes each piece separately, long enough apart that they
+// reach the gateway in separate reads
+func writeSlowly(c net.Conn, pieces ...string) {
+	for i, p := range pieces {
+		if i > 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		c.Write([]byte(p))
+	}
+}
+
+// readOnce returns what a single read of the client connection gets
+func readOnce(t *testing.T, c net.Conn) string {
+	t.Helper()
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestSessionMultilineAcrossReads(t *testing.T) {
+	startScriptedBackend(t, func(c net.Conn, r *bufio.Reader) {
+		writeSlowly(c, "220-backend.example.com ESMTP\r\n", "220 ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.TrimSpace(line)) {
+			case "EHLO CLIENT.EXAMPLE.COM":
+				// Split within a line as well as between them
+				writeSlowly(c, "250-backend\r\n250-PIPE", "LINING\r\n", "250 8BITMIME\r\n")
+			case "HELP":
+				writeSlowly(c, "214-Commands:\r\n", "214-  HELO EHLO MAIL RCPT DATA\r\n", "214 End of HELP\r\n")
+			default:
+				c.Write([]byte("250 2.0.0 Ok\r\n"))
+			}
+		}
+	})
+	conn := dialGatewayConn(t)
+
+	if got := readOnce(t, conn); got != "220-backend.example.com ESMTP\r\n220 ready\r\n" {
+		t.Errorf("greeting arrived as %q", got)
+	}
+	conn.Write([]byte("EHLO client.example.com\r\n"))
+	if got := readOnce(t, conn); !strings.HasPrefix(got, "250-backend\r\n") || !strings.Contains(got, "\r\n250-PIPELINING\r\n") ||
+		!strings.Contains(got, "\r\n250 ") || !strings.HasSuffix(got, "\r\n") {
+		t.Errorf("EHLO reply arrived as %q", got)
+	}
+	conn.Write([]byte("HELP\r\n"))
+	if got := readOnce(t, conn); got != "214-Commands:\r\n214-  HELO EHLO MAIL RCPT DATA\r\n214 End of HELP\r\n" {
+		t.Errorf("HELP reply arrived as %q", got)
+	}
+	conn.Write([]byte("NOOP\r\n"))
+	if got := readOnce(t, conn); got != "250 2.0.0 Ok\r\n" {
+		t.Errorf("NOOP reply arrived as %q", got)
+	}
+}
+
+func TestSessionQuit(t *testing.T) {
+	b := startTestBackend(t)
+	b.mu.Lock()
+	b.lingers = true
+	b.mu.Unlock()
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	write(t, c, "QUIT\r\nNOOP\r\n")
+	expect(t, c, 221)
+	// Closed by the gateway, though the backend hasn't hung up
+	if line, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("read %q, %v after QUIT, want EOF", line, err)
+	}
+	if cmds := b.commands(); cmds[len(cmds)-1] != "QUIT" {
+		t.Errorf("backend got %q, want nothing after QUIT", cmds)
+	}
+}
+
+func TestSessionQuitFlushesReceipts(t *testing.T) {
+	oldSize, oldInterval := *receiptBatchSize, *receiptBatchInterval
+	*receiptBatchSize, *receiptBatchInterval = 10, time.Hour
+	t.Cleanup(func() { *receiptBatchSize, *receiptBatchInterval = oldSize, oldInterval })
+	client, posts := receiptService(t, 201, `{}`)
+	t.Cleanup(func() { client.Shutdown(context.Background()) })
+	useReceipts(t, client)
+	startTestBackend(t)
+
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	if n := posts.Load(); n != 0 {
+		t.Fatalf("%d batches posted before the batch filled", n)
+	}
+	command(t, c, 221, "QUIT")
+	deadline := time.Now().Add(5 * time.Second)
+	for posts.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("receipt still batched after QUIT")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receivedEnvelope returns the receipt of a message the session delivered,
+// checking the backend got just that one
+func receivedEnvelope(t *testing.T, b *testBackend, store *memReceiptStore) (Receipt, string) {
+	t.Helper()
+	r := <-store.calls
+	msgs := b.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("backend got %d messages, want 1", len(msgs))
+	}
+	return r, msgs[0]
+}
+
+func TestSessionRSETClearsTransaction(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<old@example.com>")
+	command(t, c, 550, "RCPT TO:<bad@example.com>")
+	command(t, c, 250, "RCPT TO:<stale@example.com>")
+	bdat(t, c, "Subject: stale\r\n", false)
+	expect(t, c, 250)
+	command(t, c, 250, "RSET")
+
+	command(t, c, 250, "MAIL FROM:<new@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 250, "NOOP")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte(testBody))
+	w.Close()
+	expect(t, c, 250)
+
+	r, msg := receivedEnvelope(t, b, store)
+	if !strings.Contains(r.Sender, "new@example.com") || len(r.Recipients) != 1 || !strings.Contains(r.Recipients[0], "b@example.com") {
+		t.Errorf("receipt for %q to %q, want only the second transaction", r.Sender, r.Recipients)
+	}
+	for rcpt := range r.RecipientStatus {
+		if strings.Contains(rcpt, "bad") || strings.Contains(rcpt, "stale") {
+			t.Errorf("receipt records %s from the reset transaction", rcpt)
+		}
+	}
+	if strings.Contains(msg, "Subject: stale") {
+		t.Errorf("chunk from the reset transaction delivered:\n%s", msg)
+	}
+}
+
+func TestSessionRSETAfterRefusedDATA(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<old@example.com>")
+	command(t, c, 550, "RCPT TO:<bad@example.com>")
+	command(t, c, 554, "DATA")
+	command(t, c, 250, "RSET")
+	sendMessage(t, c, 250, testBody)
+
+	r, _ := receivedEnvelope(t, b, store)
+	if _, ok := r.RecipientStatus["<bad@example.com>"]; ok || len(r.RecipientStatus) != 1 {
+		t.Errorf("receipt recipients %v, want only the second transaction's", r.RecipientStatus)
+	}
+}
+
+func TestSessionPipelining(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	write(t, c, "EHLO client.example.com\r\nMAIL FROM:<a@example.com> SIZE=100\r\n"+
+		"RCPT TO:<b@example.com>\r\nRCPT TO:<bad@example.com>\r\nRCPT TO:<c@example.com>\r\nDATA\r\n")
+	for _, code := range []int{250, 250, 250, 550, 250, 354} {
+		expect(t, c, code)
+	}
+	w := c.DotWriter()
+	w.Write([]byte(testBody))
+	w.Close()
+	expect(t, c, 250)
+	// A second group, ending in QUIT
+	write(t, c, "RSET\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<d@example.com>\r\nNOOP\r\nQUIT\r\n")
+	for _, code := range []int{250, 250, 250, 250, 221} {
+		expect(t, c, code)
+	}
+
+	want := []string{
+		"EHLO client.example.com", "MAIL FROM:<a@example.com> SIZE=100",
+		"RCPT TO:<b@example.com>", "RCPT TO:<bad@example.com>", "RCPT TO:<c@example.com>", "DATA",
+	}
+	got := b.commands()
+	if len(got) < len(want) || !reflect.DeepEqual(got[:len(want)], want) {
+		t.Fatalf("backend got %q, want it to start %q", got, want)
+	}
+	// The message, then the second group in order
+	rest := got[len(want):]
+	tail := []string{"RSET", "MAIL FROM:<a@example.com>", "RCPT TO:<d@example.com>", "NOOP", "QUIT"}
+	if len(rest) < len(tail) || !reflect.DeepEqual(rest[len(rest)-len(tail):], tail) {
+		t.Errorf("backend got %q after DATA, want it to end %q", rest, tail)
+	}
+}
+
+func TestSessionCommandSplitAcrossWrites(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	group := "EHLO client.example.com\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\n"
+	for i := 0; i < len(group); i += 5 {
+		write(t, c, group[i:min(i+5, len(group))])
+		time.Sleep(time.Millisecond)
+	}
+	for _, code := range []int{250, 250, 250} {
+		expect(t, c, code)
+	}
+	want := []string{"EHLO client.example.com", "MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>"}
+	if got := b.commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("backend got %q, want %q", got, want)
+	}
+}
+
+func TestSessionCompleteLineTooLong(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	write(t, c, "NOOP "+strings.Repeat("x", *maxLineLength)+"\r\nNOOP\r\n")
+	expect(t, c, 500)
+	expect(t, c, 250)
+	// A line right at the limit is fine
+	command(t, c, 250, "NOOP "+strings.Repeat("x", *maxLineLength-len("NOOP \r\n")))
+	if got := b.commands(); len(got) != 2 || got[0] != "NOOP" {
+		t.Errorf("backend got %d commands, want the NOOPs within the limit", len(got))
+	}
+}
+
+func TestSessionLongAUTHLine(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	auth := "AUTH PLAIN " + strings.Repeat("A", 4096)
+	command(t, c, 250, auth)
+	if got := b.commands(); len(got) != 1 || got[0] != auth {
+		t.Errorf("long AUTH line not relayed")
+	}
+}
+
+func TestSessionLongLinesClose(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	long := "NOOP " + strings.Repeat("x", *maxLineLength) + "\r\n"
+	for i := 1; i < *maxLongLines; i++ {
+		command(t, c, 500, strings.TrimSuffix(long, "\r\n"))
+	}
+	write(t, c, long+"NOOP\r\n")
+	expect(t, c, 421)
+	if line, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("read %q, %v after 421, want EOF", line, err)
+	}
+	if got := b.commands(); len(got) != 0 {
+		t.Errorf("backend got %q", got)
+	}
+}
+
+func TestSessionLineBufferBound(t *testing.T) {
+	client, far := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, far)
+	backend, _ := net.Pipe()
+	defer backend.Close()
+	timer := &sessionTimer{}
+	s := newSMTPSession(slog.Default(), client, newBackendWriter(backend, timer), timer, nil)
+
+	// An endless line is never held past the limit
+	chunk := []byte(strings.Repeat("x", 1000))
+	for i := 0; i < 100; i++ {
+		if err := s.clientData(context.Background(), chunk); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.line) > *maxLineLength {
+			t.Fatalf("%d bytes buffered after %d reads", len(s.line), i+1)
+		}
+	}
+	if s.longLines != 1 {
+		t.Errorf("%d long lines counted, want 1", s.longLines)
+	}
+}
+
+func TestSessionLineTooLong(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	long := "NOOP " + strings.Repeat("x", maxCommandLine)
+	for i := 0; i < 3; i++ {
+		write(t, c, long)
+	}
+	write(t, c, "\r\nNOOP\r\n")
+	expect(t, c, 500)
+	expect(t, c, 250)
+	if got := b.commands(); !reflect.DeepEqual(got, []string{"NOOP"}) {
+		t.Errorf("backend got %d commands, want just the NOOP", len(got))
+	}
+}
+
+func TestSessionOverUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	backendSock := filepath.Join(dir, "postfix.sock")
+	bl, err := net.Listen("unix", backendSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := serveTestBackend(t, bl)
+	old := postfixBackends
+	postfixBackends = newBackendPool("unix:" + backendSock)
+	t.Cleanup(func() { postfixBackends = old })
+
+	gatewaySock := filepath.Join(dir, "smtp.sock")
+	ln := listen("unix:" + gatewaySock)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if conn, err := ln.Accept(); err == nil {
+			handleConnection(conn, nil)
+		}
+	}()
+	conn, err := net.Dial("unix", gatewaySock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(conn)
+	expect(t, c, 220)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+	c.Close()
+	<-done
+
+	if msgs := b.messages(); len(msgs) != 1 || !strings.Contains(msgs[0], "X-PQC-Signature:") {
+		t.Errorf("backend got %q", msgs)
+	}
+	ln.Close()
+	if _, err := os.Stat(gatewaySock); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file left after close: %v", err)
+	}
+}
+
+func TestListenRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	// A gateway that was killed leaves its socket file behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln := listen("unix:" + path)
+	defer ln.Close()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestMailSize(t *testing.T) {
+	for line, want := range map[string]int64{
+		"MAIL FROM:<a@example.com> SIZE=1000\r\n":          1000,
+		"MAIL FROM:<> BODY=8BITMIME size=20\r\n":           20,
+		"MAIL FROM:a@example.com SIZE=30\r\n":              30,
+		"MAIL FROM:<用户@例子.广告> SMTPUTF8 SIZE=2048\r\n":      2048,
+		"MAIL FROM:<\"x\u3000SIZE=1\"@例子.广告> SMTPUTF8\r\n": 0,
+		"MAIL FROM:<\"a SIZE=5\"@example.com>\r\n":         0,
+		"MAIL FROM:<a@example.com>\r\n":                    0,
+	} {
+		if got, _ := mailSize([]byte(line)); got != want {
+			t.Errorf("%q: %d, want %d", line, got, want)
+		}
+	}
+}
+
+func TestSessionSMTPUTF8(t *testing.T) {
+	b := &smtptest.Server{Extensions: []string{"PIPELINING", "8BITMIME", "SMTPUTF8"}}
+	startFakeBackend(t, b)
+	body := "From: 用户 <用户@例子.广告>\r\nTo: δοκιμή@παράδειγμα.δοκιμή\r\nSubject: Grüße – 你好\u00a0\r\n\r\nZeile mit Umlauten: äöü\r\n"
+	c := dialGateway(t)
+	if ehlo := command(t, c, 250, "EHLO client.example.com"); !strings.Contains(ehlo, "\nSMTPUTF8\n") {
+		t.Errorf("EHLO reply %q doesn't offer the backend's SMTPUTF8", ehlo)
+	}
+	command(t, c, 250, "MAIL FROM:<用户@例子.广告> SMTPUTF8 SIZE=1000")
+	command(t, c, 250, "RCPT TO:<δοκιμή@παράδειγμα.δοκιμή>")
+	command(t, c, 354, "DATA")
+	w := c.DotWriter()
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, c, 250)
+	command(t, c, 221, "QUIT")
+
+	cmds := b.Commands()
+	for _, want := range []string{"MAIL FROM:<用户@例子.广告> SMTPUTF8 SIZE=1000", "RCPT TO:<δοκιμή@παράδειγμα.δοκιμή>"} {
+		if !slices.Contains(cmds, want) {
+			t.Errorf("backend got %q, want %q", cmds, want)
+		}
+	}
+	msgs := b.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("backend got %q", msgs)
+	}
+	for _, line := range strings.SplitAfter(body, "\r\n") {
+		if !strings.Contains(msgs[0], line) {
+			t.Errorf("%q lost from %q", line, msgs[0])
+		}
+	}
+	if r := verifyMessage(context.Background(), []byte(msgs[0])); r.status != verifyPass {
+		t.Errorf("signature %v", r)
+	}
+}
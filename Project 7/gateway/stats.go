@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats counts the gateway's connections, traffic and signing. /metrics
+// and /stats both report from a Snapshot, so they never disagree.
+type Stats struct {
+	// Updates hold mu shared, so they run concurrently with each other;
+	// Snapshot holds it exclusively, so it never sees an update that has
+	// moved one counter and not yet its partner
+	mu sync.RWMutex
+
+	connectionsAccepted atomic.Int64
+	connectionsActive   atomic.Int64
+	connectionsClosed   atomic.Int64
+	bytesFromClient     atomic.Int64
+	bytesFromBackend    atomic.Int64
+	messagesSigned      atomic.Int64
+	signingErrors       atomic.Int64
+}
+
+// StatsSnapshot is a copy of Stats at one instant. Accepted connections
+// always equal active plus closed ones.
+type StatsSnapshot struct {
+	ConnectionsAccepted int64 `json:"connections_accepted"`
+	ConnectionsActive   int64 `json:"connections_active"`
+	ConnectionsClosed   int64 `json:"connections_closed"`
+	BytesFromClient     int64 `json:"bytes_from_client"`
+	BytesFromBackend    int64 `json:"bytes_from_backend"`
+	MessagesSigned      int64 `json:"messages_signed"`
+	SigningErrors       int64 `json:"signing_errors"`
+}
+
+// The gateway's counters
+var stats = &Stats{}
+
+func (s *Stats) connectionOpened() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.connectionsAccepted.Add(1)
+	s.connectionsActive.Add(1)
+}
+
+func (s *Stats) connectionClosed() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.connectionsActive.Add(-1)
+	s.connectionsClosed.Add(1)
+}
+
+// Single-counter updates need no lock: there's no partner to keep in step
+
+func (s *Stats) clientBytes(n int)  { s.bytesFromClient.Add(int64(n)) }
+func (s *Stats) backendBytes(n int) { s.bytesFromBackend.Add(int64(n)) }
+func (s *Stats) messageSigned()     { s.messagesSigned.Add(1) }
+func (s *Stats) signingFailed()     { s.signingErrors.Add(1) }
+
+// active is the number of connections being served
+func (s *Stats) active() int64 { return s.connectionsActive.Load() }
+
+// Snapshot returns a consistent copy of the counters
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StatsSnapshot{
+		ConnectionsAccepted: s.connectionsAccepted.Load(),
+		ConnectionsActive:   s.connectionsActive.Load(),
+		ConnectionsClosed:   s.connectionsClosed.Load(),
+		BytesFromClient:     s.bytesFromClient.Load(),
+		BytesFromBackend:    s.bytesFromBackend.Load(),
+		MessagesSigned:      s.messagesSigned.Load(),
+		SigningErrors:       s.signingErrors.Load(),
+	}
+}
+
+// statsCollector exports Stats to Prometheus, one Snapshot a scrape
+type statsCollector struct{ stats *Stats }
+
+var (
+	connectionsAcceptedDesc = prometheus.NewDesc("pqc_gateway_connections_accepted_total",
+		"Client connections accepted.", nil, nil)
+	connectionsActiveDesc = prometheus.NewDesc("pqc_gateway_connections_active",
+		"Client connections being served.", nil, nil)
+	bytesProxiedDesc = prometheus.NewDesc("pqc_gateway_bytes_proxied_total",
+		"Bytes read from each side of proxied sessions.", []string{"direction"}, nil)
+	messagesSignedDesc = prometheus.NewDesc("pqc_gateway_messages_signed_total",
+		"Messages signed and forwarded.", nil, nil)
+	signingErrorsDesc = prometheus.NewDesc("pqc_gateway_signing_errors_total",
+		"Messages that could not be signed.", nil, nil)
+)
+
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectionsAcceptedDesc
+	ch <- connectionsActiveDesc
+	ch <- bytesProxiedDesc
+	ch <- messagesSignedDesc
+	ch <- signingErrorsDesc
+}
+
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats.Snapshot()
+	ch <- prometheus.MustNewConstMetric(connectionsAcceptedDesc, prometheus.CounterValue, float64(s.ConnectionsAccepted))
+	ch <- prometheus.MustNewConstMetric(connectionsActiveDesc, prometheus.GaugeValue, float64(s.ConnectionsActive))
+	ch <- prometheus.MustNewConstMetric(bytesProxiedDesc, prometheus.CounterValue, float64(s.BytesFromClient), "client_to_backend")
+	ch <- prometheus.MustNewConstMetric(bytesProxiedDesc, prometheus.CounterValue, float64(s.BytesFromBackend), "backend_to_client")
+	ch <- prometheus.MustNewConstMetric(messagesSignedDesc, prometheus.CounterValue, float64(s.MessagesSigned))
+	ch <- prometheus.MustNewConstMetric(signingErrorsDesc, prometheus.CounterValue, float64(s.SigningErrors))
+}
+
+// statsHandler serves GET /stats: the counters as plain text, for people
+// rather than Prometheus
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := stats.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Connections: %d accepted, %d active, %d closed\n",
+		s.ConnectionsAccepted, s.ConnectionsActive, s.ConnectionsClosed)
+	fmt.Fprintf(w, "Bytes proxied: %d from clients, %d from backends\n", s.BytesFromClient, s.BytesFromBackend)
+	fmt.Fprintf(w, "Messages: %d signed, %d signing errors\n", s.MessagesSigned, s.SigningErrors)
+}
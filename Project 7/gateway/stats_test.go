@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStatsSnapshotConsistent(t *testing.T) {
+	s := &Stats{}
+	const workers, rounds = 16, 2000
+	done := make(chan struct{})
+	var snapshots sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		snapshots.Add(1)
+		go func() {
+			defer snapshots.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := s.Snapshot()
+				if snap.ConnectionsAccepted != snap.ConnectionsActive+snap.ConnectionsClosed {
+					t.Errorf("inconsistent snapshot: %+v", snap)
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				s.connectionOpened()
+				s.clientBytes(10)
+				s.backendBytes(20)
+				if j%2 == 0 {
+					s.messageSigned()
+				} else {
+					s.signingFailed()
+				}
+				s.connectionClosed()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	snapshots.Wait()
+
+	want := StatsSnapshot{
+		ConnectionsAccepted: workers * rounds,
+		ConnectionsClosed:   workers * rounds,
+		BytesFromClient:     workers * rounds * 10,
+		BytesFromBackend:    workers * rounds * 20,
+		MessagesSigned:      workers * rounds / 2,
+		SigningErrors:       workers * rounds / 2,
+	}
+	if got := s.Snapshot(); got != want {
+		t.Errorf("final snapshot %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	startTestBackend(t)
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+
+	srv := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	snap := stats.Snapshot()
+	if snap.MessagesSigned == 0 || snap.BytesFromClient == 0 {
+		t.Fatalf("session not counted: %+v", snap)
+	}
+	for _, want := range []string{"Connections: ", "Bytes proxied: ", "Messages: "} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/stats missing %q:\n%s", want, body)
+		}
+	}
+
+	// /metrics reports the same counters
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		if m := f.GetMetric(); len(m) == 1 && m[0].GetCounter() != nil {
+			got[f.GetName()] = m[0].GetCounter().GetValue()
+		}
+	}
+	if got["pqc_gateway_messages_signed_total"] != float64(snap.MessagesSigned) ||
+		got["pqc_gateway_signing_errors_total"] != float64(snap.SigningErrors) {
+		t.Errorf("/metrics disagrees with the snapshot %+v: %v", snap, got)
+	}
+}
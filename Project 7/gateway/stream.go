@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+var streamAbove = flag.Int("stream-above", 0, "Sign DATA bodies over this many bytes while they stream to the backend, as multipart/signed, rather than holding them whole (0 holds every message)")
+
+// ph= value of a signature made over the SHA-256 digest of its signed bytes
+// rather than the bytes themselves
+const prehashSHA256 = "sha256"
+
+// Raw DATA bytes held back from a stream until more arrive: enough that a
+// terminator split across reads is still seen whole
+const streamHold = len("\r\n.\r\n") - 1
+
+// streamSigner signs a message while it passes through to the backend, for
+// messages too large to hold (-stream-above). A header signature can't go
+// ahead of a body not yet seen, so the message goes out as multipart/signed:
+// the wrapper as soon as the header block is complete, the body as it
+// arrives, and the signature part after the last of it. The signer only
+// ever sees the digest of the part, so the signature carries ph=sha256.
+type streamSigner struct {
+	signer   Signer
+	msgID    string
+	nonce    string
+	boundary string
+
+	signed hash.Hash // nonce and part, for the signature
+	part   hash.Hash // part alone, for the receipt
+	in     dotUnstuffer
+	out    dotStuffer
+	buf    []byte // unstuffed bytes of the piece being passed on
+	size   int64  // raw DATA taken so far
+}
+
+// newStreamSigner starts signing a message streamed through in pieces.
+// The boundary can't be checked against a body that hasn't arrived, so it
+// rests on being random.
+func newStreamSigner(signer Signer, msgID, nonce string) (*streamSigner, error) {
+	boundary, err := newBoundary(nil)
+	if err != nil {
+		return nil, err
+	}
+	st := &streamSigner{
+		signer:   signer,
+		msgID:    msgID,
+		nonce:    nonce,
+		boundary: boundary,
+		signed:   sha256.New(),
+		part:     sha256.New(),
+	}
+	st.signed.Write(bindNonce(nil, nonce))
+	return st, nil
+}
+
+// begin takes the first raw DATA of the message and returns what to send
+// the backend for it, stuffed. msg is that DATA unstuffed, with the header
+// block complete and any header changes made; later pieces go to write.
+func (st *streamSigner) begin(raw, msg []byte) ([]byte, error) {
+	// Carry on unstuffing where msg left off, at raw's last byte
+	last := raw[len(raw)-1]
+	st.in = dotUnstuffer{midLine: last != '\n', lastCR: last == '\r'}
+	st.size = int64(len(raw))
+
+	outer, inner := splitContentHeaders(msg)
+	head, err := multipartHead(outer, st.signer.Algorithm(), st.boundary)
+	if err != nil {
+		return nil, err
+	}
+	out := st.out.stuff(nil, head)
+	body := bytes.TrimPrefix(msg[headerEnd(msg):], crlf)
+	for _, b := range [][]byte{inner, crlf, body} {
+		st.signed.Write(b)
+		st.part.Write(b)
+		out = st.out.stuff(out, b)
+	}
+	return out, nil
+}
+
+// write passes on a raw piece of the body, returning it stuffed for the
+// backend
+func (st *streamSigner) write(raw []byte) []byte {
+	st.size += int64(len(raw))
+	st.buf = st.in.unstuff(st.buf[:0], raw)
+	st.signed.Write(st.buf)
+	st.part.Write(st.buf)
+	return st.out.stuff(make([]byte, 0, len(st.buf)+len(st.buf)/64), st.buf)
+}
+
+// finish signs what has passed through and returns the rest of the message,
+// the signature part, with the signature
+func (st *streamSigner) finish(ctx context.Context) (tail, sig []byte, err error) {
+	digest := st.signed.Sum(nil)
+	if sig, err = sign(ctx, st.signer, st.msgID, digest); err != nil {
+		return nil, nil, err
+	}
+	value, err := formatSignatureHeader(st.signer.Algorithm(), st.signer.KeyID(), st.nonce, canonSimple, prehashSHA256, nil, sig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed signature part: %w", err)
+	}
+	// The last body byte may have been a line break, so this starts a line
+	var out dotStuffer
+	return out.stuff(nil, multipartTail(st.boundary, value)), sig, nil
+}
+
+// partSum is the SHA-256 of the signed part, as a receipt records it
+func (st *streamSigner) partSum() [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	st.part.Sum(sum[:0])
+	return sum
+}
+
+// startStream switches a message over -stream-above from being held to
+// being streamed, once its header block has arrived. A message that can't
+// be wrapped stays held.
+func (s *smtpSession) startStream(ctx context.Context) error {
+	// Filters need the whole message before any of it goes on
+	if *streamAbove <= 0 || *observeOnly || len(filters) > 0 || len(s.body) <= *streamAbove {
+		return nil
+	}
+	raw := s.body[:len(s.body)-streamHold]
+	msg := unstuffDots(raw)
+	if headerEnd(msg) == len(msg) {
+		return nil // no end to the header block yet
+	}
+
+	env, log := s.messageEnvelope()
+	msgID, ok := headerValue(msg, "Message-ID")
+	if !ok {
+		msgID = newMessageID()
+		msg = insertHeader(msg, "Message-ID", msgID)
+	}
+	msg, forged := removeOwnAuthResults(msg)
+	if forged > 0 {
+		log.Warn("Removed Authentication-Results claiming to be from this gateway", "event", "auth_results_removed",
+			"message_id", msgID, "count", forged)
+	}
+	st, err := newStreamSigner(signerFor(env.mailFrom), msgID, newNonce())
+	var out []byte
+	if err == nil {
+		out, err = st.begin(raw, msg)
+	}
+	if err != nil {
+		log.Warn("Can't stream message, holding it whole", "event", "stream_failed", "message_id", msgID, "error", err)
+		return nil
+	}
+	// An upstream signature can't be checked without the whole message, nor
+	// a -dkim-key one made: its body hash goes in the header sent first
+	log.Info("Streaming large message to backend", "event", "message_streaming", "message_id", msgID,
+		"threshold", *streamAbove)
+
+	s.stream, s.streamEnv, s.streamLog = st, env, log
+	s.phase = phaseDataStream
+	s.body, s.scanned = append([]byte(nil), s.body[len(raw):]...), 0
+	if err := s.openBackendData(ctx); err != nil {
+		return err
+	}
+	s.message = append(s.receivedHeader(), out...)
+	return nil
+}
+
+// streamData takes a raw piece of a streamed body, ending the session if
+// it takes the message over -max-message-size
+func (s *smtpSession) streamData(raw []byte) error {
+	out := s.stream.write(raw)
+	if s.tooLarge(s.stream.size) {
+		return s.abortStream("message_too_large", errMessageTooLarge)
+	}
+	return s.sendStream(out, false)
+}
+
+// sendStream passes on streamed bytes: held with the message until the
+// backend's 354, written behind it after. The write of the message's end
+// ends its span.
+func (s *smtpSession) sendStream(out []byte, last bool) error {
+	if s.message != nil {
+		s.message = append(s.message, out...)
+		return nil
+	}
+	if !last {
+		return s.backend.write(out)
+	}
+	err := s.backend.writeMessage(queuedWrite{p: out, span: s.messageSpan})
+	s.messageSpan = nil
+	return err
+}
+
+// finishStream signs a streamed message now that its end has arrived, and
+// sends the backend the rest of it
+func (s *smtpSession) finishStream(ctx context.Context, raw []byte) error {
+	if err := s.streamData(raw); err != nil || s.stream == nil {
+		return err
+	}
+	st, env, log := s.stream, s.streamEnv, s.streamLog
+	s.stream, s.streamLog = nil, nil
+	s.phase = phaseCommand
+	s.body, s.scanned = nil, 0
+
+	tail, sig, err := st.finish(ctx)
+	if err != nil {
+		log.Error("Failed to sign message", "event", "sign_failed", "message_id", st.msgID, "error", err)
+		stats.signingFailed()
+		return s.abortStream("sign_failed", fmt.Errorf("%w: %w", errSigningFailed, err))
+	}
+	log.Debug("Signed message", "event", "message_signed", "message_id", st.msgID,
+		"alg", st.signer.Algorithm(), "kid", st.signer.KeyID(), "format", formatMultipart, "size", st.size)
+	stats.messageSigned()
+	r := messageReceipt(st.signer, st.msgID, st.nonce, env, st.partSum(), sig)
+	if s.delivered, err = vouch(ctx, log, st.msgID, env, r); err != nil {
+		return s.abortStream("receipt_failed", err)
+	}
+	return s.sendStream(append(tail, ".\r\n"...), true)
+}
+
+// abortStream ends a session whose streamed message can't be finished. Its
+// start has already gone to the backend, so it can't be refused the usual
+// way; instead the session closes before the terminator is sent, and the
+// backend discards what it has.
+func (s *smtpSession) abortStream(reason string, err error) error {
+	log := s.streamLog
+	if log == nil {
+		log = s.log
+	}
+	log.Warn("Abandoning streamed message, closing session", "event", "stream_aborted", "reason", reason)
+	s.stream, s.streamLog, s.message = nil, nil, nil
+	s.closing, s.quit = true, true
+	rejected := smtpReplyFor(err)
+	return s.writeClient([]byte(fmt.Sprintf("%d %s\r\n", rejected.code, rejected.text)))
+}
+
+// refuseStream turns the backend's refusal of DATA for a message still
+// streaming in into the reply to its end, once the client gets there
+func (s *smtpSession) refuseStream(line []byte) {
+	code, _ := strconv.Atoi(string(line[:3]))
+	text := strings.TrimSpace(string(line[3:]))
+	s.stream, s.streamLog, s.message = nil, nil, nil
+	s.phase, s.discard = phaseDataDiscard, &smtpError{code, text}
+	s.body = dataTail(s.body)
+}
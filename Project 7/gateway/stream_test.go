@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const streamHeader = "From: a@example.com\r\nTo: b@example.com\r\nSubject: large\r\nContent-Type: text/plain\r\n\r\n"
+
+// streamLines returns n raw DATA body lines, some dot-stuffed
+func streamLines(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		if i%10 == 3 {
+			b.WriteString("..leading dot\r\n")
+		}
+		fmt.Fprintf(&b, "line %06d of a message too large to hold\r\n", i)
+	}
+	return b.String()
+}
+
+// streamThrough feeds raw DATA, less its terminator, through a streamSigner
+// in pieces of size bytes, returning what the backend would be sent
+func streamThrough(t testing.TB, raw string, size int, out io.Writer) {
+	t.Helper()
+	st, err := newStreamSigner(currentSigner(), "<large@example.com>", newNonce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := raw[:len(streamHeader)+1]
+	begun, err := st.begin([]byte(first), unstuffDots([]byte(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(begun)
+	for rest := raw[len(first):]; len(rest) > 0; {
+		n := min(size, len(rest))
+		out.Write(st.write([]byte(rest[:n])))
+		rest = rest[n:]
+	}
+	tail, _, err := st.finish(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(tail)
+}
+
+func TestStreamSigner(t *testing.T) {
+	raw := streamHeader + streamLines(500)
+	// Odd-sized pieces split CRLFs and stuffed dots between writes
+	for _, size := range []int{1, 7, 4096} {
+		var out bytes.Buffer
+		streamThrough(t, raw, size, &out)
+		msg := unstuffDots(out.Bytes())
+		if r := verifyMessage(context.Background(), msg); r.status != verifyPass {
+			t.Fatalf("pieces of %d: %+v", size, r)
+		}
+		part, _, _ := signedPart(msg)
+		want := "Content-Type: text/plain\r\n\r\n" + string(unstuffDots([]byte(streamLines(500))))
+		if string(part) != want {
+			t.Errorf("pieces of %d: signed part differs from the body", size)
+		}
+	}
+}
+
+func TestStreamSignerTamper(t *testing.T) {
+	var out bytes.Buffer
+	streamThrough(t, streamHeader+streamLines(50), 100, &out)
+	msg := strings.Replace(string(unstuffDots(out.Bytes())), "line 000042", "line 000043", 1)
+	if r := verifyMessage(context.Background(), []byte(msg)); r.status != verifyFail {
+		t.Errorf("altered body: %+v", r)
+	}
+}
+
+// countingWriter keeps only the size of what it is given
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestStreamSignerMemory(t *testing.T) {
+	const chunk = 64 << 10
+	total := 64 << 20
+	if testing.Short() {
+		total = 8 << 20
+	}
+	lines := streamLines(chunk / 45)
+	st, err := newStreamSigner(currentSigner(), "<large@example.com>", newNonce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	begun, err := st.begin([]byte(streamHeader), []byte(streamHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base, peak := m.HeapAlloc, m.HeapAlloc
+	out := &countingWriter{n: int64(len(begun))}
+	for i := 0; out.n < int64(total); i++ {
+		out.Write(st.write([]byte(lines)))
+		if i%16 == 0 {
+			runtime.ReadMemStats(&m)
+			peak = max(peak, m.HeapAlloc)
+		}
+	}
+	tail, _, err := st.finish(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(tail)
+	if grew := int64(peak) - int64(base); grew > 16<<20 {
+		t.Errorf("heap grew %d bytes streaming %d", grew, out.n)
+	}
+}
+
+func BenchmarkStreamSigning(b *testing.B) {
+	lines := []byte(streamLines(64 << 10 / 45))
+	st, err := newStreamSigner(currentSigner(), "<large@example.com>", newNonce())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := st.begin([]byte(streamHeader), []byte(streamHeader)); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(lines)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st.write(lines)
+	}
+	if _, _, err := st.finish(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// startStreamBackend runs a backend that reports the first line of each
+// message as it arrives and the whole message once it ends, and answers
+// DATA with dataReply
+func startStreamBackend(t *testing.T, dataReply string) (first, msgs chan string) {
+	first, msgs = make(chan string, 1), make(chan string, 1)
+	startScriptedBackend(t, func(c net.Conn, r *bufio.Reader) {
+		c.Write([]byte("220 backend ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch verb, _, _ := strings.Cut(strings.TrimSpace(line), " "); verb {
+			case "EHLO":
+				c.Write([]byte("250-backend\r\n250 PIPELINING\r\n"))
+			case "DATA":
+				c.Write([]byte(dataReply))
+				if !strings.HasPrefix(dataReply, "354") {
+					continue
+				}
+				var msg strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if msg.Len() == 0 {
+						first <- l
+					}
+					if l == ".\r\n" {
+						break
+					}
+					msg.WriteString(l)
+				}
+				msgs <- msg.String()
+				c.Write([]byte("250 2.0.0 Ok: queued\r\n"))
+			case "QUIT":
+				c.Write([]byte("221 2.0.0 Bye\r\n"))
+				return
+			default:
+				c.Write([]byte("250 2.0.0 Ok\r\n"))
+			}
+		}
+	})
+	return first, msgs
+}
+
+// startStreamedMessage opens a transaction and sends DATA the header and
+// first lines of a message over -stream-above
+func startStreamedMessage(t *testing.T) *textproto.Conn {
+	t.Helper()
+	setFlags(t, map[string]string{"stream-above": "4096"})
+	c := dialGateway(t)
+	command(t, c, 250, "EHLO client.example.com")
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+	command(t, c, 250, "RCPT TO:<b@example.com>")
+	command(t, c, 354, "DATA")
+	write(t, c, streamHeader+streamLines(200))
+	return c
+}
+
+func TestSessionStreamsLargeMessage(t *testing.T) {
+	store := &memReceiptStore{calls: make(chan Receipt, 1)}
+	useReceipts(t, store)
+	first, msgs := startStreamBackend(t, "354 go ahead\r\n")
+	c := startStreamedMessage(t)
+
+	// The backend has the start of the message before the client is done
+	select {
+	case <-first:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing reached the backend while the message was arriving")
+	}
+	write(t, c, streamLines(2000)+".\r\n")
+	expect(t, c, 250)
+
+	msg := unstuffDots([]byte(<-msgs))
+	if r := verifyMessage(context.Background(), msg); r.status != verifyPass {
+		t.Fatalf("streamed message: %+v", r)
+	}
+	if ct, _ := headerValue(msg, "Content-Type"); !strings.HasPrefix(ct, "multipart/signed") {
+		t.Errorf("Content-Type %q, want multipart/signed", ct)
+	}
+	part, value, _ := signedPart(msg)
+	if tags, err := parseSignatureHeader(value); err != nil || tags["ph"] != prehashSHA256 {
+		t.Errorf("signature %q, want ph=%s", value, prehashSHA256)
+	}
+	command(t, c, 221, "QUIT")
+	sum := sha256.Sum256(part)
+	if r := <-store.calls; r.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("receipt hash %s doesn't match the signed part", r.Hash)
+	}
+}
+
+func TestSessionStreamRefusedByBackend(t *testing.T) {
+	startStreamBackend(t, "552 5.3.4 Message too big for me\r\n")
+	c := startStreamedMessage(t)
+	write(t, c, streamLines(2000)+".\r\n")
+	if msg := expect(t, c, 552); !strings.Contains(msg, "too big for me") {
+		t.Errorf("reply %q, want the backend's", msg)
+	}
+	// The transaction is over, and the session carries on
+	command(t, c, 250, "MAIL FROM:<a@example.com>")
+}
+
+func TestSessionStreamOverSizeLimit(t *testing.T) {
+	setFlags(t, map[string]string{"max-message-size": "16384"})
+	first, msgs := startStreamBackend(t, "354 go ahead\r\n")
+	c := startStreamedMessage(t)
+	<-first // streaming, not yet over the limit
+	write(t, c, streamLines(200))
+	expect(t, c, 552)
+	select {
+	case msg := <-msgs:
+		t.Errorf("backend was handed %d bytes as a whole message", len(msg))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
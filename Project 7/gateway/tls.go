@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	clientCA      = flag.String("client-ca", "", "PEM CA bundle for submission clients; when set, SMTP clients must present a certificate it issued")
+	tlsCurves     = flag.String("tls-curves", "", "Comma-separated key exchange groups in preference order (default: X25519MLKEM768,X25519 where supported)")
+	tlsCiphers    = flag.String("tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites (TLS 1.3 suites are fixed by crypto/tls; default: Go's secure set)")
+	tlsMinVersion = flag.String("tls-min-version", "1.3", "Lowest TLS version accepted: 1.2 or 1.3")
+	tlsMaxVersion = flag.String("tls-max-version", "", "Highest TLS version offered: 1.2 or 1.3 (default: highest supported)")
+)
+
+// TLS versions -tls-min-version and -tls-max-version accept. Anything older
+// than 1.2 is not offered.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig sets up TLS for the listeners. When that fails it is an
+// error unless -require-tls=false, which returns a nil config and leaves
+// the listeners in plaintext.
+func serverTLSConfig() (*tls.Config, error) {
+	config, err := getHybridTLSConfig()
+	if err == nil {
+		return config, nil
+	}
+	if *requireTLS {
+		return nil, fmt.Errorf("%w (-require-tls=false serves plaintext instead)", err)
+	}
+	slog.Warn("TLS unavailable, serving plaintext as -require-tls=false allows", "event", "tls_unavailable", "error", err)
+	return nil, nil
+}
+
+// Hybrid TLS configuration (X25519 + ML-KEM768 key exchange)
+func getHybridTLSConfig() (*tls.Config, error) {
+	cert, err := loadKeyPair()
+	if err != nil {
+		// For demo purposes, generate a self-signed cert if files don't exist
+		slog.Warn("Could not load TLS cert/key, generating a self-signed certificate", "event", "tls_self_signed", "error", err)
+		if cert, err = selfSignedCertificate(); err != nil {
+			return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+		}
+	}
+
+	if !hybridKEMAvailable {
+		slog.Warn("Runtime cannot negotiate X25519MLKEM768, TLS key exchange will be classical only",
+			"event", "tls_classical_only", "go_version", runtime.Version())
+	}
+
+	// TLS 1.3 only by default: the hybrid group isn't defined for earlier
+	// versions, and 1.3 cipher suites are fixed so there's nothing to list.
+	// The certificate comes from serverCert so it can be renewed in place.
+	serverCert.set(cert)
+	config := &tls.Config{
+		GetCertificate:         serverCert.getCertificate,
+		CurvePreferences:       hybridCurvePreferences,
+		SessionTicketsDisabled: !*tlsSessionTickets,
+	}
+	if err := applyTLSOptions(config); err != nil {
+		return nil, err
+	}
+
+	// Per-connection copy so the handshake log can name the peer
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		remote := hello.Conn.RemoteAddr()
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			attrs := []any{"event", "tls_handshake", "remote_addr", remote.String(),
+				"version", tls.VersionName(cs.Version), "cipher_suite", tls.CipherSuiteName(cs.CipherSuite),
+				"key_exchange", negotiatedGroup(cs)}
+			if cs.NegotiatedProtocol != "" {
+				attrs = append(attrs, "alpn", cs.NegotiatedProtocol)
+			}
+			if id := certIdentity(cs); id != "" {
+				attrs = append(attrs, "client_identity", id)
+			}
+			slog.Info("TLS handshake", attrs...)
+			return nil
+		}
+		return c, nil
+	}
+	return config, nil
+}
+
+// applyTLSOptions sets the -tls-* protocol options on config
+func applyTLSOptions(config *tls.Config) error {
+	var err error
+	if config.MinVersion, err = parseTLSVersion(*tlsMinVersion); err != nil {
+		return fmt.Errorf("-tls-min-version: %w", err)
+	}
+	if *tlsMaxVersion != "" {
+		if config.MaxVersion, err = parseTLSVersion(*tlsMaxVersion); err != nil {
+			return fmt.Errorf("-tls-max-version: %w", err)
+		}
+	}
+	if *tlsCiphers != "" {
+		if config.CipherSuites, err = parseCipherSuites(*tlsCiphers); err != nil {
+			return fmt.Errorf("-tls-ciphers: %w", err)
+		}
+	}
+	if config.CurvePreferences, err = effectiveCurves(); err != nil {
+		return fmt.Errorf("-tls-curves: %w", err)
+	}
+	if config.NextProtos, err = parseALPN(*tlsALPN); err != nil {
+		return fmt.Errorf("-tls-alpn: %w", err)
+	}
+	return nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q (supported: 1.2, 1.3)", s)
+}
+
+// parseCipherSuites resolves crypto/tls suite names, e.g.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Only TLS 1.2 suites crypto/tls
+// considers secure are accepted; the 1.3 ones can't be configured.
+func parseCipherSuites(list string) ([]uint16, error) {
+	var suites []*tls.CipherSuite
+	for _, suite := range tls.CipherSuites() {
+		if slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			suites = append(suites, suite)
+		}
+	}
+
+	var ids []uint16
+	for _, name := range splitList(list) {
+		i := slices.IndexFunc(suites, func(s *tls.CipherSuite) bool { return strings.EqualFold(s.Name, name) })
+		if i < 0 {
+			var names []string
+			for _, suite := range suites {
+				names = append(names, suite.Name)
+			}
+			return nil, fmt.Errorf("unknown cipher suite %q (supported: %s)", name, strings.Join(names, ", "))
+		}
+		ids = append(ids, suites[i].ID)
+	}
+	return ids, nil
+}
+
+// effectiveCurves returns the groups listeners offer in preference order:
+// -tls-curves when set, else the hybrid defaults. Empty means crypto/tls
+// picks.
+func effectiveCurves() ([]tls.CurveID, error) {
+	if *tlsCurves != "" {
+		return parseCurves(*tlsCurves)
+	}
+	return hybridCurvePreferences, nil
+}
+
+// parseCurves resolves group names as crypto/tls prints them (X25519MLKEM768,
+// X25519, CurveP256, ...); the Curve prefix is optional
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range splitList(list) {
+		i := slices.IndexFunc(supportedCurves, func(id tls.CurveID) bool {
+			return strings.EqualFold(id.String(), name) || strings.EqualFold(strings.TrimPrefix(id.String(), "Curve"), name)
+		})
+		if i < 0 {
+			var names []string
+			for _, id := range supportedCurves {
+				names = append(names, id.String())
+			}
+			return nil, fmt.Errorf("unknown or unsupported group %q (supported: %s)", name, strings.Join(names, ", "))
+		}
+		ids = append(ids, supportedCurves[i])
+	}
+	return ids, nil
+}
+
+// requireClientCerts returns a copy of config that demands a client
+// certificate issued by one of the CAs in caFile
+func requireClientCerts(config *tls.Config, caFile string) (*tls.Config, error) {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := config.Clone()
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	c.ClientCAs = pool
+	perClient := config.GetConfigForClient
+	c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		cc, err := perClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		cc.ClientAuth = tls.RequireAndVerifyClientCert
+		cc.ClientCAs = pool
+		return cc, nil
+	}
+	return c, nil
+}
+
+// loadCertPool reads a PEM CA bundle
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", caFile)
+	}
+	return pool, nil
+}
+
+// certIdentity names the verified client certificate: its subject CN, else
+// its first DNS or email SAN. Empty when the client sent no certificate.
+func certIdentity(cs tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := cs.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// selfSignedCertificate creates an in-memory ECDSA certificate for localhost
+// and this host's name, saving it to -cert/-key when -write-cert is set
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" && host != "localhost" {
+		names = append(names, host)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[len(names)-1], Organization: []string{"PQC Gateway (self-signed)"}},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if *writeCert {
+		if err := os.WriteFile(*certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(*keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		slog.Info("Wrote self-signed certificate", "event", "tls_cert_written", "cert", *certFile, "key", *keyFile)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,21 @@
+//go:build go1.25
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// Go 1.25+ negotiates the X25519MLKEM768 hybrid group and reports which
+// group a handshake used. Classical X25519 stays as a fallback for clients
+// that don't offer ML-KEM yet.
+const hybridKEMAvailable = true
+
+var hybridCurvePreferences = []tls.CurveID{tls.X25519MLKEM768, tls.X25519}
+
+// Groups -tls-curves may name
+var supportedCurves = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+func negotiatedGroup(cs tls.ConnectionState) string {
+	return cs.CurveID.String()
+}
@@ -0,0 +1,20 @@
+//go:build !go1.25
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// Older runtimes can't negotiate (or report) the hybrid group, so leave
+// curve selection to crypto/tls
+const hybridKEMAvailable = false
+
+var hybridCurvePreferences []tls.CurveID
+
+// Groups -tls-curves may name
+var supportedCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+func negotiatedGroup(tls.ConnectionState) string {
+	return "unknown"
+}
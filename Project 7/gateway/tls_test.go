@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a client certificate for cn
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// clientCertConfig is the gateway's TLS config with -client-ca set to ca
+func clientCertConfig(t *testing.T, ca *testCA) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	oldCert, oldKey := *certFile, *keyFile
+	*certFile, *keyFile = filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")
+	t.Cleanup(func() { *certFile, *keyFile = oldCert, oldKey })
+	config, err := getHybridTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if config, err = requireClientCerts(config, caFile); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// handshake runs a TLS handshake between config and a client presenting
+// certs, returning the server's error and what it saw
+func handshake(t *testing.T, config *tls.Config, certs []tls.Certificate) (tls.ConnectionState, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err == nil {
+			// TLS 1.3 reports a refused certificate on the first read
+			c.Read(make([]byte, 1))
+			c.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	server := tls.Server(conn, config)
+	err = server.Handshake()
+	return server.ConnectionState(), err
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca := newTestCA(t, "Submission CA")
+	config := clientCertConfig(t, ca)
+
+	t.Run("issued by -client-ca", func(t *testing.T) {
+		cs, err := handshake(t, config, []tls.Certificate{ca.issue(t, "relay.example.com")})
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		if id := certIdentity(cs); id != "relay.example.com" {
+			t.Errorf("client identity %q", id)
+		}
+	})
+	t.Run("issued by another CA", func(t *testing.T) {
+		other := newTestCA(t, "Other CA")
+		if _, err := handshake(t, config, []tls.Certificate{other.issue(t, "relay.example.com")}); err == nil {
+			t.Fatal("certificate from another CA accepted")
+		}
+	})
+	t.Run("no certificate", func(t *testing.T) {
+		if _, err := handshake(t, config, nil); err == nil {
+			t.Fatal("client without a certificate accepted")
+		}
+	})
+}
+
+func TestRequireClientCertsBadCA(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(file, []byte("not a certificate"), 0o600)
+	if _, err := requireClientCerts(&tls.Config{}, file); err == nil {
+		t.Error("CA file without certificates accepted")
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	chain := func(c *x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{c}}}
+	}
+	for _, tc := range []struct {
+		cs   tls.ConnectionState
+		want string
+	}{
+		{tls.ConnectionState{}, ""},
+		{chain(&x509.Certificate{Subject: pkix.Name{CommonName: "cn"}, DNSNames: []string{"dns"}}), "cn"},
+		{chain(&x509.Certificate{DNSNames: []string{"dns"}, EmailAddresses: []string{"a@x"}}), "dns"},
+		{chain(&x509.Certificate{EmailAddresses: []string{"a@x"}}), "a@x"},
+	} {
+		if got := certIdentity(tc.cs); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	setFlags(t, map[string]string{"tls-curves": "not-a-group"})
+	if config, err := serverTLSConfig(); err == nil || config != nil {
+		t.Errorf("started with broken TLS: %v", err)
+	}
+
+	// The demo fallback has to be asked for
+	setFlags(t, map[string]string{"require-tls": "false"})
+	if config, err := serverTLSConfig(); err != nil || config != nil {
+		t.Errorf("with -require-tls=false: %v, %v", config, err)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls_ecdhe_rsa_with_chacha20_poly1305_sha256")
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}
+	if err != nil || !slices.Equal(ids, want) {
+		t.Errorf("got %v, %v; want %v", ids, err, want)
+	}
+	for _, bad := range []string{
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,TLS_BOGUS",
+		"TLS_RSA_WITH_RC4_128_SHA", // insecure
+		"TLS_AES_128_GCM_SHA256",   // TLS 1.3, not configurable
+	} {
+		name := bad[strings.LastIndex(bad, ",")+1:]
+		if _, err := parseCipherSuites(bad); err == nil || !strings.Contains(err.Error(), `unknown cipher suite "`+name+`"`) {
+			t.Errorf("%s: %v, want %s rejected", bad, err, name)
+		}
+	}
+}
+
+func TestCipherSuitesNegotiated(t *testing.T) {
+	setFlags(t, map[string]string{"tls-min-version": "1.2", "tls-max-version": "1.2",
+		"tls-ciphers": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", "tls-curves": "X25519"})
+	config := testServerConfig(t)
+	cs, err := handshake(t, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Version != tls.VersionTLS12 || cs.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+		t.Errorf("negotiated %s with %s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+	}
+
+	setFlags(t, map[string]string{"tls-ciphers": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,TLS_RSA_WITH_RC4_128_SHA"})
+	if _, err := getHybridTLSConfig(); err == nil || !strings.Contains(err.Error(), `-tls-ciphers: unknown cipher suite "TLS_RSA_WITH_RC4_128_SHA"`) {
+		t.Errorf("got %v, want the insecure suite rejected", err)
+	}
+}
+
+// testServerConfig is the gateway's TLS config with a self-signed
+// certificate, leaving the server certificate as it was after the test
+func testServerConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	old := serverCert.cert.Load()
+	t.Cleanup(func() { serverCert.cert.Store(old) })
+	dir := t.TempDir()
+	setFlags(t, map[string]string{"cert": filepath.Join(dir, "missing.crt"), "key": filepath.Join(dir, "missing.key")})
+	config, err := getHybridTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// writeCertificate saves a self-signed certificate for cn to -cert and -key
+func writeCertificate(t *testing.T, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(*certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(*keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedCertificate returns the name on the certificate a new handshake
+// with config gets
+func servedCertificate(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		tls.Server(server, config).Handshake()
+	}()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	c := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificate(t *testing.T) {
+	old := serverCert.cert.Load()
+	t.Cleanup(func() { serverCert.cert.Store(old) })
+	dir := t.TempDir()
+	setFlags(t, map[string]string{"cert": filepath.Join(dir, "server.crt"), "key": filepath.Join(dir, "server.key")})
+	writeCertificate(t, "old.example.com")
+	config, err := getHybridTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCertificate(t, config); cn != "old.example.com" {
+		t.Fatalf("serving %s before the reload", cn)
+	}
+
+	writeCertificate(t, "new.example.com")
+	if err := reloadCertificate("test"); err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCertificate(t, config); cn != "new.example.com" {
+		t.Errorf("serving %s after the reload, want the new certificate", cn)
+	}
+
+	// A pair that doesn't load leaves the current one serving
+	os.WriteFile(*keyFile, []byte("not a key"), 0o600)
+	if err := reloadCertificate("test"); err == nil {
+		t.Error("reloaded a broken key pair")
+	}
+	if cn := servedCertificate(t, config); cn != "new.example.com" {
+		t.Errorf("serving %s after a failed reload", cn)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var otelEndpoint = flag.String("otel-endpoint", "", "OTLP/HTTP collector to send traces to, as host:port (plaintext) or a URL (empty disables tracing)")
+
+// Tracer for the mail pipeline. Until setupTracing installs a provider it
+// is a no-op, so spans cost nothing when -otel-endpoint isn't set.
+var tracer = otel.Tracer("pqc-gateway")
+
+// setupTracing exports spans to endpoint in batches. The returned function
+// flushes what is still buffered; call it on shutdown.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var opt otlptracehttp.Option
+	if strings.Contains(endpoint, "://") {
+		opt = otlptracehttp.WithEndpointURL(endpoint)
+	} else {
+		opt = otlptracehttp.WithEndpoint(endpoint)
+	}
+	exporter, err := otlptracehttp.New(ctx, opt, otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("pqc-gateway"))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Exporting traces", "event", "tracing_enabled", "endpoint", endpoint)
+	return provider.Shutdown, nil
+}
+
+// traceLogger tags log lines with the trace and span of ctx, so they can be
+// found from the trace and the other way round. Unchanged when not tracing.
+func traceLogger(ctx context.Context, log *slog.Logger) *slog.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return log
+	}
+	return log.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+}
+
+// endSpan finishes span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Attribute keys set on pipeline spans
+var (
+	attrBackend   = attribute.Key("pqc.backend")
+	attrMessageID = attribute.Key("pqc.message_id")
+	attrAlgorithm = attribute.Key("pqc.algorithm")
+	attrBytes     = attribute.Key("pqc.bytes")
+	attrReceipts  = attribute.Key("pqc.receipts")
+)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans points the gateway's tracer at a recorder until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	old := tracer
+	tracer = provider.Tracer("pqc-gateway")
+	t.Cleanup(func() {
+		tracer = old
+		provider.Shutdown(context.Background())
+	})
+	return rec
+}
+
+func TestSessionSpans(t *testing.T) {
+	rec := recordSpans(t)
+	c, _ := receiptService(t, 201, `{}`)
+	useReceipts(t, c)
+	startTestBackend(t)
+	conn, _, done := runSession(t)
+	expect(t, conn, 220)
+	sendMessage(t, conn, 250, testBody)
+	command(t, conn, 221, "QUIT")
+	waitSession(t, done)
+	receiptsInFlight.Wait()
+
+	// One trace per session: every pipeline step is a child of its root
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	root, ok := spans["smtp.session"]
+	if !ok || root.Parent().IsValid() {
+		t.Fatalf("no root smtp.session span in %v", spanNames(rec.Ended()))
+	}
+	for _, name := range []string{"backend.dial", "smtp.data", "message.sign", "backend.write", "receipt.post"} {
+		s, ok := spans[name]
+		switch {
+		case !ok:
+			t.Errorf("no %s span in %v", name, spanNames(rec.Ended()))
+		case s.Parent().SpanID() != root.SpanContext().SpanID() || s.SpanContext().TraceID() != root.SpanContext().TraceID():
+			t.Errorf("%s is not a child of smtp.session", name)
+		}
+	}
+	if len(rec.Ended()) != 6 {
+		t.Errorf("spans %v, want one of each", spanNames(rec.Ended()))
+	}
+
+	if got := spanAttribute(spans["message.sign"], attrAlgorithm); got != "ml-dsa-65" {
+		t.Errorf("message.sign %s = %q", attrAlgorithm, got)
+	}
+	if got := spanAttribute(spans["receipt.post"], attrMessageID); got == "" || got != spanAttribute(spans["message.sign"], attrMessageID) {
+		t.Errorf("receipt.post is for message %q, not the one signed", got)
+	}
+}
+
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// spanAttribute returns span's value for key as a string, or ""
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	if span == nil {
+		return ""
+	}
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
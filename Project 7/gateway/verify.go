@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var rejectOnBadSig = flag.Bool("reject-on-bad-sig", false, "Refuse inbound mail whose X-PQC-Signature fails verification (550)")
+
+// Verifier checks signatures made by the matching Signer
+type Verifier interface {
+	Verify(ctx context.Context, data, sig []byte) error
+	Algorithm() string
+}
+
+// Returned by a Verifier that has no key to verify with
+var errNoVerifyKey = errors.New("no public key loaded")
+
+// Verification outcomes, as Authentication-Results method results
+const (
+	verifyPass      = "pass"
+	verifyFail      = "fail"
+	verifyNone      = "none"      // message isn't signed
+	verifyPermError = "permerror" // signature can't be checked here
+)
+
+type verifyResult struct {
+	status string
+	alg    string
+	reason string
+	nonce  string // n= of the signature, if it has one
+}
+
+func (r verifyResult) String() string {
+	s := r.status
+	if r.alg != "" {
+		s += " (" + r.alg + ")"
+	}
+	if r.reason != "" {
+		s += ": " + r.reason
+	}
+	return s
+}
+
+// header renders the result as an Authentication-Results value
+func (r verifyResult) header() string {
+	v := fmt.Sprintf("%s; pqc=%s", gatewayHostname(), r.status)
+	if r.reason != "" {
+		v += " (" + r.reason + ")"
+	}
+	if r.alg != "" {
+		v += " header.a=" + r.alg
+	}
+	return v
+}
+
+// removeOwnAuthResults drops Authentication-Results fields claiming to be
+// from this gateway (RFC 8601 section 5), so a sender can't forge a pqc=pass
+// for downstream filters to trust. It returns how many were removed.
+func removeOwnAuthResults(msg []byte) ([]byte, int) {
+	fields := parseHeaders(msg)
+	removed := 0
+	// Bottom up, so earlier fields keep their offsets
+	for i := len(fields) - 1; i >= 0; i-- {
+		f := fields[i]
+		if !strings.EqualFold(f.Name, "Authentication-Results") {
+			continue
+		}
+		// authserv-id is the first token, optionally followed by a version
+		id, _, _ := strings.Cut(f.Value(), ";")
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if strings.EqualFold(strings.Fields(id)[0], gatewayHostname()) {
+			msg = removeHeader(msg, f)
+			removed++
+		}
+	}
+	return msg, removed
+}
+
+// verifyMessage checks a message's most recent X-PQC-Signature. The
+// signature covers the message as it was before that header was added,
+// canonicalized and restricted to its h= headers, so the signed bytes are
+// rebuilt from the message with the field removed. A message without one
+// may be multipart/signed, with the signature over its first part.
+func verifyMessage(ctx context.Context, msg []byte) verifyResult {
+	data, value, ok := messageSignature(msg)
+	if !ok {
+		return verifyResult{status: verifyNone}
+	}
+
+	result := checkSignature(ctx, data, value)
+	signatureVerifications.WithLabelValues(result.status).Inc()
+	return result
+}
+
+// messageSignature finds the signature a message carries, returning the
+// bytes it was made over (before canonicalization) and its value: the most
+// recent X-PQC-Signature, else the detached signature of a multipart/signed
+// body
+func messageSignature(msg []byte) (data []byte, value string, ok bool) {
+	if data, value, ok = lastSignature(msg); ok {
+		return data, value, ok
+	}
+	return signedPart(msg)
+}
+
+// lastSignature finds a message's most recent X-PQC-Signature, returning
+// its value and the message with that field removed
+func lastSignature(msg []byte) (data []byte, value string, ok bool) {
+	var field *headerField
+	fields := parseHeaders(msg)
+	for i := range fields {
+		if strings.EqualFold(fields[i].Name, "X-PQC-Signature") {
+			field = &fields[i]
+		}
+	}
+	if field == nil {
+		return nil, "", false
+	}
+	return removeHeader(msg, *field), field.Value(), true
+}
+
+func checkSignature(ctx context.Context, data []byte, value string) verifyResult {
+	tags, err := parseSignatureHeader(value)
+	if err != nil {
+		return verifyResult{status: verifyPermError, reason: err.Error()}
+	}
+	alg := strings.ToLower(tags["alg"])
+	verifier := keyVerifier(tags["kid"])
+	if verifier == nil {
+		reason := "no verification key"
+		if tags["kid"] != "" {
+			reason = "no verification key for kid=" + tags["kid"]
+		}
+		return verifyResult{status: verifyPermError, alg: alg, reason: reason}
+	}
+	if alg != verifier.Algorithm() {
+		return verifyResult{status: verifyPermError, alg: alg, reason: "not signed with " + verifier.Algorithm()}
+	}
+
+	data, err = canonicalize(data, tags["c"], parseHeaderList(tags["h"]))
+	if err != nil {
+		return verifyResult{status: verifyPermError, alg: alg, reason: err.Error()}
+	}
+	data = bindNonce(data, tags["n"])
+	switch tags["ph"] {
+	case "":
+	case prehashSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	default:
+		return verifyResult{status: verifyPermError, alg: alg, reason: "unsupported ph=" + tags["ph"]}
+	}
+	key := verifyCacheKey(data, value)
+	if result, ok := verifyResults.get(key); ok {
+		return result
+	}
+	result := verifyResult{status: verifyPass, alg: alg, nonce: tags["n"]}
+	if err := verifier.Verify(ctx, data, []byte(tags["sig"])); err != nil {
+		if errors.Is(err, errNoVerifyKey) {
+			return verifyResult{status: verifyPermError, alg: alg, reason: err.Error()}
+		}
+		result = verifyResult{status: verifyFail, alg: alg, reason: err.Error()}
+	}
+	// A verification cut short says nothing about the signature
+	if ctx.Err() == nil {
+		verifyResults.put(key, result)
+	}
+	return result
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRemoveOwnAuthResults(t *testing.T) {
+	host := gatewayHostname()
+	msg := []byte("From: a@x\r\n" +
+		"Authentication-Results: " + host + "; pqc=pass\r\n" +
+		"Authentication-Results: mx.other.example; spf=pass\r\n" +
+		"Authentication-Results: " + strings.ToUpper(host) + " 1;\r\n pqc=pass header.a=ml-dsa-65\r\n" +
+		"\r\nbody\r\n")
+
+	out, n := removeOwnAuthResults(msg)
+	if n != 2 {
+		t.Errorf("removed %d, want 2", n)
+	}
+	want := "From: a@x\r\nAuthentication-Results: mx.other.example; spf=pass\r\n\r\nbody\r\n"
+	if string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestProcessMailDropsForgedAuthResults(t *testing.T) {
+	forged := "Authentication-Results: " + gatewayHostname() + "; pqc=pass\r\n"
+	msg := []byte(forged + "From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), forged) {
+		t.Errorf("forged result delivered: %q", out)
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Errorf("signed message: %+v", r)
+	}
+	tampered := []byte(strings.Replace(string(out), "Subject: hi", "Subject: changed", 1))
+	if r := verifyMessage(context.Background(), tampered); r.status != verifyFail {
+		t.Errorf("tampered message: %+v", r)
+	}
+	if r := verifyMessage(context.Background(), testMessage); r.status != verifyNone {
+		t.Errorf("unsigned message: %+v", r)
+	}
+}
+
+func TestVerifySignedHeaders(t *testing.T) {
+	setFlags(t, map[string]string{"sign-headers": "From,To,Subject,Cc"})
+	out, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := signatureTags(t, out)["h"]; h != "From:To:Subject:Cc" {
+		t.Errorf("h=%s, want every listed header", h)
+	}
+
+	// Fields are taken in h= order, wherever they are in the message
+	reordered := []byte(strings.Replace(string(out), "To: b@example.com\r\nSubject: hi\r\n", "Subject: hi\r\nTo: b@example.com\r\n", 1))
+	if string(reordered) == string(out) {
+		t.Fatalf("To and Subject not found in %q", out)
+	}
+	if r := verifyMessage(context.Background(), reordered); r.status != verifyPass {
+		t.Errorf("reordered headers: %v", r)
+	}
+	// Cc was signed as absent, so one can't be added
+	if r := verifyMessage(context.Background(), out); r.status != verifyPass {
+		t.Errorf("signed without Cc: %v", r)
+	}
+	added := []byte(strings.Replace(string(out), "To: b@example.com\r\n", "To: b@example.com\r\nCc: c@example.com\r\n", 1))
+	if r := verifyMessage(context.Background(), added); r.status != verifyFail {
+		t.Errorf("Cc added after signing: %v", r)
+	}
+	// Headers not listed aren't covered
+	unlisted := []byte(strings.Replace(string(out), "To: b@example.com\r\n", "To: b@example.com\r\nX-Mailer: test\r\n", 1))
+	if r := verifyMessage(context.Background(), unlisted); r.status != verifyPass {
+		t.Errorf("unlisted header added: %v", r)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	verifyCacheSize = flag.Int("verify-cache-size", 4096, "Signature verification results kept for repeat checks of the same message (0 disables)")
+	verifyCacheTTL  = flag.Duration("verify-cache-ttl", 10*time.Minute, "How long a cached verification result is reused")
+)
+
+// verifyCache remembers the outcome of verifying a signature over given
+// canonical bytes, so a message fetched again isn't verified again. It
+// evicts the least recently used entry once full.
+type verifyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List // of *verifyEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+	now     func() time.Time // time.Now, except in tests
+}
+
+type verifyEntry struct {
+	key     [sha256.Size]byte
+	result  verifyResult
+	expires time.Time
+}
+
+// Set up in main; nil verifies every time
+var verifyResults *verifyCache
+
+func newVerifyCache(size int, ttl time.Duration) *verifyCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &verifyCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: map[[sha256.Size]byte]*list.Element{},
+		now:     time.Now,
+	}
+}
+
+// verifyCacheKey identifies a verification: the canonical signed bytes and
+// the signature header checked against them, which names key and algorithm
+func verifyCacheKey(data []byte, header string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte{0})
+	h.Write([]byte(header))
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// get returns the cached result for key, if there is a live one
+func (c *verifyCache) get(key [sha256.Size]byte) (verifyResult, bool) {
+	if c == nil {
+		return verifyResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && c.now().After(el.Value.(*verifyEntry).expires) {
+		c.remove(el)
+		ok = false
+	}
+	if !ok {
+		verifyCacheLookups.WithLabelValues("miss").Inc()
+		return verifyResult{}, false
+	}
+	verifyCacheLookups.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(el)
+	return el.Value.(*verifyEntry).result, true
+}
+
+// put caches result for key, evicting the least recently used entry if full
+func (c *verifyCache) put(key [sha256.Size]byte, result verifyResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*verifyEntry).result, el.Value.(*verifyEntry).expires = result, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&verifyEntry{key: key, result: result, expires: expires})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *verifyCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*verifyEntry).key)
+}
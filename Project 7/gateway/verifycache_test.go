@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSigner counts the verifications its key does
+type countingSigner struct {
+	Signer
+	verifies atomic.Int32
+}
+
+func (s *countingSigner) Verify(ctx context.Context, data, sig []byte) error {
+	s.verifies.Add(1)
+	return s.Signer.(Verifier).Verify(ctx, data, sig)
+}
+
+// cacheLookups reads the verification cache lookup counter for result
+func cacheLookups(result string) float64 {
+	families, _ := metricsRegistry.Gather()
+	for _, f := range families {
+		if f.GetName() != "pqc_gateway_verify_cache_lookups_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "result" && l.GetValue() == result {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// useVerifyCache swaps in a cache on clock for the rest of the test
+func useVerifyCache(t *testing.T, size int, ttl time.Duration, clock *fakeClock) {
+	old := verifyResults
+	verifyResults = newVerifyCache(size, ttl)
+	verifyResults.now = clock.Now
+	t.Cleanup(func() { verifyResults = old })
+}
+
+func TestVerifyCache(t *testing.T) {
+	signer := &countingSigner{Signer: currentSigner()}
+	useSigner(t, signer)
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	useVerifyCache(t, 16, time.Minute, clock)
+	msg, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, misses := cacheLookups("hit"), cacheLookups("miss")
+
+	for i := 0; i < 2; i++ {
+		if r := verifyMessage(context.Background(), msg); r.status != verifyPass {
+			t.Fatalf("verification %d: %v", i+1, r)
+		}
+	}
+	if n := signer.verifies.Load(); n != 1 {
+		t.Errorf("%d verifications for two identical checks, want 1", n)
+	}
+	if got := cacheLookups("hit") - hits; got != 1 {
+		t.Errorf("%v cache hits, want 1", got)
+	}
+	if got := cacheLookups("miss") - misses; got != 1 {
+		t.Errorf("%v cache misses, want 1", got)
+	}
+
+	clock.advance(time.Minute + time.Second)
+	verifyMessage(context.Background(), msg)
+	if n := signer.verifies.Load(); n != 2 {
+		t.Errorf("expired entry reused: %d verifications, want 2", n)
+	}
+}
+
+func TestVerifyCacheCanceled(t *testing.T) {
+	signer := &countingSigner{Signer: currentSigner()}
+	useSigner(t, signer)
+	useVerifyCache(t, 16, time.Minute, &fakeClock{t: time.Unix(1700000000, 0)})
+	msg, _, err := processMail(context.Background(), slog.Default(), envelope{}, testMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	verifyMessage(ctx, msg)
+	verifyMessage(context.Background(), msg)
+	if n := signer.verifies.Load(); n != 2 {
+		t.Errorf("result of a canceled verification reused: %d verifications, want 2", n)
+	}
+}
+
+func TestVerifyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newVerifyCache(2, time.Minute)
+	a, b, d := verifyCacheKey([]byte("a"), "v"), verifyCacheKey([]byte("b"), "v"), verifyCacheKey([]byte("d"), "v")
+	c.put(a, verifyResult{status: verifyPass})
+	c.put(b, verifyResult{status: verifyFail})
+	c.get(a)
+	c.put(d, verifyResult{status: verifyPass})
+
+	if _, ok := c.get(b); ok {
+		t.Error("least recently used entry kept")
+	}
+	if r, ok := c.get(a); !ok || r.status != verifyPass {
+		t.Errorf("recently used entry: %v, %v", r, ok)
+	}
+	if _, ok := c.get(d); !ok {
+		t.Error("newest entry evicted")
+	}
+	if verifyCacheKey([]byte("a"), "v") == verifyCacheKey([]byte("a"), "w") {
+		t.Error("key ignores the signature header")
+	}
+	if newVerifyCache(0, time.Minute) != nil {
+		t.Error("cache size 0 should disable caching")
+	}
+}
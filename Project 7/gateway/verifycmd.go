@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Exit statuses of the verify subcommand
+const (
+	verifyExitValid   = 0
+	verifyExitInvalid = 1
+	verifyExitError   = 2 // unsigned, unreadable or uncheckable, or bad usage
+)
+
+// runVerify is "gateway verify": it checks one message's X-PQC-Signature,
+// as inbound mail is checked, with the public key given instead of the
+// gateway's own, and prints the verdict. It returns the exit status.
+func runVerify(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	in := fs.String("in", "-", "Message file to check (- for standard input)")
+	pubKey := fs.String("pubkey", "", "The signer's public key file (liboqs builds only)")
+	alg := fs.String("alg", "", "Signature algorithm (default the signature's alg=)")
+	if err := fs.Parse(args); err != nil {
+		return verifyExitError
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "verify: unexpected arguments %q\n", fs.Args())
+		return verifyExitError
+	}
+
+	msg, err := readMessageFile(*in, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "verify: %v\n", err)
+		return verifyExitError
+	}
+	name := *in
+	if name == "-" {
+		name = "stdin"
+	}
+	// Mail saved to a file often has bare LF line endings
+	if !bytes.Contains(msg, []byte("\r\n")) {
+		msg = bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+	}
+
+	_, value, ok := messageSignature(msg)
+	if !ok {
+		fmt.Fprintf(stdout, "%s: unsigned: %s\n", name, verifyResult{status: verifyNone})
+		return verifyExitError
+	}
+	if *alg == "" {
+		// A header that doesn't parse is reported by verifyMessage
+		tags, _ := parseSignatureHeader(value)
+		if *alg = tags["alg"]; *alg == "" {
+			*alg = *sigAlg
+		}
+	}
+	v, err := loadVerifier(*alg, *pubKey)
+	if err != nil {
+		fmt.Fprintf(stderr, "verify: %v\n", err)
+		return verifyExitError
+	}
+	signingKeys.rotate(v)
+
+	result := verifyMessage(context.Background(), msg)
+	switch result.status {
+	case verifyPass:
+		fmt.Fprintf(stdout, "%s: valid: %s\n", name, result)
+		return verifyExitValid
+	case verifyFail:
+		fmt.Fprintf(stdout, "%s: invalid: %s\n", name, result)
+		return verifyExitInvalid
+	}
+	fmt.Fprintf(stdout, "%s: not verified: %s\n", name, result)
+	return verifyExitError
+}
+
+// readMessageFile reads the message named by -in
+func readMessageFile(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(name)
+}
@@ -0,0 +1,69 @@
+//go:build liboqs
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// useGeneratedKey signs with a new ml-dsa-65 key pair for the rest of the
+// test and returns a file holding its public key
+func useGeneratedKey(t *testing.T) string {
+	t.Helper()
+	s, err := generateOQSSigner("ml-dsa-65", "ML-DSA-65")
+	if err != nil {
+		t.Skip(err)
+	}
+	useSigner(t, s)
+	return writeFile(t, "key.pub", s.publicKey)
+}
+
+func TestVerifyCommand(t *testing.T) {
+	pubKey := useGeneratedKey(t)
+	signed := preSigned(t)
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		code int
+		out  string
+	}{
+		{"valid", signed, verifyExitValid, "msg.eml: valid: pass (ml-dsa-65)"},
+		{"bare LF", bytes.ReplaceAll(signed, []byte("\r\n"), []byte("\n")), verifyExitValid, "valid: pass"},
+		{"tampered body", bytes.Replace(signed, []byte("body"), []byte("Body"), 1), verifyExitInvalid, "msg.eml: invalid: fail (ml-dsa-65)"},
+		{"tampered header", bytes.Replace(signed, []byte("Subject: hi"), []byte("Subject: hello"), 1), verifyExitInvalid, "invalid: fail"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, out, _ := verifyCmd(t, nil, "-in", writeFile(t, "msg.eml", tc.msg), "-pubkey", pubKey)
+			if code != tc.code || !strings.Contains(out, tc.out) {
+				t.Errorf("exit %d, %q; want %d, %q", code, out, tc.code, tc.out)
+			}
+		})
+	}
+}
+
+func TestVerifyCommandStdin(t *testing.T) {
+	pubKey := useGeneratedKey(t)
+	code, out, _ := verifyCmd(t, preSigned(t), "-pubkey", pubKey)
+	if code != verifyExitValid || !strings.HasPrefix(out, "stdin: valid") {
+		t.Errorf("exit %d, %q; want a valid signature on stdin", code, out)
+	}
+}
+
+func TestVerifyCommandPublicKey(t *testing.T) {
+	useGeneratedKey(t)
+	file := writeFile(t, "msg.eml", preSigned(t))
+
+	code, out, errOut := verifyCmd(t, nil, "-in", file)
+	if code != verifyExitError || out != "" || !strings.Contains(errOut, "public key") {
+		t.Errorf("without -pubkey: exit %d, %q, %q; want %d and the key asked for", code, out, errOut, verifyExitError)
+	}
+
+	// Another key's signatures carry a kid= this one doesn't match
+	other := useGeneratedKey(t)
+	code, out, _ = verifyCmd(t, nil, "-in", file, "-pubkey", other)
+	if code != verifyExitError || !strings.Contains(out, "not verified: permerror (ml-dsa-65): no verification key for kid=") {
+		t.Errorf("other key: exit %d, %q; want %d and no key for its kid=", code, out, verifyExitError)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !liboqs
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCommand(t *testing.T) {
+	signed := preSigned(t)
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		code int
+		out  string
+	}{
+		{"valid", signed, verifyExitValid, "msg.eml: valid: pass (ml-dsa-65)"},
+		{"bare LF", bytes.ReplaceAll(signed, []byte("\r\n"), []byte("\n")), verifyExitValid, "valid: pass"},
+		{"tampered body", bytes.Replace(signed, []byte("body"), []byte("Body"), 1), verifyExitInvalid, "msg.eml: invalid: fail (ml-dsa-65)"},
+		{"tampered header", bytes.Replace(signed, []byte("Subject: hi"), []byte("Subject: hello"), 1), verifyExitInvalid, "invalid: fail"},
+		{"other algorithm", bytes.Replace(signed, []byte("alg=ml-dsa-65"), []byte("alg=falcon-512"), 1), verifyExitInvalid, "invalid: fail (falcon-512)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, out, _ := verifyCmd(t, nil, "-in", writeFile(t, "msg.eml", tc.msg))
+			if code != tc.code || !strings.Contains(out, tc.out) {
+				t.Errorf("exit %d, %q; want %d, %q", code, out, tc.code, tc.out)
+			}
+		})
+	}
+}
+
+func TestVerifyCommandStdin(t *testing.T) {
+	code, out, _ := verifyCmd(t, preSigned(t))
+	if code != verifyExitValid || !strings.HasPrefix(out, "stdin: valid") {
+		t.Errorf("exit %d, %q; want a valid signature on stdin", code, out)
+	}
+}
+
+// Simulated signatures have no keys to be given
+func TestVerifyCommandPublicKey(t *testing.T) {
+	file := writeFile(t, "msg.eml", preSigned(t))
+	code, out, errOut := verifyCmd(t, nil, "-in", file, "-pubkey", "key.pub")
+	if code != verifyExitError || out != "" || !strings.Contains(errOut, "-tags liboqs") {
+		t.Errorf("exit %d, %q, %q; want %d and a liboqs build asked for", code, out, errOut, verifyExitError)
+	}
+}
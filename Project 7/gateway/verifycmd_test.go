@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// verifyCmd runs the verify subcommand with args, restoring the signing
+// key it installs afterwards
+func verifyCmd(t *testing.T, stdin []byte, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	useSigner(t, currentSigner())
+	var out, errOut bytes.Buffer
+	code = runVerify(args, bytes.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// writeFile saves b to a file named name in a temporary directory
+func writeFile(t *testing.T, name string, b []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestVerifyCommandUnsigned(t *testing.T) {
+	code, out, _ := verifyCmd(t, nil, "-in", writeFile(t, "msg.eml", testMessage))
+	if code != verifyExitError || !strings.HasSuffix(out, "msg.eml: unsigned: none\n") {
+		t.Errorf("exit %d, %q; want %d and unsigned", code, out, verifyExitError)
+	}
+}
+
+func TestVerifyCommandErrors(t *testing.T) {
+	file := writeFile(t, "msg.eml", preSigned(t))
+	for _, tc := range []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"missing file", []string{"-in", filepath.Join(t.TempDir(), "none.eml")}, "no such file"},
+		{"unknown flag", []string{"-in", file, "-bogus"}, "-bogus"},
+		{"extra argument", []string{"-in", file, "other.eml"}, "unexpected arguments"},
+		{"unknown algorithm", []string{"-in", file, "-alg", "rsa"}, "rsa"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, out, errOut := verifyCmd(t, nil, tc.args...)
+			if code != verifyExitError || out != "" || !strings.Contains(errOut, tc.err) {
+				t.Errorf("exit %d, %q, %q; want %d and an error about %q", code, out, errOut, verifyExitError, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Left unset, the commit and date come from the VCS stamp go build adds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var showVersion = flag.Bool("version", false, "Print the version, commit and build date, then exit")
+
+// buildInfo identifies the running binary, for -version, /version and
+// /health
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`     // empty if unknown
+	BuildDate string `json:"build_date"` // empty if unknown
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuild returns what the binary knows about its build
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildDate == "":
+				b.BuildDate = s.Value
+			}
+		}
+	}
+	return b
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("pqc-gateway %s (commit %s, built %s, %s)", b.Version, orNone(b.Commit), orNone(b.BuildDate), b.GoVersion)
+}
+
+// writeText writes the build as "key: value" lines, as /health does
+func (b buildInfo) writeText(w io.Writer) {
+	fmt.Fprintf(w, "version: %s\n", b.Version)
+	fmt.Fprintf(w, "commit: %s\n", orNone(b.Commit))
+	fmt.Fprintf(w, "build_date: %s\n", orNone(b.BuildDate))
+	fmt.Fprintf(w, "go_version: %s\n", b.GoVersion)
+}
+
+// Version handler: the build as "key: value" lines, or JSON when the client
+// accepts it
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	b := currentBuild()
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, b)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	b.writeText(w)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useVersion(t *testing.T, v, c, date string) {
+	oldV, oldC, oldDate := version, commit, buildDate
+	version, commit, buildDate = v, c, date
+	t.Cleanup(func() { version, commit, buildDate = oldV, oldC, oldDate })
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	useVersion(t, "1.4.0", "0123abcd", "2026-10-01T12:00:00Z")
+	srv := httptest.NewServer(newHealthServer("", "", "").Handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	text, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"version: 1.4.0\n", "commit: 0123abcd\n", "build_date: 2026-10-01T12:00:00Z\n"} {
+		if !strings.Contains(string(text), want) {
+			t.Errorf("no %q in:\n%s", want, text)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/version", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var b buildInfo
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Version != "1.4.0" || b.Commit != "0123abcd" || b.GoVersion == "" {
+		t.Errorf("got %+v", b)
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	useVersion(t, "1.4.0", "", "")
+	got := currentBuild().String()
+	if !strings.HasPrefix(got, "pqc-gateway 1.4.0 (") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+var xclient = flag.Bool("xclient", false, "Pass each client's address to the backend with XCLIENT, so its logs and checks name the client rather than the gateway. The backend must trust the gateway with it, e.g. Postfix's smtpd_authorized_xclient_hosts")
+
+// xclientCommand returns the XCLIENT command naming conn's client to the
+// backend (https://www.postfix.org/XCLIENT_README.html), or nil without
+// -xclient. A client without an IP address, over a Unix socket, is sent as
+// [UNAVAILABLE] so a pooled connection doesn't keep the last one's.
+func xclientCommand(conn net.Conn) []byte {
+	if !*xclient {
+		return nil
+	}
+	addr, port := "[UNAVAILABLE]", "[UNAVAILABLE]"
+	if host, p, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			ip = ip.Unmap().WithZone("")
+			addr, port = ip.String(), p
+			if ip.Is6() {
+				addr = "IPV6:" + addr
+			}
+		}
+	}
+	return []byte(fmt.Sprintf("XCLIENT ADDR=%s PORT=%s\r\n", addr, port))
+}
+
+// sendXCLIENT passes the client's address to a backend connection before
+// the session starts on it. A new connection's greeting is read first and
+// returned, for the client to be greeted with, and XCLIENT only sent if it
+// was a 220; a pooled one was greeted long ago. A backend refusing XCLIENT
+// still has the session, which it sees as coming from the gateway, and the
+// refusal is logged; accepted reports whether it took it.
+func sendXCLIENT(log *slog.Logger, conn net.Conn, cmd []byte, pooled bool) (greeting []byte, accepted bool, err error) {
+	conn.SetDeadline(time.Now().Add(*backendDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	if !pooled {
+		if greeting, err = readReply(r); err != nil {
+			return nil, false, fmt.Errorf("greeting: %w", err)
+		}
+		if !bytes.HasPrefix(greeting, []byte("220")) {
+			return greeting, false, nil
+		}
+	}
+	if _, err := conn.Write(cmd); err != nil {
+		return nil, false, err
+	}
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("XCLIENT: %w", err)
+	}
+	// Postfix answers with a new greeting, 220
+	if reply[0] != '2' {
+		log.Warn("Backend refused XCLIENT, it sees the gateway as the client", "event", "xclient_refused",
+			"reply", string(bytes.TrimRight(reply, "\r\n")))
+		return greeting, false, nil
+	}
+	log.Debug("Passed client address to backend", "event", "xclient_accepted",
+		"command", string(bytes.TrimRight(cmd, "\r\n")))
+	return greeting, true, nil
+}
+
+// readReply reads a whole SMTP reply, every line of a multiline one, as sent
+func readReply(r *bufio.Reader) ([]byte, error) {
+	var reply []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		reply = append(reply, line...)
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) < 3 {
+			return nil, fmt.Errorf("malformed reply %q", trimmed)
+		}
+		if !continuesReply(trimmed) {
+			return reply, nil
+		}
+	}
+}
+
+// receivedHeader is the Received field (RFC 5321 section 4.4) put on top
+// of a message the gateway relays, naming the client as it greeted and
+// connected and the session by the ID its log lines carry, so the message
+// can be traced back from the backend to them. There is none under
+// -observe, which delivers messages as they came.
+func (s *smtpSession) receivedHeader() []byte {
+	if *observeOnly {
+		return nil
+	}
+	helo := s.clientHELO
+	if helo == "" {
+		helo = "unknown"
+	}
+	from := helo
+	if ip, err := netip.ParseAddr(remoteIP(s.client)); err == nil {
+		ip = ip.Unmap().WithZone("")
+		literal := ip.String()
+		if ip.Is6() {
+			literal = "IPv6:" + literal
+		}
+		from += " ([" + literal + "])"
+	}
+	// RFC 3848 protocol names
+	with := "SMTP"
+	if s.extended {
+		with = "ESMTP"
+		if s.tls {
+			with += "S"
+		}
+		if s.authed {
+			with += "A"
+		}
+	}
+	value := fmt.Sprintf("from %s by %s (pqc-gateway) with %s", from, gatewayHostname(), with)
+	if s.id != "" {
+		value += " id " + s.id
+	}
+	value += "; " + time.Now().Format(time.RFC1123Z)
+
+	var b bytes.Buffer
+	writeFoldedHeader(&b, "Received", sanitizeHeaderValue(value))
+	return b.Bytes()
+}
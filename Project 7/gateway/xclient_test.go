@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// sessionIDs returns the session IDs in logs, in order of appearance
+func sessionIDs(logs string) []string {
+	var ids []string
+	for _, m := range regexp.MustCompile(`"session_id":"([0-9a-f]+)"`).FindAllStringSubmatch(logs, -1) {
+		if len(ids) == 0 || ids[len(ids)-1] != m[1] {
+			ids = append(ids, m[1])
+		}
+	}
+	return ids
+}
+
+// unfold joins a message's folded header lines
+func unfold(msg string) string {
+	return strings.ReplaceAll(msg, "\r\n ", " ")
+}
+
+func TestXCLIENT(t *testing.T) {
+	setFlag(t, xclient, true)
+	logs := captureLogs(t, slog.LevelInfo, "")
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+
+	cmds := b.commands()
+	if len(cmds) < 2 || !strings.HasPrefix(cmds[0], "XCLIENT ADDR=127.0.0.1 PORT=") || cmds[1] != "EHLO client.example.com" {
+		t.Fatalf("backend got %q, want XCLIENT before the client's EHLO", cmds)
+	}
+	ids := sessionIDs(logs.String())
+	if len(ids) != 1 {
+		t.Fatalf("session IDs %q in %s", ids, logs)
+	}
+	msgs := b.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("backend got %q", msgs)
+	}
+	received, _, _ := strings.Cut(unfold(msgs[0]), "\r\n")
+	for _, want := range []string{"Received: from client.example.com ([127.0.0.1]) by ", " with ESMTP ", " id " + ids[0] + ";"} {
+		if !strings.Contains(received, want) {
+			t.Errorf("%q doesn't have %q", received, want)
+		}
+	}
+}
+
+func TestXCLIENTRefused(t *testing.T) {
+	setFlag(t, xclient, true)
+	logs := captureLogs(t, slog.LevelInfo, "")
+	b := startTestBackend(t)
+	b.refusesXCLIENT = true
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+
+	if !strings.Contains(logs.String(), `"event":"xclient_refused"`) {
+		t.Errorf("no xclient_refused log in %s", logs)
+	}
+	if msgs := b.messages(); len(msgs) != 1 {
+		t.Errorf("backend got %q", msgs)
+	}
+}
+
+func TestNoXCLIENT(t *testing.T) {
+	b := startTestBackend(t)
+	c := dialGateway(t)
+	sendMessage(t, c, 250, testBody)
+	command(t, c, 221, "QUIT")
+
+	for _, cmd := range b.commands() {
+		if strings.HasPrefix(cmd, "XCLIENT") {
+			t.Errorf("backend got %q without -xclient", cmd)
+		}
+	}
+	// The Received field is there all the same
+	if msgs := b.messages(); len(msgs) != 1 || !strings.HasPrefix(unfold(msgs[0]), "Received: from client.example.com ([127.0.0.1]) by ") ||
+		!strings.Contains(unfold(msgs[0]), " with ESMTP id ") {
+		t.Errorf("backend got %q", msgs)
+	}
+}
+
+func TestXCLIENTCommand(t *testing.T) {
+	setFlag(t, xclient, true)
+	for _, tc := range []struct {
+		conn net.Conn
+		want string
+	}{
+		{connFrom("192.0.2.7"), "XCLIENT ADDR=192.0.2.7 PORT=40000\r\n"},
+		{connFrom("::ffff:192.0.2.7"), "XCLIENT ADDR=192.0.2.7 PORT=40000\r\n"},
+		{connFrom("2001:db8::1"), "XCLIENT ADDR=IPV6:2001:db8::1 PORT=40000\r\n"},
+		{remoteConn{addr: &net.UnixAddr{Name: "@", Net: "unix"}}, "XCLIENT ADDR=[UNAVAILABLE] PORT=[UNAVAILABLE]\r\n"},
+	} {
+		if got := string(xclientCommand(tc.conn)); got != tc.want {
+			t.Errorf("%v: %q, want %q", tc.conn.RemoteAddr(), got, tc.want)
+		}
+	}
+}
+
+func TestReceivedHeader(t *testing.T) {
+	setFlags(t, map[string]string{"myhostname": "gw.example.com"})
+	s := &smtpSession{id: "0123456789abcdef", client: connFrom("2001:db8::1"),
+		clientHELO: "client.example.com", extended: true, tls: true, authed: true}
+	got := unfold(string(s.receivedHeader()))
+	want := "Received: from client.example.com ([IPv6:2001:db8::1]) by gw.example.com (pqc-gateway) with ESMTPSA id 0123456789abcdef; "
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "\r\n") {
+		t.Errorf("%q, want it to start %q", got, want)
+	}
+
+	setFlag(t, observeOnly, true)
+	if got := s.receivedHeader(); got != nil {
+		t.Errorf("%q under -observe", got)
+	}
+}
@@ -217,6 +217,62 @@ async def create_receipt(receipt: ReceiptCreate):
     
     return receipt_data
 
+@app.post("/receipts/batch", status_code=201, response_model=List[Receipt])
+async def create_receipts(receipts: List[ReceiptCreate]):
+    """Create several receipts in one transaction, chained in the order given.
+    Receipts whose ID already exists are skipped, so a batch retried after a
+    lost response is not rejected."""
+    conn = get_db_connection()
+    cursor = conn.cursor()
+    previous_hash = get_latest_receipt_hash()
+    created = []
+
+    try:
+        for receipt in receipts:
+            if not receipt.id:
+                receipt.id = str(uuid.uuid4())
+            cursor.execute("SELECT 1 FROM receipts WHERE id = ?", (receipt.id,))
+            if cursor.fetchone():
+                logger.info(f"Skipping existing receipt in batch: ID={receipt.id}")
+                continue
+
+            receipt_data = {
+                "id": receipt.id,
+                "document_hash": receipt.document_hash,
+                "signature": receipt.signature,
+                "timestamp": receipt.timestamp,
+                "type": receipt.type,
+                "previous_hash": previous_hash,
+                "metadata": json.dumps(receipt.metadata) if receipt.metadata else None
+            }
+            cursor.execute(
+                "INSERT INTO receipts (id, document_hash, signature, timestamp, type, previous_hash, metadata) "
+                "VALUES (?, ?, ?, ?, ?, ?, ?)",
+                (
+                    receipt_data["id"],
+                    receipt_data["document_hash"],
+                    receipt_data["signature"],
+                    receipt_data["timestamp"],
+                    receipt_data["type"],
+                    receipt_data["previous_hash"],
+                    receipt_data["metadata"]
+                )
+            )
+            previous_hash = receipt_data["document_hash"]
+            if receipt_data["metadata"]:
+                receipt_data["metadata"] = json.loads(receipt_data["metadata"])
+            created.append(receipt_data)
+        conn.commit()
+    except Exception as e:
+        conn.rollback()
+        logger.error(f"Error creating receipt batch: {str(e)}")
+        raise HTTPException(status_code=500, detail=f"Internal server error: {str(e)}")
+    finally:
+        conn.close()
+
+    logger.info(f"Receipt batch created: {len(created)} of {len(receipts)} receipts")
+    return created
+
 @app.get("/receipts/{receipt_id}", response_model=Receipt)
 async def get_receipt(receipt_id: str, request: Request):
     """Get a receipt by ID"""